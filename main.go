@@ -4,6 +4,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"os"
 	"os/signal"
@@ -13,6 +14,7 @@ import (
 	"time"
 
 	"github.com/stolostron/search-collector/pkg/config"
+	"github.com/stolostron/search-collector/pkg/graph"
 	"github.com/stolostron/search-collector/pkg/informer"
 	lease "github.com/stolostron/search-collector/pkg/lease"
 	rec "github.com/stolostron/search-collector/pkg/reconciler"
@@ -54,6 +56,17 @@ func main() {
 	klog.InitFlags(nil)
 	flag.Parse()
 	defer klog.Flush()
+
+	// The graph subcommand exports a reconciler snapshot instead of running the collector.
+	if flag.Arg(0) == "graph" {
+		if err := graph.Command(flag.Args()[1:], os.Stdout); err != nil {
+			klog.Error(err)
+			klog.Flush()
+			os.Exit(1)
+		}
+		return
+	}
+
 	klog.Info("Starting search-collector")
 
 	// determine number of CPUs available.
@@ -67,20 +80,27 @@ func main() {
 
 	config.InitConfig()
 
-	if !config.Cfg.DeployedInHub {
-		leaseReconciler := lease.LeaseReconciler{
-			HubKubeClient:        config.GetKubeClient(config.Cfg.AggregatorConfig),
-			LocalKubeClient:      config.GetKubeClient(config.GetKubeConfig()),
-			LeaseName:            AddonName,
-			ClusterName:          config.Cfg.ClusterName,
-			LeaseDurationSeconds: int32(LeaseDurationSeconds),
+	if !config.Cfg.DeployedInHub && config.Cfg.SendsToAggregator() {
+		// Keep the lease on every hub, so each one sees the addon as available.
+		localKubeClient := config.GetKubeClient(config.GetKubeConfig())
+		for _, target := range config.Cfg.AggregatorTargets {
+			leaseReconciler := lease.LeaseReconciler{
+				HubKubeClient:        config.GetKubeClient(target.Config),
+				LocalKubeClient:      localKubeClient,
+				LeaseName:            AddonName,
+				ClusterName:          config.Cfg.ClusterName,
+				HubName:              target.Name,
+				LeaseDurationSeconds: int32(LeaseDurationSeconds),
+			}
+			klog.Infof("Create/Update lease for search on hub %s", target.Name)
+			go wait.Forever(leaseReconciler.Reconcile, time.Duration(leaseReconciler.LeaseDurationSeconds)*time.Second)
 		}
-		klog.Info("Create/Update lease for search")
-		go wait.Forever(leaseReconciler.Reconcile, time.Duration(leaseReconciler.LeaseDurationSeconds)*time.Second)
 	}
 
-	// Start metrics server to serve Prometheus metrics
-	go server.StartAndListen()
+	mainCtx := getMainContext()
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
 
 	// Merge configurable collection config with existing config FUTURE: ACM-21892 combine and merge with search-collector-config configmap
 	tr.LoadAndMergeConfigurableCollection()
@@ -95,14 +115,35 @@ func main() {
 	reconciler := rec.NewReconciler()
 	reconciler.Input = upsertTransformer.Output
 
-	// Create Sender, attached to transformer
-	sender := send.NewSender(reconciler, config.Cfg.AggregatorURL, config.Cfg.ClusterName)
+	// Warm restart from the nodes of the snapshot saved at the last shutdown. The state the aggregator
+	// acknowledged is restored by the senders, from their own state files.
+	snapshotDir := ""
+	if config.Cfg.FeatureSnapshot {
+		snapshotDir = config.Cfg.StateDir
+	}
+	if snapshotDir != "" {
+		if err := reconciler.LoadSnapshot(snapshotDir); err != nil && !errors.Is(err, os.ErrNotExist) {
+			klog.Warningf("Failed to read the snapshot from %s. Starting without it. Error: %s", snapshotDir, err)
+		}
+	}
 
-	informersInitialized := make(chan interface{})
+	// Create a Sender for each aggregator, attached to transformer
+	senders := send.NewSenders(reconciler, config.Cfg.ClusterName)
 
-	mainCtx := getMainContext()
+	// The diff stream tracks the changes with a cursor of its own, so it doesn't depend on the senders.
+	var diffs server.DiffSource
+	if config.Cfg.FeatureDiffStream {
+		diffs = reconciler.NewCursor()
+	}
+
+	// Start server to serve the probes, Prometheus metrics, the query API, the diff stream and the admin routes
+	go func() {
+		server.StartAndListen(mainCtx, reconciler, diffs, server.NewAdmin(senders, reconciler))
+		wg.Done()
+	}()
+
+	informersInitialized := make(chan interface{})
 
-	wg := sync.WaitGroup{}
 	wg.Add(1)
 
 	// Start a routine to keep our informers up to date.
@@ -122,14 +163,27 @@ func main() {
 	// and recreate of existing rows in the database during the resync.
 	klog.Info("Waiting for informers to load initial state.")
 	<-informersInitialized
-
-	klog.Info("Starting the sender.")
-	wg.Add(1)
-
-	go func() {
-		sender.StartSendLoop(mainCtx)
-		wg.Done()
-	}()
+	// The events of the informers may still be in the transformer. After a restore or a snapshot, the first diff
+	// must wait for them, or it deletes the nodes the reconciler didn't get yet.
+	reconciler.WaitForTransformer(upsertTransformer)
+
+	klog.Infof("Starting %d sender(s).", len(senders))
+	for _, sender := range senders {
+		wg.Add(1)
+
+		go func(sender *send.Sender) {
+			sender.StartSendLoop(mainCtx)
+			wg.Done()
+		}(sender)
+	}
 
 	wg.Wait()
+
+	if snapshotDir != "" {
+		if err := reconciler.SaveSnapshot(snapshotDir); err != nil {
+			klog.Warningf("Failed to save the snapshot to %s. Error: %s", snapshotDir, err)
+		} else {
+			klog.Infof("Saved the snapshot to %s.", snapshotDir)
+		}
+	}
 }
@@ -17,6 +17,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/tkanos/gonfig"
 	"k8s.io/client-go/rest"
@@ -30,41 +31,131 @@ const (
 	DEFAULT_AGGREGATOR_URL         = "https://localhost:3010" // this will be deprecated in the future
 	DEFAULT_AGGREGATOR_HOST        = "https://localhost"
 	DEFAULT_AGGREGATOR_PORT        = "3010"
+	DEFAULT_AGGREGATOR_TARGET      = "default" // Name of the aggregator from HUB_CONFIG or AGGREGATOR_URL
+	DEFAULT_CAPABILITIES_TTL_MS    = 600000    // 10 min
 	DEFAULT_CLUSTER_NAME           = "local-cluster"
+	DEFAULT_DIAL_TIMEOUT_MS        = 30000 // 30 seconds
+	DEFAULT_DIFF_STREAM_HISTORY    = 100
+	DEFAULT_DIFF_STREAM_QUEUE      = 16
 	DEFAULT_POD_NAMESPACE          = "open-cluster-management"
 	DEFAULT_HEARTBEAT_MS           = 300000 // 5 min
+	DEFAULT_HTTP2_PING_MS          = 30000  // 30 seconds
+	DEFAULT_IDLE_CONN_TIMEOUT_MS   = 90000  // 90 seconds
+	DEFAULT_KEEP_ALIVE_MS          = 30000  // 30 seconds
+	DEFAULT_LIVENESS_HEARTBEATS    = 3
 	DEFAULT_MAX_BACKOFF_MS         = 600000 // 10 min
-	DEFAULT_REDISCOVER_RATE_MS     = 60000  // 1 min
-	DEFAULT_REPORT_RATE_MS         = 5000   // 5 seconds
+	DEFAULT_MAX_IDLE_CONNS         = 100
+	DEFAULT_MAX_SYNC_ERRORS        = 500
+	DEFAULT_REDISCOVER_RATE_MS     = 60000 // 1 min
+	DEFAULT_REPORT_RATE_MS         = 5000  // 5 seconds
+	DEFAULT_RESYNC_CHUNK_RETRIES   = 3
 	DEFAULT_NS_FILTER_CACHE_TTL_MS = 300000 // 5 min
 	DEFAULT_RETRY_JITTER_MS        = 5000   // 5 seconds
 	DEFAULT_RUNTIME_MODE           = "production"
+	DEFAULT_SHUTDOWN_FLUSH_MS      = 10000 // 10 seconds
+	DEFAULT_SIGNING_ALGORITHM      = "hmac-sha256"
+	DEFAULT_SINK                   = SINK_AGGREGATOR
+	DEFAULT_SINK_FILE_MAX_BACKUPS  = 5
+	DEFAULT_SINK_FILE_MAX_MB       = 100
+	DEFAULT_SINK_FILE_PATH         = "./search-collector.ndjson"
+	DEFAULT_STATE_SAVE_INTERVAL_MS = 300000 // 5 min
+	DEFAULT_SYNC_COMPRESSION       = "none"
+	DEFAULT_TLS_CERT_FILE          = "./sslcert/tls.crt"
+	DEFAULT_TLS_CIPHER_SUITES      = "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384," +
+		"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256," +
+		"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256"
+	DEFAULT_TLS_CURVES            = "X25519,P256,P384,P521"
+	DEFAULT_TLS_KEY_FILE          = "./sslcert/tls.key"
+	DEFAULT_TLS_MIN_VERSION       = "1.2"
+	DEFAULT_TOMBSTONE_MAX_ENTRIES = 100000
+	DEFAULT_TOMBSTONE_TTL_MS      = 3600000 // 1 hour
 )
 
+// Sinks selectable with SINK.
+const (
+	SINK_AGGREGATOR = "aggregator"
+	SINK_FILE       = "file"
+	SINK_STDOUT     = "stdout"
+)
+
+// An aggregator the collector sends to.
+type AggregatorTarget struct {
+	Name   string       // Identifies the target in the logs and names its state directory
+	URL    string       // URL of the Aggregator, includes port but not any path
+	Config *rest.Config // Config object for the hub. Nil when deployed in the hub.
+}
+
 // Configuration options for the search-collector.
 type Config struct {
+	AdditionalHubConfigs          string       `env:"ADDITIONAL_HUB_CONFIGS"` // Comma separated config files for more hubs to send to
 	AggregatorConfig              *rest.Config // Config object for hub. Used to get TLS credentials.
 	AggregatorConfigFile          string       `env:"HUB_CONFIG"`                      // Config file for hub. Will be mounted in a secret.
 	AggregatorURL                 string       `env:"AGGREGATOR_URL"`                  // URL of the Aggregator, includes port but not any path
 	AggregatorHost                string       `env:"AGGREGATOR_HOST"`                 // Host of the Aggregator
 	AggregatorPort                string       `env:"AGGREGATOR_PORT"`                 // Port of the Aggregator
+	AggregatorProxyURL            string       `env:"AGGREGATOR_PROXY_URL"`            // Proxy for the aggregator connections
+	AggregatorNoProxy             string       `env:"AGGREGATOR_NO_PROXY"`             // Hosts that bypass AGGREGATOR_PROXY_URL
+	CapabilitiesTTLMS             int          `env:"CAPABILITIES_TTL_MS"`             // Time(ms) to cache the aggregator capabilities. 0 disables it
 	CollectAnnotations            bool         `env:"COLLECT_ANNOTATIONS"`             // Collect all annotations with values <=64 characters
 	CollectCRDPrinterColumns      bool         `env:"COLLECT_CRD_PRINTER_COLUMNS"`     // Enable collecting additional printer columns in the CRD
 	CollectStatusConditions       bool         `env:"COLLECT_STATUS_CONDITIONS"`       // Collect all status condition types and values if present
 	ClusterName                   string       `env:"CLUSTER_NAME"`                    // The name of of the cluster where this pod is running
 	DeployedInHub                 bool         `env:"DEPLOYED_IN_HUB"`                 // Tracks if deployed in the Hub or Managed cluster
+	DiffStreamHistory             int          `env:"DIFF_STREAM_HISTORY"`             // Diffs kept to resume the diff stream
+	DiffStreamQueue               int          `env:"DIFF_STREAM_QUEUE"`               // Diffs queued for a subscriber before it's dropped
+	FeatureAdminAPI               bool         `env:"FEATURE_ADMIN_API"`               // Serve the authenticated admin routes
 	FeatureConfigurableCollection bool         `env:"FEATURE_CONFIGURABLE_COLLECTION"` // Enable configurable collection feature to extend transforms config
+	FeatureDiffStream             bool         `env:"FEATURE_DIFF_STREAM"`             // Stream the diffs to local subscribers
+	FeatureQueryAPI               bool         `env:"FEATURE_QUERY_API"`               // Serve the nodes and edges held by the collector
+	FeatureSnapshot               bool         `env:"FEATURE_SNAPSHOT"`                // Keep the resources of the nodes to write reconciler snapshots
 	HeartbeatMS                   int          `env:"HEARTBEAT_MS"`                    // Interval(ms) to send empty payload to ensure connection
 	HTTPTimeout                   int          `env:"HTTP_TIMEOUT"`                    // Timeout for http server connections. Default: 5 min
 	KubeConfig                    string       `env:"KUBECONFIG"`                      // Local kubeconfig path
+	LivenessHeartbeats            int          `env:"LIVENESS_HEARTBEATS"`             // Heartbeats a send cycle can be late before the liveness probe fails
 	MaxBackoffMS                  int          `env:"MAX_BACKOFF_MS"`                  // Maximum backoff in ms to wait after error
+	MaxSyncErrors                 int          `env:"MAX_SYNC_ERRORS"`                 // Failed resources and edges to retry before a full resync
 	NSFilterCacheTTLMS            int          `env:"NS_FILTER_CACHE_TTL_MS"`          // TTL(ms) for the namespace filter cache
 	PodNamespace                  string       `env:"POD_NAMESPACE"`                   // The namespace of this pod
 	RediscoverRateMS              int          `env:"REDISCOVER_RATE_MS"`              // Interval(ms) between CRD discovery syncs
 	RetryJitterMS                 int          `env:"RETRY_JITTER_MS"`                 // Random jitter added to backoff wait.
 	ReportRateMS                  int          `env:"REPORT_RATE_MS"`                  // Interval(ms) to send changes to the aggregator
+	ResyncChunkRetries            int          `env:"RESYNC_CHUNK_RETRIES"`            // Retries for a failed chunk of a resync session
+	ResyncChunkSize               int          `env:"RESYNC_CHUNK_SIZE"`               // Max nodes and edges per resync chunk. 0 disables chunking
 	RuntimeMode                   string       `env:"RUNTIME_MODE"`                    // Running mode (development or production)
 	ServerAddress                 string       `env:"SERVER_ADDRESS"`                  // Web server address
+	ServerAuthn                   bool         `env:"SERVER_AUTHN"`                    // Require a token allowed by RBAC for the metrics and API routes
+	ServerTLSCertFile             string       `env:"SERVER_TLS_CERT_FILE"`            // Serving certificate. Empty serves plain HTTP
+	ServerTLSKeyFile              string       `env:"SERVER_TLS_KEY_FILE"`             // Key of the serving certificate
+	ShutdownFlushTimeoutMS        int          `env:"SHUTDOWN_FLUSH_TIMEOUT_MS"`       // Time in ms to send the last changes on shutdown. 0 disables it
+	SigningAlgorithm              string       `env:"SIGNING_ALGORITHM"`               // Algorithm to sign sync requests (hmac-sha256 or ed25519)
+	SigningKeyFile                string       `env:"SIGNING_KEY_FILE"`                // File with the signing key. Empty disables signing
+	SigningKeyID                  string       `env:"SIGNING_KEY_ID"`                  // Key ID sent to the aggregator. Derived from the key if empty
+	Sink                          string       `env:"SINK"`                            // Where to send payloads (aggregator, file or stdout)
+	SinkFileMaxBackups            int          `env:"SINK_FILE_MAX_BACKUPS"`           // Rotated files kept by the file sink
+	SinkFileMaxMB                 int          `env:"SINK_FILE_MAX_MB"`                // Size in MB at which the file sink rotates the file
+	SinkFilePath                  string       `env:"SINK_FILE_PATH"`                  // Path of the NDJSON file written by the file sink
+	StateDir                      string       `env:"STATE_DIR"`                       // Directory to save the acknowledged state. Empty disables it
+	StateSaveIntervalMS           int          `env:"STATE_SAVE_INTERVAL_MS"`          // Interval(ms) to save the acknowledged state to STATE_DIR
+	SyncCompression               string       `env:"SYNC_COMPRESSION"`                // Encoding of sync request bodies (none, gzip or zstd)
+	TLSCAFile                     string       `env:"TLS_CA_FILE"`                     // CA bundle to verify the aggregator. Defaults to TLS_CERT_FILE
+	TLSCertFile                   string       `env:"TLS_CERT_FILE"`                   // Client certificate, reloaded when it changes
+	TLSCipherSuites               string       `env:"TLS_CIPHER_SUITES"`               // Comma separated cipher suites for TLS 1.2
+	TLSCurves                     string       `env:"TLS_CURVES"`                      // Comma separated curve preferences
+	TLSKeyFile                    string       `env:"TLS_KEY_FILE"`                    // Client certificate key, reloaded when it changes
+	TLSMinVersion                 string       `env:"TLS_MIN_VERSION"`                 // Minimum TLS version, 1.2 or 1.3
+	TLSStrict                     bool         `env:"TLS_STRICT"`                      // Refuse to start without certificates instead of using insecure TLS
+	TombstoneMaxEntries           int          `env:"TOMBSTONE_MAX_ENTRIES"`           // Deleted resources remembered to ignore late events
+	TombstoneTTLMS                int          `env:"TOMBSTONE_TTL_MS"`                // Time(ms) a deleted resource is remembered. 0 keeps it until evicted
+	TransportDialTimeoutMS        int          `env:"TRANSPORT_DIAL_TIMEOUT_MS"`       // Timeout(ms) to connect to the aggregator or proxy
+	TransportDisableHTTP2         bool         `env:"TRANSPORT_DISABLE_HTTP2"`         // Use HTTP/1.1 for the aggregator connections
+	TransportHeaderTimeoutMS      int          `env:"TRANSPORT_HEADER_TIMEOUT_MS"`     // Timeout(ms) to wait for the response headers. 0 waits forever
+	TransportHTTP2PingMS          int          `env:"TRANSPORT_HTTP2_PING_MS"`         // Idle time(ms) before pinging an HTTP/2 connection
+	TransportIdleTimeoutMS        int          `env:"TRANSPORT_IDLE_TIMEOUT_MS"`       // Time(ms) an idle connection is kept open
+	TransportKeepAliveMS          int          `env:"TRANSPORT_KEEP_ALIVE_MS"`         // Interval(ms) between TCP keep-alive probes
+	TransportMaxIdleConns         int          `env:"TRANSPORT_MAX_IDLE_CONNS"`        // Idle connections kept open to the aggregator
+
+	// Aggregators to send to. The first one is AggregatorURL, then one for each ADDITIONAL_HUB_CONFIGS file.
+	AggregatorTargets []AggregatorTarget
 }
 
 var Cfg = Config{}
@@ -103,12 +194,38 @@ func InitConfig() {
 		setDefault(&Cfg.AggregatorURL, "AGGREGATOR_URL", DEFAULT_AGGREGATOR_URL)
 	}
 
+	setDefaultInt(&Cfg.CapabilitiesTTLMS, "CAPABILITIES_TTL_MS", DEFAULT_CAPABILITIES_TTL_MS)
+	setDefaultInt(&Cfg.DiffStreamHistory, "DIFF_STREAM_HISTORY", DEFAULT_DIFF_STREAM_HISTORY)
+	setDefaultInt(&Cfg.DiffStreamQueue, "DIFF_STREAM_QUEUE", DEFAULT_DIFF_STREAM_QUEUE)
 	setDefaultInt(&Cfg.HeartbeatMS, "HEARTBEAT_MS", DEFAULT_HEARTBEAT_MS)
+	setDefaultInt(&Cfg.LivenessHeartbeats, "LIVENESS_HEARTBEATS", DEFAULT_LIVENESS_HEARTBEATS)
 	setDefaultInt(&Cfg.MaxBackoffMS, "MAX_BACKOFF_MS", DEFAULT_MAX_BACKOFF_MS)
+	setDefaultInt(&Cfg.MaxSyncErrors, "MAX_SYNC_ERRORS", DEFAULT_MAX_SYNC_ERRORS)
 	setDefaultInt(&Cfg.NSFilterCacheTTLMS, "NS_FILTER_CACHE_TTL_MS", DEFAULT_NS_FILTER_CACHE_TTL_MS)
 	setDefaultInt(&Cfg.RediscoverRateMS, "REDISCOVER_RATE_MS", DEFAULT_REDISCOVER_RATE_MS)
 	setDefaultInt(&Cfg.ReportRateMS, "REPORT_RATE_MS", DEFAULT_REPORT_RATE_MS)
 	setDefaultInt(&Cfg.RetryJitterMS, "RETRY_JITTER_MS", DEFAULT_RETRY_JITTER_MS)
+	setDefaultInt(&Cfg.ResyncChunkSize, "RESYNC_CHUNK_SIZE", 0)
+	setDefaultInt(&Cfg.ResyncChunkRetries, "RESYNC_CHUNK_RETRIES", DEFAULT_RESYNC_CHUNK_RETRIES)
+	setDefault(&Cfg.SyncCompression, "SYNC_COMPRESSION", DEFAULT_SYNC_COMPRESSION)
+	setDefault(&Cfg.StateDir, "STATE_DIR", "")
+	setDefaultInt(&Cfg.StateSaveIntervalMS, "STATE_SAVE_INTERVAL_MS", DEFAULT_STATE_SAVE_INTERVAL_MS)
+	setDefaultInt(&Cfg.ShutdownFlushTimeoutMS, "SHUTDOWN_FLUSH_TIMEOUT_MS", DEFAULT_SHUTDOWN_FLUSH_MS)
+	setDefault(&Cfg.SigningAlgorithm, "SIGNING_ALGORITHM", DEFAULT_SIGNING_ALGORITHM)
+	setDefault(&Cfg.SigningKeyFile, "SIGNING_KEY_FILE", "")
+	setDefault(&Cfg.SigningKeyID, "SIGNING_KEY_ID", "")
+	setDefault(&Cfg.Sink, "SINK", DEFAULT_SINK)
+	sink, err := parseSink(Cfg.Sink)
+	if err != nil {
+		// Exit because sending to an unexpected place without the checks of that sink is worse than not starting.
+		klog.Fatal(err)
+	}
+	Cfg.Sink = sink
+	setDefault(&Cfg.SinkFilePath, "SINK_FILE_PATH", DEFAULT_SINK_FILE_PATH)
+	setDefaultInt(&Cfg.SinkFileMaxMB, "SINK_FILE_MAX_MB", DEFAULT_SINK_FILE_MAX_MB)
+	setDefaultInt(&Cfg.SinkFileMaxBackups, "SINK_FILE_MAX_BACKUPS", DEFAULT_SINK_FILE_MAX_BACKUPS)
+	setDefaultInt(&Cfg.TombstoneTTLMS, "TOMBSTONE_TTL_MS", DEFAULT_TOMBSTONE_TTL_MS)
+	setDefaultInt(&Cfg.TombstoneMaxEntries, "TOMBSTONE_MAX_ENTRIES", DEFAULT_TOMBSTONE_MAX_ENTRIES)
 
 	defaultKubePath := filepath.Join(os.Getenv("HOME"), ".kube", "config")
 	if _, err := os.Stat(defaultKubePath); os.IsNotExist(err) { // #nosec G703
@@ -138,7 +255,11 @@ func InitConfig() {
 	}
 
 	setDefaultBool(&Cfg.DeployedInHub, "DEPLOYED_IN_HUB", false)
+	setDefaultBool(&Cfg.FeatureAdminAPI, "FEATURE_ADMIN_API", false)
 	setDefaultBool(&Cfg.FeatureConfigurableCollection, "FEATURE_CONFIGURABLE_COLLECTION", false)
+	setDefaultBool(&Cfg.FeatureDiffStream, "FEATURE_DIFF_STREAM", false)
+	setDefaultBool(&Cfg.FeatureQueryAPI, "FEATURE_QUERY_API", false)
+	setDefaultBool(&Cfg.FeatureSnapshot, "FEATURE_SNAPSHOT", false)
 	setDefault(&Cfg.AggregatorConfigFile, "HUB_CONFIG", "")
 
 	if collectCRDPrinterCols := os.Getenv("COLLECT_CRD_PRINTER_COLUMNS"); collectCRDPrinterCols != "" {
@@ -153,7 +274,7 @@ func InitConfig() {
 
 	if Cfg.DeployedInHub && Cfg.AggregatorConfigFile != "" {
 		klog.Fatal("Config mismatch: DEPLOYED_IN_HUB is true, but HUB_CONFIG is set to connect to another hub")
-	} else if !Cfg.DeployedInHub && Cfg.AggregatorConfigFile == "" {
+	} else if !Cfg.DeployedInHub && Cfg.AggregatorConfigFile == "" && Cfg.SendsToAggregator() {
 		klog.Fatal("Config mismatch: DEPLOYED_IN_HUB is false, but no HUB_CONFIG is set to connect to another hub")
 	}
 
@@ -164,18 +285,104 @@ func InitConfig() {
 				err)
 		}
 
-		Cfg.AggregatorURL = hubConfig.Host + "/apis/proxy.open-cluster-management.io/v1beta1/namespaces/" +
-			Cfg.ClusterName + "/clusterstatuses"
+		Cfg.AggregatorURL = hubAggregatorURL(hubConfig)
 		Cfg.AggregatorConfig = hubConfig
 
 		klog.Info("Running inside klusterlet. Aggregator URL: ", Cfg.AggregatorURL)
 	}
 
+	setDefault(&Cfg.TLSCAFile, "TLS_CA_FILE", "")
+	setDefault(&Cfg.TLSCertFile, "TLS_CERT_FILE", DEFAULT_TLS_CERT_FILE)
+	setDefault(&Cfg.TLSKeyFile, "TLS_KEY_FILE", DEFAULT_TLS_KEY_FILE)
+	setDefault(&Cfg.TLSMinVersion, "TLS_MIN_VERSION", DEFAULT_TLS_MIN_VERSION)
+	setDefault(&Cfg.TLSCipherSuites, "TLS_CIPHER_SUITES", DEFAULT_TLS_CIPHER_SUITES)
+	setDefault(&Cfg.TLSCurves, "TLS_CURVES", DEFAULT_TLS_CURVES)
+	setDefaultBool(&Cfg.TLSStrict, "TLS_STRICT", false)
+
+	setDefault(&Cfg.AggregatorProxyURL, "AGGREGATOR_PROXY_URL", "")
+	setDefault(&Cfg.AggregatorNoProxy, "AGGREGATOR_NO_PROXY", "")
+	setDefaultInt(&Cfg.TransportDialTimeoutMS, "TRANSPORT_DIAL_TIMEOUT_MS", DEFAULT_DIAL_TIMEOUT_MS)
+	setDefaultInt(&Cfg.TransportHeaderTimeoutMS, "TRANSPORT_HEADER_TIMEOUT_MS", 0)
+	setDefaultInt(&Cfg.TransportIdleTimeoutMS, "TRANSPORT_IDLE_TIMEOUT_MS", DEFAULT_IDLE_CONN_TIMEOUT_MS)
+	setDefaultInt(&Cfg.TransportKeepAliveMS, "TRANSPORT_KEEP_ALIVE_MS", DEFAULT_KEEP_ALIVE_MS)
+	setDefaultInt(&Cfg.TransportMaxIdleConns, "TRANSPORT_MAX_IDLE_CONNS", DEFAULT_MAX_IDLE_CONNS)
+	setDefaultInt(&Cfg.TransportHTTP2PingMS, "TRANSPORT_HTTP2_PING_MS", DEFAULT_HTTP2_PING_MS)
+	setDefaultBool(&Cfg.TransportDisableHTTP2, "TRANSPORT_DISABLE_HTTP2", false)
+
+	setDefault(&Cfg.AdditionalHubConfigs, "ADDITIONAL_HUB_CONFIGS", "")
+	Cfg.AggregatorTargets = aggregatorTargets()
+
 	// setting configs for metrics server
 	setDefault(&Cfg.ServerAddress, "SERVER_ADDRESS", ":5010")
+	setDefaultBool(&Cfg.ServerAuthn, "SERVER_AUTHN", false)
+	setDefault(&Cfg.ServerTLSCertFile, "SERVER_TLS_CERT_FILE", "")
+	setDefault(&Cfg.ServerTLSKeyFile, "SERVER_TLS_KEY_FILE", "")
 	setDefaultInt(&Cfg.HTTPTimeout, "HTTP_TIMEOUT", 5*60*1000)
 }
 
+// URL of the aggregator on the hub, through the cluster proxy.
+func hubAggregatorURL(hubConfig *rest.Config) string {
+	return hubConfig.Host + "/apis/proxy.open-cluster-management.io/v1beta1/namespaces/" +
+		Cfg.ClusterName + "/clusterstatuses"
+}
+
+// Builds the list of aggregators to send to: the one from HUB_CONFIG or AGGREGATOR_URL, then one for each
+// config file in ADDITIONAL_HUB_CONFIGS.
+func aggregatorTargets() []AggregatorTarget {
+	targets := []AggregatorTarget{{Name: DEFAULT_AGGREGATOR_TARGET, URL: Cfg.AggregatorURL, Config: Cfg.AggregatorConfig}}
+	if Cfg.AdditionalHubConfigs == "" {
+		return targets
+	}
+	if Cfg.DeployedInHub {
+		klog.Fatal("Config mismatch: DEPLOYED_IN_HUB is true, but ADDITIONAL_HUB_CONFIGS is set to connect to other hubs")
+	}
+	for i, file := range strings.Split(Cfg.AdditionalHubConfigs, ",") {
+		file = strings.TrimSpace(file)
+		if file == "" {
+			continue
+		}
+		hubConfig, err := clientcmd.BuildConfigFromFlags("", file)
+		if err != nil {
+			klog.Error("Error building K8s client from config file [", file, "]. Skipping this hub. Original error: ",
+				err)
+			continue
+		}
+		target := AggregatorTarget{Name: fmt.Sprintf("hub-%d", i+1), URL: hubAggregatorURL(hubConfig), Config: hubConfig}
+		klog.Infof("Sending to additional hub %s. Aggregator URL: %s", target.Name, target.URL)
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// Returns the aggregator target with the name.
+func (c Config) AggregatorTarget(name string) (AggregatorTarget, bool) {
+	for _, target := range c.AggregatorTargets {
+		if target.Name == name {
+			return target, true
+		}
+	}
+	return AggregatorTarget{}, false
+}
+
+// Returns true unless the payloads go to a sink other than the aggregator, in which case no hub is needed.
+// The SINK value is normalized by InitConfig.
+func (c Config) SendsToAggregator() bool {
+	return c.Sink == "" || c.Sink == SINK_AGGREGATOR
+}
+
+// Returns the normalized SINK value, or an error if it isn't one of the sinks.
+func parseSink(value string) (string, error) {
+	sink := strings.ToLower(strings.TrimSpace(value))
+	switch sink {
+	case "":
+		return DEFAULT_SINK, nil
+	case SINK_AGGREGATOR, SINK_FILE, SINK_STDOUT:
+		return sink, nil
+	}
+	return "", fmt.Errorf("unsupported SINK value [%s], expected %s, %s or %s", value, SINK_AGGREGATOR, SINK_FILE,
+		SINK_STDOUT)
+}
+
 // Sets config field to perfer the env over config file
 // If no config or env set to the default value
 func setDefault(field *string, env, defaultVal string) {
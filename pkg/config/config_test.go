@@ -52,3 +52,18 @@ func Test_SetDefaultInt_02(t *testing.T) {
 		t.Errorf("Failed testing setDefault() Expected: %d  Got: %d", 9999, property)
 	}
 }
+
+// Should normalize the known sinks and reject unknown values instead of falling back to the aggregator.
+func Test_parseSink(t *testing.T) {
+	for value, expected := range map[string]string{"": SINK_AGGREGATOR, " Aggregator ": SINK_AGGREGATOR,
+		"file": SINK_FILE, "STDOUT": SINK_STDOUT} {
+		sink, err := parseSink(value)
+		if err != nil || sink != expected {
+			t.Errorf("Failed testing parseSink(%q) Expected: %s  Got: %s, %v", value, expected, sink, err)
+		}
+	}
+
+	if _, err := parseSink("aggregater"); err == nil {
+		t.Errorf("Failed testing parseSink() Expected an error for an unknown value")
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package graph
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/stolostron/search-collector/pkg/config"
+	rec "github.com/stolostron/search-collector/pkg/reconciler"
+)
+
+// Command runs the graph subcommand, which exports the graph of a reconciler snapshot:
+//
+//	search-collector graph -snapshot <file> [-format dot] [-namespace a,b] [-kind Pod,ReplicaSet] [-cluster name]
+func Command(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("graph", flag.ContinueOnError)
+	snapshotFile := flags.String("snapshot", "", "Reconciler snapshot to export")
+	format := flags.String("format", DOT, "Export format: "+strings.Join(Formats, ", "))
+	namespaces := flags.String("namespace", "", "Comma separated namespaces to export. Empty exports all")
+	kinds := flags.String("kind", "", "Comma separated kinds to export. Empty exports all")
+	clusterName := flags.String("cluster", os.Getenv("CLUSTER_NAME"),
+		"Cluster of the snapshot, needed to build the edges again")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *snapshotFile == "" {
+		return fmt.Errorf("the -snapshot file is required")
+	}
+	config.Cfg.ClusterName = *clusterName
+	if config.Cfg.ClusterName == "" {
+		config.Cfg.ClusterName = config.DEFAULT_CLUSTER_NAME
+	}
+
+	file, err := os.Open(*snapshotFile) // #nosec G304
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := rec.NewReconciler()
+	if err := r.ReadSnapshot(file); err != nil {
+		return err
+	}
+	nodes, edges := Filter(r.CurrentNodes(), r.CurrentEdges(), SplitList(*namespaces), SplitList(*kinds))
+	return Write(out, *format, nodes, edges)
+}
+
+// SplitList returns the trimmed, non-empty items of the comma separated list.
+func SplitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
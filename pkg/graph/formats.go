@@ -0,0 +1,164 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package graph
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	tr "github.com/stolostron/search-collector/pkg/transforms"
+)
+
+// Writes GraphML with the kind, namespace and name of each node as attributes, and all its properties as
+// JSON in the properties attribute.
+func writeGraphML(w io.Writer, nodes []tr.Node, edges []tr.Edge) error {
+	bw := bufio.NewWriter(w)
+	_, _ = bw.WriteString(xml.Header)
+	_, _ = bw.WriteString(`<graphml xmlns="http://graphml.graphdrawing.org/xmlns">` + "\n")
+	for _, key := range []string{"kind", "namespace", "name", "label", "properties"} {
+		_, _ = fmt.Fprintf(bw, `  <key id="%s" for="node" attr.name="%s" attr.type="string"/>`+"\n", key, key)
+	}
+	_, _ = bw.WriteString(`  <key id="type" for="edge" attr.name="type" attr.type="string"/>` + "\n")
+	_, _ = bw.WriteString(`  <graph id="search-collector" edgedefault="directed">` + "\n")
+	for _, n := range nodes {
+		properties, err := json.Marshal(n.Properties)
+		if err != nil {
+			return fmt.Errorf("could not encode the properties of node %s: %w", n.UID, err)
+		}
+		_, _ = fmt.Fprintf(bw, `    <node id="%s">`+"\n", xmlEscape(n.UID))
+		for _, data := range [][2]string{{"kind", fmt.Sprint(n.Properties["kind"])},
+			{"namespace", stringProperty(n, "namespace")}, {"name", stringProperty(n, "name")},
+			{"label", displayName(n)}, {"properties", string(properties)}} {
+			if data[1] != "" {
+				_, _ = fmt.Fprintf(bw, `      <data key="%s">%s</data>`+"\n", data[0], xmlEscape(data[1]))
+			}
+		}
+		_, _ = bw.WriteString("    </node>\n")
+	}
+	for _, e := range edges {
+		_, _ = fmt.Fprintf(bw, `    <edge source="%s" target="%s"><data key="type">%s</data></edge>`+"\n",
+			xmlEscape(e.SourceUID), xmlEscape(e.DestUID), xmlEscape(string(e.EdgeType)))
+	}
+	_, _ = bw.WriteString("  </graph>\n</graphml>\n")
+	return bw.Flush()
+}
+
+// Writes a Graphviz digraph with the kind, namespace and name as the label of each node, and the edge type as
+// the label of each edge.
+func writeDOT(w io.Writer, nodes []tr.Node, edges []tr.Edge) error {
+	bw := bufio.NewWriter(w)
+	_, _ = bw.WriteString("digraph \"search-collector\" {\n  node [shape=box];\n")
+	for _, n := range nodes {
+		_, _ = fmt.Fprintf(bw, "  %s [label=%s];\n", dotQuote(n.UID), dotQuote(displayName(n)))
+	}
+	for _, e := range edges {
+		_, _ = fmt.Fprintf(bw, "  %s -> %s [label=%s];\n", dotQuote(e.SourceUID), dotQuote(e.DestUID),
+			dotQuote(string(e.EdgeType)))
+	}
+	_, _ = bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+// Writes Cypher statements that create a node with the Resource label and the kind label for each node, and a
+// relationship with the edge type for each edge. Properties that Neo4j can't store, like the labels map, are
+// stored as JSON strings.
+func writeCypher(w io.Writer, nodes []tr.Node, edges []tr.Edge) error {
+	bw := bufio.NewWriter(w)
+	_, _ = bw.WriteString("CREATE INDEX resource_uid IF NOT EXISTS FOR (n:Resource) ON (n.uid);\n")
+	for _, n := range nodes {
+		keys := make([]string, 0, len(n.Properties))
+		for key := range n.Properties {
+			if key != "uid" {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		properties := []string{"uid: " + cypherString(n.UID)}
+		for _, key := range keys {
+			value, err := cypherValue(n.Properties[key])
+			if err != nil {
+				return fmt.Errorf("could not encode property %s of node %s: %w", key, n.UID, err)
+			}
+			properties = append(properties, cypherName(key)+": "+value)
+		}
+		_, _ = fmt.Fprintf(bw, "CREATE (:Resource:%s {%s});\n", cypherName(fmt.Sprint(n.Properties["kind"])),
+			strings.Join(properties, ", "))
+	}
+	for _, e := range edges {
+		_, _ = fmt.Fprintf(bw, "MATCH (a:Resource {uid: %s}), (b:Resource {uid: %s}) CREATE (a)-[:%s]->(b);\n",
+			cypherString(e.SourceUID), cypherString(e.DestUID), cypherName(string(e.EdgeType)))
+	}
+	return bw.Flush()
+}
+
+func stringProperty(n tr.Node, key string) string {
+	value, _ := n.Properties[key].(string)
+	return value
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + strings.ReplaceAll(s, "\n", `\n`) + `"`
+}
+
+// Quotes a label, relationship type or property key with backticks.
+func cypherName(s string) string {
+	return "`" + strings.ReplaceAll(s, "`", "``") + "`"
+}
+
+// Quotes a string literal, escaping the characters Cypher doesn't take as they are.
+func cypherString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r < 0x20:
+			_, _ = fmt.Fprintf(&b, `\u%04x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// Returns the Cypher literal of a property value. Numbers, booleans, strings and lists of strings are kept,
+// other values are stored as JSON strings.
+func cypherValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return cypherString(v), nil
+	case bool, int, int64, float64:
+		return fmt.Sprint(v), nil
+	case []string:
+		quoted := make([]string, len(v))
+		for i, item := range v {
+			quoted[i] = cypherString(item)
+		}
+		return "[" + strings.Join(quoted, ", ") + "]", nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return cypherString(string(encoded)), nil
+}
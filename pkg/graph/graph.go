@@ -0,0 +1,94 @@
+// Copyright Contributors to the Open Cluster Management project
+
+// Package graph exports the nodes and edges of the collector as GraphML, Graphviz DOT or Cypher, to look at
+// the cluster topology in tools like Gephi, Graphviz or Neo4j.
+package graph
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	tr "github.com/stolostron/search-collector/pkg/transforms"
+)
+
+// Export formats.
+const (
+	GraphML = "graphml"
+	DOT     = "dot"
+	Cypher  = "cypher"
+)
+
+// Formats lists the supported export formats.
+var Formats = []string{GraphML, DOT, Cypher}
+
+// ContentType returns the media type of the export format.
+func ContentType(format string) string {
+	switch format {
+	case GraphML:
+		return "application/graphml+xml"
+	case DOT:
+		return "text/vnd.graphviz"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// Filter returns the nodes in the namespaces and of the kinds, and the edges between them. Empty lists
+// don't filter. Kinds are compared ignoring case.
+func Filter(nodes []tr.Node, edges []tr.Edge, namespaces, kinds []string) ([]tr.Node, []tr.Edge) {
+	if len(namespaces) == 0 && len(kinds) == 0 {
+		return nodes, edges
+	}
+	kept := make(map[string]struct{}, len(nodes))
+	filteredNodes := []tr.Node{}
+	for _, n := range nodes {
+		if len(namespaces) > 0 && !contains(namespaces, fmt.Sprint(n.Properties["namespace"]), false) {
+			continue
+		}
+		if len(kinds) > 0 && !contains(kinds, fmt.Sprint(n.Properties["kind"]), true) {
+			continue
+		}
+		kept[n.UID] = struct{}{}
+		filteredNodes = append(filteredNodes, n)
+	}
+	filteredEdges := []tr.Edge{}
+	for _, e := range edges {
+		_, sourceKept := kept[e.SourceUID]
+		_, destKept := kept[e.DestUID]
+		if sourceKept && destKept {
+			filteredEdges = append(filteredEdges, e)
+		}
+	}
+	return filteredNodes, filteredEdges
+}
+
+func contains(list []string, value string, ignoreCase bool) bool {
+	for _, item := range list {
+		if item == value || (ignoreCase && strings.EqualFold(item, value)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Write writes the nodes and edges in the export format.
+func Write(w io.Writer, format string, nodes []tr.Node, edges []tr.Edge) error {
+	switch format {
+	case GraphML:
+		return writeGraphML(w, nodes, edges)
+	case DOT:
+		return writeDOT(w, nodes, edges)
+	case Cypher:
+		return writeCypher(w, nodes, edges)
+	}
+	return fmt.Errorf("unsupported graph format %q, use one of %s", format, strings.Join(Formats, ", "))
+}
+
+// Returns the node label shown in the pictures: kind, namespace and name.
+func displayName(n tr.Node) string {
+	name := fmt.Sprint(n.Properties["name"])
+	if namespace, ok := n.Properties["namespace"].(string); ok {
+		name = namespace + "/" + name
+	}
+	return fmt.Sprint(n.Properties["kind"]) + "\n" + name
+}
@@ -0,0 +1,95 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package graph
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stolostron/search-collector/pkg/config"
+	tr "github.com/stolostron/search-collector/pkg/transforms"
+	"github.com/stretchr/testify/assert"
+)
+
+func testGraph() ([]tr.Node, []tr.Edge) {
+	nodes := []tr.Node{
+		{UID: "local-cluster/pod1", Properties: map[string]interface{}{"kind": "Pod", "name": "pod1",
+			"namespace": "a", "label": map[string]string{"app": "web"}, "restarts": int64(2)}},
+		{UID: "local-cluster/rs1", Properties: map[string]interface{}{"kind": "ReplicaSet", "name": `rs"1`,
+			"namespace": "a"}},
+		{UID: "local-cluster/node1", Properties: map[string]interface{}{"kind": "Node", "name": "node1"}},
+	}
+	edges := []tr.Edge{
+		{EdgeType: "ownedBy", SourceUID: "local-cluster/pod1", DestUID: "local-cluster/rs1"},
+		{EdgeType: "runsOn", SourceUID: "local-cluster/pod1", DestUID: "local-cluster/node1"},
+	}
+	return nodes, edges
+}
+
+func TestFilter(t *testing.T) {
+	nodes, edges := testGraph()
+
+	filteredNodes, filteredEdges := Filter(nodes, edges, []string{"a"}, nil)
+	assert.Len(t, filteredNodes, 2)
+	assert.Equal(t, []tr.Edge{edges[0]}, filteredEdges, "Expected only the edges between the filtered nodes.")
+
+	filteredNodes, filteredEdges = Filter(nodes, edges, nil, []string{"pod", "node"})
+	assert.Len(t, filteredNodes, 2)
+	assert.Equal(t, []tr.Edge{edges[1]}, filteredEdges)
+}
+
+func TestWrite(t *testing.T) {
+	nodes, edges := testGraph()
+	write := func(format string) string {
+		var b strings.Builder
+		assert.Nil(t, Write(&b, format, nodes, edges))
+		return b.String()
+	}
+
+	graphML := write(GraphML)
+	assert.Contains(t, graphML, `<node id="local-cluster/rs1">`)
+	assert.Contains(t, graphML, `<data key="name">rs&#34;1</data>`)
+	assert.Contains(t, graphML, `<edge source="local-cluster/pod1" target="local-cluster/rs1"><data key="type">ownedBy</data></edge>`)
+
+	dot := write(DOT)
+	assert.Contains(t, dot, `"local-cluster/rs1" [label="ReplicaSet\na/rs\"1"];`)
+	assert.Contains(t, dot, `"local-cluster/pod1" -> "local-cluster/node1" [label="runsOn"];`)
+
+	cypher := write(Cypher)
+	assert.Contains(t, cypher, "CREATE (:Resource:`Pod` {uid: \"local-cluster/pod1\", `kind`: \"Pod\", "+
+		"`label`: \"{\\\"app\\\":\\\"web\\\"}\", `name`: \"pod1\", `namespace`: \"a\", `restarts`: 2});")
+	assert.Contains(t, cypher, "MATCH (a:Resource {uid: \"local-cluster/pod1\"}), "+
+		"(b:Resource {uid: \"local-cluster/rs1\"}) CREATE (a)-[:`ownedBy`]->(b);")
+
+	assert.ErrorContains(t, Write(&strings.Builder{}, "svg", nodes, edges), "unsupported graph format")
+}
+
+// Snapshot of a pod owned by a replica set, as written by the reconciler.
+const testSnapshot = `{"version": 1, "clusterName": "test-cluster", "edges": [], "nodes": [
+  {"uid": "test-cluster/pod1", "resourceString": "pods", "properties": {"kind": "Pod"}, "source": {
+    "resourceString": "pods", "resource": {"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "pod1",
+      "namespace": "a", "uid": "pod1", "ownerReferences": [{"apiVersion": "apps/v1", "kind": "ReplicaSet",
+      "name": "rs1", "uid": "rs1", "controller": true}]}}}},
+  {"uid": "test-cluster/rs1", "resourceString": "replicasets", "properties": {"kind": "ReplicaSet"}, "source": {
+    "resourceString": "replicasets", "resource": {"apiVersion": "apps/v1", "kind": "ReplicaSet",
+      "metadata": {"name": "rs1", "namespace": "a", "uid": "rs1"}}}}
+]}`
+
+func TestCommand(t *testing.T) {
+	originalClusterName := config.Cfg.ClusterName
+	defer func() { config.Cfg.ClusterName = originalClusterName }()
+	snapshotFile := filepath.Join(t.TempDir(), "snapshot.json")
+	assert.Nil(t, os.WriteFile(snapshotFile, []byte(testSnapshot), 0o600))
+
+	var out strings.Builder
+	err := Command([]string{"-snapshot", snapshotFile, "-cluster", "test-cluster", "-kind", "Pod,ReplicaSet"}, &out)
+
+	assert.Nil(t, err)
+	assert.Contains(t, out.String(), `"test-cluster/pod1" [label="Pod\na/pod1"];`)
+	assert.Contains(t, out.String(), `"test-cluster/pod1" -> "test-cluster/rs1" [label="ownedBy"];`,
+		"Expected the edges to be built again from the snapshot resources.")
+
+	assert.ErrorContains(t, Command([]string{}, &out), "-snapshot")
+}
@@ -0,0 +1,163 @@
+// Copyright Contributors to the Open Cluster Management project
+
+// Package health tracks the progress of the collector pipeline for the readiness and liveness probes.
+// The informers, transformers, reconciler and senders report to it, like they report metrics.
+package health
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/stolostron/search-collector/pkg/config"
+)
+
+// Check is the result of one check of a probe.
+type Check struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"` // Why the check failed
+}
+
+// Stage of the pipeline with goroutines that work on one item at a time. It's stuck when all its goroutines
+// have been busy with their item for too long, for example blocked sending it to the next stage.
+type Stage struct {
+	mutex      sync.Mutex
+	workers    int       // Running goroutines
+	busy       int       // Goroutines working on an item
+	stuckSince time.Time // When the last idle goroutine got busy. Zero while a goroutine is idle.
+}
+
+var (
+	Reconciler   = &Stage{} // The receive loop, busy from receiving an event until it's reconciled
+	Transformers = &Stage{} // The transformer routines, busy while sending a node event to the reconciler
+
+	informersSynced atomic.Bool
+	sent            atomic.Bool
+
+	sendCyclesMutex sync.Mutex
+	sendCycles      = map[string]time.Time{} // When the next send cycle of each aggregator target is due
+)
+
+// Start records a goroutine of the stage that started.
+func (s *Stage) Start() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.workers++
+	s.stuckSince = time.Time{}
+}
+
+// Stop records a goroutine of the stage that stopped.
+func (s *Stage) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.workers--
+}
+
+// Begin records a goroutine that got an item to work on.
+func (s *Stage) Begin() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.busy++
+	if s.busy >= s.workers && s.stuckSince.IsZero() {
+		s.stuckSince = time.Now()
+	}
+}
+
+// End records a goroutine that is done with its item.
+func (s *Stage) End() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.busy--
+	s.stuckSince = time.Time{}
+}
+
+// Returns the running goroutines, and how long all of them have been busy.
+func (s *Stage) busyFor(now time.Time) (int, time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.workers == 0 || s.stuckSince.IsZero() {
+		return s.workers, 0
+	}
+	return s.workers, now.Sub(s.stuckSince)
+}
+
+// InformersSynced records that the informers listed all the resources for the first time.
+func InformersSynced() {
+	informersSynced.Store(true)
+}
+
+// SendSucceeded records a successful send.
+func SendSucceeded() {
+	sent.Store(true)
+}
+
+// SendCycle records that the next send cycle of the aggregator target is due after the wait. The backoff after
+// errors and the wait asked by the aggregator aren't counted as a stuck send loop.
+func SendCycle(target string, wait time.Duration) {
+	sendCyclesMutex.Lock()
+	defer sendCyclesMutex.Unlock()
+	sendCycles[target] = time.Now().Add(wait)
+}
+
+// Reset forgets the progress recorded by the pipeline. Used by tests.
+func Reset() {
+	for _, s := range []*Stage{Reconciler, Transformers} {
+		s.mutex.Lock()
+		s.workers, s.busy, s.stuckSince = 0, 0, time.Time{}
+		s.mutex.Unlock()
+	}
+	informersSynced.Store(false)
+	sent.Store(false)
+	sendCyclesMutex.Lock()
+	defer sendCyclesMutex.Unlock()
+	sendCycles = map[string]time.Time{}
+}
+
+// Readiness returns the checks of the readiness probe: the informers listed all the resources, and the state was
+// sent at least once.
+func Readiness() []Check {
+	checks := []Check{{Name: "informers", OK: informersSynced.Load()}, {Name: "send", OK: sent.Load()}}
+	if !checks[0].OK {
+		checks[0].Message = "The informers haven't listed all the resources yet."
+	}
+	if !checks[1].OK {
+		checks[1].Message = "No successful send yet."
+	}
+	return checks
+}
+
+// Liveness returns the checks of the liveness probe: the reconciler and the transformers aren't stuck for
+// longer than HEARTBEAT_MS, and no send cycle is late by more than LIVENESS_HEARTBEATS heartbeats.
+func Liveness(now time.Time) []Check {
+	stuckTimeout := time.Duration(config.Cfg.HeartbeatMS) * time.Millisecond
+	checks := []Check{{Name: "reconciler", OK: true}, {Name: "transformers", OK: true}, {Name: "send", OK: true}}
+
+	if _, busy := Reconciler.busyFor(now); busy > stuckTimeout {
+		checks[0].OK = false
+		checks[0].Message = fmt.Sprintf("The reconciler has been reconciling an event for %s.", busy.Round(time.Second))
+	}
+	if workers, busy := Transformers.busyFor(now); busy > stuckTimeout {
+		checks[1].OK = false
+		checks[1].Message = fmt.Sprintf("All %d transformer routines have been blocked for %s.", workers,
+			busy.Round(time.Second))
+	}
+
+	sendTimeout := time.Duration(config.Cfg.LivenessHeartbeats) * stuckTimeout
+	sendCyclesMutex.Lock()
+	defer sendCyclesMutex.Unlock()
+	var late []string
+	for target, due := range sendCycles {
+		if now.Sub(due) > sendTimeout {
+			late = append(late, target)
+		}
+	}
+	if len(late) > 0 {
+		sort.Strings(late)
+		checks[2].OK = false
+		checks[2].Message = fmt.Sprintf("No send cycle for %v in %s after it was due.", late, sendTimeout)
+	}
+	return checks
+}
@@ -0,0 +1,79 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package health
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stolostron/search-collector/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStage(t *testing.T) {
+	s := &Stage{}
+	s.Start()
+	s.Start()
+	now := time.Now()
+
+	s.Begin()
+	_, busy := s.busyFor(now.Add(time.Minute))
+	assert.Zero(t, busy, "Expected the stage not to be stuck while a goroutine is idle.")
+
+	s.Begin()
+	workers, busy := s.busyFor(now.Add(time.Minute))
+	assert.Equal(t, 2, workers)
+	assert.Greater(t, busy, 59*time.Second, "Expected the stage to be stuck since all its goroutines are busy.")
+
+	s.End()
+	_, busy = s.busyFor(now.Add(time.Minute))
+	assert.Zero(t, busy)
+
+	s.Stop() // The idle goroutine stopped, the busy one is the last one.
+	s.Begin()
+	s.End()
+	s.Begin()
+	_, busy = s.busyFor(time.Now().Add(time.Minute))
+	assert.Greater(t, busy, 59*time.Second)
+}
+
+func TestReadiness(t *testing.T) {
+	defer Reset()
+
+	checks := Readiness()
+	assert.False(t, checks[0].OK)
+	assert.False(t, checks[1].OK)
+
+	InformersSynced()
+	SendSucceeded()
+	for _, check := range Readiness() {
+		assert.True(t, check.OK, check.Name)
+		assert.Empty(t, check.Message)
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	originalHeartbeat, originalHeartbeats := config.Cfg.HeartbeatMS, config.Cfg.LivenessHeartbeats
+	config.Cfg.HeartbeatMS, config.Cfg.LivenessHeartbeats = 60000, 3
+	defer func() {
+		config.Cfg.HeartbeatMS, config.Cfg.LivenessHeartbeats = originalHeartbeat, originalHeartbeats
+		Reset()
+	}()
+
+	Reconciler.Start()
+	Reconciler.Begin()
+	SendCycle("default", 0)
+	SendCycle("backoff", 10*time.Minute)
+	now := time.Now()
+
+	for _, check := range Liveness(now) {
+		assert.True(t, check.OK, check.Name)
+	}
+
+	checks := Liveness(now.Add(4 * time.Minute))
+	assert.False(t, checks[0].OK, "Expected the reconciler to be stuck for longer than a heartbeat.")
+	assert.True(t, checks[1].OK)
+	assert.False(t, checks[2].OK, "Expected the send cycle to be late by more than 3 heartbeats.")
+	assert.Equal(t, "No send cycle for [default] in 3m0s after it was due.", checks[2].Message,
+		"Expected the wait before the next send cycle not to be counted.")
+}
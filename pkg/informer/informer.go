@@ -5,6 +5,7 @@ package informer
 
 import (
 	"context"
+	"errors"
 	"sync/atomic"
 	"time"
 
@@ -28,6 +29,22 @@ type GenericInformer struct {
 	retries       int64             // Counts times we have tried without establishing a watch.
 }
 
+// Cause of the informer context when the resource is no longer available in the cluster.
+var errInformerRemoved = errors.New("resource no longer available")
+
+// ErrInformerNotFound is returned when restarting the informer of a resource that isn't collected.
+var ErrInformerNotFound = errors.New("no informer is running for the resource")
+
+// Cause of the informer context when the informer is restarted. The informer hands its resource index over to
+// the one that replaces it.
+type informerRestart struct {
+	resourceIndex chan map[string]string
+}
+
+func (r *informerRestart) Error() string {
+	return "informer restarted"
+}
+
 // InformerForResource initialize a Generic Informer for a resource (GVR).
 func InformerForResource(res schema.GroupVersionResource) (*GenericInformer, error) {
 	i := &GenericInformer{
@@ -46,6 +63,17 @@ func (inform *GenericInformer) Run(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
+			var restart *informerRestart
+			if errors.As(context.Cause(ctx), &restart) {
+				klog.V(2).Info("Informer stopped to restart. ", inform.gvr.String())
+				restart.resourceIndex <- inform.resourceIndex
+				return
+			}
+			// On shutdown the resources still exist, only delete them when the resource type was removed.
+			if !errors.Is(context.Cause(ctx), errInformerRemoved) {
+				klog.V(3).Info("Informer stopped on shutdown. ", inform.gvr.String())
+				return
+			}
 			klog.Info("Informer stopped. ", inform.gvr.String())
 			for key := range inform.resourceIndex {
 				klog.V(5).Infof("Stopping informer %s and removing resource with UID: %s", inform.gvr.Resource, key)
@@ -59,14 +87,18 @@ func (inform *GenericInformer) Run(ctx context.Context) {
 				// Backoff strategy: Adds 2 seconds each retry, up to 2 mins.
 				wait := time.Duration(min(inform.retries*2, 120)) * time.Second
 				klog.V(3).Infof("Waiting %s before retrying listAndWatch for %s", wait, inform.gvr.String())
-				time.Sleep(wait)
+				select {
+				case <-ctx.Done():
+					continue
+				case <-time.After(wait):
+				}
 			}
 			klog.V(3).Info("(Re)starting informer: ", inform.gvr.String())
 			if inform.client == nil {
 				inform.client = config.GetDynamicClient()
 			}
 
-			err := inform.listAndResync()
+			err := inform.listAndResync(ctx)
 			if err == nil {
 				inform.initialized.Store(true)
 				inform.watch(ctx.Done())
@@ -89,7 +121,7 @@ func newUnstructured(kind, uid string) *unstructured.Unstructured {
 
 // List current resources and fires ADDED events. Then sync the current state with the previous
 // state and delete any resources that are still in our cache, but no longer exist in the cluster.
-func (inform *GenericInformer) listAndResync() error {
+func (inform *GenericInformer) listAndResync(ctx context.Context) error {
 
 	// Keep track of new resources added to consolidate against the previous state.
 	newResourceIndex := make(map[string]string)
@@ -98,7 +130,7 @@ func (inform *GenericInformer) listAndResync() error {
 	// it generates more requests to the kube api server.
 	opts := metav1.ListOptions{Limit: 250}
 	for {
-		resources, listError := inform.client.Resource(inform.gvr).List(context.TODO(), opts)
+		resources, listError := inform.client.Resource(inform.gvr).List(ctx, opts)
 		if listError != nil {
 			klog.Warningf("Error listing resources for %s.  Error: %s", inform.gvr.String(), listError)
 			inform.retries++
@@ -96,7 +96,7 @@ func Test_listAndResync(t *testing.T) {
 	informer, addFuncCount, _, _ := initInformer()
 
 	// Execute function
-	err := informer.listAndResync()
+	err := informer.listAndResync(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -117,7 +117,7 @@ func Test_listAndResync_syncWithPrevState(t *testing.T) {
 	informer.resourceIndex["id-001"] = "some-resource-version"   // This resource won't get deleted.
 
 	// Execute function
-	err := informer.listAndResync()
+	err := informer.listAndResync(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -149,12 +149,12 @@ func Test_StoppedInformer_ValidateDeleteFunc(t *testing.T) {
 	}
 
 	// start informer
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancelCause(context.Background())
 	go informer.Run(ctx)
 	time.Sleep(10 * time.Millisecond)
 
 	// exit informer to trigger DeleteFunc
-	cancel()
+	cancel(errInformerRemoved)
 
 	// allow test to process
 	time.Sleep(10 * time.Millisecond)
@@ -167,6 +167,47 @@ func Test_StoppedInformer_ValidateDeleteFunc(t *testing.T) {
 	}
 }
 
+// Verify that the informer doesn't delete its resources when the collector shuts down.
+func Test_Run_shutdown(t *testing.T) {
+	informer, _, deleteFuncCount, _ := initInformer()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go informer.Run(ctx)
+	time.Sleep(10 * time.Millisecond)
+
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+
+	if *deleteFuncCount != 0 {
+		t.Errorf("Expected informer.DeleteFunc not to be called on shutdown, but got %d calls.", *deleteFuncCount)
+	}
+}
+
+// Verify that a restarted informer hands its resources over instead of deleting them.
+func Test_Run_restart(t *testing.T) {
+	informer, _, deleteFuncCount, _ := initInformer()
+	informer.resourceIndex["id-001"] = "12345"
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	go informer.Run(ctx)
+	time.Sleep(10 * time.Millisecond)
+
+	restart := &informerRestart{resourceIndex: make(chan map[string]string, 1)}
+	cancel(restart)
+
+	select {
+	case resourceIndex := <-restart.resourceIndex:
+		if _, ok := resourceIndex["id-001"]; !ok {
+			t.Errorf("Expected the resource index to include id-001, but got %v.", resourceIndex)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the informer to hand its resource index over.")
+	}
+	if *deleteFuncCount != 0 {
+		t.Errorf("Expected informer.DeleteFunc not to be called on restart, but got %d calls.", *deleteFuncCount)
+	}
+}
+
 // Verify the informer's Run function.
 func Test_Run(t *testing.T) {
 	// Create informer instance to test.
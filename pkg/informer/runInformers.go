@@ -13,6 +13,7 @@ import (
 	"unicode/utf8"
 
 	"github.com/stolostron/search-collector/pkg/config"
+	"github.com/stolostron/search-collector/pkg/health"
 	rec "github.com/stolostron/search-collector/pkg/reconciler"
 	tr "github.com/stolostron/search-collector/pkg/transforms"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -24,6 +25,27 @@ import (
 	"k8s.io/klog/v2"
 )
 
+// Queue of the informer sync loop while RunInformers runs, to restart an informer on request.
+var (
+	syncQueueMutex sync.Mutex
+	syncQueue      *workqueue.Type
+)
+
+// Request to restart the informer of a resource, queued to the informer sync loop.
+type restartRequest struct {
+	gvr    schema.GroupVersionResource
+	result chan error
+}
+
+// Queued once an informer that didn't stop in time hands its resource index over, to start the new informer.
+type resumeRequest struct {
+	gvr           schema.GroupVersionResource
+	resourceIndex map[string]string
+}
+
+// Time to wait for a restarted informer to hand its resource index over. A variable so tests can shorten it.
+var restartTimeout = 30 * time.Second
+
 var crdGVR = schema.GroupVersionResource{
 	Group:    "apiextensions.k8s.io",
 	Version:  "v1",
@@ -460,6 +482,14 @@ func RunInformers(
 
 	syncInformersQueue := workqueue.NewTypedWithConfig(workqueue.QueueConfig{})
 	defer syncInformersQueue.ShutDown()
+	syncQueueMutex.Lock()
+	syncQueue = syncInformersQueue
+	syncQueueMutex.Unlock()
+	defer func() {
+		syncQueueMutex.Lock()
+		syncQueue = nil
+		syncQueueMutex.Unlock()
+	}()
 
 	dynSharedInformer, err := getCRDInformer(ctx, &gvrToColumns, syncInformersQueue)
 	if err != nil {
@@ -469,8 +499,9 @@ func RunInformers(
 	// Get kubernetes client for discovering resource types
 	discoveryClient := config.GetDiscoveryClient()
 
-	// We keep each of the informer's stopper channel in a map, so we can stop them if the resource is no longer valid.
-	stoppers := make(map[schema.GroupVersionResource]context.CancelFunc)
+	// We keep each of the informer's stopper channel in a map, so we can stop them if the resource is no longer valid,
+	// or restart them on request.
+	stoppers := make(map[schema.GroupVersionResource]context.CancelCauseFunc)
 
 	// These functions return handler functions, which are then used in creation of the informers.
 	createInformAddHandler := func(gvr schema.GroupVersionResource) func(interface{}) {
@@ -482,6 +513,7 @@ func RunInformers(
 				Resource:                 resource,
 				ResourceString:           gvr.Resource,
 				AdditionalPrinterColumns: gvrToColumns.get(gvr),
+				Sequence:                 tr.NextEventSequence(),
 			}
 			upsertTransformer.Input <- &upsert // Send resource into the transformer input channel
 		}
@@ -496,6 +528,7 @@ func RunInformers(
 				Resource:                 resource,
 				ResourceString:           gvr.Resource,
 				AdditionalPrinterColumns: gvrToColumns.get(gvr),
+				Sequence:                 tr.NextEventSequence(),
 			}
 			upsertTransformer.Input <- &upsert // Send resource into the transformer input channel
 		}
@@ -510,6 +543,8 @@ func RunInformers(
 			Node: tr.Node{
 				UID: strings.Join([]string{config.Cfg.ClusterName, string(resource.GetUID())}, "/"),
 			},
+			ResourceVersion: resource.GetResourceVersion(),
+			Sequence:        tr.NextEventSequence(),
 		}
 		reconciler.Input <- ne
 	}
@@ -519,11 +554,18 @@ func RunInformers(
 
 	// Close the initialized channel so that we can start the sender.
 	wasInitialized = true
+	health.InformersSynced()
 	close(initialized)
 
 	lastSynced := time.Now()
 	minBetweenSyncs := time.Duration(config.Cfg.RediscoverRateMS) * time.Millisecond
 
+	// Stop waiting for sync requests on shutdown.
+	go func() {
+		<-ctx.Done()
+		syncInformersQueue.ShutDown()
+	}()
+
 	// Keep the informers synchronized when CRDs are added or deleted in the cluster.
 	for {
 		select {
@@ -544,7 +586,22 @@ func RunInformers(
 
 		syncRequest, shutdown := syncInformersQueue.Get()
 		if shutdown {
-			return
+			// Shutting down, the next iteration waits for the CRD informer.
+			continue
+		}
+
+		// Restarts don't wait for the minimum delay between syncs.
+		if restart, ok := syncRequest.(*restartRequest); ok {
+			restart.result <- restartInformer(ctx, restart.gvr, stoppers, createInformAddHandler,
+				createInformUpdateHandler, informDeleteHandler)
+			syncInformersQueue.Done(syncRequest)
+			continue
+		}
+		if resume, ok := syncRequest.(*resumeRequest); ok {
+			resumeInformer(ctx, resume, stoppers, createInformAddHandler, createInformUpdateHandler,
+				informDeleteHandler)
+			syncInformersQueue.Done(syncRequest)
+			continue
 		}
 
 		// Enforce a minimum delay between syncs (configurable via REDISCOVER_RATE_MS, default 60s)
@@ -552,7 +609,12 @@ func RunInformers(
 		sinceLastSync := time.Since(lastSynced)
 
 		if sinceLastSync < minBetweenSyncs {
-			time.Sleep(minBetweenSyncs - sinceLastSync)
+			select {
+			case <-ctx.Done():
+				syncInformersQueue.Done(syncRequest)
+				continue
+			case <-time.After(minBetweenSyncs - sinceLastSync):
+			}
 		}
 
 		syncInformers(
@@ -569,7 +631,7 @@ func RunInformers(
 func syncInformers(
 	ctx context.Context,
 	client discovery.DiscoveryClient,
-	stoppers map[schema.GroupVersionResource]context.CancelFunc,
+	stoppers map[schema.GroupVersionResource]context.CancelCauseFunc,
 	createInformerAddHandler func(schema.GroupVersionResource) func(interface{}),
 	createInformerUpdateHandler func(schema.GroupVersionResource) func(interface{}, interface{}),
 	informerDeleteHandler func(obj interface{}),
@@ -594,29 +656,138 @@ func syncInformers(
 				continue
 			} else { // if it's in the old and NOT in the new, stop the informer
 				klog.V(2).Infof("Stopping informer: %s", gvr.String())
-				stopper()
+				stopper(errInformerRemoved)
 				delete(stoppers, gvr)
 			}
 		}
 		// Now, loop through the new list, which after the above deletions, contains only stuff that needs to
 		// have a new informer created for it.
 		for gvr := range gvrList {
-			klog.V(2).Infof("Starting informer: %s", gvr.String())
-			// Using our custom informer.
-			informer, _ := InformerForResource(gvr)
-
-			// Set up handler to pass this informer's resources into transformer
-			informer.AddFunc = createInformerAddHandler(gvr)
-			informer.UpdateFunc = createInformerUpdateHandler(gvr)
-			informer.DeleteFunc = informerDeleteHandler
-
-			informerCtx, informerCancel := context.WithCancel(ctx) // #nosec G118
-			stoppers[gvr] = informerCancel
-			go informer.Run(informerCtx)
-			// This wait serializes the informer initialization. It is needed to avoid a
-			// spike in memory when the collector starts.
-			informer.WaitUntilInitialized(time.Duration(10) * time.Second) // Times out after 10 seconds.
+			startInformer(ctx, gvr, nil, stoppers, createInformerAddHandler, createInformerUpdateHandler,
+				informerDeleteHandler)
 		}
 		klog.V(2).Info("Done synchronizing informers. Informers running: ", len(stoppers))
 	}
 }
+
+// Starts the informer of the resource and waits until it's initialized. A restarted informer gets the resource
+// index of the informer it replaces, so its first list deletes the resources that are gone.
+func startInformer(
+	ctx context.Context,
+	gvr schema.GroupVersionResource,
+	resourceIndex map[string]string,
+	stoppers map[schema.GroupVersionResource]context.CancelCauseFunc,
+	createInformerAddHandler func(schema.GroupVersionResource) func(interface{}),
+	createInformerUpdateHandler func(schema.GroupVersionResource) func(interface{}, interface{}),
+	informerDeleteHandler func(obj interface{}),
+) {
+	klog.V(2).Infof("Starting informer: %s", gvr.String())
+	// Using our custom informer.
+	informer, _ := InformerForResource(gvr)
+	if resourceIndex != nil {
+		informer.resourceIndex = resourceIndex
+	}
+
+	// Set up handler to pass this informer's resources into transformer
+	informer.AddFunc = createInformerAddHandler(gvr)
+	informer.UpdateFunc = createInformerUpdateHandler(gvr)
+	informer.DeleteFunc = informerDeleteHandler
+
+	informerCtx, informerCancel := context.WithCancelCause(ctx) // #nosec G118
+	stoppers[gvr] = informerCancel
+	go informer.Run(informerCtx)
+	// This wait serializes the informer initialization. It is needed to avoid a
+	// spike in memory when the collector starts.
+	informer.WaitUntilInitialized(time.Duration(10) * time.Second) // Times out after 10 seconds.
+}
+
+// Stops the informer of the resource and starts a new one, which lists all the resources again.
+func restartInformer(
+	ctx context.Context,
+	gvr schema.GroupVersionResource,
+	stoppers map[schema.GroupVersionResource]context.CancelCauseFunc,
+	createInformerAddHandler func(schema.GroupVersionResource) func(interface{}),
+	createInformerUpdateHandler func(schema.GroupVersionResource) func(interface{}, interface{}),
+	informerDeleteHandler func(obj interface{}),
+) error {
+	stopper, ok := stoppers[gvr]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrInformerNotFound, gvr.String())
+	}
+	klog.Infof("Restarting informer: %s", gvr.String())
+	restart := &informerRestart{resourceIndex: make(chan map[string]string, 1)}
+	stopper(restart)
+
+	var resourceIndex map[string]string
+	select {
+	case resourceIndex = <-restart.resourceIndex:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(restartTimeout):
+		// Starting the new informer now would leave two informers sending the events of the resource, and the
+		// new one couldn't delete the resources that are gone. The old one stays in the stoppers until it stops.
+		go waitForResourceIndex(ctx, gvr, restart)
+		return fmt.Errorf("informer %s didn't stop in %s, the new informer starts once it stops",
+			gvr.String(), restartTimeout)
+	}
+	startInformer(ctx, gvr, resourceIndex, stoppers, createInformerAddHandler, createInformerUpdateHandler,
+		informerDeleteHandler)
+	return nil
+}
+
+// Waits for the stopped informer to hand its resource index over, and queues the start of the new informer.
+func waitForResourceIndex(ctx context.Context, gvr schema.GroupVersionResource, restart *informerRestart) {
+	select {
+	case resourceIndex := <-restart.resourceIndex:
+		syncQueueMutex.Lock()
+		defer syncQueueMutex.Unlock()
+		if syncQueue != nil {
+			syncQueue.Add(&resumeRequest{gvr: gvr, resourceIndex: resourceIndex})
+		}
+	case <-ctx.Done():
+	}
+}
+
+// Starts the informer that replaces an informer that didn't stop in time. If the resource was removed in the
+// meantime, deletes the resources of the stopped informer instead.
+func resumeInformer(
+	ctx context.Context,
+	resume *resumeRequest,
+	stoppers map[schema.GroupVersionResource]context.CancelCauseFunc,
+	createInformerAddHandler func(schema.GroupVersionResource) func(interface{}),
+	createInformerUpdateHandler func(schema.GroupVersionResource) func(interface{}, interface{}),
+	informerDeleteHandler func(obj interface{}),
+) {
+	if _, ok := stoppers[resume.gvr]; !ok {
+		klog.Infof("Informer %s stopped after its resource was removed.", resume.gvr.String())
+		for key := range resume.resourceIndex {
+			informerDeleteHandler(newUnstructured(resume.gvr.Resource, key))
+		}
+		return
+	}
+	klog.Infof("Informer %s stopped, starting the new informer.", resume.gvr.String())
+	startInformer(ctx, resume.gvr, resume.resourceIndex, stoppers, createInformerAddHandler,
+		createInformerUpdateHandler, informerDeleteHandler)
+}
+
+// RestartInformer stops the informer of the resource and starts a new one, which lists all the resources again
+// and sends them through the transformer. Waits until the new informer is initialized, or the context is done.
+// Returns ErrInformerNotFound if no informer is running for the resource, and an error if the informer didn't
+// stop in time. The new informer then starts once it stopped.
+func RestartInformer(ctx context.Context, gvr schema.GroupVersionResource) error {
+	syncQueueMutex.Lock()
+	queue := syncQueue
+	syncQueueMutex.Unlock()
+	if queue == nil {
+		return errors.New("the informers are not running")
+	}
+
+	request := &restartRequest{gvr: gvr, result: make(chan error, 1)}
+	queue.Add(request)
+	select {
+	case err := <-request.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
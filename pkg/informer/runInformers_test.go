@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stolostron/search-collector/pkg/config"
 	tr "github.com/stolostron/search-collector/pkg/transforms"
@@ -17,6 +18,7 @@ import (
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/discovery"
 	restclient "k8s.io/client-go/rest"
+	"k8s.io/client-go/util/workqueue"
 )
 
 var mockAddFn = func(gvr schema.GroupVersionResource) func(interface{}) {
@@ -72,7 +74,7 @@ func Test_syncInformers(t *testing.T) {
 	// Establish the config
 	config.InitConfig()
 
-	mockStoppers := make(map[schema.GroupVersionResource]context.CancelFunc)
+	mockStoppers := make(map[schema.GroupVersionResource]context.CancelCauseFunc)
 
 	fakeServer, fakeClient := fakeDiscoveryClient()
 	defer fakeServer.Close()
@@ -91,8 +93,8 @@ func Test_syncInformers(t *testing.T) {
 
 // Validate that informer is stopped when resource no longer exists.
 func Test_syncInformers_removeInformers(t *testing.T) {
-	mockStoppers := make(map[schema.GroupVersionResource]context.CancelFunc)
-	ctx, cancel := context.WithCancel(context.Background())
+	mockStoppers := make(map[schema.GroupVersionResource]context.CancelCauseFunc)
+	ctx, cancel := context.WithCancelCause(context.Background())
 	mockStoppers[schema.GroupVersionResource{Group: "", Version: "v1", Resource: "notExist"}] = cancel
 
 	fakeServer, fakeClient := fakeDiscoveryClient()
@@ -361,3 +363,63 @@ func newSimpleCRDWithAdditionalPrinterColumns() unstructured.Unstructured {
 		},
 	}
 }
+
+// Validate that only running informers are restarted.
+func Test_restartInformer_notFound(t *testing.T) {
+	mockStoppers := make(map[schema.GroupVersionResource]context.CancelCauseFunc)
+	gvr := schema.GroupVersionResource{Group: "", Version: "v1", Resource: "notExist"}
+
+	err := restartInformer(context.Background(), gvr, mockStoppers, mockAddFn, mockUpdateFn, mockDeleteHandler)
+
+	assert.ErrorIs(t, err, ErrInformerNotFound)
+	assert.Equal(t, 0, len(mockStoppers))
+}
+
+// Validate that a restart fails when the informer sync loop isn't running.
+func Test_RestartInformer_notRunning(t *testing.T) {
+	err := RestartInformer(context.Background(), schema.GroupVersionResource{Version: "v1", Resource: "pods"})
+
+	assert.EqualError(t, err, "the informers are not running")
+}
+
+// Validate that an informer that doesn't stop in time is kept, and replaced once it hands its resources over.
+func Test_restartInformer_timeout(t *testing.T) {
+	timeout := restartTimeout
+	restartTimeout = 10 * time.Millisecond
+	defer func() { restartTimeout = timeout }()
+	queue := workqueue.New()
+	defer queue.ShutDown()
+	syncQueueMutex.Lock()
+	syncQueue = queue
+	syncQueueMutex.Unlock()
+	defer func() {
+		syncQueueMutex.Lock()
+		syncQueue = nil
+		syncQueueMutex.Unlock()
+	}()
+
+	gvr := schema.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
+	mockStoppers := map[schema.GroupVersionResource]context.CancelCauseFunc{
+		gvr: func(cause error) {
+			restart := cause.(*informerRestart)
+			go func() {
+				time.Sleep(50 * time.Millisecond) // Stops after the timeout.
+				restart.resourceIndex <- map[string]string{"uid1": "1"}
+			}()
+		},
+	}
+
+	err := restartInformer(context.Background(), gvr, mockStoppers, mockAddFn, mockUpdateFn, mockDeleteHandler)
+
+	assert.ErrorContains(t, err, "didn't stop in")
+	assert.Contains(t, mockStoppers, gvr, "Expected the running informer to be kept.")
+	request, _ := queue.Get()
+	assert.Equal(t, &resumeRequest{gvr: gvr, resourceIndex: map[string]string{"uid1": "1"}}, request)
+
+	// The resource was removed in the meantime, its resources are deleted instead.
+	deleted := []string{}
+	resumeInformer(context.Background(), request.(*resumeRequest),
+		map[schema.GroupVersionResource]context.CancelCauseFunc{}, mockAddFn, mockUpdateFn,
+		func(obj interface{}) { deleted = append(deleted, string(obj.(*unstructured.Unstructured).GetUID())) })
+	assert.Equal(t, []string{"uid1"}, deleted)
+}
@@ -22,6 +22,7 @@ type LeaseReconciler struct {
 	LeaseName            string
 	LeaseDurationSeconds int32
 	ClusterName          string
+	HubName              string // Aggregator target of the hub client, reloaded after errors
 	componentNamespace   string
 }
 
@@ -105,6 +106,8 @@ func getPodNamespace() string {
 
 func (r *LeaseReconciler) reloadClient() {
 	config.InitConfig()
-	r.HubKubeClient = config.GetKubeClient(config.Cfg.AggregatorConfig)
+	if target, ok := config.Cfg.AggregatorTarget(r.HubName); ok {
+		r.HubKubeClient = config.GetKubeClient(target.Config)
+	}
 	r.LocalKubeClient = config.GetKubeClient(config.GetKubeConfig())
 }
@@ -7,8 +7,12 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 const (
@@ -57,3 +61,30 @@ func TestUpdateLeaseAddon(t *testing.T) {
 	assert.True(t, createdTime.Before(updatedTime), "Expected lease renewtime to be updated and 'true' value to be returned. Got %b.", createdTime.Before(updatedTime))
 
 }
+
+// Each hub gets the lease when the managed cluster doesn't support leases.
+func TestLeaseAddonOnEachHub(t *testing.T) {
+	local := fake.NewSimpleClientset()
+	local.PrependReactor("*", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.NewNotFound(schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}, AddonName)
+	})
+	hubs := []*fake.Clientset{fake.NewSimpleClientset(), fake.NewSimpleClientset()}
+
+	for i, hub := range hubs {
+		leaseReconciler := LeaseReconciler{
+			HubKubeClient:        hub,
+			LocalKubeClient:      local,
+			LeaseName:            AddonName,
+			ClusterName:          "cluster1",
+			HubName:              []string{"default", "hub-1"}[i],
+			LeaseDurationSeconds: int32(LeaseDurationSeconds),
+		}
+		leaseReconciler.Reconcile()
+	}
+
+	for _, hub := range hubs {
+		lease, err := hub.CoordinationV1().Leases("cluster1").Get(contextVar, AddonName, metav1.GetOptions{})
+		assert.Nil(t, err, "Expected the lease on the hub: Got %v", err)
+		assert.Equal(t, AddonName, lease.Name)
+	}
+}
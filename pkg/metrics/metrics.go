@@ -27,4 +27,71 @@ var (
 		Name: "search_collector_sync_requests_total",
 		Help: "Total number of HTTP requests sent",
 	}, []string{"status_code", "sync_type"})
+
+	// SyncCompressionRatio ratio between the uncompressed and the compressed size of sync request bodies
+	SyncCompressionRatio = promauto.With(PromRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "search_collector_sync_compression_ratio",
+		Help:    "Ratio between the uncompressed and compressed size of the sync request body",
+		Buckets: []float64{1, 2, 4, 8, 16, 32, 64},
+	}, []string{"encoding"})
+
+	// SyncBytesSavedTotal bytes not sent to the indexer thanks to request body compression
+	SyncBytesSavedTotal = promauto.With(PromRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "search_collector_sync_bytes_saved_total",
+		Help: "Total bytes saved by compressing sync request bodies",
+	}, []string{"encoding"})
+
+	// SyncErrorsTotal resources and edges the indexer failed to apply, by operation and reason
+	SyncErrorsTotal = promauto.With(PromRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "search_collector_sync_errors_total",
+		Help: "Total resources and edges the indexer reported as failed, by operation and reason",
+	}, []string{"operation", "reason"})
+
+	// StateHashMismatchTotal times the state hash reported by the indexer didn't match the state we sent
+	StateHashMismatchTotal = promauto.With(PromRegistry).NewCounter(prometheus.CounterOpts{
+		Name: "search_collector_state_hash_mismatch_total",
+		Help: "Times the state hash reported by the indexer didn't match the state sent by the collector",
+	})
+
+	// KindsReconciledTotal kinds replaced to reconcile the indexer state after a state hash mismatch
+	KindsReconciledTotal = promauto.With(PromRegistry).NewCounter(prometheus.CounterOpts{
+		Name: "search_collector_kinds_reconciled_total",
+		Help: "Total kinds replaced to reconcile the indexer state after a state hash mismatch",
+	})
+
+	// SyncRetryPending resources and edges waiting to be sent again after the indexer failed to apply them
+	SyncRetryPending = promauto.With(PromRegistry).NewGauge(prometheus.GaugeOpts{
+		Name: "search_collector_sync_retry_pending",
+		Help: "Resources and edges waiting to be resent after the indexer failed to apply them",
+	})
+
+	// TombstoneEvictionsTotal deleted resources forgotten before late events could be checked against them
+	TombstoneEvictionsTotal = promauto.With(PromRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "search_collector_tombstone_evictions_total",
+		Help: "Total deleted resources forgotten by the reconciler, by reason (expired or capacity)",
+	}, []string{"reason"})
+
+	// TombstoneResurrectionsPreventedTotal late add or update events ignored because the resource was deleted
+	TombstoneResurrectionsPreventedTotal = promauto.With(PromRegistry).NewCounter(prometheus.CounterOpts{
+		Name: "search_collector_tombstone_resurrections_prevented_total",
+		Help: "Total add or update events ignored because they were older than the deletion of the resource",
+	})
+
+	// UpdatesSuppressedTotal updates not sent to the indexer because of the update rules
+	UpdatesSuppressedTotal = promauto.With(PromRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "search_collector_updates_suppressed_total",
+		Help: "Total updates not sent to the indexer, by reason (unchanged, ignored_properties or older_revision)",
+	}, []string{"resource_kind", "reason"})
+
+	// DiffStreamSubscribers clients subscribed to the diff stream
+	DiffStreamSubscribers = promauto.With(PromRegistry).NewGauge(prometheus.GaugeOpts{
+		Name: "search_collector_diff_stream_subscribers",
+		Help: "Clients subscribed to the diff stream",
+	})
+
+	// DiffStreamDroppedTotal subscribers disconnected because they didn't keep up with the diffs
+	DiffStreamDroppedTotal = promauto.With(PromRegistry).NewCounter(prometheus.CounterOpts{
+		Name: "search_collector_diff_stream_dropped_total",
+		Help: "Total diff stream subscribers disconnected because their queue was full",
+	})
 )
@@ -0,0 +1,264 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package reconciler
+
+import (
+	"reflect"
+
+	tr "github.com/stolostron/search-collector/pkg/transforms"
+	"k8s.io/klog/v2"
+)
+
+// State sent to a target with the last diff or complete payload.
+type view struct {
+	previousNodes map[string]tr.Node            // Keyed by UID
+	previousEdges map[string]map[string]tr.Edge // Keyed by source then dest so we can quickly compare the new list
+	restored      map[string]struct{}           // UIDs restored from a saved state and not seen since. Nil when nothing was restored.
+	nodeHash      setHash                       // Rolling hash of previousNodes
+	edgeHash      setHash                       // Rolling hash of previousEdges
+	dirtyEdges    map[edgeKey]struct{}          // Edges resolved again since the last payload, see Reconciler.allEdges
+	allEdgesDirty bool                          // Compare all the edges with the next payload, after a restore or a rebuild
+}
+
+// Records edges that changed since the last payload. NOT THREADSAFE, locking left up to the caller.
+func (v *view) markEdgesDirty(keys []edgeKey) {
+	if v.allEdgesDirty || len(keys) == 0 {
+		return
+	}
+	if v.dirtyEdges == nil {
+		v.dirtyEdges = make(map[edgeKey]struct{}, len(keys))
+	}
+	for _, key := range keys {
+		v.dirtyEdges[key] = struct{}{}
+	}
+}
+
+// NOT THREADSAFE, locking left up to the caller.
+func (v *view) resetDirtyEdges() {
+	v.dirtyEdges = nil
+	v.allEdgesDirty = false
+}
+
+// Rolls the edges changed since the last payload into the previous edges and their hash, and returns the
+// added and deleted edges. Edges of deleted nodes are left out, the aggregator deletes them with the node.
+// After a restore or a rebuild, compares all the edges instead. NOT THREADSAFE, locking left up to the caller.
+func (v *view) rollEdges(current map[string]map[string]tr.Edge, deleteNodes []tr.Deletion) (
+	addEdges, deleteEdges []tr.Edge) {
+
+	if v.allEdgesDirty || v.previousEdges == nil {
+		newEdges := copyEdges(current)
+		addEdges, deleteEdges = diffEdges(v.previousEdges, newEdges, deleteNodes)
+		v.previousEdges = newEdges
+		v.rehashEdges(newEdges)
+		v.resetDirtyEdges()
+		return addEdges, deleteEdges
+	}
+
+	deleted := make(map[string]struct{}, len(deleteNodes))
+	for _, d := range deleteNodes {
+		deleted[d.UID] = struct{}{}
+	}
+	for key := range v.dirtyEdges {
+		previous, inPrevious := v.previousEdges[key.src][key.dest]
+		edge, inCurrent := current[key.src][key.dest]
+		if inPrevious {
+			v.edgeHash.flipEdge(previous)
+			delete(v.previousEdges[key.src], key.dest)
+			if len(v.previousEdges[key.src]) == 0 {
+				delete(v.previousEdges, key.src)
+			}
+		}
+		if inCurrent {
+			v.edgeHash.flipEdge(edge)
+			if _, ok := v.previousEdges[key.src]; !ok {
+				v.previousEdges[key.src] = make(map[string]tr.Edge)
+			}
+			v.previousEdges[key.src][key.dest] = edge
+		}
+		_, srcDeleted := deleted[key.src]
+		_, destDeleted := deleted[key.dest]
+		switch {
+		case inCurrent && !inPrevious:
+			addEdges = append(addEdges, edge)
+		case inPrevious && !inCurrent && !srcDeleted && !destDeleted:
+			deleteEdges = append(deleteEdges, previous)
+		}
+	}
+	v.resetDirtyEdges()
+	return addEdges, deleteEdges
+}
+
+// Diff cursor for an additional target over the reconciler state. It has the same methods as the
+// Reconciler, but keeps its own previous state, so each target gets the diff since its own last send.
+// The reconciler records the UIDs of the nodes it changes in each cursor, like diffNodes for the first target,
+// so a diff only compares those nodes with the previous state.
+type Cursor struct {
+	view
+	r        *Reconciler
+	dirty    map[string]struct{} // UIDs of the nodes changed since the last diff
+	allDirty bool                // Compare all the nodes with the next diff, after a restore or a new snapshot
+}
+
+// Creates a cursor with an empty previous state, the first diff adds everything.
+func (r *Reconciler) NewCursor() *Cursor {
+	c := &Cursor{
+		view:     view{previousNodes: make(map[string]tr.Node)},
+		r:        r,
+		dirty:    make(map[string]struct{}),
+		allDirty: true,
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.cursors = append(r.cursors, c)
+	return c
+}
+
+// Returns the diff between the current state and the state sent with the last payload of this cursor.
+func (c *Cursor) Diff() Diff {
+	klog.V(4).Info("Reconciler cursor is calculating diff from previous state.")
+	c.r.mutex.Lock()
+	defer c.r.mutex.Unlock()
+
+	uids := c.dirty
+	if c.allDirty {
+		uids = make(map[string]struct{}, len(c.r.currentNodes))
+		for uid := range c.r.currentNodes {
+			uids[uid] = struct{}{}
+		}
+		for uid := range c.previousNodes {
+			uids[uid] = struct{}{}
+		}
+	}
+
+	ret := Diff{}
+	for uid := range uids {
+		n, inCurrent := c.r.currentNodes[uid]
+		previous, inPrevious := c.previousNodes[uid]
+		switch {
+		case !inCurrent && inPrevious:
+			ret.DeleteNodes = append(ret.DeleteNodes, tr.Deletion{UID: uid})
+		case !inCurrent:
+			continue // Added and deleted since the last diff.
+		case !inPrevious:
+			ret.AddNodes = append(ret.AddNodes, n)
+		case reflect.DeepEqual(n.Properties, previous.Properties):
+			continue
+		default:
+			// Restored properties went through JSON.
+			if _, restored := c.restored[uid]; restored && sameProperties(n.Properties, previous.Properties) {
+				c.previousNodes[uid] = n
+				continue
+			}
+			ret.UpdateNodes = append(ret.UpdateNodes, n)
+			appendPatch(&ret, previous, n)
+		}
+	}
+	c.rollNodes(ret)
+	for _, n := range ret.AddNodes {
+		c.previousNodes[n.UID] = n
+	}
+	for _, n := range ret.UpdateNodes {
+		c.previousNodes[n.UID] = n
+	}
+	for _, d := range ret.DeleteNodes {
+		delete(c.previousNodes, d.UID)
+	}
+	c.resetDirty()
+
+	c.r.allEdges()
+	ret.AddEdges, ret.DeleteEdges = c.rollEdges(c.r.edges.resolved, ret.DeleteNodes)
+	c.restored = nil
+
+	sortDiff(&ret)
+	ret.TotalNodes = len(c.r.currentNodes)
+	ret.TotalEdges = c.r.totalEdges
+	ret.StateHash = c.stateHash()
+	return ret
+}
+
+// Returns the complete current state and makes it the previous state of this cursor.
+func (c *Cursor) Complete() CompleteState {
+	klog.V(3).Info("Reconciler cursor is building the complete state.")
+	c.r.mutex.Lock()
+	defer c.r.mutex.Unlock()
+
+	ret := c.r.complete(&c.view)
+	c.previousNodes = copyNodes(c.r.currentNodes)
+	c.resetDirty()
+	return ret
+}
+
+// Records a node changed by the reconciler. NOT THREADSAFE, locking left up to the caller.
+func (c *Cursor) markDirty(uid string) {
+	if !c.allDirty {
+		c.dirty[uid] = struct{}{}
+	}
+}
+
+// NOT THREADSAFE, locking left up to the caller.
+func (c *Cursor) resetDirty() {
+	c.dirty = make(map[string]struct{})
+	c.allDirty = false
+}
+
+// Returns the hash of the nodes and edges sent with the last payload of this cursor.
+func (c *Cursor) StateHash() string {
+	c.r.mutex.Lock()
+	defer c.r.mutex.Unlock()
+	return c.stateHash()
+}
+
+// Returns the hashes of the nodes and edges sent with the last payload of this cursor, by kind.
+func (c *Cursor) KindHashes() map[string]string {
+	c.r.mutex.Lock()
+	defer c.r.mutex.Unlock()
+	return c.kindHashes()
+}
+
+// Returns the nodes of the kinds sent with the last payload of this cursor, and all their edges.
+func (c *Cursor) KindState(kinds []string) State {
+	c.r.mutex.Lock()
+	defer c.r.mutex.Unlock()
+	return c.kindState(kinds)
+}
+
+// Returns the state sent with the last payload of this cursor.
+func (c *Cursor) SentState() State {
+	c.r.mutex.Lock()
+	defer c.r.mutex.Unlock()
+	return c.sentState()
+}
+
+// Seeds the previous state of this cursor with a state saved before a restart.
+func (c *Cursor) Restore(state State) {
+	c.r.mutex.Lock()
+	defer c.r.mutex.Unlock()
+
+	c.restore(state)
+	c.allDirty = true
+	klog.Infof("Reconciler cursor restored %d nodes and %d edges.", len(state.Nodes), len(state.Edges))
+}
+
+// Returns the current state of a node.
+func (c *Cursor) GetNode(uid string) (tr.Node, bool) {
+	return c.r.GetNode(uid)
+}
+
+func copyNodes(nodes map[string]tr.Node) map[string]tr.Node {
+	copied := make(map[string]tr.Node, len(nodes))
+	for uid, n := range nodes {
+		copied[uid] = n
+	}
+	return copied
+}
+
+func copyEdges(edges map[string]map[string]tr.Edge) map[string]map[string]tr.Edge {
+	copied := make(map[string]map[string]tr.Edge, len(edges))
+	for srcUID, destMap := range edges {
+		copied[srcUID] = make(map[string]tr.Edge, len(destMap))
+		for destUID, e := range destMap {
+			copied[srcUID][destUID] = e
+		}
+	}
+	return copied
+}
@@ -0,0 +1,280 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package reconciler
+
+import (
+	tr "github.com/stolostron/search-collector/pkg/transforms"
+	"k8s.io/klog/v2"
+)
+
+// Keeps the node store indexes and the edges built by each node between diffs, so only the edges of the
+// changed nodes and of the nodes that depend on them are built again.
+// A node depends on a changed node when:
+//   - its edges include the changed node, for example a Pod owned by a changed ReplicaSet.
+//   - it's in the same namespace, where most edges are found by name or selector, for example a Service
+//     selecting a changed Pod, or a Pod whose owner was just added.
+//   - its kind looks up nodes in other namespaces, see tr.GlobalEdges.
+//
+// NOT THREADSAFE, locking left up to the reconciler.
+type edgeCache struct {
+	built      bool                                     // False until all edges are built, and after a full rebuild is needed
+	nodes      map[string]map[string]map[string]tr.Node // Nodes by kind, namespace and name, see nodeTripleMap
+	inNs       map[string]map[string]struct{}           // UIDs of the nodes in each namespace
+	global     map[string]struct{}                      // UIDs of the nodes built with every diff
+	byNode     map[string][]tr.Edge                     // Edges built by each node, keyed by UID
+	dependents map[string]map[string]struct{}           // UIDs of the nodes that built edges to or from each UID
+	changed    map[string]struct{}                      // UIDs of the nodes changed since the edges were built
+	changedNs  map[string]struct{}                      // Namespaces of the changed nodes
+	resolved   map[string]map[string]tr.Edge            // Edges of all the nodes keyed by source then dest, see resolve
+	total      int                                      // Number of resolved edges
+	touched    map[edgeKey]struct{}                     // Edges built or removed since they were resolved
+}
+
+// Source and destination UID of an edge. Only one edge is kept between two nodes.
+type edgeKey struct {
+	src, dest string
+}
+
+// Returns the namespace of the node in the node store. Cluster scoped nodes are in _NONE.
+func nodeNamespace(n tr.Node) string {
+	if namespace, ok := n.Properties["namespace"].(string); ok {
+		return namespace
+	}
+	return "_NONE"
+}
+
+// Returns true if a change to the node can add or remove edges of nodes in any namespace.
+func rebuildsAll(n tr.Node) bool {
+	return edgeScope(n) == tr.RebuildAllEdges
+}
+
+// Returns true if the edges of the node are built with every diff.
+func isGlobal(n tr.Node) bool {
+	return edgeScope(n) != tr.NamespaceEdges
+}
+
+// Returns the edge scope declared by the transform of the node.
+func edgeScope(n tr.Node) tr.EdgeScope {
+	group, _ := n.Properties["apigroup"].(string)
+	kind, _ := n.Properties["kind"].(string)
+	return tr.KindEdgeScope(kind, group)
+}
+
+// Records a node that was added, updated or deleted, before it's changed in currentNodes. Pass a zero node
+// for the side that doesn't exist. Until the edges are built, the indexes aren't kept.
+func (c *edgeCache) update(previous, current tr.Node, currentNodes map[string]tr.Node) {
+	if !c.built {
+		return
+	}
+	created, deleted := previous.UID == "", current.UID == ""
+	for _, n := range []tr.Node{previous, current} {
+		if n.UID == "" {
+			continue
+		}
+		// Nodes in other namespaces look up cluster scoped nodes by name, e.g. a Pod running on a Node.
+		if rebuildsAll(n) || (nodeNamespace(n) == "_NONE" && (created || deleted)) {
+			klog.V(5).Infof("Change to %s %s rebuilds all edges.", n.Properties["kind"], n.UID)
+			c.built = false
+			return
+		}
+		c.changed[n.UID] = struct{}{}
+		if namespace := nodeNamespace(n); namespace != "_NONE" {
+			c.changedNs[namespace] = struct{}{}
+		}
+	}
+	if !created {
+		c.removeNode(previous, currentNodes)
+	}
+	if !deleted {
+		c.addNode(current)
+	}
+}
+
+// Adds the node to the indexes.
+func (c *edgeCache) addNode(n tr.Node) {
+	kind := n.Properties["kind"].(string) // blindly assert to string - it's always string
+	namespace := nodeNamespace(n)
+	if name, ok := n.Properties["name"].(string); ok {
+		if _, ok := c.nodes[kind]; !ok {
+			c.nodes[kind] = map[string]map[string]tr.Node{}
+		}
+		if _, ok := c.nodes[kind][namespace]; !ok {
+			c.nodes[kind][namespace] = map[string]tr.Node{}
+		}
+		c.nodes[kind][namespace][name] = n
+	}
+	if _, ok := c.inNs[namespace]; !ok {
+		c.inNs[namespace] = map[string]struct{}{}
+	}
+	c.inNs[namespace][n.UID] = struct{}{}
+	if isGlobal(n) {
+		c.global[n.UID] = struct{}{}
+	}
+}
+
+// Removes the node from the indexes. Another node with the same kind, namespace and name takes its place,
+// as it would in a new nodeTripleMap.
+func (c *edgeCache) removeNode(n tr.Node, currentNodes map[string]tr.Node) {
+	kind := n.Properties["kind"].(string)
+	namespace := nodeNamespace(n)
+	delete(c.inNs[namespace], n.UID)
+	delete(c.global, n.UID)
+	name, ok := n.Properties["name"].(string)
+	if !ok || c.nodes[kind][namespace][name].UID != n.UID {
+		return
+	}
+	delete(c.nodes[kind][namespace], name)
+	for uid := range c.inNs[namespace] {
+		if other := currentNodes[uid]; other.Properties["kind"] == kind && other.Properties["name"] == name {
+			c.nodes[kind][namespace][name] = other
+			return
+		}
+	}
+}
+
+// Builds the indexes and the edges of all the nodes.
+func (c *edgeCache) rebuild(currentNodes map[string]tr.Node) {
+	c.nodes = nodeTripleMap(currentNodes)
+	c.inNs = map[string]map[string]struct{}{}
+	c.global = map[string]struct{}{}
+	c.byNode = map[string][]tr.Edge{}
+	c.dependents = map[string]map[string]struct{}{}
+	c.changed = map[string]struct{}{}
+	c.changedNs = map[string]struct{}{}
+	c.resolved = map[string]map[string]tr.Edge{}
+	c.total = 0
+	c.touched = map[edgeKey]struct{}{}
+	for uid, n := range currentNodes {
+		namespace := nodeNamespace(n)
+		if _, ok := c.inNs[namespace]; !ok {
+			c.inNs[namespace] = map[string]struct{}{}
+		}
+		c.inNs[namespace][uid] = struct{}{}
+		if isGlobal(n) {
+			c.global[uid] = struct{}{}
+		}
+	}
+	c.built = true
+}
+
+// Returns the UIDs of the nodes whose edges have to be built again: the changed nodes, the nodes that depend
+// on them, and the global nodes. Forgets the edges of the deleted nodes.
+func (c *edgeCache) stale(currentNodes map[string]tr.Node) map[string]struct{} {
+	uids := make(map[string]struct{}, len(c.changed)+len(c.global))
+	for uid := range c.changed {
+		if _, ok := currentNodes[uid]; ok {
+			uids[uid] = struct{}{}
+		} else {
+			c.setEdges(uid, nil)
+		}
+		for dependent := range c.dependents[uid] {
+			uids[dependent] = struct{}{}
+		}
+	}
+	for namespace := range c.changedNs {
+		for uid := range c.inNs[namespace] {
+			uids[uid] = struct{}{}
+		}
+	}
+	for uid := range c.global {
+		uids[uid] = struct{}{}
+	}
+	for uid := range uids {
+		if _, ok := currentNodes[uid]; !ok {
+			delete(uids, uid) // A dependent deleted in the same diff.
+		}
+	}
+	c.changed = map[string]struct{}{}
+	c.changedNs = map[string]struct{}{}
+	return uids
+}
+
+// Replaces the edges built by the node, and the dependents of the nodes in them.
+func (c *edgeCache) setEdges(uid string, edges []tr.Edge) {
+	for _, edge := range edges {
+		c.touched[edgeKey{edge.SourceUID, edge.DestUID}] = struct{}{}
+	}
+	for _, edge := range c.byNode[uid] {
+		c.touched[edgeKey{edge.SourceUID, edge.DestUID}] = struct{}{}
+		for _, other := range []string{edge.SourceUID, edge.DestUID} {
+			delete(c.dependents[other], uid)
+			if len(c.dependents[other]) == 0 {
+				delete(c.dependents, other)
+			}
+		}
+	}
+	if len(edges) == 0 {
+		delete(c.byNode, uid)
+		return
+	}
+	c.byNode[uid] = edges
+	for _, edge := range edges {
+		for _, other := range []string{edge.SourceUID, edge.DestUID} {
+			if other == uid {
+				continue
+			}
+			if _, ok := c.dependents[other]; !ok {
+				c.dependents[other] = map[string]struct{}{}
+			}
+			c.dependents[other][uid] = struct{}{}
+		}
+	}
+}
+
+// Resolves the touched edges again from the edges built by the nodes, and returns the ones that changed.
+func (c *edgeCache) resolve(currentNodes map[string]tr.Node) []edgeKey {
+	changed := []edgeKey{}
+	for key := range c.touched {
+		edge, found := c.builtEdge(key, currentNodes)
+		old, ok := c.resolved[key.src][key.dest]
+		switch {
+		case found && ok && old == edge:
+			continue
+		case found:
+			if _, ok := c.resolved[key.src]; !ok { // Init if it's not there
+				c.resolved[key.src] = map[string]tr.Edge{}
+			}
+			if !ok {
+				c.total++
+			}
+			c.resolved[key.src][key.dest] = edge
+		case ok:
+			delete(c.resolved[key.src], key.dest)
+			if len(c.resolved[key.src]) == 0 {
+				delete(c.resolved, key.src)
+			}
+			c.total--
+		default:
+			continue
+		}
+		changed = append(changed, key)
+	}
+	c.touched = map[edgeKey]struct{}{}
+	return changed
+}
+
+// Returns the edge between the source and dest of the key, out of the edges built by the source and its
+// dependents. Edges of other nodes take the place of application edges between the same nodes, as when they
+// were built after the applications. Otherwise the edge of the node with the lowest UID is kept.
+func (c *edgeCache) builtEdge(key edgeKey, currentNodes map[string]tr.Node) (tr.Edge, bool) {
+	builders := make([]string, 0, len(c.dependents[key.src])+1)
+	builders = append(builders, key.src)
+	for uid := range c.dependents[key.src] {
+		builders = append(builders, uid)
+	}
+	var edge tr.Edge
+	builder, builderApp, found := "", false, false
+	for _, uid := range builders {
+		app := currentNodes[uid].Properties["kind"] == "Application"
+		for _, e := range c.byNode[uid] {
+			if e.SourceUID != key.src || e.DestUID != key.dest {
+				continue
+			}
+			if found && !(builderApp && !app) && (builderApp != app || uid > builder) {
+				continue
+			}
+			edge, builder, builderApp, found = e, uid, app, true
+		}
+	}
+	return edge, found
+}
@@ -0,0 +1,179 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package reconciler
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+
+	tr "github.com/stolostron/search-collector/pkg/transforms"
+)
+
+// Rolling hash of a set of nodes or edges. Each item is hashed on its own and combined with XOR, so an item
+// is added to or removed from the hash by flipping it, without hashing the whole set again.
+// The hash is also kept per kind, to find out which kinds differ when the total doesn't match.
+type setHash struct {
+	total uint64
+	kinds map[string]uint64
+}
+
+// Adds the item to the hash, or removes it if it was already added.
+func (h *setHash) flip(kind string, itemHash uint64) {
+	if h.kinds == nil {
+		h.kinds = map[string]uint64{}
+	}
+	h.total ^= itemHash
+	h.kinds[kind] ^= itemHash
+	if h.kinds[kind] == 0 {
+		delete(h.kinds, kind)
+	}
+}
+
+func (h *setHash) flipNode(n tr.Node) {
+	h.flip(nodeKind(n), nodeHash(n))
+}
+
+func (h *setHash) flipEdge(e tr.Edge) {
+	h.flip(e.SourceKind, edgeHash(e))
+}
+
+// Hash of the UID and the JSON encoding of the properties. JSON sorts the keys, so the hash doesn't depend
+// on the order of the map, and it doesn't change when the node goes through JSON.
+func nodeHash(n tr.Node) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(n.UID))
+	_, _ = h.Write([]byte{0})
+	properties, err := json.Marshal(n.Properties)
+	if err == nil {
+		_, _ = h.Write(properties)
+	}
+	return h.Sum64()
+}
+
+// Hash of the source UID, destination UID and type.
+func edgeHash(e tr.Edge) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(e.SourceUID))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(e.DestUID))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(e.EdgeType))
+	return h.Sum64()
+}
+
+func nodeKind(n tr.Node) string {
+	kind, _ := n.Properties["kind"].(string)
+	return kind
+}
+
+func formatHash(h uint64) string {
+	return fmt.Sprintf("%016x", h)
+}
+
+// Returns the hash of the nodes and edges sent with the last diff or complete payload.
+// NOT THREADSAFE, locking left up to the caller.
+func (v *view) stateHash() string {
+	return formatHash(v.nodeHash.total ^ v.edgeHash.total)
+}
+
+// Returns the hash of the nodes and edges sent with the last diff or complete payload.
+func (r *Reconciler) StateHash() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.stateHash()
+}
+
+// Returns the hashes of the nodes and edges sent with the last payload, by kind.
+// Edges count towards the kind of their source.
+func (r *Reconciler) KindHashes() map[string]string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.kindHashes()
+}
+
+// NOT THREADSAFE, locking left up to the caller.
+func (v *view) kindHashes() map[string]string {
+	combined := make(map[string]uint64, len(v.nodeHash.kinds))
+	for kind, h := range v.nodeHash.kinds {
+		combined[kind] ^= h
+	}
+	for kind, h := range v.edgeHash.kinds {
+		combined[kind] ^= h
+	}
+	hashes := make(map[string]string, len(combined))
+	for kind, h := range combined {
+		if h != 0 {
+			hashes[kind] = formatHash(h)
+		}
+	}
+	return hashes
+}
+
+// Returns the nodes of the kinds sent with the last payload, and all their edges in either direction.
+func (r *Reconciler) KindState(kinds []string) State {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.kindState(kinds)
+}
+
+// NOT THREADSAFE, locking left up to the caller.
+func (v *view) kindState(kinds []string) State {
+	wanted := make(map[string]struct{}, len(kinds))
+	for _, kind := range kinds {
+		wanted[kind] = struct{}{}
+	}
+	state := State{}
+	for _, n := range v.previousNodes {
+		if _, ok := wanted[nodeKind(n)]; ok {
+			state.Nodes = append(state.Nodes, n)
+		}
+	}
+	for _, destMap := range v.previousEdges {
+		for _, e := range destMap {
+			_, src := wanted[e.SourceKind]
+			_, dest := wanted[e.DestKind]
+			if src || dest {
+				state.Edges = append(state.Edges, e)
+			}
+		}
+	}
+	sortNodes(state.Nodes)
+	sortEdges(state.Edges)
+	return state
+}
+
+// Rolls the node changes of the diff into the hash. Must be called before the previous nodes are replaced.
+// NOT THREADSAFE, locking left up to the caller.
+func (v *view) rollNodes(diff Diff) {
+	for _, n := range diff.AddNodes {
+		v.nodeHash.flipNode(n)
+	}
+	for _, n := range diff.UpdateNodes {
+		v.nodeHash.flipNode(v.previousNodes[n.UID])
+		v.nodeHash.flipNode(n)
+	}
+	for _, d := range diff.DeleteNodes {
+		if old, ok := v.previousNodes[d.UID]; ok {
+			v.nodeHash.flipNode(old)
+		}
+	}
+}
+
+// Rebuilds the hash of all nodes. NOT THREADSAFE, locking left up to the caller.
+func (v *view) rehashNodes(nodes map[string]tr.Node) {
+	v.nodeHash = setHash{}
+	for _, n := range nodes {
+		v.nodeHash.flipNode(n)
+	}
+}
+
+// Rebuilds the hash of all edges. NOT THREADSAFE, locking left up to the caller.
+func (v *view) rehashEdges(edges map[string]map[string]tr.Edge) {
+	v.edgeHash = setHash{}
+	for _, destMap := range edges {
+		for _, e := range destMap {
+			v.edgeHash.flipEdge(e)
+		}
+	}
+}
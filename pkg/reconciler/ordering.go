@@ -0,0 +1,33 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package reconciler
+
+import (
+	tr "github.com/stolostron/search-collector/pkg/transforms"
+)
+
+// Position of an event in the history of a node.
+type eventOrder struct {
+	time            int64
+	resourceVersion string
+	sequence        uint64
+}
+
+func orderOf(ne tr.NodeEvent) eventOrder {
+	return eventOrder{time: ne.Time, resourceVersion: ne.ResourceVersion, sequence: ne.Sequence}
+}
+
+// Returns true if the event a happened before the event b of the same node. The informers deliver the events of
+// each object in order, so the informer sequence numbers order them. The resourceVersions are opaque and only
+// compared for equality: events with the same one are the same state of the object, and neither is older.
+// The times have a resolution of one second, so they are only used for nodes without sequence numbers, like
+// Helm releases.
+func (a eventOrder) before(b eventOrder) bool {
+	if a.resourceVersion != "" && a.resourceVersion == b.resourceVersion {
+		return false
+	}
+	if a.sequence != 0 && b.sequence != 0 {
+		return a.sequence < b.sequence
+	}
+	return a.time < b.time
+}
@@ -0,0 +1,59 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package reconciler
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+
+	tr "github.com/stolostron/search-collector/pkg/transforms"
+)
+
+// Returns the patch from the previous to the current properties of a node. A property is set again with
+// its whole value when anything in it changed, for example all the labels when one label changed.
+func propertyPatch(uid string, previous, current map[string]interface{}) tr.NodePatch {
+	patch := tr.NodePatch{UID: uid}
+	for key, value := range current {
+		previousValue, ok := previous[key]
+		if ok && sameValue(previousValue, value) {
+			continue
+		}
+		if patch.Set == nil {
+			patch.Set = map[string]interface{}{}
+		}
+		patch.Set[key] = value
+	}
+	for key := range previous {
+		if _, ok := current[key]; !ok {
+			patch.Unset = append(patch.Unset, key)
+		}
+	}
+	sort.Strings(patch.Unset)
+	return patch
+}
+
+// Compares two property values. Values restored from a saved state went through JSON, so they are
+// compared by their JSON encoding when they aren't deeply equal.
+func sameValue(a, b interface{}) bool {
+	if reflect.DeepEqual(a, b) {
+		return true
+	}
+	aJSON, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bJSON, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return string(aJSON) == string(bJSON)
+}
+
+// Appends the patch of the updated node to the diff, unless no property changed. Nodes can be updated for
+// changes that only affect their edges.
+func appendPatch(ret *Diff, previous, current tr.Node) {
+	if patch := propertyPatch(current.UID, previous.Properties, current.Properties); !patch.Empty() {
+		ret.PatchNodes = append(ret.PatchNodes, patch)
+	}
+}
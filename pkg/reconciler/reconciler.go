@@ -12,18 +12,16 @@ Copyright (c) 2020 Red Hat, Inc.
 package reconciler
 
 import (
-	"reflect"
+	"sort"
 	"sync"
 
-	lru "github.com/golang/groupcache/lru"
+	"github.com/stolostron/search-collector/pkg/config"
+	"github.com/stolostron/search-collector/pkg/health"
 	"github.com/stolostron/search-collector/pkg/metrics"
 	tr "github.com/stolostron/search-collector/pkg/transforms"
 	"k8s.io/klog/v2"
 )
 
-// Size of the LRU cache used to find out of order delete/add sequences
-const CACHE_SIZE = 500
-
 // Public type for the complete state of the system.
 // Looks a little different than the format of reconciler's internal state because this is friendlier
 // for outside use by other packages
@@ -31,6 +29,7 @@ type CompleteState struct {
 	Nodes                  []tr.Node // All the nodes
 	Edges                  []tr.Edge // All the edges
 	TotalNodes, TotalEdges int
+	StateHash              string // Hash of all the nodes and edges
 }
 
 // Public type for the diff state of the system since the previous.
@@ -41,6 +40,9 @@ type Diff struct {
 	DeleteNodes            []tr.Deletion // UIDs of nodes to be deleted
 	AddEdges, DeleteEdges  []tr.Edge     // Edges to be added or deleted
 	TotalNodes, TotalEdges int
+	StateHash              string // Hash of all the nodes and edges after applying the diff
+
+	PatchNodes []tr.NodePatch // Changed properties of the updated nodes, left out when only their edges changed
 }
 
 // Create mapping with kind, namespace, and name as keys, and the Node itself as the value.
@@ -73,32 +75,40 @@ func nodeTripleMap(allNodes map[string]tr.Node) map[string]map[string]map[string
 // This object tracks and stores resources, and can regurgitate diffs based on the last time it was asked.
 type Reconciler struct {
 	currentNodes       map[string]tr.Node                         // Keyed by UID
-	previousNodes      map[string]tr.Node                         // Keyed by UID
 	diffNodes          map[string]tr.NodeEvent                    // Keyed by UID
 	k8sEventNodes      map[string]tr.NodeEvent                    // Keyed by UID
 	previousEventEdges map[string]tr.Edge                         // Keyed by UID
 	edgeFuncs          map[string]func(ns tr.NodeStore) []tr.Edge // Edge building functions, keyed by UID
+	edges              edgeCache                                  // Indexes and edges kept between diffs
+	lastEvents         map[string]eventOrder                      // Last event of each current node, keyed by UID
+	sources            map[string]*snapshotSource                 // Resources the current nodes were built from, with FEATURE_SNAPSHOT
+	snapshotNodes      map[string]struct{}                        // UIDs read from a snapshot and not seen since
+	cursors            []*Cursor                                  // Cursors of the other targets, see markDirty
+	allDirty           bool                                       // Copy all the current nodes with the next reset, see resetDiffs
 
-	previousEdges map[string]map[string]tr.Edge // Keyed by source then dest so we can quickly compare the new list
-	totalEdges    int                           // Save the total count as we build to avoid looping when needed
+	// State sent with the last diff or complete, for the first target. See Cursor for the others.
+	view
+	totalEdges int // Save the total count as we build to avoid looping when needed
 
 	Input       chan tr.NodeEvent
-	mutex       sync.Mutex // Used to protect currentState and diffState as they are accessed by multiple goroutines
-	purgedNodes *lru.Cache // Tracks deleted nodes, so the reconciler can prevent out of order processing of events
+	mutex       sync.Mutex  // Used to protect currentState and diffState as they are accessed by multiple goroutines
+	purgedNodes *tombstones // Tracks deleted nodes, so the reconciler can prevent out of order processing of events
 }
 
 // Creates a new Reconciler with a nil Input. To use it, set the Input and then start sending things through.
 func NewReconciler() *Reconciler {
 	r := &Reconciler{
 		currentNodes:       make(map[string]tr.Node),
-		previousNodes:      make(map[string]tr.Node),
+		view:               view{previousNodes: make(map[string]tr.Node)},
 		diffNodes:          make(map[string]tr.NodeEvent),
 		k8sEventNodes:      make(map[string]tr.NodeEvent),
 		previousEventEdges: make(map[string]tr.Edge),
 		edgeFuncs:          make(map[string]func(ns tr.NodeStore) []tr.Edge),
+		lastEvents:         make(map[string]eventOrder),
+		sources:            make(map[string]*snapshotSource),
 
 		mutex:       sync.Mutex{},
-		purgedNodes: lru.New(CACHE_SIZE),
+		purgedNodes: newTombstones(),
 	}
 
 	go r.receive() // start it listening on input channel
@@ -115,11 +125,22 @@ func (r *Reconciler) Diff() Diff {
 
 	ret := Diff{}
 
-	if len(r.diffNodes) == 0 {
+	// Restored nodes that the informers didn't find anymore were deleted while we were down.
+	for uid := range r.restored {
+		_, inCurrent := r.currentNodes[uid]
+		_, inDiff := r.diffNodes[uid]
+		if !inCurrent && !inDiff {
+			ret.DeleteNodes = append(ret.DeleteNodes, tr.Deletion{UID: uid})
+		}
+	}
+
+	// After a restore, compare all the edges at least once, even if no node changed.
+	if len(r.diffNodes) == 0 && r.restored == nil && len(r.dirtyEdges) == 0 && !r.allEdgesDirty {
 		klog.V(5).Info("Reconciler has no events since the last reconcile.")
 		// allEdges() modifies r.totalEdges, so we have to set these fields both here and after allEdges() call
 		ret.TotalNodes = len(r.currentNodes)
 		ret.TotalEdges = r.totalEdges
+		ret.StateHash = r.stateHash()
 		return ret
 	}
 
@@ -130,13 +151,33 @@ func (r *Reconciler) Diff() Diff {
 			ret.AddNodes = append(ret.AddNodes, ne.Node)
 		case tr.Update:
 			ret.UpdateNodes = append(ret.UpdateNodes, ne.Node)
+			appendPatch(&ret, r.previousNodes[ne.UID], ne.Node)
 		case tr.Delete:
 			ret.DeleteNodes = append(ret.DeleteNodes, tr.Deletion{UID: ne.UID})
 		}
 	}
 
+	r.rollNodes(ret)
+
 	// Fill out edges
-	newEdges := r.allEdges()
+	r.allEdges()
+	ret.AddEdges, ret.DeleteEdges = r.rollEdges(r.edges.resolved, ret.DeleteNodes)
+
+	r.resetDiffs()
+	r.restored = nil
+
+	sortDiff(&ret)
+	ret.TotalNodes = len(r.currentNodes)
+	ret.TotalEdges = r.totalEdges
+	ret.StateHash = r.stateHash()
+	return ret
+}
+
+// Returns the edges added and deleted between the previous and the new edges. Edges of deleted nodes are
+// left out, the aggregator deletes them with the node. Consumes the previous edges. Used when all the edges
+// are compared, see view.rollEdges.
+func diffEdges(previousEdges, newEdges map[string]map[string]tr.Edge, deleteNodes []tr.Deletion) (
+	addEdges, deleteEdges []tr.Edge) {
 
 	// TODO combine the following 2 loops?
 
@@ -147,31 +188,31 @@ func (r *Reconciler) Diff() Diff {
 	for srcUID, destMap := range newEdges {
 		for destUID, newEdge := range destMap {
 			// If it's present in this loop it's obviously in the new set, so check the old.
-			if _, ok := r.previousEdges[srcUID][destUID]; ok {
-				delete(r.previousEdges[srcUID], destUID)
+			if _, ok := previousEdges[srcUID][destUID]; ok {
+				delete(previousEdges[srcUID], destUID)
 			} else { // If it's in the new and NOT the old, it's an edge that's been added
-				ret.AddEdges = append(ret.AddEdges, newEdge)
+				addEdges = append(addEdges, newEdge)
 			}
 		}
 	}
 
 	// Now go back through the remains of the previous and coerce to slice of edges to be deleted
-	for srcUID, destMap := range r.previousEdges {
-		srcDeleted := false // flag to check if the sourceNode is in ret.DeleteNodes
+	for srcUID, destMap := range previousEdges {
+		srcDeleted := false // flag to check if the sourceNode is in deleteNodes
 		for destUID, oldEdge := range destMap {
-			destDeleted := false // flag to check if the destNode is in ret.DeleteNodes
-			// Loop through ret.DeleteNodes and check if the source or destination nodes are up for delete.
+			destDeleted := false // flag to check if the destNode is in deleteNodes
+			// Loop through deleteNodes and check if the source or destination nodes are up for delete.
 			// Since the associated edges gets deleted automatically when the node is deleted,
-			// we won't add the edges to ret.DeleteEdges
-			for _, delNode := range ret.DeleteNodes {
+			// we won't add the edges to deleteEdges
+			for _, delNode := range deleteNodes {
 				if srcUID == delNode.UID {
-					// If srcUID is in ret.DeleteNodes, delete the whole sourceUID map from previousEdges and break
-					delete(r.previousEdges, srcUID)
+					// If srcUID is in deleteNodes, delete the whole sourceUID map from previousEdges and break
+					delete(previousEdges, srcUID)
 					srcDeleted = true
 					break
 				} else if destUID == delNode.UID {
-					// If the srcUID is in ret.DeleteNodes, delete the edge from previousEdges
-					delete(r.previousEdges[srcUID], destUID)
+					// If the srcUID is in deleteNodes, delete the edge from previousEdges
+					delete(previousEdges[srcUID], destUID)
 					destDeleted = true
 				}
 			}
@@ -179,21 +220,23 @@ func (r *Reconciler) Diff() Diff {
 				break //break out of the inner for loop since the whole sourceUID map is already deleted
 			}
 			if !srcDeleted && !destDeleted {
-				//Add the edge to be deleted only if the source and destination nodes are not in ret.DeleteNodes
-				ret.DeleteEdges = append(ret.DeleteEdges, oldEdge)
+				//Add the edge to be deleted only if the source and destination nodes are not in deleteNodes
+				deleteEdges = append(deleteEdges, oldEdge)
 			}
 		}
 	}
 
-	// We are now done with the old list of previousEdges.
-	// Next time this is called we will want the edges we just calculated to be the previous.
-	r.previousEdges = newEdges
-
-	r.resetDiffs()
+	return addEdges, deleteEdges
+}
 
-	ret.TotalNodes = len(r.currentNodes)
-	ret.TotalEdges = r.totalEdges
-	return ret
+// Sorts the diff so the payloads built from it are reproducible.
+func sortDiff(ret *Diff) {
+	sortNodes(ret.AddNodes)
+	sortNodes(ret.UpdateNodes)
+	sort.Slice(ret.DeleteNodes, func(i, j int) bool { return ret.DeleteNodes[i].UID < ret.DeleteNodes[j].UID })
+	sort.Slice(ret.PatchNodes, func(i, j int) bool { return ret.PatchNodes[i].UID < ret.PatchNodes[j].UID })
+	sortEdges(ret.AddEdges)
+	sortEdges(ret.DeleteEdges)
 }
 
 // Returns the complete current state and resets the diff
@@ -202,6 +245,15 @@ func (r *Reconciler) Complete() CompleteState {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
+	ret := r.complete(&r.view)
+	r.allDirty = true // All the current nodes were sent.
+	r.resetDiffs()
+	return ret
+}
+
+// Builds the complete current state and makes its edges the previous edges of the view.
+// The caller updates the previous nodes. NOT THREADSAFE, locking left up to the caller.
+func (r *Reconciler) complete(v *view) CompleteState {
 	allNodes := make([]tr.Node, 0, len(r.currentNodes)) // We know the size ahead of time
 	for _, n := range r.currentNodes {
 		allNodes = append(allNodes, n)
@@ -222,76 +274,186 @@ func (r *Reconciler) Complete() CompleteState {
 
 	// We are now done with the old list of previousEdges.
 	// Next time this is called we will want the edges we just calculated to be the previous.
-	r.previousEdges = newEdges
+	v.previousEdges = copyEdges(newEdges)
+	v.rehashEdges(v.previousEdges)
+	v.resetDirtyEdges()
+	v.rehashNodes(r.currentNodes)
+	v.restored = nil
 
-	r.resetDiffs()
+	// Sort so the payloads built from the complete state are reproducible.
+	sortNodes(ret.Nodes)
+	sortEdges(ret.Edges)
 
 	ret.TotalNodes = len(r.currentNodes)
 	ret.TotalEdges = r.totalEdges
+	ret.StateHash = v.stateHash()
 	return ret
 }
 
+// Returns the current state of a node.
+func (r *Reconciler) GetNode(uid string) (tr.Node, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	node, ok := r.currentNodes[uid]
+	return node, ok
+}
+
+// Returns the current nodes, sorted by UID.
+func (r *Reconciler) CurrentNodes() []tr.Node {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	nodes := make([]tr.Node, 0, len(r.currentNodes))
+	for _, n := range r.currentNodes {
+		nodes = append(nodes, n)
+	}
+	sortNodes(nodes)
+	return nodes
+}
+
+// Returns the edges of the current nodes, sorted like the payloads. The edges are built like for the next
+// diff, which still compares them with the edges sent last.
+func (r *Reconciler) CurrentEdges() []tr.Edge {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	edges := []tr.Edge{}
+	for _, destMap := range r.allEdges() {
+		for _, e := range destMap {
+			edges = append(edges, e)
+		}
+	}
+	sortEdges(edges)
+	return edges
+}
+
+// Sorts nodes by UID.
+func sortNodes(nodes []tr.Node) {
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].UID < nodes[j].UID })
+}
+
+// Sorts edges by source UID, destination UID and type.
+func sortEdges(edges []tr.Edge) {
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].SourceUID != edges[j].SourceUID {
+			return edges[i].SourceUID < edges[j].SourceUID
+		}
+		if edges[i].DestUID != edges[j].DestUID {
+			return edges[i].DestUID < edges[j].DestUID
+		}
+		return edges[i].EdgeType < edges[j].EdgeType
+	})
+}
+
 // Builds all edges for all the nodes.
 // Keyed by srcUID then destUID for fast comparison with previous.
+// Only the edges of the nodes changed since the last call, and of the nodes that depend on them, are built
+// again, and only the edges between the same nodes as theirs are resolved again. The others are kept from the
+// last call, see edgeCache. The changed edges are recorded in each view, so the next diff only compares those.
+// The returned map is kept between calls, don't modify it.
 // This function reads from the state, locking left up to caller (complete and diff methods)
 func (r *Reconciler) allEdges() map[string]map[string]tr.Edge {
-	klog.V(4).Info("Reconciler is rebuilding edges for all nodes.")
-	ret := make(map[string]map[string]tr.Edge)
+	var uids map[string]struct{}
+	rebuilt := !r.edges.built
+	if rebuilt {
+		klog.V(4).Info("Reconciler is rebuilding edges for all nodes.")
+		r.edges.rebuild(r.currentNodes)
+		uids = make(map[string]struct{}, len(r.edgeFuncs))
+		for uid := range r.edgeFuncs {
+			uids[uid] = struct{}{}
+		}
+	} else {
+		uids = r.edges.stale(r.currentNodes)
+		klog.V(4).Infof("Reconciler is rebuilding edges for %d of %d nodes.", len(uids), len(r.currentNodes))
+	}
 
 	ns := tr.NodeStore{
 		ByUID:               r.currentNodes,
-		ByKindNamespaceName: nodeTripleMap(r.currentNodes),
+		ByKindNamespaceName: r.edges.nodes,
 	}
 
-	// After building the nodestore, get all the application UIDs in appUIDs and others in otherUIDs.
 	// Process the application nodes first while building edges so that _hostingApplication metadata
 	// gets populated for subscription nodes
-	allUIDs := make([]string, len(r.edgeFuncs))
+	appUIDs, otherUIDs := r.splitApplications(uids)
 
-	// Copy all uids from reconciler edgeFuncs
-	i := 0
-	for uid := range r.edgeFuncs {
-		allUIDs[i] = uid
-		i++
-	}
-	// Filter all application nodes, store their UIDs in appUIDs
-	apps := ns.ByKindNamespaceName["Application"]
-	var appUIDs []string
-	for namespace := range apps {
-		for name := range apps[namespace] {
-			appUIDs = append(appUIDs, apps[namespace][name].UID)
-		}
-	}
-	// Store non-app UIDs in otherUIDs
-	otherUIDs := tr.SliceDiff(allUIDs, appUIDs)
-
-	// Loop across all the nodes and build their edges.
+	// Loop across the nodes and build their edges.
 	for _, uid := range append(appUIDs, otherUIDs...) {
 		klog.V(6).Infof("Calculating edges for node with UID: %s", uid)
 		edges := r.edgeFuncs[uid](ns) // Get edges from this specific node
 
 		edges = append(edges, tr.CommonEdges(uid, ns)...) // Get common edges for this node
-		for _, edge := range edges {
-			if _, ok := ret[edge.SourceUID]; !ok { // Init if it's not there
-				ret[edge.SourceUID] = make(map[string]tr.Edge)
-			}
-			ret[edge.SourceUID][edge.DestUID] = edge
+		r.edges.setEdges(uid, edges)
+	}
+
+	changed := r.edges.resolve(r.currentNodes)
+	for _, v := range r.views() {
+		if rebuilt {
+			v.allEdgesDirty = true // The edges that are gone weren't resolved again.
 		}
+		v.markEdgesDirty(changed)
 	}
+	r.totalEdges = r.edges.total
+
+	return r.edges.resolved
+}
 
-	totalEdges := 0
-	// loop over double map to get the total number we added
-	for _, destUID := range ret {
-		totalEdges += len(destUID)
+// Returns the view of the first target and the view of each cursor. NOT THREADSAFE, locking left up to the caller.
+func (r *Reconciler) views() []*view {
+	views := make([]*view, 0, len(r.cursors)+1)
+	views = append(views, &r.view)
+	for _, c := range r.cursors {
+		views = append(views, &c.view)
 	}
-	r.totalEdges = totalEdges
+	return views
+}
 
-	return ret
+// Splits the UIDs into the application nodes and the others.
+func (r *Reconciler) splitApplications(uids map[string]struct{}) (appUIDs, otherUIDs []string) {
+	for uid := range uids {
+		if r.currentNodes[uid].Properties["kind"] == "Application" {
+			appUIDs = append(appUIDs, uid)
+		} else {
+			otherUIDs = append(otherUIDs, uid)
+		}
+	}
+	return appUIDs, otherUIDs
+}
+
+// Records the node as changed in each cursor. NOT THREADSAFE, locking left up to the caller.
+func (r *Reconciler) markDirty(uid string) {
+	for _, c := range r.cursors {
+		c.markDirty(uid)
+	}
+}
+
+// Sets the node, its edge function and its source in the current state. The source is only kept to write
+// snapshots, see snapshotSource.
+func (r *Reconciler) setNode(ne tr.NodeEvent) {
+	r.markDirty(ne.UID)
+	r.edges.update(r.currentNodes[ne.UID], ne.Node, r.currentNodes)
+	r.currentNodes[ne.UID] = ne.Node
+	r.edgeFuncs[ne.UID] = ne.ComputeEdges
+	delete(r.sources, ne.UID)
+	if config.Cfg.FeatureSnapshot {
+		if source := newSnapshotSource(ne.Source); source != nil {
+			r.sources[ne.UID] = source
+		}
+	}
+}
+
+// Removes the node, its edge function and its source from the current state, if it was ever there.
+func (r *Reconciler) removeNode(uid string) {
+	if previous, ok := r.currentNodes[uid]; ok {
+		r.markDirty(uid)
+		r.edges.update(previous, tr.Node{}, r.currentNodes)
+	}
+	delete(r.currentNodes, uid)
+	delete(r.edgeFuncs, uid)
+	delete(r.sources, uid)
 }
 
 // This method takes a channel and constantly receives from it, reconciling the input with whatever is currently stored
 func (r *Reconciler) receive() {
 	klog.Info("Reconciler receive routine started.")
+	health.Reconciler.Start()
 	for {
 		r.reconcileNode()
 	}
@@ -300,6 +462,12 @@ func (r *Reconciler) receive() {
 // This is a separate function so we can defer the mutex unlock and guarantee the lock is lifted every iteration
 func (r *Reconciler) reconcileNode() {
 	ne := <-r.Input
+	if ne.Barrier != nil {
+		ne.Barrier() // The events received before are reconciled. Called without the lock.
+		return
+	}
+	health.Reconciler.Begin()
+	defer health.Reconciler.End()
 
 	// Take care of diffState and currentState
 	// Have to lock before the if statements, little awkward but if we made the decision to go ahead and edit
@@ -309,29 +477,30 @@ func (r *Reconciler) reconcileNode() {
 
 	metrics.EventsReceivedCount.WithLabelValues(ne.Node.ResourceString).Inc() //nolint:staticcheck // "could remove embedded field 'Node' from selector"
 
-	// Check whether we already have this node in our diff/purged state with a more up to date time.
+	// Check whether we already have a more up to date event of this node in our current/purged state.
 	// If so, we ignore the version of it we're currently processing.
-	otherNode, inDiff := r.diffNodes[ne.Node.UID]             //nolint:staticcheck // "could remove embedded field 'Node' from selector"
-	nodeInterface, inPurged := r.purgedNodes.Get(ne.Node.UID) //nolint:staticcheck // "could remove embedded field 'Node' from selector"
-
-	if inDiff && otherNode.Time > ne.Time {
+	if last, ok := r.lastEvents[ne.UID]; ok && orderOf(ne).before(last) {
+		klog.V(5).Infof("Ignoring %s event older than the last event of %s.", ne.ResourceString, ne.UID)
 		return
 	}
-	if inPurged {
-		purgedNode, ok := nodeInterface.(tr.NodeEvent)
-		// If the event is already present in purged list , check if the purge time is
-		// equal or greater than the current time. Then we can skip processing the event
-		if ok && purgedNode.Time >= ne.Time {
-			return
+	// If the node was deleted after this event, we can skip processing the event
+	if purged, inPurged := r.purgedNodes.get(ne.UID); inPurged && purged.newerThan(ne) {
+		if ne.Operation != tr.Delete {
+			klog.V(4).Infof("Ignoring %s event for deleted resource %s.", ne.ResourceString, ne.UID)
+			metrics.TombstoneResurrectionsPreventedTotal.Inc()
 		}
+		return
 	}
 
 	previousNode, inPrevious := r.previousNodes[ne.Node.UID] //nolint:staticcheck // "could remove embedded field 'Node' from selector"
+	_, restored := r.restored[ne.UID]
+	delete(r.restored, ne.UID)
+	delete(r.snapshotNodes, ne.UID)
 
 	if ne.Operation == tr.Delete {
-		delete(r.currentNodes, ne.UID) // Get rid of it from our currentState, if it was ever there.
-		delete(r.edgeFuncs, ne.UID)
-		r.purgedNodes.Add(ne.UID, ne) // Add this to the list of node purged resources
+		r.removeNode(ne.UID)  // Get rid of it from our currentState, if it was ever there.
+		r.purgedNodes.add(ne) // Add this to the list of node purged resources
+		delete(r.lastEvents, ne.UID)
 
 		if inPrevious {
 			r.diffNodes[ne.UID] = ne // Since it was in the previous, we need to have a deletion diff.
@@ -341,84 +510,67 @@ func (r *Reconciler) reconcileNode() {
 		}
 	} else { // This is either an update or create, which look very similar. TODO actually combine the two.
 		ne.Operation = tr.Create
+		rule := updateRuleOf(ne.Node)
 		if inPrevious { // If this was in the previous, our operation for diffs is update, not create
 			ne.Operation = tr.Update
 
 			// skip updates if new event is redundant to our previous state
 			// (a property that we don't care about triggered an update)
-			// For nodes that are not applications or subscriptions, We only care about the Properties,
-			// the Metadata is only used to compute the edges and not sent with the node data.
-			skip := reflect.DeepEqual(ne.Node.Properties, previousNode.Properties) //nolint:staticcheck // "could remove embedded field 'Node' from selector"
-
-			kind := ne.Node.Properties["kind"] //nolint:staticcheck // "could remove embedded field 'Node' from selector"
-
-			// If the node is an application or subscription, it might have changes to its metadata we
-			// need to account for so don't skip updates on those
-			if skip && (kind == "Application" || kind == "Subscription") {
-				skip = false
-			}
-
-			// VAPBs specially need to update edges based on this piece of metadata
-			if skip && kind == "ValidatingAdmissionPolicyBinding" {
-				if ne.Node.Metadata["paramRef"] != previousNode.Metadata["paramRef"] { //nolint:staticcheck // "could remove embedded field 'Node' from selector"
-					skip = false
+			if reason := suppressedUpdate(rule, ne, previousNode, restored); reason != "" {
+				metrics.UpdatesSuppressedTotal.WithLabelValues(ne.ResourceString, reason).Inc()
+				r.lastEvents[ne.UID] = orderOf(ne)
+				if restored {
+					// Same as the restored node, keep it without sending an update.
+					r.setNode(ne)
+					r.previousNodes[ne.UID] = ne.Node
 				}
-			}
-
-			isPolicy := (kind == "CertificatePolicy" || kind == "ConfigurationPolicy" || kind == "OperatorPolicy")
-			isConstraint := ne.Node.Properties["apigroup"] == "constraints.gatekeeper.sh" //nolint:staticcheck // "could remove embedded field 'Node' from selector"
-
-			if skip && (isPolicy || isConstraint) {
-				if !reflect.DeepEqual(ne.Node.Metadata["relObjs"], previousNode.Metadata["relObjs"]) { //nolint:staticcheck // "could remove embedded field 'Node' from selector"
-					skip = false
-				}
-			}
-
-			if skip {
 				return
 			}
 		}
 		// Each configmap for a helm release triggers a releases tranformation . If there are N configmaps
 		// we are processing the same helm release N times. Since the order which the configmap gets this point
 		// is not gauranteed , we are setting helm status which are old . Skipping if the current helm revison
-		// is OLDER than one we already have.
-		if ne.Node.ResourceString == "releases" { //nolint:staticcheck // "could remove embedded field 'Node' from selector"
-			// If node has already been sent, check the previous helm revision is latest and discard current one
-			if inPrevious {
-				if previousNode.Properties["revision"].(int64) > ne.Node.Properties["revision"].(int64) { //nolint:staticcheck // "could remove embedded field 'Node' from selector"
-					klog.V(5).Infof("Skip %d for  release %s - previous is good",
-						ne.Node.Properties["revision"], ne.Node.Properties["name"]) //nolint:staticcheck // "could remove embedded field 'Node' from selector"
-					return
-				}
-			}
-			// If we have processed this release already (ready to send), check it's the latest and discard current one
-			if nodeVal, ok := r.currentNodes[ne.UID]; ok {
-				if nodeVal.Properties["revision"].(int64) > ne.Node.Properties["revision"].(int64) { //nolint:staticcheck // "could remove embedded field 'Node' from selector"
-					klog.V(5).Infof("Skip %d for  release %s - lower revision",
-						ne.Node.Properties["revision"], ne.Node.Properties["name"]) //nolint:staticcheck // "could remove embedded field 'Node' from selector"
-					return
-				}
-			}
+		// is OLDER than the one already sent or ready to send.
+		if olderRevision(rule, ne.Node, previousNode) || olderRevision(rule, ne.Node, r.currentNodes[ne.UID]) {
+			klog.V(5).Infof("Skip %v for %s %s - lower revision",
+				ne.Properties[rule.Revision], ne.Properties["kind"], ne.Properties["name"])
+			metrics.UpdatesSuppressedTotal.WithLabelValues(ne.ResourceString, suppressedOlderRevision).Inc()
+			return
 		}
 		// TODO: log the resources that surpass a specific threshold of EventsReceivedCount - ResourcesSentToIndexerCount
 		metrics.ResourcesSentToIndexerCount.WithLabelValues(ne.Node.ResourceString).Inc()
 
-		r.currentNodes[ne.UID] = ne.Node
-		r.edgeFuncs[ne.UID] = ne.ComputeEdges
+		r.setNode(ne)
+		r.lastEvents[ne.UID] = orderOf(ne)
 		r.diffNodes[ne.UID] = ne
 	}
 }
 
-// Clears out diffState and copies currentState into previousState.
-// (has to actually make a copy, maps are normally pass by reference)
+// Clears out diffState and rolls the nodes changed since the last diff, and the restored ones, into previousState.
+// Copies all of currentState after a complete state or a snapshot replaced the current nodes.
 // NOT THREADSAFE with anything that edits structures in s, locking left up to the caller.
 func (r *Reconciler) resetDiffs() {
 	// We have to reset the diff every time we try to prepare something to send,
 	// so that it doesn't get out of sync with the complete/old.
+	if r.allDirty {
+		r.previousNodes = copyNodes(r.currentNodes)
+	} else {
+		for uid := range r.diffNodes {
+			r.rollPrevious(uid)
+		}
+		for uid := range r.restored {
+			r.rollPrevious(uid)
+		}
+	}
 	r.diffNodes = make(map[string]tr.NodeEvent)
-	r.previousNodes = make(map[string]tr.Node, len(r.currentNodes))
+	r.allDirty = false
+}
 
-	for uid, node := range r.currentNodes {
-		r.previousNodes[uid] = node
+// Sets the previous node to the current one, or deletes it. NOT THREADSAFE, locking left up to the caller.
+func (r *Reconciler) rollPrevious(uid string) {
+	if n, ok := r.currentNodes[uid]; ok {
+		r.previousNodes[uid] = n
+	} else {
+		delete(r.previousNodes, uid)
 	}
 }
@@ -11,22 +11,29 @@ Copyright (c) 2020 Red Hat, Inc.
 package reconciler
 
 import (
+	"container/list"
+	"encoding/json"
 	"log"
 	"os"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 
-	lru "github.com/golang/groupcache/lru"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stolostron/search-collector/pkg/config"
 	"github.com/stolostron/search-collector/pkg/metrics"
 	tr "github.com/stolostron/search-collector/pkg/transforms"
 	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/helm/pkg/proto/hapi/release"
 	"k8s.io/klog/v2"
 )
@@ -39,14 +46,16 @@ type NodeEdge struct {
 func initTestReconciler() *Reconciler {
 	return &Reconciler{
 		currentNodes:       make(map[string]tr.Node),
-		previousNodes:      make(map[string]tr.Node),
+		view:               view{previousNodes: make(map[string]tr.Node)},
 		diffNodes:          make(map[string]tr.NodeEvent),
 		k8sEventNodes:      make(map[string]tr.NodeEvent),
 		previousEventEdges: make(map[string]tr.Edge),
 		edgeFuncs:          make(map[string]func(ns tr.NodeStore) []tr.Edge),
+		lastEvents:         make(map[string]eventOrder),
+		sources:            make(map[string]*snapshotSource),
 
 		Input:       make(chan tr.NodeEvent),
-		purgedNodes: lru.New(CACHE_SIZE),
+		purgedNodes: newTombstones(),
 	}
 }
 
@@ -202,7 +211,7 @@ func TestReconcilerOutOfOrderDelete(t *testing.T) {
 		t.Fatal("failed to ignore add event received out of order")
 	}
 
-	if _, found := s.purgedNodes.Get("test-event"); !found {
+	if _, found := s.purgedNodes.get("test-event"); !found {
 		t.Fatal("failed to added deleted NodeEvent to purgedNodes cache")
 	}
 }
@@ -477,6 +486,15 @@ func TestReconcilerComplete(t *testing.T) {
 		t.Log("Correct number of edges and nodes")
 	}
 
+	// The complete state is sorted, so payloads built from it are reproducible.
+	assert.True(t, sort.SliceIsSorted(com.Nodes, func(i, j int) bool { return com.Nodes[i].UID < com.Nodes[j].UID }))
+	assert.True(t, sort.SliceIsSorted(com.Edges, func(i, j int) bool {
+		if com.Edges[i].SourceUID != com.Edges[j].SourceUID {
+			return com.Edges[i].SourceUID < com.Edges[j].SourceUID
+		}
+		return com.Edges[i].DestUID < com.Edges[j].DestUID
+	}))
+
 	// Verify some properties are set during BuildEdges on ConfigurationPolicies
 	configPolNode := ns.ByKindNamespaceName["ConfigurationPolicy"]["local-cluster"]["policy-namespace"]
 
@@ -490,3 +508,693 @@ func TestReconcilerComplete(t *testing.T) {
 		t.Fatal("Incorrect _nonCompliantResources; got", noncompliant)
 	}
 }
+
+func TestReconcilerRestore(t *testing.T) {
+	config.InitConfig()
+
+	// Build the state the aggregator has.
+	sent := initTestReconciler()
+	createAndReconcileNodeEvents(sent, "", "")
+	sent.Diff()
+	state := sent.SentState()
+	assert.Len(t, state.Nodes, 2)
+	assert.Len(t, state.Edges, 1)
+
+	// Save and load it, like the sender does, and add a node that was deleted while the collector was down.
+	saved, err := json.Marshal(state)
+	assert.Nil(t, err)
+	restoredState := State{}
+	assert.Nil(t, json.Unmarshal(saved, &restoredState))
+	restoredState.Nodes = append(restoredState.Nodes, tr.Node{UID: "local-cluster/gone"})
+
+	testReconciler := initTestReconciler()
+	testReconciler.Restore(restoredState)
+	createAndReconcileNodeEvents(testReconciler, "", "")
+	diff := testReconciler.Diff()
+
+	assert.Empty(t, diff.AddNodes, "Expected restored nodes not to be added again.")
+	assert.Empty(t, diff.UpdateNodes, "Expected unchanged restored nodes not to be updated.")
+	assert.Equal(t, []tr.Deletion{{UID: "local-cluster/gone"}}, diff.DeleteNodes)
+	assert.Empty(t, diff.AddEdges)
+	assert.Empty(t, diff.DeleteEdges)
+	assert.Equal(t, 2, diff.TotalNodes)
+	assert.Equal(t, 1, diff.TotalEdges)
+	assert.Nil(t, testReconciler.restored)
+}
+
+func TestReconcilerStateHash(t *testing.T) {
+	config.InitConfig()
+	testReconciler := initTestReconciler()
+	events := createNodeEvents("", "")
+
+	createAndReconcileNodeEvents(testReconciler, "", "")
+	added := testReconciler.Diff().StateHash
+	assert.Equal(t, added, testReconciler.Complete().StateHash, "Expected the rolling hash to match the complete hash.")
+
+	// Update the pod.
+	pod := events[1]
+	pod.Time = time.Now().Unix() + 1
+	pod.Node.Properties = map[string]interface{}{}
+	for k, v := range events[1].Node.Properties {
+		pod.Node.Properties[k] = v
+	}
+	pod.Node.Properties["status"] = "Failed"
+	go func() { testReconciler.Input <- pod }()
+	testReconciler.reconcileNode()
+	updated := testReconciler.Diff().StateHash
+	assert.NotEqual(t, added, updated)
+	assert.Equal(t, updated, testReconciler.Complete().StateHash, "Expected the rolling hash to match the complete hash.")
+
+	// Only the pod kind changed.
+	hashes := testReconciler.KindHashes()
+	assert.Len(t, hashes, 2)
+	podState := testReconciler.KindState([]string{"Pod"})
+	assert.Len(t, podState.Nodes, 1)
+	assert.Len(t, podState.Edges, 1, "Expected the edges of the kind.")
+
+	// Delete the pod, the hash goes back to the owner alone.
+	go func() {
+		testReconciler.Input <- tr.NodeEvent{Time: pod.Time + 1, Operation: tr.Delete, Node: tr.Node{UID: pod.UID}}
+	}()
+	testReconciler.reconcileNode()
+	deleted := testReconciler.Diff().StateHash
+	assert.Equal(t, deleted, testReconciler.Complete().StateHash, "Expected the rolling hash to match the complete hash.")
+	assert.Len(t, testReconciler.KindHashes(), 1)
+}
+
+func TestReconcilerCursor(t *testing.T) {
+	config.InitConfig()
+	testReconciler := initTestReconciler()
+	cursor := testReconciler.NewCursor()
+	events := createNodeEvents("", "")
+
+	createAndReconcileNodeEvents(testReconciler, "", "")
+	primary := testReconciler.Diff()
+	diff := cursor.Diff()
+	assert.Len(t, diff.AddNodes, 2)
+	assert.Len(t, diff.AddEdges, 1)
+	assert.Equal(t, primary.StateHash, diff.StateHash)
+
+	// The first target sends the update before the cursor, the cursor still gets it.
+	pod := events[1]
+	pod.Time = time.Now().Unix() + 1
+	pod.Node.Properties = map[string]interface{}{}
+	for k, v := range events[1].Node.Properties {
+		pod.Node.Properties[k] = v
+	}
+	pod.Node.Properties["status"] = "Failed"
+	go func() { testReconciler.Input <- pod }()
+	testReconciler.reconcileNode()
+	assert.Equal(t, map[string]struct{}{pod.UID: {}}, cursor.dirty, "Expected the cursor to compare only the pod.")
+	primary = testReconciler.Diff()
+	assert.Len(t, testReconciler.Diff().UpdateNodes, 0)
+	diff = cursor.Diff()
+	assert.Len(t, diff.UpdateNodes, 1)
+	assert.Empty(t, diff.AddNodes)
+	assert.Empty(t, diff.AddEdges)
+	assert.Equal(t, primary.StateHash, diff.StateHash)
+	assert.Empty(t, cursor.Diff().UpdateNodes, "Expected the cursor to move past the update.")
+
+	// Delete the pod, the cursor deletes it without deleting its edge on its own.
+	go func() {
+		testReconciler.Input <- tr.NodeEvent{Time: pod.Time + 1, Operation: tr.Delete, Node: tr.Node{UID: pod.UID}}
+	}()
+	testReconciler.reconcileNode()
+	diff = cursor.Diff()
+	assert.Equal(t, []tr.Deletion{{UID: pod.UID}}, diff.DeleteNodes)
+	assert.Empty(t, diff.DeleteEdges)
+	assert.Equal(t, testReconciler.Diff().StateHash, diff.StateHash)
+	assert.Equal(t, cursor.Complete().StateHash, diff.StateHash, "Expected the rolling hash to match the complete hash.")
+}
+
+func TestReconcilerResetDiffs(t *testing.T) {
+	testReconciler := initTestReconciler()
+	createAndReconcileNodeEvents(testReconciler, "", "")
+	testReconciler.Diff()
+	assert.Equal(t, testReconciler.currentNodes, testReconciler.previousNodes)
+
+	// Only the changed nodes are rolled into the previous nodes.
+	marker := tr.Node{UID: "local-cluster/marker"}
+	testReconciler.previousNodes[marker.UID] = marker
+	deletion := createNodeEvents("", "")[1]
+	deletion.Operation = tr.Delete
+	deletion.Time++
+	reconcileEvents(testReconciler, deletion)
+	diff := testReconciler.Diff()
+	assert.Equal(t, []tr.Deletion{{UID: deletion.Node.UID}}, diff.DeleteNodes)
+	assert.NotContains(t, testReconciler.previousNodes, deletion.Node.UID)
+	assert.Contains(t, testReconciler.previousNodes, marker.UID, "Expected the unchanged nodes not to be copied.")
+
+	// The complete state copies all the current nodes.
+	testReconciler.Complete()
+	assert.Equal(t, testReconciler.currentNodes, testReconciler.previousNodes)
+}
+
+func TestReconcilerDiffPatch(t *testing.T) {
+	testReconciler := initTestReconciler()
+	cursor := testReconciler.NewCursor()
+	events := createNodeEvents("", "")
+	createAndReconcileNodeEvents(testReconciler, "", "")
+	testReconciler.Diff()
+	cursor.Diff()
+
+	// Change the status and remove the namespace of the pod.
+	pod := events[1]
+	pod.Time = time.Now().Unix() + 1
+	pod.Node.Properties = map[string]interface{}{}
+	for k, v := range events[1].Node.Properties {
+		if k != "namespace" {
+			pod.Node.Properties[k] = v
+		}
+	}
+	pod.Node.Properties["status"] = "Failed"
+	go func() { testReconciler.Input <- pod }()
+	testReconciler.reconcileNode()
+
+	expected := []tr.NodePatch{{UID: pod.UID, Set: map[string]interface{}{"status": "Failed"}, Unset: []string{"namespace"}}}
+	diff := testReconciler.Diff()
+	assert.Len(t, diff.UpdateNodes, 1, "Expected the whole node for aggregators without patches.")
+	assert.Equal(t, expected, diff.PatchNodes)
+	assert.Equal(t, expected, cursor.Diff().PatchNodes)
+}
+
+func Test_propertyPatch(t *testing.T) {
+	previous := map[string]interface{}{
+		"kind":     "Pod",
+		"label":    map[string]interface{}{"app": "search", "tier": "api"},
+		"restarts": float64(2), // Restored from JSON.
+	}
+	current := map[string]interface{}{
+		"kind":     "Pod",
+		"label":    map[string]string{"app": "search"},
+		"restarts": int64(2),
+		"status":   "Running",
+	}
+
+	patch := propertyPatch("uid1", previous, current)
+
+	assert.Equal(t, map[string]interface{}{"label": map[string]string{"app": "search"}, "status": "Running"}, patch.Set)
+	assert.Empty(t, patch.Unset)
+	assert.True(t, propertyPatch("uid1", current, current).Empty())
+}
+
+// Sends the events to the reconciler, one at a time.
+func reconcileEvents(testReconciler *Reconciler, events ...tr.NodeEvent) {
+	go func() {
+		for _, ne := range events {
+			testReconciler.Input <- ne
+		}
+	}()
+	for range events {
+		testReconciler.reconcileNode()
+	}
+}
+
+// Builds the edges of all the nodes, without the edges kept by the reconciler.
+func rebuiltEdges(testReconciler *Reconciler) map[string]map[string]tr.Edge {
+	rebuilt := &Reconciler{currentNodes: testReconciler.currentNodes, edgeFuncs: testReconciler.edgeFuncs}
+	return rebuilt.allEdges()
+}
+
+func TestReconcilerIncrementalEdges(t *testing.T) {
+	config.InitConfig()
+	testReconciler := initTestReconciler()
+	ts := time.Now().Unix()
+	event := func(op tr.Operation, trans tr.Transform, resourceString string) tr.NodeEvent {
+		ts++
+		return tr.NewNodeEvent(&tr.Event{Time: ts, Operation: op}, trans, resourceString)
+	}
+	pod := func(name, namespace, app string, owner *metav1.OwnerReference) tr.NodeEvent {
+		p := v1.Pod{TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}, ObjectMeta: metav1.ObjectMeta{
+			Name: name, Namespace: namespace, UID: types.UID(name), Labels: map[string]string{"app": app}}}
+		p.Spec.NodeName = "node1"
+		if owner != nil {
+			p.OwnerReferences = []metav1.OwnerReference{*owner}
+		}
+		return event(tr.Create, tr.PodResourceBuilder(&p, &unstructured.Unstructured{}), "pods")
+	}
+	replicaSet := func(owner *metav1.OwnerReference) tr.NodeEvent {
+		rs := appsv1.ReplicaSet{TypeMeta: metav1.TypeMeta{Kind: "ReplicaSet", APIVersion: "apps/v1"},
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "a", UID: "rs1"}}
+		if owner != nil {
+			rs.OwnerReferences = []metav1.OwnerReference{*owner}
+		}
+		return event(tr.Create, tr.ReplicaSetResourceBuilder(&rs), "replicasets")
+	}
+	svc := v1.Service{TypeMeta: metav1.TypeMeta{Kind: "Service", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "a", UID: "svc1"},
+		Spec:       v1.ServiceSpec{Selector: map[string]string{"app": "web"}}}
+	node := v1.Node{TypeMeta: metav1.TypeMeta{Kind: "Node", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "node1", UID: "node1"}}
+	deploy := appsv1.Deployment{TypeMeta: metav1.TypeMeta{Kind: "Deployment", APIVersion: "apps/v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "a", UID: "deploy1"}}
+	controller := true
+	rsOwner := &metav1.OwnerReference{Kind: "ReplicaSet", Name: "web", UID: "rs1", Controller: &controller}
+	deployOwner := &metav1.OwnerReference{Kind: "Deployment", Name: "web", UID: "deploy1", Controller: &controller}
+	uid := func(name string) string { return "local-cluster/" + name }
+
+	steps := []struct {
+		name   string
+		events []tr.NodeEvent
+		edge   [2]string // An edge expected after the step.
+	}{
+		{"service selecting a pod", []tr.NodeEvent{
+			pod("pod1", "a", "web", rsOwner), pod("pod2", "b", "web", nil),
+			event(tr.Create, tr.ServiceResourceBuilder(&svc, &unstructured.Unstructured{}), "services"),
+		}, [2]string{"svc1", "pod1"}},
+		{"owner added", []tr.NodeEvent{replicaSet(nil)}, [2]string{"pod1", "rs1"}},
+		{"owner of the owner added", []tr.NodeEvent{
+			event(tr.Create, tr.DeploymentResourceBuilder(&deploy), "deployments"), replicaSet(deployOwner),
+		}, [2]string{"pod1", "deploy1"}},
+		{"cluster scoped node added", []tr.NodeEvent{
+			event(tr.Create, tr.NodeResourceBuilder(&node, &unstructured.Unstructured{}), "nodes"),
+		}, [2]string{"pod2", "node1"}},
+		{"pod selected by another service", []tr.NodeEvent{pod("pod1", "a", "db", rsOwner)}, [2]string{"pod1", "rs1"}},
+		{"pod selected again", []tr.NodeEvent{pod("pod1", "a", "web", rsOwner)}, [2]string{"svc1", "pod1"}},
+		{"owner deleted", []tr.NodeEvent{
+			{Time: ts + 100, Operation: tr.Delete, Node: tr.Node{UID: uid("rs1")}},
+		}, [2]string{"svc1", "pod1"}},
+		{"cluster scoped node deleted", []tr.NodeEvent{
+			{Time: ts + 101, Operation: tr.Delete, Node: tr.Node{UID: uid("node1")}},
+		}, [2]string{"svc1", "pod1"}},
+	}
+
+	for _, step := range steps {
+		reconcileEvents(testReconciler, step.events...)
+
+		edges := testReconciler.allEdges()
+
+		assert.Equal(t, rebuiltEdges(testReconciler), edges, "Expected the same edges as a rebuild after: %s", step.name)
+		assert.Contains(t, edges[uid(step.edge[0])], uid(step.edge[1]), "Expected an edge after: %s", step.name)
+	}
+	assert.NotContains(t, testReconciler.allEdges()[uid("pod1")], uid("rs1"))
+	assert.Empty(t, testReconciler.edges.dependents[uid("rs1")], "Expected the deleted owner to be forgotten.")
+}
+
+func TestReconcilerIncrementalEdgesBuildsChanged(t *testing.T) {
+	testReconciler := initTestReconciler()
+	built := map[string]int{}
+	event := func(name, namespace string, ts int64) tr.NodeEvent {
+		uid := "local-cluster/" + name
+		return tr.NodeEvent{
+			Time:      ts,
+			Operation: tr.Create,
+			Node: tr.Node{UID: uid, Properties: map[string]interface{}{
+				"kind": "ConfigMap", "name": name, "namespace": namespace, "updated": ts}},
+			ComputeEdges: func(ns tr.NodeStore) []tr.Edge {
+				built[uid]++
+				return []tr.Edge{}
+			},
+		}
+	}
+	reconcileEvents(testReconciler, event("cm1", "a", 1), event("cm2", "a", 1), event("cm3", "b", 1))
+	testReconciler.allEdges()
+
+	reconcileEvents(testReconciler, event("cm3", "b", 2))
+	testReconciler.allEdges()
+	testReconciler.allEdges()
+
+	assert.Equal(t, map[string]int{"local-cluster/cm1": 1, "local-cluster/cm2": 1, "local-cluster/cm3": 2}, built,
+		"Expected only the edges of the changed namespace to be built again.")
+}
+
+func TestReconcilerIncrementalEdgesDiff(t *testing.T) {
+	testReconciler := initTestReconciler()
+	cursor := testReconciler.NewCursor()
+	links := map[string]string{} // Dest of the edge built by each node.
+	event := func(name string, ts int64) tr.NodeEvent {
+		uid := "local-cluster/" + name
+		return tr.NodeEvent{
+			Time:      ts,
+			Operation: tr.Create,
+			Node: tr.Node{UID: uid, Properties: map[string]interface{}{
+				"kind": "ConfigMap", "name": name, "namespace": "a", "updated": ts}},
+			ComputeEdges: func(ns tr.NodeStore) []tr.Edge {
+				if dest, ok := links[uid]; ok && ns.ByUID[dest].UID != "" {
+					return []tr.Edge{{EdgeType: "uses", SourceUID: uid, DestUID: dest, SourceKind: "ConfigMap",
+						DestKind: "ConfigMap"}}
+				}
+				return []tr.Edge{}
+			},
+		}
+	}
+	edge := func(src, dest string) tr.Edge {
+		return tr.Edge{EdgeType: "uses", SourceUID: "local-cluster/" + src, DestUID: "local-cluster/" + dest,
+			SourceKind: "ConfigMap", DestKind: "ConfigMap"}
+	}
+	// The rolling hashes and the previous edges must match the ones built from all the edges.
+	assertView := func(v *view, step string) {
+		assert.Equal(t, rebuiltEdges(testReconciler), v.previousEdges, "Expected the sent edges after: %s", step)
+		rehashed := view{}
+		rehashed.rehashEdges(v.previousEdges)
+		assert.Equal(t, rehashed.edgeHash.total, v.edgeHash.total, "Expected the hash of all the edges after: %s", step)
+		rehashed.nodeHash = v.nodeHash
+		assert.Equal(t, rehashed.kindHashes(), v.kindHashes(), "Expected the hashes of all the kinds after: %s", step)
+		assert.Empty(t, v.dirtyEdges)
+	}
+
+	links["local-cluster/cm1"] = "local-cluster/cm2"
+	reconcileEvents(testReconciler, event("cm1", 1), event("cm2", 1), event("cm3", 1))
+	assert.Equal(t, []tr.Edge{edge("cm1", "cm2")}, testReconciler.Diff().AddEdges)
+	assert.Equal(t, []tr.Edge{edge("cm1", "cm2")}, cursor.Diff().AddEdges)
+
+	// The first target sends the changed edge before the cursor, the cursor still gets it.
+	links["local-cluster/cm1"] = "local-cluster/cm3"
+	reconcileEvents(testReconciler, event("cm1", 2))
+	diff := testReconciler.Diff()
+	assert.Equal(t, []tr.Edge{edge("cm1", "cm3")}, diff.AddEdges)
+	assert.Equal(t, []tr.Edge{edge("cm1", "cm2")}, diff.DeleteEdges)
+	assertView(&testReconciler.view, "edge changed")
+	cursorDiff := cursor.Diff()
+	assert.Equal(t, diff.AddEdges, cursorDiff.AddEdges)
+	assert.Equal(t, diff.DeleteEdges, cursorDiff.DeleteEdges)
+	assert.Equal(t, diff.StateHash, cursorDiff.StateHash)
+	assertView(&cursor.view, "edge changed")
+
+	// The edge to a deleted node is deleted with the node.
+	reconcileEvents(testReconciler, tr.NodeEvent{Time: 3, Operation: tr.Delete, Node: tr.Node{UID: "local-cluster/cm3"}})
+	diff = testReconciler.Diff()
+	assert.Equal(t, []tr.Deletion{{UID: "local-cluster/cm3"}}, diff.DeleteNodes)
+	assert.Empty(t, diff.DeleteEdges)
+	assertView(&testReconciler.view, "node deleted")
+	assert.Empty(t, testReconciler.previousEdges)
+	assert.Empty(t, testReconciler.Diff().DeleteNodes)
+	assert.Equal(t, diff.StateHash, cursor.Diff().StateHash)
+	assert.Equal(t, testReconciler.Complete().StateHash, diff.StateHash,
+		"Expected the rolling hash to match the complete hash.")
+}
+
+func TestReconcilerTombstonesMassDelete(t *testing.T) {
+	testReconciler := initTestReconciler()
+	deletes := make([]tr.NodeEvent, 0, 2000)
+	for i := range 2000 {
+		deletes = append(deletes, tr.NodeEvent{Time: 10, Operation: tr.Delete,
+			Node: tr.Node{UID: "local-cluster/pod" + strconv.Itoa(i)}})
+	}
+	reconcileEvents(testReconciler, deletes...)
+
+	late := tr.NodeEvent{Time: 9, Operation: tr.Create, Node: tr.Node{UID: "local-cluster/pod0",
+		Properties: map[string]interface{}{"kind": "Pod", "name": "pod0", "namespace": "a"}}}
+	prevented := testutil.ToFloat64(metrics.TombstoneResurrectionsPreventedTotal)
+	reconcileEvents(testReconciler, late)
+
+	assert.NotContains(t, testReconciler.currentNodes, "local-cluster/pod0",
+		"Expected the late add event of the first deleted pod to be ignored.")
+	assert.Equal(t, prevented+1, testutil.ToFloat64(metrics.TombstoneResurrectionsPreventedTotal))
+}
+
+func TestReconcilerTombstonesSequence(t *testing.T) {
+	testReconciler := initTestReconciler()
+	node := func(status string) tr.Node {
+		return tr.Node{UID: "local-cluster/pod1",
+			Properties: map[string]interface{}{"kind": "Pod", "name": "pod1", "namespace": "a", "status": status}}
+	}
+	reconcileEvents(testReconciler, tr.NodeEvent{Time: 10, Operation: tr.Delete, Node: tr.Node{UID: "local-cluster/pod1"},
+		ResourceVersion: "200", Sequence: 20})
+
+	reconcileEvents(testReconciler, tr.NodeEvent{Time: 10, Operation: tr.Update, Node: node("Terminating"),
+		ResourceVersion: "199", Sequence: 19})
+	assert.NotContains(t, testReconciler.currentNodes, "local-cluster/pod1",
+		"Expected an update received before the delete in the same second to be ignored.")
+
+	reconcileEvents(testReconciler, tr.NodeEvent{Time: 10, Operation: tr.Create, Node: node("Running"),
+		ResourceVersion: "1000", Sequence: 21})
+	assert.Contains(t, testReconciler.currentNodes, "local-cluster/pod1",
+		"Expected an add received after the delete in the same second to be processed.")
+}
+
+func Test_tombstones_evict(t *testing.T) {
+	metrics.TombstoneEvictionsTotal.Reset()
+	now := time.Unix(1000, 0)
+	ts := &tombstones{ttl: time.Minute, maxEntries: 2, byUID: map[string]*list.Element{}, order: list.New(),
+		now: func() time.Time { return now }}
+
+	ts.add(tr.NodeEvent{Node: tr.Node{UID: "uid1"}, Time: 1})
+	now = now.Add(30 * time.Second)
+	ts.add(tr.NodeEvent{Node: tr.Node{UID: "uid2"}, Time: 2})
+	ts.add(tr.NodeEvent{Node: tr.Node{UID: "uid3"}, Time: 3})
+
+	_, found := ts.get("uid1")
+	assert.False(t, found, "Expected the oldest tombstone to be evicted over the max entries.")
+	_, found = ts.get("uid2")
+	assert.True(t, found)
+
+	now = now.Add(time.Minute)
+	_, found = ts.get("uid3")
+	assert.False(t, found, "Expected the tombstone to expire after the TTL.")
+	assert.Equal(t, 0, ts.order.Len())
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.TombstoneEvictionsTotal.WithLabelValues("capacity")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(metrics.TombstoneEvictionsTotal.WithLabelValues("expired")))
+}
+
+func Test_tombstone_newerThan(t *testing.T) {
+	ts := &tombstone{order: eventOrder{time: 10, resourceVersion: "200", sequence: 20}}
+
+	assert.True(t, ts.newerThan(tr.NodeEvent{Time: 11, ResourceVersion: "250", Sequence: 19}))
+	assert.False(t, ts.newerThan(tr.NodeEvent{Time: 9, ResourceVersion: "150", Sequence: 21}))
+	assert.True(t, ts.newerThan(tr.NodeEvent{Time: 11, ResourceVersion: "200", Sequence: 21}),
+		"Expected the event with the resourceVersion of the delete not to be newer.")
+	assert.True(t, ts.newerThan(tr.NodeEvent{Time: 9, ResourceVersion: "250"}),
+		"Expected the times to be compared without a sequence, and the resourceVersions not to be ordered.")
+	assert.False(t, (&tombstone{order: eventOrder{time: 10}}).newerThan(tr.NodeEvent{Time: 11, Sequence: 1}))
+}
+
+func TestReconcilerEventOrder(t *testing.T) {
+	testReconciler := initTestReconciler()
+	event := func(status, resourceVersion string, sequence uint64) tr.NodeEvent {
+		return tr.NodeEvent{Time: 10, Operation: tr.Update, ResourceVersion: resourceVersion, Sequence: sequence,
+			Node: tr.Node{UID: "local-cluster/pod1",
+				Properties: map[string]interface{}{"kind": "Pod", "name": "pod1", "namespace": "a", "status": status}},
+			ComputeEdges: func(ns tr.NodeStore) []tr.Edge { return []tr.Edge{} }}
+	}
+
+	// Two updates in the same second, processed out of order by the transformer routines.
+	reconcileEvents(testReconciler, event("Running", "12", 5))
+	testReconciler.Diff()
+	reconcileEvents(testReconciler, event("Pending", "11", 4))
+
+	assert.Equal(t, "Running", testReconciler.currentNodes["local-cluster/pod1"].Properties["status"],
+		"Expected the update with the older sequence to be ignored, also after a diff.")
+
+	reconcileEvents(testReconciler, event("Pending", "", 3))
+	assert.Equal(t, "Running", testReconciler.currentNodes["local-cluster/pod1"].Properties["status"],
+		"Expected the sequence to order the updates without a resourceVersion.")
+
+	reconcileEvents(testReconciler, event("Failed", "9", 6))
+	assert.Equal(t, "Failed", testReconciler.currentNodes["local-cluster/pod1"].Properties["status"],
+		"Expected the opaque resourceVersions not to be compared as numbers.")
+
+	reconcileEvents(testReconciler, event("Succeeded", "", 0))
+	assert.Equal(t, "Succeeded", testReconciler.currentNodes["local-cluster/pod1"].Properties["status"],
+		"Expected events in the same second to be processed without a resourceVersion or sequence.")
+}
+
+func Test_eventOrder_before(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     eventOrder
+		expected bool
+	}{
+		{"resourceVersion isn't ordered", eventOrder{time: 11, resourceVersion: "9", sequence: 8},
+			eventOrder{time: 10, resourceVersion: "10", sequence: 7}, false},
+		{"same resourceVersion", eventOrder{time: 9, resourceVersion: "10", sequence: 7},
+			eventOrder{time: 10, resourceVersion: "10", sequence: 8}, false},
+		{"sequence", eventOrder{time: 10, sequence: 7}, eventOrder{time: 10, sequence: 8}, true},
+		{"time", eventOrder{time: 9, resourceVersion: "10"}, eventOrder{time: 10}, true},
+		{"same time", eventOrder{time: 10}, eventOrder{time: 10}, false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, test.a.before(test.b), test.name)
+	}
+}
+
+func TestReconcilerUpdateRules(t *testing.T) {
+	metrics.UpdatesSuppressedTotal.Reset()
+	testReconciler := initTestReconciler()
+	noEdges := func(ns tr.NodeStore) []tr.Edge { return []tr.Edge{} }
+	binding := func(time int64, paramRef string) tr.NodeEvent {
+		return tr.NodeEvent{Time: time, Operation: tr.Update, ComputeEdges: noEdges, Node: tr.Node{
+			UID: "local-cluster/vapb1", ResourceString: "validatingadmissionpolicybindings",
+			Properties: map[string]interface{}{"kind": "ValidatingAdmissionPolicyBinding",
+				"apigroup": "admissionregistration.k8s.io", "name": "vapb1"},
+			Metadata: map[string]interface{}{"paramRef": paramRef}}}
+	}
+	release := func(time int64, revision int64) tr.NodeEvent {
+		return tr.NodeEvent{Time: time, Operation: tr.Update, ComputeEdges: noEdges, Node: tr.Node{
+			UID: "local-cluster/Release/release1", ResourceString: "releases",
+			Properties: map[string]interface{}{"kind": "Release", "name": "release1", "revision": revision}}}
+	}
+	reconcileEvents(testReconciler, binding(10, "param1"), release(10, 3))
+	testReconciler.Diff()
+
+	reconcileEvents(testReconciler, binding(11, "param2"))
+	assert.Contains(t, testReconciler.diffNodes, "local-cluster/vapb1",
+		"Expected a change to the paramRef metadata to be sent.")
+	testReconciler.Diff()
+
+	reconcileEvents(testReconciler, binding(12, "param2"), release(12, 2))
+	assert.Empty(t, testReconciler.diffNodes, "Expected the unchanged binding and the older release to be skipped.")
+	assert.Equal(t, int64(3), testReconciler.currentNodes["local-cluster/Release/release1"].Properties["revision"])
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.UpdatesSuppressedTotal.WithLabelValues(
+		"validatingadmissionpolicybindings", "unchanged")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.UpdatesSuppressedTotal.WithLabelValues(
+		"releases", "older_revision")))
+}
+
+func Test_suppressedUpdate(t *testing.T) {
+	rule := tr.UpdateRule{IgnoreProperties: []string{"restarts"}}
+	previous := tr.Node{Properties: map[string]interface{}{"kind": "Pod", "status": "Running", "restarts": int64(1)}}
+	event := func(status string, restarts int64) tr.NodeEvent {
+		return tr.NodeEvent{Node: tr.Node{
+			Properties: map[string]interface{}{"kind": "Pod", "status": status, "restarts": restarts}}}
+	}
+
+	assert.Equal(t, suppressedUnchanged, suppressedUpdate(rule, event("Running", 1), previous, false))
+	assert.Equal(t, suppressedIgnoredProperties, suppressedUpdate(rule, event("Running", 2), previous, false))
+	assert.Equal(t, "", suppressedUpdate(rule, event("Pending", 2), previous, false))
+	assert.Equal(t, "", suppressedUpdate(rule, event("Running", 2), previous, true),
+		"Expected changes to the ignored properties of restored nodes to be sent.")
+	assert.Equal(t, "", suppressedUpdate(tr.UpdateRule{ForceMetadata: []string{"*"}}, event("Running", 1), previous,
+		false), "Expected every update to be sent.")
+}
+
+func TestReconcilerSnapshot(t *testing.T) {
+	config.InitConfig()
+	config.Cfg.FeatureSnapshot = true
+	defer func() { config.Cfg.FeatureSnapshot = false }()
+	testReconciler := initTestReconciler()
+	controller := true
+	rs := appsv1.ReplicaSet{TypeMeta: metav1.TypeMeta{Kind: "ReplicaSet", APIVersion: "apps/v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "a", UID: "rs1"}}
+	pod := v1.Pod{TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}, ObjectMeta: metav1.ObjectMeta{
+		Name: "pod1", Namespace: "a", UID: "pod1", OwnerReferences: []metav1.OwnerReference{
+			{Kind: "ReplicaSet", Name: "web", UID: "rs1", Controller: &controller}},
+		ManagedFields: []metav1.ManagedFieldsEntry{{Manager: "kubectl"}}}}
+	event := func(obj interface{}, resourceString string) tr.NodeEvent {
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+		assert.Nil(t, err)
+		nes, errs := tr.TransformEvents([]*tr.Event{{Time: time.Now().Unix(), Operation: tr.Create,
+			Resource: &unstructured.Unstructured{Object: content}, ResourceString: resourceString}})
+		assert.Nil(t, errs[0])
+		return nes[0]
+	}
+	reconcileEvents(testReconciler, event(&rs, "replicasets"), event(&pod, "pods"),
+		tr.NodeEvent{Time: time.Now().Unix(), Operation: tr.Create,
+			Node: tr.Node{UID: "local-cluster/nosource",
+				Properties: map[string]interface{}{"kind": "Other", "name": "other", "namespace": "a"}},
+			ComputeEdges: func(ns tr.NodeStore) []tr.Edge { return []tr.Edge{} }})
+	testReconciler.Diff()
+	assert.NotContains(t, string(testReconciler.sources["local-cluster/pod1"].Resource), "managedFields",
+		"Expected only the fields needed to build the node again to be kept.")
+
+	var buf strings.Builder
+	assert.Nil(t, testReconciler.WriteSnapshot(&buf))
+
+	restored := initTestReconciler()
+	assert.Nil(t, restored.ReadSnapshot(strings.NewReader(buf.String())))
+
+	assert.Equal(t, testReconciler.currentNodes, restored.currentNodes,
+		"Expected the nodes to be built again from their resources.")
+	assert.Contains(t, restored.allEdges()["local-cluster/pod1"], "local-cluster/rs1",
+		"Expected the edge functions to be built again.")
+	assert.Equal(t, testReconciler.StateHash(), restored.StateHash())
+	diff := restored.Diff()
+	assert.Empty(t, diff.AddNodes)
+	assert.Empty(t, diff.AddEdges)
+	assert.Empty(t, diff.DeleteEdges)
+
+	err := restored.ReadSnapshot(strings.NewReader(`{"version": 0}`))
+	assert.ErrorContains(t, err, "unsupported reconciler snapshot version 0")
+	err = testReconciler.ReadSnapshot(strings.NewReader(buf.String()))
+	assert.ErrorContains(t, err, "after the reconciler received events")
+	assert.NotEmpty(t, testReconciler.lastEvents, "Expected the order of the events to be kept.")
+
+	// Warm restart: the snapshot only has the current nodes, the state the aggregator acknowledged is restored
+	// by the senders, before or after the snapshot.
+	dir := t.TempDir()
+	assert.Nil(t, testReconciler.SaveSnapshot(dir))
+	acknowledged := testReconciler.SentState()
+	withoutState := initTestReconciler()
+	assert.Nil(t, withoutState.LoadSnapshot(dir))
+	assert.Equal(t, testReconciler.currentNodes, withoutState.currentNodes)
+	assert.Empty(t, withoutState.SentState().Nodes, "Expected the snapshot not to be taken as acknowledged.")
+	restoredFirst := initTestReconciler()
+	restoredFirst.Restore(acknowledged)
+	assert.Nil(t, restoredFirst.LoadSnapshot(dir))
+	restarted := initTestReconciler()
+	assert.Nil(t, restarted.LoadSnapshot(dir))
+	restarted.Restore(acknowledged)
+	assert.Equal(t, restoredFirst.currentNodes, restarted.currentNodes)
+	assert.Equal(t, restoredFirst.view, restarted.view)
+	assert.Equal(t, acknowledged, restarted.SentState())
+
+	// The nodes the informers don't send again are deleted.
+	reconcileEvents(restarted, event(&rs, "replicasets"), event(&pod, "pods"),
+		tr.NodeEvent{Barrier: restarted.DropUnseenSnapshotNodes})
+	assert.Contains(t, restarted.currentNodes, "local-cluster/pod1")
+	assert.NotContains(t, restarted.currentNodes, "local-cluster/nosource")
+	diff = restarted.Diff()
+	assert.Equal(t, []tr.Deletion{{UID: "local-cluster/nosource"}}, diff.DeleteNodes)
+	assert.Empty(t, diff.AddNodes)
+	assert.ErrorIs(t, initTestReconciler().LoadSnapshot(t.TempDir()), os.ErrNotExist)
+
+	// Without FEATURE_SNAPSHOT, the resources aren't kept and the nodes are written without them.
+	config.Cfg.FeatureSnapshot = false
+	withoutSources := initTestReconciler()
+	reconcileEvents(withoutSources, event(&pod, "pods"))
+	assert.Empty(t, withoutSources.sources)
+	buf.Reset()
+	assert.Nil(t, withoutSources.WriteSnapshot(&buf))
+	assert.NotContains(t, buf.String(), `"source"`)
+}
+
+func TestReconcilerCurrentState(t *testing.T) {
+	testReconciler := initTestReconciler()
+	createAndReconcileNodeEvents(testReconciler, "testowners", "pods")
+
+	nodes := testReconciler.CurrentNodes()
+	assert.Equal(t, []string{"local-cluster/1234", "local-cluster/5678"}, []string{nodes[0].UID, nodes[1].UID})
+	edges := testReconciler.CurrentEdges()
+	assert.Len(t, edges, 1)
+	assert.Equal(t, "local-cluster/5678", edges[0].SourceUID)
+	assert.NotEmpty(t, testReconciler.diffNodes, "Expected the changes to be kept for the next diff.")
+}
+
+// The first diff after a restore waits for the events still in the transformer.
+func TestReconcilerWaitForTransformer(t *testing.T) {
+	config.InitConfig()
+	pod := v1.Pod{TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "a", UID: "pod1"}}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&pod)
+	assert.Nil(t, err)
+	event := &tr.Event{Time: time.Now().Unix(), Operation: tr.Create,
+		Resource: &unstructured.Unstructured{Object: content}, ResourceString: "pods"}
+	nes, errs := tr.TransformEvents([]*tr.Event{event})
+	assert.Nil(t, errs[0])
+
+	testReconciler := initTestReconciler()
+	testReconciler.Restore(State{Nodes: []tr.Node{nes[0].Node}})
+	input := make(chan *tr.Event)
+	transformer := tr.NewTransformer(input, make(chan tr.NodeEvent), 2)
+	go func() {
+		for ne := range transformer.Output {
+			time.Sleep(50 * time.Millisecond) // The reconciler is slow to get the node events.
+			testReconciler.Input <- ne
+		}
+	}()
+	go func() {
+		for {
+			testReconciler.reconcileNode()
+		}
+	}()
+
+	input <- event // Still in the transformer
+	testReconciler.WaitForTransformer(transformer)
+	diff := testReconciler.Diff()
+	assert.Empty(t, diff.DeleteNodes, "Expected the restored node not to be deleted.")
+	assert.Empty(t, diff.AddNodes)
+	assert.Equal(t, 1, diff.TotalNodes)
+
+	// Without a restore, it doesn't wait.
+	initTestReconciler().WaitForTransformer(tr.Transformer{})
+}
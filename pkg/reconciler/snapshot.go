@@ -0,0 +1,389 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package reconciler
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/stolostron/search-collector/pkg/config"
+	tr "github.com/stolostron/search-collector/pkg/transforms"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/klog/v2"
+)
+
+// State the aggregator has after it applied the last payload built from the reconciler.
+type State struct {
+	Nodes []tr.Node `json:"nodes"`
+	Edges []tr.Edge `json:"edges"`
+}
+
+// Returns the state sent with the last diff or complete payload, sorted like the payloads.
+func (r *Reconciler) SentState() State {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.sentState()
+}
+
+// NOT THREADSAFE, locking left up to the caller.
+func (v *view) sentState() State {
+	state := State{
+		Nodes: make([]tr.Node, 0, len(v.previousNodes)),
+		Edges: []tr.Edge{},
+	}
+	for _, n := range v.previousNodes {
+		state.Nodes = append(state.Nodes, n)
+	}
+	for _, destMap := range v.previousEdges {
+		for _, e := range destMap {
+			state.Edges = append(state.Edges, e)
+		}
+	}
+	sortNodes(state.Nodes)
+	sortEdges(state.Edges)
+	return state
+}
+
+// Seeds the previous state with a state saved before a restart, so the next diff is calculated against
+// what the aggregator already has. Must be called before the informers send the first events.
+// Restored nodes that don't show up again before the next diff are deleted with that diff.
+func (r *Reconciler) Restore(state State) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.restore(state)
+	r.totalEdges = len(state.Edges)
+	klog.Infof("Reconciler restored %d nodes and %d edges.", len(state.Nodes), len(state.Edges))
+}
+
+// NOT THREADSAFE, locking left up to the caller.
+func (v *view) restore(state State) {
+	v.previousNodes = make(map[string]tr.Node, len(state.Nodes))
+	v.restored = make(map[string]struct{}, len(state.Nodes))
+	for _, n := range state.Nodes {
+		v.previousNodes[n.UID] = n
+		v.restored[n.UID] = struct{}{}
+	}
+	v.previousEdges = make(map[string]map[string]tr.Edge)
+	for _, e := range state.Edges {
+		if _, ok := v.previousEdges[e.SourceUID]; !ok {
+			v.previousEdges[e.SourceUID] = make(map[string]tr.Edge)
+		}
+		v.previousEdges[e.SourceUID][e.DestUID] = e
+	}
+	v.rehashNodes(v.previousNodes)
+	v.rehashEdges(v.previousEdges)
+	v.allEdgesDirty = true
+}
+
+// Restored properties went through JSON, so their types may differ from the ones built by the transforms.
+// Compares the JSON encoding instead.
+func sameProperties(a, b map[string]interface{}) bool {
+	aJSON, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bJSON, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return string(aJSON) == string(bJSON)
+}
+
+// Version of the format written by WriteSnapshot. Increase it with changes that older versions can't read.
+const snapshotVersion = 1
+
+// Name of the snapshot file in STATE_DIR, see SaveSnapshot.
+const snapshotFileName = "snapshot.json"
+
+// Current nodes of the reconciler and the edges sent with the last diff, see WriteSnapshot.
+type snapshot struct {
+	Version     int            `json:"version"`
+	ClusterName string         `json:"clusterName"`
+	Nodes       []snapshotNode `json:"nodes"`
+	Edges       []tr.Edge      `json:"edges"`
+}
+
+// Node with the resource it was built from, to build its edges after reading the snapshot.
+type snapshotNode struct {
+	tr.Node
+	Source *snapshotSource `json:"source,omitempty"`
+}
+
+// What's needed to build a node and its edges again. The reconciler keeps it for each node with FEATURE_SNAPSHOT.
+// The resource is kept encoded and without its managed fields, which takes a fraction of the memory of the
+// decoded resource.
+type snapshotSource struct {
+	ResourceString           string               `json:"resourceString"`
+	AdditionalPrinterColumns []tr.ExtractProperty `json:"additionalPrinterColumns,omitempty"`
+	Resource                 json.RawMessage      `json:"resource"`
+}
+
+// Returns the source of the node built from the event, or nil if the event has no resource.
+func newSnapshotSource(event *tr.Event) *snapshotSource {
+	if event == nil || event.Resource == nil {
+		return nil
+	}
+	// Shallow copies, the resource is shared with the informer.
+	object := maps.Clone(event.Resource.Object)
+	if metadata, ok := object["metadata"].(map[string]interface{}); ok {
+		metadata = maps.Clone(metadata)
+		delete(metadata, "managedFields")
+		object["metadata"] = metadata
+	}
+	resource, err := json.Marshal(object)
+	if err != nil {
+		klog.V(2).Infof("Not keeping the resource of %s for snapshots. %v", event.Resource.GetUID(), err)
+		return nil
+	}
+	return &snapshotSource{
+		ResourceString:           event.ResourceString,
+		AdditionalPrinterColumns: event.AdditionalPrinterColumns,
+		Resource:                 resource,
+	}
+}
+
+// WriteSnapshot writes the current nodes, with the resources they were built from, and the edges sent with the
+// last diff. The snapshot can be read with ReadSnapshot, to restart with the same state or to debug it.
+// The resources are only kept with FEATURE_SNAPSHOT, without it the nodes are read back without edges.
+// The nodes and the resources aren't changed once they're built, so they're encoded without holding the lock and
+// a slow writer doesn't block the reconciler.
+func (r *Reconciler) WriteSnapshot(w io.Writer) error {
+	s := r.snapshot()
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		return fmt.Errorf("could not write the reconciler snapshot: %w", err)
+	}
+	klog.V(2).Infof("Reconciler wrote a snapshot of %d nodes and %d edges.", len(s.Nodes), len(s.Edges))
+	return nil
+}
+
+func (r *Reconciler) snapshot() snapshot {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	s := snapshot{
+		Version:     snapshotVersion,
+		ClusterName: config.Cfg.ClusterName,
+		Nodes:       make([]snapshotNode, 0, len(r.currentNodes)),
+		Edges:       r.sentState().Edges,
+	}
+	for uid, n := range r.currentNodes {
+		s.Nodes = append(s.Nodes, snapshotNode{Node: n, Source: r.sources[uid]})
+	}
+	sort.Slice(s.Nodes, func(i, j int) bool { return s.Nodes[i].UID < s.Nodes[j].UID })
+	return s
+}
+
+// ReadSnapshot replaces the state of the reconciler with a snapshot written by WriteSnapshot. The nodes are
+// transformed again from their resources to build their edge functions. The snapshot nodes and edges become
+// the state sent with the last diff, so the next diff only has the changes after the snapshot.
+// Must be called before the reconciler receives the first events, it returns an error after.
+func (r *Reconciler) ReadSnapshot(rd io.Reader) error {
+	return r.readSnapshot(rd, true)
+}
+
+// Reads the snapshot as the current nodes, and as the state sent with the last diff when asSent is true.
+func (r *Reconciler) readSnapshot(rd io.Reader, asSent bool) error {
+	var s snapshot
+	if err := json.NewDecoder(rd).Decode(&s); err != nil {
+		return fmt.Errorf("could not read the reconciler snapshot: %w", err)
+	}
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("unsupported reconciler snapshot version %d, expected %d", s.Version, snapshotVersion)
+	}
+	if s.ClusterName != config.Cfg.ClusterName {
+		klog.Warningf("Reading a snapshot of cluster %s in cluster %s, the nodes won't have edges.",
+			s.ClusterName, config.Cfg.ClusterName)
+	}
+
+	nodes := make([]tr.Node, 0, len(s.Nodes))
+	currentNodes := make(map[string]tr.Node, len(s.Nodes))
+	edgeFuncs := make(map[string]func(ns tr.NodeStore) []tr.Edge, len(s.Nodes))
+	sources := make(map[string]*snapshotSource, len(s.Nodes))
+	for i, ne := range snapshotNodeEvents(s.Nodes) {
+		nodes = append(nodes, ne.Node)
+		currentNodes[ne.UID] = ne.Node
+		edgeFuncs[ne.UID] = ne.ComputeEdges
+		if ne.Source != nil {
+			sources[ne.UID] = s.Nodes[i].Source
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// Replacing the nodes would leave the order of their last events and the tombstones of the deleted ones
+	// out of date.
+	if len(r.lastEvents) > 0 || r.purgedNodes.order.Len() > 0 {
+		return errors.New("the reconciler snapshot can't be read after the reconciler received events")
+	}
+	r.currentNodes = currentNodes
+	r.edgeFuncs = edgeFuncs
+	r.sources = make(map[string]*snapshotSource)
+	if config.Cfg.FeatureSnapshot {
+		r.sources = sources
+	}
+	r.snapshotNodes = make(map[string]struct{}, len(currentNodes))
+	for uid := range currentNodes {
+		r.snapshotNodes[uid] = struct{}{}
+	}
+	r.diffNodes = make(map[string]tr.NodeEvent)
+	r.allDirty = true
+	r.edges = edgeCache{}
+	for _, c := range r.cursors {
+		c.allDirty = true
+	}
+	if asSent {
+		r.restore(State{Nodes: nodes, Edges: s.Edges})
+		r.restored = nil // Unlike a restored state, the snapshot nodes are current and kept until deleted.
+		r.totalEdges = len(s.Edges)
+	}
+	klog.Infof("Reconciler read a snapshot of %d nodes and %d edges.", len(s.Nodes), len(s.Edges))
+	return nil
+}
+
+// SaveSnapshot writes the snapshot to snapshot.json in the directory. Writes to a temporary file and renames it,
+// so a crash never leaves a partial snapshot.
+func (r *Reconciler) SaveSnapshot(dir string) error {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, snapshotFileName+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }() // No-op after the rename.
+
+	buffered := bufio.NewWriter(tmp)
+	err = r.WriteSnapshot(buffered)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, snapshotFileName))
+}
+
+// LoadSnapshot reads the snapshot.json of the directory for a warm restart. Unlike ReadSnapshot, it only replaces
+// the current nodes. The state the aggregator acknowledged is only restored from the state saved by each sender,
+// see Restore, so the order of the two doesn't matter. The informers send all the resources again, call
+// DropUnseenSnapshotNodes once they did. Returns an error wrapping os.ErrNotExist if there's no snapshot.
+func (r *Reconciler) LoadSnapshot(dir string) error {
+	f, err := os.Open(filepath.Join(dir, snapshotFileName))
+	if err != nil {
+		return err
+	}
+	defer f.Close() // #nosec G307
+	return r.readSnapshot(bufio.NewReader(f), false)
+}
+
+// DropUnseenSnapshotNodes deletes the snapshot nodes that the informers didn't send again, their resources were
+// deleted while the collector was down. Call it once the informers listed all the resources and the reconciler
+// got their node events, for example from the callback of a transformer barrier.
+func (r *Reconciler) DropUnseenSnapshotNodes() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for uid := range r.snapshotNodes {
+		node := r.currentNodes[uid]
+		r.removeNode(uid)
+		if _, inPrevious := r.previousNodes[uid]; inPrevious {
+			delete(r.restored, uid) // Deleted with the diff below, instead of as a restored node.
+			r.diffNodes[uid] = tr.NodeEvent{Node: node, Operation: tr.Delete}
+		}
+	}
+	if len(r.snapshotNodes) > 0 {
+		klog.Infof("Reconciler dropped %d snapshot nodes deleted while the collector was down.", len(r.snapshotNodes))
+	}
+	r.snapshotNodes = nil
+}
+
+// WaitForTransformer returns once the reconciler got the node events of all the events sent to the transformer
+// so far, then drops the snapshot nodes the informers didn't send again. Only waits after a restore or a snapshot:
+// a restored node the reconciler didn't get yet would be deleted with the first diff and added again after.
+func (r *Reconciler) WaitForTransformer(t tr.Transformer) {
+	if !r.restoredOrLoaded() {
+		return
+	}
+	done := make(chan struct{})
+	t.Barrier(func() {
+		r.DropUnseenSnapshotNodes()
+		close(done)
+	})
+	<-done
+}
+
+// Returns whether any view was restored and not diffed since, or a snapshot was loaded.
+func (r *Reconciler) restoredOrLoaded() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.snapshotNodes != nil {
+		return true
+	}
+	for _, v := range r.views() {
+		if v.restored != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Builds the nodes again from their resources. Without the resource, or when it can't be built again with the
+// same UID, a node is kept as it was written without edges.
+func snapshotNodeEvents(snapshotNodes []snapshotNode) []tr.NodeEvent {
+	nes := make([]tr.NodeEvent, len(snapshotNodes))
+	events := []*tr.Event{}
+	indexes := []int{} // Index of the snapshot node of each event.
+	for i, sn := range snapshotNodes {
+		nes[i] = tr.NodeEvent{
+			Node:         sn.Node,
+			ComputeEdges: func(ns tr.NodeStore) []tr.Edge { return []tr.Edge{} },
+			Operation:    tr.Create,
+		}
+		if sn.Source == nil || len(sn.Source.Resource) == 0 {
+			continue
+		}
+		resource := &unstructured.Unstructured{}
+		if err := resource.UnmarshalJSON(sn.Source.Resource); err != nil {
+			klog.Warningf("Keeping snapshot node %s without edges. %v", sn.UID, err)
+			continue
+		}
+		events = append(events, &tr.Event{
+			Operation:                tr.Create,
+			Resource:                 resource,
+			ResourceString:           sn.Source.ResourceString,
+			AdditionalPrinterColumns: sn.Source.AdditionalPrinterColumns,
+		})
+		indexes = append(indexes, i)
+	}
+
+	built, errs := tr.TransformEvents(events)
+	for j, i := range indexes {
+		uid := snapshotNodes[i].UID
+		if errs[j] != nil {
+			klog.Warningf("Keeping snapshot node %s without edges. %v", uid, errs[j])
+			continue
+		}
+		if built[j].UID != uid {
+			klog.V(2).Infof("Keeping snapshot node %s without edges, its resource builds node %s.", uid, built[j].UID)
+			continue
+		}
+		nes[i] = built[j]
+	}
+	return nes
+}
@@ -0,0 +1,88 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package reconciler
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/stolostron/search-collector/pkg/config"
+	"github.com/stolostron/search-collector/pkg/metrics"
+	tr "github.com/stolostron/search-collector/pkg/transforms"
+)
+
+// A deleted node, kept to ignore add and update events that arrive after the delete event.
+type tombstone struct {
+	uid       string
+	order     eventOrder // Of the delete event
+	deletedAt time.Time
+}
+
+// Returns true if the node event didn't happen after the deletion.
+func (t *tombstone) newerThan(ne tr.NodeEvent) bool {
+	return !t.order.before(orderOf(ne))
+}
+
+// Tombstones of the deleted nodes, keyed by UID. They are forgotten after a TTL, or the oldest first when
+// there are more than the max entries.
+// NOT THREADSAFE, locking left up to the reconciler.
+type tombstones struct {
+	ttl        time.Duration // 0 keeps the tombstones until evicted
+	maxEntries int
+	byUID      map[string]*list.Element
+	order      *list.List // Oldest first
+	now        func() time.Time
+}
+
+func newTombstones() *tombstones {
+	return &tombstones{
+		ttl:        time.Duration(config.Cfg.TombstoneTTLMS) * time.Millisecond,
+		maxEntries: config.Cfg.TombstoneMaxEntries,
+		byUID:      map[string]*list.Element{},
+		order:      list.New(),
+		now:        time.Now,
+	}
+}
+
+// Adds the tombstone of the deleted node, or replaces the one it already has.
+func (ts *tombstones) add(ne tr.NodeEvent) {
+	ts.expire()
+	if e, ok := ts.byUID[ne.UID]; ok {
+		ts.order.Remove(e)
+	}
+	ts.byUID[ne.UID] = ts.order.PushBack(&tombstone{
+		uid:       ne.UID,
+		order:     orderOf(ne),
+		deletedAt: ts.now(),
+	})
+	for ts.maxEntries > 0 && ts.order.Len() > ts.maxEntries {
+		ts.remove(ts.order.Front())
+		metrics.TombstoneEvictionsTotal.WithLabelValues("capacity").Inc()
+	}
+}
+
+// Returns the tombstone of the node, if it was deleted and not forgotten yet.
+func (ts *tombstones) get(uid string) (*tombstone, bool) {
+	ts.expire()
+	e, ok := ts.byUID[uid]
+	if !ok {
+		return nil, false
+	}
+	return e.Value.(*tombstone), true
+}
+
+// Forgets the tombstones older than the TTL.
+func (ts *tombstones) expire() {
+	if ts.ttl <= 0 {
+		return
+	}
+	for e := ts.order.Front(); e != nil && ts.now().Sub(e.Value.(*tombstone).deletedAt) >= ts.ttl; e = ts.order.Front() {
+		ts.remove(e)
+		metrics.TombstoneEvictionsTotal.WithLabelValues("expired").Inc()
+	}
+}
+
+func (ts *tombstones) remove(e *list.Element) {
+	delete(ts.byUID, e.Value.(*tombstone).uid)
+	ts.order.Remove(e)
+}
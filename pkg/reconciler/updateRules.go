@@ -0,0 +1,80 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package reconciler
+
+import (
+	"reflect"
+
+	tr "github.com/stolostron/search-collector/pkg/transforms"
+)
+
+// Reasons an update isn't sent to the indexer, counted in metrics.UpdatesSuppressedTotal.
+const (
+	suppressedUnchanged         = "unchanged"
+	suppressedIgnoredProperties = "ignored_properties"
+	suppressedOlderRevision     = "older_revision"
+)
+
+// Returns the update rule for the kind and apigroup of the node.
+func updateRuleOf(n tr.Node) tr.UpdateRule {
+	group, _ := n.Properties["apigroup"].(string)
+	kind, _ := n.Properties["kind"].(string)
+	return tr.GetUpdateRule(group, kind)
+}
+
+// Returns the reason to not send the update of the previous node, or "" to send it.
+// We only care about the Properties, the Metadata is only used to compute the edges and not sent with the
+// node data, unless the rule forces the update on changes to some metadata keys.
+// Changes to ignored properties of restored nodes are sent, since the restored node is replaced when skipped.
+func suppressedUpdate(rule tr.UpdateRule, ne tr.NodeEvent, previous tr.Node, restored bool) string {
+	for _, key := range rule.ForceMetadata {
+		if key == "*" || !reflect.DeepEqual(ne.Metadata[key], previous.Metadata[key]) {
+			return ""
+		}
+	}
+	if reflect.DeepEqual(ne.Properties, previous.Properties) ||
+		(restored && sameProperties(ne.Properties, previous.Properties)) {
+		return suppressedUnchanged
+	}
+	if !restored && len(rule.IgnoreProperties) > 0 && reflect.DeepEqual(
+		withoutProperties(ne.Properties, rule.IgnoreProperties),
+		withoutProperties(previous.Properties, rule.IgnoreProperties)) {
+		return suppressedIgnoredProperties
+	}
+	return ""
+}
+
+// Returns a copy of the properties without the keys.
+func withoutProperties(properties map[string]interface{}, keys []string) map[string]interface{} {
+	result := make(map[string]interface{}, len(properties))
+	for key, value := range properties {
+		result[key] = value
+	}
+	for _, key := range keys {
+		delete(result, key)
+	}
+	return result
+}
+
+// Returns true if the rule has a revision property, and the node has a lower revision than the other node.
+func olderRevision(rule tr.UpdateRule, n, other tr.Node) bool {
+	if rule.Revision == "" {
+		return false
+	}
+	revision, ok := revisionNumber(n.Properties[rule.Revision])
+	otherRevision, otherOk := revisionNumber(other.Properties[rule.Revision])
+	return ok && otherOk && revision < otherRevision
+}
+
+// Revisions are int64 from the transforms, or float64 when restored from JSON.
+func revisionNumber(value interface{}) (float64, bool) {
+	switch revision := value.(type) {
+	case int64:
+		return float64(revision), true
+	case int:
+		return float64(revision), true
+	case float64:
+		return revision, true
+	}
+	return 0, false
+}
@@ -0,0 +1,100 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package send
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/stolostron/search-collector/pkg/config"
+)
+
+// Header the aggregator can set on any response, with the earliest time the collector should send again.
+// Accepts the same formats as Retry-After: delay in seconds or HTTP-date.
+const nextSyncHeader = "X-Next-Sync-After"
+
+// Returned when the indexer is busy. Carries the wait requested by the indexer, if any.
+type busyError struct {
+	retryAfter time.Duration // Zero if the indexer didn't ask for a specific wait.
+}
+
+func (e busyError) Error() string {
+	return "indexer busy"
+}
+
+// Returns true if the error is a busy response from the indexer.
+func isBusy(err error) bool {
+	var busy busyError
+	return errors.As(err, &busy)
+}
+
+// Returns the time to wait before retrying after the error. Honors the wait requested by the indexer,
+// plus jitter so the collectors across the fleet don't come back at once. Otherwise uses our own backoff.
+func retryWait(err error, retry int) time.Duration {
+	var busy busyError
+	if errors.As(err, &busy) && busy.retryAfter > 0 {
+		return capWait(busy.retryAfter + time.Duration(addJitter())*time.Millisecond)
+	}
+	return sendInterval(retry)
+}
+
+// Caps the wait requested by the server at MAX_BACKOFF_MS.
+func capWait(wait time.Duration) time.Duration {
+	if maxWait := time.Duration(config.Cfg.MaxBackoffMS) * time.Millisecond; wait > maxWait {
+		return maxWait
+	}
+	return wait
+}
+
+// Waits for the duration or until the context is done. Returns the context error if it was done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Parses a Retry-After value, either a delay in seconds or an HTTP-date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if date.Before(now) {
+			return 0, true
+		}
+		return date.Sub(now), true
+	}
+	klog.V(2).Infof("Ignoring invalid Retry-After value [%s].", value)
+	return 0, false
+}
+
+// Records the earliest time to send again, when the aggregator sets the hint header.
+func (s *Sender) recordNextSyncHint(header http.Header) {
+	wait, ok := parseRetryAfter(header.Get(nextSyncHeader), time.Now())
+	if !ok {
+		return
+	}
+	wait = capWait(wait)
+	if notBefore := time.Now().Add(wait); notBefore.After(s.notBefore) {
+		klog.V(2).Infof("Aggregator asked to wait %s before the next sync.", wait)
+		s.notBefore = notBefore
+	}
+}
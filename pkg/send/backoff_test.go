@@ -0,0 +1,109 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package send
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stolostron/search-collector/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	wait, ok := parseRetryAfter("120", now)
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Minute, wait)
+
+	wait, ok = parseRetryAfter(now.Add(30*time.Second).Format(http.TimeFormat), now)
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, wait)
+
+	wait, ok = parseRetryAfter(now.Add(-time.Hour).Format(http.TimeFormat), now)
+	assert.True(t, ok, "Expected a date in the past to allow sending right away.")
+	assert.Equal(t, time.Duration(0), wait)
+
+	_, ok = parseRetryAfter("", now)
+	assert.False(t, ok)
+	_, ok = parseRetryAfter("-1", now)
+	assert.False(t, ok)
+	_, ok = parseRetryAfter("soon", now)
+	assert.False(t, ok)
+}
+
+func Test_retryWait(t *testing.T) {
+	defer func(jitter, backoff int) {
+		config.Cfg.RetryJitterMS, config.Cfg.MaxBackoffMS = jitter, backoff
+	}(config.Cfg.RetryJitterMS, config.Cfg.MaxBackoffMS)
+	config.Cfg.RetryJitterMS = 0
+	config.Cfg.MaxBackoffMS = 60000
+
+	assert.Equal(t, 7*time.Second, retryWait(busyError{retryAfter: 7 * time.Second}, 1))
+	assert.Equal(t, time.Minute, retryWait(busyError{retryAfter: time.Hour}, 1), "Expected the wait to be capped.")
+	assert.Equal(t, sendInterval(3), retryWait(busyError{}, 3))
+	assert.Equal(t, sendInterval(3), retryWait(errors.New("other"), 3))
+}
+
+func TestSenderRetryAfter(t *testing.T) {
+	defer func(backoff int) { config.Cfg.MaxBackoffMS = backoff }(config.Cfg.MaxBackoffMS)
+	config.Cfg.MaxBackoffMS = 600000
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.Header().Set(nextSyncHeader, "90")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	s := Sender{
+		httpClient:    *ts.Client(),
+		aggregatorURL: ts.URL,
+	}
+
+	_, err := s.post(context.Background(), Payload{})
+
+	assert.True(t, isBusy(err), "Expected a 503 with Retry-After to be handled as busy.")
+	assert.Equal(t, busyError{retryAfter: 30 * time.Second}, err)
+	assert.WithinDuration(t, time.Now().Add(90*time.Second), s.notBefore, 5*time.Second,
+		"Expected the hint for the next sync to be recorded.")
+}
+
+func Test_sleep(t *testing.T) {
+	assert.Nil(t, sleep(context.Background(), time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	assert.Equal(t, context.Canceled, sleep(ctx, time.Hour))
+	assert.Less(t, time.Since(start), time.Second, "Expected the wait to end when the context is done.")
+}
+
+func TestSenderRetryCanceled(t *testing.T) {
+	defer func(backoff int) { config.Cfg.MaxBackoffMS = backoff }(config.Cfg.MaxBackoffMS)
+	config.Cfg.MaxBackoffMS = 600000
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "300")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+
+	s := Sender{
+		httpClient:    *ts.Client(),
+		aggregatorURL: ts.URL,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := s.sendWithRetry(ctx, Payload{}, 0, 0)
+
+	assert.True(t, isBusy(err))
+	assert.Less(t, time.Since(start), 5*time.Second, "Expected the busy wait to end on shutdown.")
+}
@@ -0,0 +1,156 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package send
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/stolostron/search-collector/pkg/config"
+)
+
+// Optional protocol features. Each one is used only if the aggregator lists it in its capabilities.
+const (
+	featureGzip          = encodingGzip    // Request bodies compressed with gzip
+	featureZstd          = encodingZstd    // Request bodies compressed with zstd
+	featureChunkedResync = "chunkedResync" // Complete state sent in a resync session, see ResyncChunk
+	featureNodePatch     = "nodePatch"     // Changed properties of updated nodes, see tr.NodePatch
+)
+
+// Features this collector can use.
+var collectorFeatures = []string{featureGzip, featureZstd, featureChunkedResync, featureNodePatch}
+
+// Features without a setting to turn them on. They are used only when the aggregator lists them.
+var negotiatedFeatures = map[string]bool{featureNodePatch: true}
+
+// Response of the aggregator's capabilities route.
+type Capabilities struct {
+	Version  string   `json:"version,omitempty"` // Version of the aggregator
+	Features []string `json:"features"`          // Optional protocol features the aggregator supports
+}
+
+// Features both the collector and the aggregator support, refreshed after a TTL.
+type featureSet struct {
+	supported map[string]bool // Features in both the collector and the aggregator capabilities.
+	disabled  map[string]bool // Configured features the aggregator doesn't support, logged once.
+	fetchedAt time.Time       // Zero until fetched, and after a config reload.
+	ttl       time.Duration
+}
+
+func newFeatureSet() *featureSet {
+	return &featureSet{
+		supported: map[string]bool{},
+		disabled:  map[string]bool{},
+		ttl:       time.Duration(config.Cfg.CapabilitiesTTLMS) * time.Millisecond,
+	}
+}
+
+// Returns true if the feature can be used with the aggregator. When the capabilities aren't negotiated,
+// the configured features are used as they are.
+func (s *Sender) supports(feature string) bool {
+	if s.features == nil {
+		return !negotiatedFeatures[feature]
+	}
+	return s.features.supported[feature]
+}
+
+// Fetches the capabilities of the aggregator if they weren't fetched yet or the TTL expired.
+// An aggregator without the capabilities route gets the plain JSON protocol. If the request fails, the
+// previous capabilities are kept and the request is retried with the next sync.
+func (s *Sender) refreshCapabilities(ctx context.Context) {
+	caps := s.features
+	if caps == nil || (!caps.fetchedAt.IsZero() && time.Since(caps.fetchedAt) < caps.ttl) {
+		return
+	}
+	theirs, err := s.getCapabilities(ctx)
+	if err != nil {
+		klog.Warningf("Error getting the capabilities of aggregator %s. Using features: %v. Error: %s",
+			s.target, featureList(caps.supported), err)
+		return
+	}
+	features := map[string]bool{}
+	for _, feature := range theirs.Features {
+		for _, ours := range collectorFeatures {
+			if feature == ours {
+				features[feature] = true
+			}
+		}
+	}
+	caps.supported = features
+	caps.fetchedAt = time.Now()
+	klog.V(2).Infof("Aggregator %s version [%s] supports features: %v", s.target, theirs.Version,
+		featureList(features))
+
+	// Warn once for each configured feature that is turned off, and again if it's turned off after it
+	// was supported.
+	for _, feature := range s.configuredFeatures() {
+		if features[feature] {
+			delete(caps.disabled, feature)
+		} else if !caps.disabled[feature] {
+			caps.disabled[feature] = true
+			klog.Warningf("Aggregator %s doesn't support the configured feature %s. Turning it off.",
+				s.target, feature)
+		}
+	}
+}
+
+// Returns the features turned on by the config. Features without a setting aren't listed.
+func (s *Sender) configuredFeatures() []string {
+	configured := []string{}
+	if isCompressed(s.contentEncoding) {
+		configured = append(configured, s.contentEncoding)
+	}
+	if config.Cfg.ResyncChunkSize > 0 {
+		configured = append(configured, featureChunkedResync)
+	}
+	return configured
+}
+
+// GETs the capabilities of the aggregator. Aggregators older than the capabilities route respond 404,
+// which means no optional features.
+func (s *Sender) getCapabilities(ctx context.Context) (Capabilities, error) {
+	path := strings.TrimSuffix(s.aggregatorSyncPath, "/sync") + "/capabilities"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.aggregatorURL+path, nil)
+	if err != nil {
+		return Capabilities{}, err
+	}
+	req.Header.Set("X-Collector-Version", config.COLLECTOR_API_VERSION)
+	req.Header.Set("X-Collector-Features", strings.Join(collectorFeatures, ","))
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return Capabilities{}, err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		theirs := Capabilities{}
+		err = json.NewDecoder(resp.Body).Decode(&theirs)
+		return theirs, err
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return Capabilities{}, nil
+	default:
+		return Capabilities{}, fmt.Errorf("GET %s responded with StatusCode: %d", path, resp.StatusCode)
+	}
+}
+
+// Lists the features in the collector's order, for the logs.
+func featureList(features map[string]bool) []string {
+	list := []string{}
+	for _, feature := range collectorFeatures {
+		if features[feature] {
+			list = append(list, feature)
+		}
+	}
+	return list
+}
@@ -0,0 +1,178 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package send
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stolostron/search-collector/pkg/config"
+	"github.com/stolostron/search-collector/pkg/reconciler"
+	tr "github.com/stolostron/search-collector/pkg/transforms"
+	"github.com/stretchr/testify/assert"
+)
+
+// Aggregator stand-in. Responds to the capabilities route with the features, or 404 when nil, and records
+// the sync requests.
+type testAggregator struct {
+	*httptest.Server
+	features          []string
+	capabilityGets    int
+	contentEncodings  []string
+	resyncPhases      []string
+	capabilityHeaders http.Header
+}
+
+func newTestAggregator(t *testing.T, features []string) *testAggregator {
+	ta := &testAggregator{features: features}
+	ta.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/capabilities") {
+			ta.capabilityGets++
+			ta.capabilityHeaders = r.Header
+			if ta.features == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(Capabilities{Version: "2.16.0", Features: ta.features})
+			return
+		}
+		ta.contentEncodings = append(ta.contentEncodings, r.Header.Get("Content-Encoding"))
+		payload := Payload{}
+		if r.Header.Get("Content-Encoding") == "" {
+			_ = json.NewDecoder(r.Body).Decode(&payload)
+		}
+		if payload.Resync != nil {
+			ta.resyncPhases = append(ta.resyncPhases, payload.Resync.Phase)
+		}
+		_ = json.NewEncoder(w).Encode(SyncResponse{TotalResources: len(payload.AddResources)})
+	}))
+	t.Cleanup(ta.Close)
+	return ta
+}
+
+func newNegotiatingSender(t *testing.T, ta *testAggregator, encoding string) *Sender {
+	defer func(ttl int) { config.Cfg.CapabilitiesTTLMS = ttl }(config.Cfg.CapabilitiesTTLMS)
+	config.Cfg.CapabilitiesTTLMS = config.DEFAULT_CAPABILITIES_TTL_MS
+	return &Sender{
+		httpClient:         *ta.Client(),
+		aggregatorURL:      ta.URL,
+		aggregatorSyncPath: "/aggregator/clusters/cluster1/sync",
+		contentEncoding:    encoding,
+		features:           newFeatureSet(),
+	}
+}
+
+func TestSenderCapabilities(t *testing.T) {
+	ta := newTestAggregator(t, []string{featureGzip, "somethingNew"})
+	s := newNegotiatingSender(t, ta, encodingGzip)
+
+	s.refreshCapabilities(context.Background())
+
+	assert.Equal(t, config.COLLECTOR_API_VERSION, ta.capabilityHeaders.Get("X-Collector-Version"))
+	assert.True(t, s.supports(featureGzip))
+	assert.False(t, s.supports(featureZstd))
+	assert.False(t, s.supports("somethingNew"), "Expected only the features of both sides.")
+
+	assert.Nil(t, s.send(context.Background(), Payload{}, 0, 0))
+	s.contentEncoding = encodingZstd
+	assert.Nil(t, s.send(context.Background(), Payload{}, 0, 0))
+	assert.Equal(t, []string{encodingGzip, ""}, ta.contentEncodings,
+		"Expected zstd not to be used, the aggregator doesn't support it.")
+}
+
+func TestSenderCapabilitiesLegacyAggregator(t *testing.T) {
+	defer func(size int) { config.Cfg.ResyncChunkSize = size }(config.Cfg.ResyncChunkSize)
+	config.Cfg.ResyncChunkSize = 1
+	ta := newTestAggregator(t, nil)
+	s := newNegotiatingSender(t, ta, encodingZstd)
+
+	s.refreshCapabilities(context.Background())
+	payload := Payload{ClearAll: true, AddResources: []tr.Node{{UID: "n1"}, {UID: "n2"}}}
+	err := s.sendComplete(context.Background(), payload, 2, 0)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{""}, ta.contentEncodings, "Expected a single plain JSON request.")
+	assert.Empty(t, ta.resyncPhases)
+}
+
+func TestSenderCapabilitiesDisabled(t *testing.T) {
+	defer func(size int) { config.Cfg.ResyncChunkSize = size }(config.Cfg.ResyncChunkSize)
+	config.Cfg.ResyncChunkSize = 100
+	ta := newTestAggregator(t, []string{featureChunkedResync})
+	s := newNegotiatingSender(t, ta, encodingZstd)
+
+	s.refreshCapabilities(context.Background())
+	assert.Equal(t, map[string]bool{featureZstd: true}, s.features.disabled,
+		"Expected the configured zstd to be reported as turned off.")
+
+	s.features.fetchedAt = time.Now().Add(-s.features.ttl)
+	ta.features = []string{featureZstd}
+	s.refreshCapabilities(context.Background())
+	assert.Equal(t, map[string]bool{featureChunkedResync: true}, s.features.disabled,
+		"Expected zstd to be cleared once supported, so it is reported again if it is turned off later.")
+}
+
+func TestSenderCapabilitiesTTL(t *testing.T) {
+	ta := newTestAggregator(t, []string{featureChunkedResync})
+	s := newNegotiatingSender(t, ta, encodingNone)
+
+	s.refreshCapabilities(context.Background())
+	s.refreshCapabilities(context.Background())
+	assert.Equal(t, 1, ta.capabilityGets, "Expected the capabilities to be cached.")
+
+	// A failed request keeps the previous capabilities and is retried with the next sync.
+	expired := time.Now().Add(-s.features.ttl)
+	s.features.fetchedAt = expired
+	s.aggregatorURL = "https://127.0.0.1:1"
+	s.refreshCapabilities(context.Background())
+	assert.True(t, s.supports(featureChunkedResync))
+	assert.Equal(t, expired, s.features.fetchedAt)
+
+	s.aggregatorURL = ta.URL
+	ta.features = []string{}
+	s.refreshCapabilities(context.Background())
+	assert.Equal(t, 2, ta.capabilityGets)
+	assert.False(t, s.supports(featureChunkedResync))
+}
+
+func TestSenderCapabilitiesNotNegotiated(t *testing.T) {
+	s := Sender{}
+
+	s.refreshCapabilities(context.Background())
+
+	assert.True(t, s.supports(featureZstd), "Expected the configured features without negotiation.")
+}
+
+// State source returning a fixed diff.
+type fakeSource struct {
+	stateSource
+	diff reconciler.Diff
+}
+
+func (f *fakeSource) Diff() reconciler.Diff { return f.diff }
+
+func TestSenderPatchPayload(t *testing.T) {
+	patch := tr.NodePatch{UID: "uid1", Set: map[string]interface{}{"status": "Failed"}}
+	s := Sender{rec: &fakeSource{diff: reconciler.Diff{
+		UpdateNodes: []tr.Node{{UID: "uid1", Properties: map[string]interface{}{"status": "Failed"}}},
+		PatchNodes:  []tr.NodePatch{patch},
+	}}}
+
+	payload, _, _ := s.diffPayload()
+	assert.Len(t, payload.UpdatedResources, 1, "Expected whole nodes without negotiation.")
+	assert.Empty(t, payload.PatchResources)
+
+	s.features = &featureSet{supported: map[string]bool{featureNodePatch: true}}
+	payload, _, _ = s.diffPayload()
+	assert.Empty(t, payload.UpdatedResources)
+	assert.Equal(t, []tr.NodePatch{patch}, payload.PatchResources)
+
+	body := &strings.Builder{}
+	assert.Nil(t, writePayload(body, payload))
+	assert.Contains(t, body.String(), `"patchResources":[{"uid":"uid1","set":{"status":"Failed"}}]`)
+}
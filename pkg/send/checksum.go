@@ -0,0 +1,95 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package send
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"k8s.io/klog/v2"
+
+	"github.com/stolostron/search-collector/pkg/config"
+	"github.com/stolostron/search-collector/pkg/metrics"
+)
+
+// Compares the state hash reported by the aggregator with the hash of the state we sent. Matching totals
+// don't catch content drift, like a lost update balanced by a lost delete. On a mismatch, replaces only the
+// kinds that differ. Aggregators that don't report a hash are not checked.
+func (s *Sender) checkStateHash(ctx context.Context, payload Payload, r SyncResponse, expectedTotalResources, expectedTotalEdges int) error {
+	if payload.StateHash == "" || r.StateHash == "" || r.StateHash == payload.StateHash {
+		return nil
+	}
+	// The aggregator is missing what it failed to apply, we resend that with the next diff.
+	if s.retry.size() > 0 {
+		return nil
+	}
+	metrics.StateHashMismatchTotal.Inc()
+	if payload.ClearAll || payload.Resync != nil {
+		// Nothing better to send than the complete state.
+		klog.Warningf("Aggregator reported state hash %s after the complete state, expected %s.",
+			r.StateHash, payload.StateHash)
+		return nil
+	}
+	klog.Warningf("Aggregator reported state hash %s, expected %s. Reconciling the kinds that differ.",
+		r.StateHash, payload.StateHash)
+	return s.reconcileKinds(ctx, payload.StateHash, expectedTotalResources, expectedTotalEdges)
+}
+
+// Asks the aggregator for its hashes by kind, then replaces the kinds that differ.
+// Returns an error if the state still differs, so the sender falls back to the complete state.
+func (s *Sender) reconcileKinds(ctx context.Context, stateHash string, expectedTotalResources, expectedTotalEdges int) error {
+	ours := s.rec.KindHashes()
+	r, err := s.post(ctx, Payload{Version: config.COLLECTOR_API_VERSION, KindHashes: ours})
+	if err != nil {
+		return err
+	}
+	if r.KindHashes == nil {
+		return fmt.Errorf("aggregator state hash doesn't match and it didn't report the hashes by kind")
+	}
+	kinds := differentKinds(ours, r.KindHashes)
+	klog.Infof("Replacing kinds %v to reconcile the aggregator state.", kinds)
+
+	state := s.rec.KindState(kinds)
+	payload := Payload{
+		Version:      config.COLLECTOR_API_VERSION,
+		ReplaceKinds: kinds,
+		AddResources: state.Nodes,
+		AddEdges:     state.Edges,
+		StateHash:    stateHash,
+	}
+	r, err = s.post(ctx, payload)
+	if err != nil {
+		return err
+	}
+	if err = verifyTotals(r, expectedTotalResources, expectedTotalEdges); err != nil {
+		return err
+	}
+	s.retry.track(payload, r)
+	if err = s.retry.checkLimit(); err != nil {
+		return err
+	}
+	if r.StateHash != "" && r.StateHash != stateHash && s.retry.size() == 0 {
+		return fmt.Errorf("aggregator state hash %s still doesn't match %s after replacing kinds %v",
+			r.StateHash, stateHash, kinds)
+	}
+	metrics.KindsReconciledTotal.Add(float64(len(kinds)))
+	return nil
+}
+
+// Returns the kinds with different hashes, including the kinds only one side has.
+func differentKinds(ours, theirs map[string]string) []string {
+	kinds := []string{}
+	for kind, hash := range ours {
+		if theirs[kind] != hash {
+			kinds = append(kinds, kind)
+		}
+	}
+	for kind := range theirs {
+		if _, ok := ours[kind]; !ok {
+			kinds = append(kinds, kind)
+		}
+	}
+	sort.Strings(kinds)
+	return kinds
+}
@@ -0,0 +1,94 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package send
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stolostron/search-collector/pkg/reconciler"
+	tr "github.com/stolostron/search-collector/pkg/transforms"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_differentKinds(t *testing.T) {
+	ours := map[string]string{"Pod": "1", "Deployment": "2", "Service": "3"}
+	theirs := map[string]string{"Pod": "1", "Deployment": "x", "ConfigMap": "4"}
+
+	assert.Equal(t, []string{"ConfigMap", "Deployment", "Service"}, differentKinds(ours, theirs))
+}
+
+func TestSenderStateHashMismatch(t *testing.T) {
+	rec := reconciler.NewReconciler()
+	rec.Restore(reconciler.State{
+		Nodes: []tr.Node{
+			{UID: "pod1", Properties: map[string]interface{}{"kind": "Pod"}},
+			{UID: "svc1", Properties: map[string]interface{}{"kind": "Service"}},
+		},
+		Edges: []tr.Edge{{EdgeType: "usedBy", SourceUID: "svc1", DestUID: "pod1", SourceKind: "Service", DestKind: "Pod"}},
+	})
+	ours := rec.KindHashes()
+	stateHash := rec.StateHash()
+
+	received := []Payload{}
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := Payload{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, payload)
+		// Counts match, but the aggregator lost an update of the pod.
+		response := SyncResponse{TotalResources: 2, TotalEdges: 1, StateHash: "lost-update"}
+		if payload.KindHashes != nil {
+			response.KindHashes = map[string]string{"Pod": "lost-update", "Service": ours["Service"]}
+		}
+		if payload.ReplaceKinds != nil {
+			response.StateHash = payload.StateHash
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+	defer ts.Close()
+
+	s := Sender{
+		httpClient:    *ts.Client(),
+		aggregatorURL: ts.URL,
+		rec:           rec,
+	}
+
+	err := s.send(context.Background(), Payload{StateHash: stateHash}, 2, 1)
+
+	assert.Nil(t, err)
+	assert.Len(t, received, 3)
+	assert.Equal(t, ours, received[1].KindHashes, "Expected the hashes by kind to be exchanged.")
+	replace := received[2]
+	assert.Equal(t, []string{"Pod"}, replace.ReplaceKinds, "Expected only the kind that differs to be sent.")
+	assert.Equal(t, []tr.Node{{UID: "pod1", Properties: map[string]interface{}{"kind": "Pod"}}}, replace.AddResources)
+	assert.Len(t, replace.AddEdges, 1, "Expected the edges to the replaced kind.")
+	assert.Equal(t, stateHash, replace.StateHash)
+}
+
+func TestSenderStateHashStillDiffers(t *testing.T) {
+	rec := reconciler.NewReconciler()
+	rec.Restore(reconciler.State{Nodes: []tr.Node{{UID: "pod1", Properties: map[string]interface{}{"kind": "Pod"}}}})
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := SyncResponse{TotalResources: 1, StateHash: "other", KindHashes: map[string]string{}}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+	defer ts.Close()
+
+	s := Sender{
+		httpClient:    *ts.Client(),
+		aggregatorURL: ts.URL,
+		rec:           rec,
+	}
+
+	err := s.send(context.Background(), Payload{StateHash: rec.StateHash()}, 1, 0)
+
+	assert.NotNil(t, err, "Expected an error to fall back to the complete state.")
+}
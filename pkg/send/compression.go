@@ -0,0 +1,86 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package send
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"k8s.io/klog/v2"
+
+	"github.com/stolostron/search-collector/pkg/metrics"
+)
+
+// Content encodings supported for the sync request body.
+const (
+	encodingNone = "none"
+	encodingGzip = "gzip"
+	encodingZstd = "zstd"
+)
+
+// Whether the aggregator rejected the Content-Encoding of the request: with 415 Unsupported Media Type, or with
+// a 400 Bad Request that names the Content-Encoding. Other 400 responses reject the payload, not its encoding.
+func rejectsEncoding(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusUnsupportedMediaType:
+		return true
+	case http.StatusBadRequest:
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return strings.Contains(strings.ToLower(string(message)), "content-encoding")
+	}
+	return false
+}
+
+// Returns the content encoding for the configured value. Unknown values fall back to no compression.
+func contentEncodingFor(configured string) string {
+	switch strings.ToLower(strings.TrimSpace(configured)) {
+	case encodingGzip:
+		return encodingGzip
+	case encodingZstd:
+		return encodingZstd
+	case "", encodingNone, "identity":
+		return encodingNone
+	default:
+		klog.Warningf("Unsupported SYNC_COMPRESSION value [%s]. Sending uncompressed payloads.", configured)
+		return encodingNone
+	}
+}
+
+// Returns true if the encoding compresses the request body.
+func isCompressed(encoding string) bool {
+	return encoding == encodingGzip || encoding == encodingZstd
+}
+
+// Wraps w with a writer that compresses with the given encoding. Closing the returned writer flushes the
+// compressed stream, it doesn't close w.
+func newEncodingWriter(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case encodingGzip:
+		return gzip.NewWriter(w), nil
+	case encodingZstd:
+		// A single goroutine keeps the memory overhead low and the output reproducible.
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Records the compression ratio and the bytes saved for a request body accepted by the aggregator.
+func recordCompression(encoding string, uncompressedSize, compressedSize int64) {
+	if !isCompressed(encoding) || compressedSize == 0 {
+		return
+	}
+	metrics.SyncCompressionRatio.WithLabelValues(encoding).Observe(float64(uncompressedSize) / float64(compressedSize))
+	if uncompressedSize > compressedSize {
+		metrics.SyncBytesSavedTotal.WithLabelValues(encoding).Add(float64(uncompressedSize - compressedSize))
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package send
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_contentEncodingFor(t *testing.T) {
+	assert.Equal(t, encodingGzip, contentEncodingFor("gzip"))
+	assert.Equal(t, encodingZstd, contentEncodingFor(" ZSTD "))
+	assert.Equal(t, encodingNone, contentEncodingFor(""))
+	assert.Equal(t, encodingNone, contentEncodingFor("brotli"))
+}
+
+// Compresses data with newEncodingWriter.
+func compress(t *testing.T, data []byte, encoding string) []byte {
+	buf := &bytes.Buffer{}
+	w, err := newEncodingWriter(buf, encoding)
+	assert.Nil(t, err)
+	_, err = w.Write(data)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+	return buf.Bytes()
+}
+
+func Test_newEncodingWriter_gzip(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"uid":"local-cluster/1234"}`), 100)
+
+	body := compress(t, data, encodingGzip)
+	assert.Less(t, len(body), len(data))
+
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	assert.Nil(t, err)
+	decoded, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, data, decoded)
+}
+
+func Test_newEncodingWriter_zstd(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"uid":"local-cluster/1234"}`), 100)
+
+	body := compress(t, data, encodingZstd)
+	assert.Less(t, len(body), len(data))
+
+	decoder, err := zstd.NewReader(nil)
+	assert.Nil(t, err)
+	decoded, err := decoder.DecodeAll(body, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, data, decoded)
+}
+
+func Test_newEncodingWriter_none(t *testing.T) {
+	data := []byte(`{}`)
+
+	assert.Equal(t, data, compress(t, data, encodingNone))
+}
@@ -0,0 +1,138 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package send
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// Counts the bytes written to the underlying writer.
+type countingWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count += int64(n)
+	return n, err
+}
+
+// Result of streaming a payload into a request body.
+type encodedPayload struct {
+	uncompressedSize int64
+	compressedSize   int64
+	err              error
+}
+
+// Streams the payload JSON into w, compressed with the given encoding.
+// The payload is never held in memory as a whole, each node and edge is encoded on its own.
+func encodePayload(w io.Writer, payload Payload, encoding string) encodedPayload {
+	compressed := &countingWriter{w: w}
+	encoder, err := newEncodingWriter(compressed, encoding)
+	if err != nil {
+		return encodedPayload{err: err}
+	}
+	uncompressed := &countingWriter{w: encoder}
+	buffered := bufio.NewWriterSize(uncompressed, 32*1024)
+
+	if err = writePayload(buffered, payload); err == nil {
+		err = buffered.Flush()
+	}
+	if closeErr := encoder.Close(); err == nil {
+		err = closeErr
+	}
+	return encodedPayload{uncompressedSize: uncompressed.count, compressedSize: compressed.count, err: err}
+}
+
+// Returns a reader streaming the encoded payload, and a channel that receives the result once the
+// payload was completely written or the reader was closed.
+func payloadReader(payload Payload, encoding string) (*io.PipeReader, <-chan encodedPayload) {
+	pr, pw := io.Pipe()
+	done := make(chan encodedPayload, 1)
+	go func() {
+		result := encodePayload(pw, payload, encoding)
+		_ = pw.CloseWithError(result.err)
+		done <- result
+	}()
+	return pr, done
+}
+
+// Writes the payload as a JSON object. The output decodes to the same Payload as json.Marshal, but the
+// lists of nodes and edges are written one element at a time.
+func writePayload(w io.Writer, payload Payload) error {
+	// Marshal the fields that aren't lists the usual way.
+	lists := []struct {
+		key   string
+		len   int
+		write func(w io.Writer, i int) error
+	}{
+		{"deleteResources", len(payload.DeletedResources), elemWriter(payload.DeletedResources)},
+		{"addResources", len(payload.AddResources), elemWriter(payload.AddResources)},
+		{"updateResources", len(payload.UpdatedResources), elemWriter(payload.UpdatedResources)},
+		{"patchResources", len(payload.PatchResources), elemWriter(payload.PatchResources)},
+		{"addEdges", len(payload.AddEdges), elemWriter(payload.AddEdges)},
+		{"deleteEdges", len(payload.DeleteEdges), elemWriter(payload.DeleteEdges)},
+	}
+	scalars := payload
+	scalars.DeletedResources = nil
+	scalars.AddResources = nil
+	scalars.UpdatedResources = nil
+	scalars.PatchResources = nil
+	scalars.AddEdges = nil
+	scalars.DeleteEdges = nil
+	head, err := json.Marshal(scalars)
+	if err != nil {
+		return err
+	}
+	head = bytes.TrimSuffix(head, []byte("}"))
+	if _, err = w.Write(head); err != nil {
+		return err
+	}
+	hasFields := len(head) > 1
+
+	for _, list := range lists {
+		if list.len == 0 {
+			continue
+		}
+		prefix := `"` + list.key + `":[`
+		if hasFields {
+			prefix = "," + prefix
+		}
+		hasFields = true
+		if _, err = io.WriteString(w, prefix); err != nil {
+			return err
+		}
+		for i := 0; i < list.len; i++ {
+			if i > 0 {
+				if _, err = io.WriteString(w, ","); err != nil {
+					return err
+				}
+			}
+			if err = list.write(w, i); err != nil {
+				return err
+			}
+		}
+		if _, err = io.WriteString(w, "]"); err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, "}")
+	return err
+}
+
+// Returns a function writing the JSON of the i-th element of the list. The output has no newlines,
+// so the payload can be written as a single line.
+func elemWriter[T any](list []T) func(w io.Writer, i int) error {
+	return func(w io.Writer, i int) error {
+		b, err := json.Marshal(list[i])
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+}
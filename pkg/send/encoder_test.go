@@ -0,0 +1,70 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package send
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+
+	tr "github.com/stolostron/search-collector/pkg/transforms"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_writePayload_empty(t *testing.T) {
+	buf := &bytes.Buffer{}
+
+	err := writePayload(buf, Payload{})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "{}", buf.String())
+}
+
+func Test_writePayload_matchesMarshal(t *testing.T) {
+	payload := Payload{
+		ClearAll: true,
+		Version:  "2.15.0",
+		AddResources: []tr.Node{
+			{UID: "local-cluster/1", ResourceString: "pods", Properties: map[string]interface{}{"kind": "Pod"}},
+			{UID: "local-cluster/2", ResourceString: "nodes", Properties: map[string]interface{}{"kind": "Node"}},
+		},
+		DeletedResources: []tr.Deletion{{UID: "local-cluster/3"}},
+		AddEdges:         []tr.Edge{{EdgeType: "runsOn", SourceUID: "local-cluster/1", DestUID: "local-cluster/2"}},
+	}
+	buf := &bytes.Buffer{}
+
+	err := writePayload(buf, payload)
+	assert.Nil(t, err)
+
+	streamed := Payload{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &streamed))
+	marshalled, _ := json.Marshal(payload)
+	expected := Payload{}
+	assert.Nil(t, json.Unmarshal(marshalled, &expected))
+	assert.Equal(t, expected, streamed)
+}
+
+func Test_payloadReader(t *testing.T) {
+	payload := Payload{AddResources: []tr.Node{{UID: "local-cluster/1"}}}
+
+	reader, done := payloadReader(payload, encodingNone)
+	body, err := io.ReadAll(reader)
+	result := <-done
+
+	assert.Nil(t, err)
+	assert.Nil(t, result.err)
+	assert.Equal(t, int64(len(body)), result.uncompressedSize)
+	assert.Equal(t, result.uncompressedSize, result.compressedSize)
+	assert.Contains(t, string(body), `"uid":"local-cluster/1"`)
+}
+
+func Test_payloadReader_closedEarly(t *testing.T) {
+	payload := Payload{AddResources: make([]tr.Node, 10000)}
+
+	reader, done := payloadReader(payload, encodingGzip)
+	_ = reader.Close()
+	result := <-done
+
+	assert.NotNil(t, result.err)
+}
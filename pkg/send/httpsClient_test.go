@@ -14,7 +14,7 @@ func Test_getHttpsClient(t *testing.T) {
 	// Establish the config
 	config.InitConfig()
 
-	client := getHTTPSClient()
+	client := getHTTPSClient(config.Cfg.AggregatorTargets[0])
 
 	assert.NotNil(t, client, "Should get a valid https client")
 }
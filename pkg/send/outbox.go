@@ -0,0 +1,289 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package send
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/stolostron/search-collector/pkg/config"
+	"github.com/stolostron/search-collector/pkg/reconciler"
+)
+
+const (
+	stateFileName    = "state.json"
+	ackFileName      = "ack.json"
+	sequenceFileName = "sequence.json"
+)
+
+// Keeps the last state acknowledged by the aggregator on disk, so a restarted collector continues with a
+// diff against that state instead of sending the complete state with ClearAll.
+// The state is only saved every STATE_SAVE_INTERVAL_MS and at shutdown, because it's large. The hash of each
+// acknowledged state is saved with every sync, to know after a crash whether the saved state is the last one.
+type stateStore struct {
+	dir string
+}
+
+// Contents of the state file.
+type savedState struct {
+	Version  string `json:"version"`  // Version of the collector that saved the state
+	Cluster  string `json:"cluster"`  // Cluster name the state was sent for
+	Sequence int64  `json:"sequence"` // Sequence of the acknowledgement of the state, see savedAck
+	reconciler.State
+}
+
+// Contents of the acknowledgement file.
+type savedAck struct {
+	Version   string `json:"version"`
+	Cluster   string `json:"cluster"`
+	Sequence  int64  `json:"sequence"`  // Increases with every acknowledged payload that changed the state
+	StateHash string `json:"stateHash"` // Hash of the state the aggregator acknowledged last
+}
+
+// Contents of the sequence file.
+type savedSignatureSequence struct {
+	Cluster  string `json:"cluster"`
+	Reserved int64  `json:"reserved"` // Signature sequence numbers up to this one may have been sent
+}
+
+func newStateStore(dir string) *stateStore {
+	return &stateStore{dir: dir}
+}
+
+// Loads the saved state. Returns an error wrapping os.ErrNotExist if nothing was saved.
+func (st *stateStore) load() (savedState, error) {
+	saved := savedState{}
+	f, err := os.Open(filepath.Join(st.dir, stateFileName))
+	if err != nil {
+		return saved, err
+	}
+	defer f.Close() // #nosec G307
+
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	decoder.UseNumber()
+	if err = decoder.Decode(&saved); err != nil {
+		return saved, err
+	}
+	// Bring the numbers back to the types built by the transforms.
+	for i := range saved.Nodes {
+		for key, value := range saved.Nodes[i].Properties {
+			saved.Nodes[i].Properties[key] = normalizeNumbers(value)
+		}
+	}
+	return saved, nil
+}
+
+// Loads the last acknowledgement. Returns an error wrapping os.ErrNotExist if nothing was saved.
+func (st *stateStore) loadAck() (savedAck, error) {
+	ack := savedAck{}
+	data, err := os.ReadFile(filepath.Join(st.dir, ackFileName))
+	if err != nil {
+		return ack, err
+	}
+	err = json.Unmarshal(data, &ack)
+	return ack, err
+}
+
+// Loads the reserved signature sequence. Returns an error wrapping os.ErrNotExist if nothing was saved.
+func (st *stateStore) loadSequence() (savedSignatureSequence, error) {
+	saved := savedSignatureSequence{}
+	data, err := os.ReadFile(filepath.Join(st.dir, sequenceFileName))
+	if err != nil {
+		return saved, err
+	}
+	err = json.Unmarshal(data, &saved)
+	return saved, err
+}
+
+func (st *stateStore) save(saved savedState) error {
+	return st.write(stateFileName, saved)
+}
+
+func (st *stateStore) saveAck(ack savedAck) error {
+	return st.write(ackFileName, ack)
+}
+
+func (st *stateStore) saveSequence(saved savedSignatureSequence) error {
+	return st.write(sequenceFileName, saved)
+}
+
+// Writes the value to a temporary file and renames it, so a crash never leaves a partial file.
+func (st *stateStore) write(name string, value interface{}) error {
+	if err := os.MkdirAll(st.dir, 0o750); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(st.dir, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }() // No-op after the rename.
+
+	buffered := bufio.NewWriter(tmp)
+	err = json.NewEncoder(buffered).Encode(value)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(st.dir, name))
+}
+
+// Removes the saved state and acknowledgement, but keeps the signature sequence. Used when the aggregator state no longer matches what we track.
+func (st *stateStore) clear() {
+	for _, name := range []string{stateFileName, ackFileName} {
+		err := os.Remove(filepath.Join(st.dir, name))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			klog.Warningf("Failed to remove the saved %s from %s: %s", name, st.dir, err)
+		}
+	}
+}
+
+// Converts JSON numbers to int64 when they are whole numbers, otherwise to float64.
+func normalizeNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalizeNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeNumbers(item)
+		}
+	}
+	return value
+}
+
+// Loads the saved state and seeds the reconciler with it.
+func (s *Sender) restoreState() {
+	saved, err := s.store.load()
+	if errors.Is(err, os.ErrNotExist) {
+		klog.Info("No saved state found. Will send the complete state.")
+		return
+	} else if err != nil {
+		klog.Warningf("Failed to load the saved state from %s. Will send the complete state. Error: %s",
+			s.store.dir, err)
+		return
+	}
+	if saved.Version != config.COLLECTOR_API_VERSION || saved.Cluster != config.Cfg.ClusterName {
+		klog.Infof("Ignoring saved state from collector version %s for cluster %s.", saved.Version, saved.Cluster)
+		return
+	}
+	s.rec.Restore(saved.State)
+	s.restoredHash = s.rec.StateHash()
+	s.restoredNodes, s.restoredEdges = len(saved.Nodes), len(saved.Edges)
+	s.ackSequence, s.savedSequence = saved.Sequence, saved.Sequence
+
+	// The collector didn't shut down cleanly after the state was saved, the aggregator has a newer state.
+	if ack, err := s.store.loadAck(); err == nil && ack.Sequence > saved.Sequence {
+		klog.Infof("Saved state is %d syncs older than the last state acknowledged by the aggregator.",
+			ack.Sequence-saved.Sequence)
+		s.ackSequence = ack.Sequence
+	}
+}
+
+// Asks the aggregator whether it still has the restored state. Only asks once after a restart.
+// An empty payload doesn't change the state, the aggregator responds with the hash of the state it has.
+// If it has another state, for example because the saved state is older than the last sync, replaces the
+// kinds that differ with the restored state.
+func (s *Sender) confirmRestoredState(ctx context.Context) bool {
+	hash := s.restoredHash
+	if hash == "" {
+		return false
+	}
+	s.restoredHash = ""
+
+	r, err := s.post(ctx, Payload{Version: config.COLLECTOR_API_VERSION, StateHash: hash})
+	if err != nil {
+		klog.Warningf("Failed to confirm the restored state with the aggregator. Error: %s", err)
+		return false
+	}
+	if r.StateHash != hash {
+		klog.Info("Aggregator doesn't have the restored state. Reconciling the kinds that differ.")
+		err = s.reconcileKinds(ctx, hash, s.restoredNodes, s.restoredEdges)
+		if err != nil {
+			klog.Infof("Failed to reconcile the restored state. Will send the complete state. Error: %s", err)
+			return false
+		}
+		s.acknowledge(hash)
+		return true
+	}
+	klog.Info("Aggregator has the restored state. Continuing with a diff.")
+	s.ackHash = hash
+	return true
+}
+
+// Records that the aggregator acknowledged the state with the hash. Only the hash is saved, the state itself
+// is saved by saveState. If the aggregator failed to apply part of it, removes the saved state instead,
+// because the aggregator doesn't have the state matching the hash.
+func (s *Sender) acknowledge(hash string) {
+	if s.store == nil || hash == "" {
+		return
+	}
+	if s.retry.size() > 0 {
+		s.ackHash = ""
+		s.store.clear()
+		return
+	}
+	s.ackHash = hash
+	s.ackSequence++
+	ack := savedAck{
+		Version:   config.COLLECTOR_API_VERSION,
+		Cluster:   config.Cfg.ClusterName,
+		Sequence:  s.ackSequence,
+		StateHash: hash,
+	}
+	if err := s.store.saveAck(ack); err != nil {
+		klog.Warningf("Failed to save the acknowledged state hash to %s. Error: %s", s.store.dir, err)
+	}
+}
+
+// Saves the acknowledged state if it changed since it was last saved, at most every STATE_SAVE_INTERVAL_MS
+// unless forced at shutdown.
+func (s *Sender) saveState(force bool) {
+	if s.store == nil || s.ackHash == "" || s.savedSequence == s.ackSequence {
+		return
+	}
+	interval := time.Duration(config.Cfg.StateSaveIntervalMS) * time.Millisecond
+	if !force && time.Since(s.lastStateSave) < interval {
+		return
+	}
+	// The last diff wasn't acknowledged, the state we track is ahead of the aggregator.
+	if s.rec.StateHash() != s.ackHash {
+		return
+	}
+	s.lastStateSave = time.Now()
+	saved := savedState{
+		Version:  config.COLLECTOR_API_VERSION,
+		Cluster:  config.Cfg.ClusterName,
+		Sequence: s.ackSequence,
+		State:    s.rec.SentState(),
+	}
+	if err := s.store.save(saved); err != nil {
+		klog.Warningf("Failed to save the state to %s. Error: %s", s.store.dir, err)
+		s.store.clear()
+		return
+	}
+	s.savedSequence = s.ackSequence
+	klog.V(2).Infof("Saved the acknowledged state of %d nodes and %d edges to %s.",
+		len(saved.Nodes), len(saved.Edges), s.store.dir)
+}
@@ -0,0 +1,184 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package send
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stolostron/search-collector/pkg/config"
+	"github.com/stolostron/search-collector/pkg/reconciler"
+	tr "github.com/stolostron/search-collector/pkg/transforms"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_stateStore_saveAndLoad(t *testing.T) {
+	store := newStateStore(t.TempDir())
+	state := reconciler.State{
+		Nodes: []tr.Node{{UID: "n1", Properties: map[string]interface{}{
+			"kind":     "Pod",
+			"restarts": int64(3),
+			"cpu":      0.5,
+			"labels":   map[string]interface{}{"replicas": int64(2)},
+		}}},
+		Edges: []tr.Edge{{EdgeType: "ownedBy", SourceUID: "n1", DestUID: "n2", SourceKind: "Pod", DestKind: "ReplicaSet"}},
+	}
+
+	err := store.save(savedState{Version: config.COLLECTOR_API_VERSION, Cluster: "c1", State: state})
+	assert.Nil(t, err)
+
+	saved, err := store.load()
+	assert.Nil(t, err)
+	assert.Equal(t, state, saved.State, "Expected numbers to load with the types built by the transforms.")
+
+	files, _ := os.ReadDir(store.dir)
+	assert.Len(t, files, 1, "Expected no temporary files left behind.")
+
+	store.clear()
+	_, err = store.load()
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+var restoredTestState = reconciler.State{
+	Nodes: []tr.Node{{UID: "deleted-while-down", Properties: map[string]interface{}{"kind": "Pod"}}},
+}
+
+// Returns the hash of the restored test state.
+func restoredTestHash() string {
+	rec := reconciler.NewReconciler()
+	rec.Restore(restoredTestState)
+	return rec.StateHash()
+}
+
+// Starts a sender with a restored state and an aggregator that reports the given state hash.
+func restoredSender(t *testing.T, aggregatorHash string) (*Sender, *[]Payload) {
+	received := []Payload{}
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := Payload{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, payload)
+		// The aggregator has the restored node until it applies the first diff or complete payload.
+		handshake := payload.empty() && !payload.ClearAll
+		if !handshake {
+			aggregatorHash = payload.StateHash
+		}
+		response := SyncResponse{StateHash: aggregatorHash}
+		if handshake {
+			response.TotalResources = 1
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+	t.Cleanup(ts.Close)
+
+	store := newStateStore(t.TempDir())
+	assert.Nil(t, store.save(savedState{
+		Version: config.COLLECTOR_API_VERSION,
+		Cluster: config.Cfg.ClusterName,
+		State:   restoredTestState,
+	}))
+
+	s := &Sender{
+		httpClient:    *ts.Client(),
+		aggregatorURL: ts.URL,
+		lastSentTime:  -1,
+		rec:           reconciler.NewReconciler(),
+		store:         store,
+	}
+	s.restoreState()
+	return s, &received
+}
+
+func TestSenderRestoredStateConfirmed(t *testing.T) {
+	s, received := restoredSender(t, restoredTestHash())
+
+	err := s.Sync(context.Background())
+
+	assert.Nil(t, err)
+	assert.Len(t, *received, 2)
+	assert.Equal(t, restoredTestHash(), (*received)[0].StateHash, "Expected the handshake to carry the restored hash.")
+	assert.True(t, (*received)[0].empty())
+	diff := (*received)[1]
+	assert.False(t, diff.ClearAll, "Expected a diff instead of a ClearAll resync.")
+	assert.Equal(t, []tr.Deletion{{UID: "deleted-while-down"}}, diff.DeletedResources)
+
+	ack, err := s.store.loadAck()
+	assert.Nil(t, err)
+	assert.Equal(t, diff.StateHash, ack.StateHash, "Expected the acknowledged hash to be saved with every sync.")
+	saved, err := s.store.load()
+	assert.Nil(t, err)
+	assert.Len(t, saved.Nodes, 1, "Expected the state to be saved only at the interval.")
+
+	s.saveState(true)
+	saved, err = s.store.load()
+	assert.Nil(t, err)
+	assert.Empty(t, saved.Nodes, "Expected the acknowledged state to be saved.")
+	assert.Equal(t, ack.Sequence, saved.Sequence)
+}
+
+func TestSenderRestoredStateMismatch(t *testing.T) {
+	s, received := restoredSender(t, "other")
+
+	err := s.Sync(context.Background())
+
+	assert.Nil(t, err)
+	assert.Len(t, *received, 3)
+	assert.NotEmpty(t, (*received)[1].KindHashes, "Expected to ask for the kinds that differ.")
+	assert.True(t, (*received)[2].ClearAll, "Expected the complete state when the kinds can't be reconciled.")
+}
+
+func TestSenderRestoredStateOlderThanAck(t *testing.T) {
+	received := []Payload{}
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := Payload{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, payload)
+		// The aggregator got a Pod update after the state was saved.
+		response := SyncResponse{TotalResources: 1, StateHash: "newer"}
+		switch {
+		case payload.KindHashes != nil:
+			response.KindHashes = map[string]string{"Pod": "newer"}
+		case payload.ReplaceKinds != nil || !payload.empty():
+			response.StateHash = payload.StateHash
+			response.TotalResources = len(payload.AddResources)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+	defer ts.Close()
+
+	store := newStateStore(t.TempDir())
+	assert.Nil(t, store.save(savedState{
+		Version:  config.COLLECTOR_API_VERSION,
+		Cluster:  config.Cfg.ClusterName,
+		Sequence: 1,
+		State:    restoredTestState,
+	}))
+	assert.Nil(t, store.saveAck(savedAck{Sequence: 3, StateHash: "newer"}))
+
+	s := &Sender{
+		httpClient:    *ts.Client(),
+		aggregatorURL: ts.URL,
+		lastSentTime:  -1,
+		rec:           reconciler.NewReconciler(),
+		store:         store,
+	}
+	s.restoreState()
+	err := s.Sync(context.Background())
+
+	assert.Nil(t, err)
+	assert.Len(t, received, 4)
+	assert.Equal(t, []string{"Pod"}, received[2].ReplaceKinds, "Expected the kinds that differ to be replaced.")
+	assert.False(t, received[3].ClearAll, "Expected a diff after replacing the kinds.")
+	ack, err := s.store.loadAck()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), ack.Sequence, "Expected the sequence to continue from the last acknowledgement.")
+}
@@ -0,0 +1,149 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package send
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/stolostron/search-collector/pkg/config"
+	tr "github.com/stolostron/search-collector/pkg/transforms"
+)
+
+// Phases of a chunked resync session.
+const (
+	resyncBegin  = "begin"
+	resyncPart   = "part"
+	resyncCommit = "commit"
+)
+
+// Identifies a chunk of a chunked resync session. The aggregator stages the parts of a session and
+// replaces the state of the cluster only when it receives the commit.
+type ResyncChunk struct {
+	Session string `json:"session"`         // Random ID of the resync session
+	Phase   string `json:"phase"`           // begin, part or commit
+	Index   int    `json:"index,omitempty"` // Number of the part, from 1 to Total
+	Total   int    `json:"total"`           // Number of parts in the session
+}
+
+// Sends the complete state. When RESYNC_CHUNK_SIZE is set and the aggregator supports it, states larger
+// than the chunk size are sent in a chunked resync session instead of a single request.
+func (s *Sender) sendComplete(ctx context.Context, payload Payload, expectedTotalResources int, expectedTotalEdges int) error {
+	// The complete state replaces everything, including what the aggregator failed to apply before.
+	s.retry.reset()
+	chunkSize := config.Cfg.ResyncChunkSize
+	if chunkSize <= 0 || !s.supports(featureChunkedResync) || len(payload.AddResources)+len(payload.AddEdges) <= chunkSize {
+		return s.sendWithRetry(ctx, payload, expectedTotalResources, expectedTotalEdges)
+	}
+	return s.sendChunked(ctx, payload, expectedTotalResources, expectedTotalEdges, chunkSize)
+}
+
+// Sends the complete payload as a resync session: begin, the numbered parts, then commit.
+// A failed part is retried on its own, the session restarts only when a part runs out of retries.
+// The totals are verified once, in the response to the commit.
+func (s *Sender) sendChunked(ctx context.Context, payload Payload, expectedTotalResources, expectedTotalEdges, chunkSize int) error {
+	parts := splitComplete(payload.AddResources, payload.AddEdges, chunkSize)
+	session := newSessionID()
+	klog.Infof("Sending complete state in resync session %s with %d parts.", session, len(parts))
+
+	begin := Payload{
+		Version: payload.Version,
+		Resync:  &ResyncChunk{Session: session, Phase: resyncBegin, Total: len(parts)},
+	}
+	if _, err := s.sendChunk(ctx, begin); err != nil {
+		return fmt.Errorf("resync session %s failed to begin: %w", session, err)
+	}
+
+	// Errors reported for the parts, to account for them when verifying the totals.
+	partErrors := SyncResponse{}
+	for i, part := range parts {
+		part.Version = payload.Version
+		part.Resync = &ResyncChunk{Session: session, Phase: resyncPart, Index: i + 1, Total: len(parts)}
+		r, err := s.sendChunk(ctx, part)
+		if err != nil {
+			return fmt.Errorf("resync session %s failed to send part %d of %d: %w", session, i+1, len(parts), err)
+		}
+		s.retry.track(part, r)
+		partErrors.AddErrors = append(partErrors.AddErrors, r.AddErrors...)
+		partErrors.AddEdgeErrors = append(partErrors.AddEdgeErrors, r.AddEdgeErrors...)
+	}
+
+	commit := Payload{
+		Version:   payload.Version,
+		Resync:    &ResyncChunk{Session: session, Phase: resyncCommit, Total: len(parts)},
+		StateHash: payload.StateHash,
+	}
+	r, err := s.sendChunk(ctx, commit)
+	if err != nil {
+		return fmt.Errorf("resync session %s failed to commit: %w", session, err)
+	}
+	r.AddErrors = append(partErrors.AddErrors, r.AddErrors...)
+	r.AddEdgeErrors = append(partErrors.AddEdgeErrors, r.AddEdgeErrors...)
+	if err = verifyTotals(r, expectedTotalResources, expectedTotalEdges); err != nil {
+		return err
+	}
+	if err = s.retry.checkLimit(); err != nil {
+		return err
+	}
+	return s.checkStateHash(ctx, payload, r, expectedTotalResources, expectedTotalEdges)
+}
+
+// Sends a single chunk of a resync session. Retries only this chunk, up to RESYNC_CHUNK_RETRIES times.
+// Busy responses from the indexer don't count against the retries.
+func (s *Sender) sendChunk(ctx context.Context, chunk Payload) (SyncResponse, error) {
+	retry := 0
+	attempt := 0
+	for {
+		r, err := s.post(ctx, chunk)
+		if err == nil {
+			return r, nil
+		}
+		attempt++
+		busy := isBusy(err)
+		if !busy {
+			retry++
+		}
+		if retry > config.Cfg.ResyncChunkRetries {
+			return r, err
+		}
+		nextRetryWait := retryWait(err, attempt)
+		klog.Warningf("Error sending %s chunk %d of resync session %s: %s. Retrying the chunk in %s.",
+			chunk.Resync.Phase, chunk.Resync.Index, chunk.Resync.Session, err.Error(), nextRetryWait)
+		if err := sleep(ctx, nextRetryWait); err != nil {
+			return r, err
+		}
+	}
+}
+
+// Splits the nodes and edges in parts of at most chunkSize items. Nodes go first, so the parts with
+// edges come after the nodes they reference. The parts share the backing arrays of the input slices.
+func splitComplete(nodes []tr.Node, edges []tr.Edge, chunkSize int) []Payload {
+	total := len(nodes) + len(edges)
+	parts := make([]Payload, 0, (total+chunkSize-1)/chunkSize)
+	for start := 0; start < total; start += chunkSize {
+		end := min(start+chunkSize, total)
+		part := Payload{}
+		if start < len(nodes) {
+			part.AddResources = nodes[start:min(end, len(nodes))]
+		}
+		if end > len(nodes) {
+			part.AddEdges = edges[max(start-len(nodes), 0) : end-len(nodes)]
+		}
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+// Generates a random ID for a resync session.
+func newSessionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,114 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package send
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stolostron/search-collector/pkg/config"
+	tr "github.com/stolostron/search-collector/pkg/transforms"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_splitComplete(t *testing.T) {
+	nodes := []tr.Node{{UID: "n1"}, {UID: "n2"}, {UID: "n3"}}
+	edges := []tr.Edge{{SourceUID: "n1", DestUID: "n2"}, {SourceUID: "n2", DestUID: "n3"}}
+
+	parts := splitComplete(nodes, edges, 2)
+
+	assert.Equal(t, 3, len(parts))
+	assert.Equal(t, nodes[0:2], parts[0].AddResources)
+	assert.Nil(t, parts[0].AddEdges)
+	assert.Equal(t, nodes[2:3], parts[1].AddResources)
+	assert.Equal(t, edges[0:1], parts[1].AddEdges)
+	assert.Nil(t, parts[2].AddResources)
+	assert.Equal(t, edges[1:2], parts[2].AddEdges)
+}
+
+func TestSenderChunkedResync(t *testing.T) {
+	defer func(size, retries, backoff int) {
+		config.Cfg.ResyncChunkSize, config.Cfg.ResyncChunkRetries, config.Cfg.MaxBackoffMS = size, retries, backoff
+	}(config.Cfg.ResyncChunkSize, config.Cfg.ResyncChunkRetries, config.Cfg.MaxBackoffMS)
+	config.Cfg.ResyncChunkSize = 2
+	config.Cfg.ResyncChunkRetries = 1
+	config.Cfg.MaxBackoffMS = 1
+
+	mutex := sync.Mutex{}
+	received := []string{}
+	failedOnce := false
+	stagedNodes, stagedEdges := 0, 0
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		payload := Payload{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+		assert.NotNil(t, payload.Resync)
+		assert.False(t, payload.ClearAll)
+		received = append(received, fmt.Sprintf("%s-%d", payload.Resync.Phase, payload.Resync.Index))
+
+		// Fail the second part once, it must be the only chunk sent again.
+		if payload.Resync.Phase == resyncPart && payload.Resync.Index == 2 && !failedOnce {
+			failedOnce = true
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		stagedNodes += len(payload.AddResources)
+		stagedEdges += len(payload.AddEdges)
+
+		response := SyncResponse{}
+		if payload.Resync.Phase == resyncCommit {
+			response.TotalResources = stagedNodes
+			response.TotalEdges = stagedEdges
+		}
+		w.WriteHeader(200)
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+	defer ts.Close()
+
+	s := Sender{
+		httpClient:    *ts.Client(),
+		aggregatorURL: ts.URL,
+	}
+
+	payload := Payload{
+		ClearAll:     true,
+		AddResources: []tr.Node{{UID: "n1"}, {UID: "n2"}, {UID: "n3"}},
+		AddEdges:     []tr.Edge{{SourceUID: "n1", DestUID: "n2"}},
+	}
+
+	err := s.sendComplete(context.Background(), payload, 3, 1)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"begin-0", "part-1", "part-2", "part-2", "commit-0"}, received)
+}
+
+func TestSenderChunkedResyncWrongTotal(t *testing.T) {
+	defer func(size int) { config.Cfg.ResyncChunkSize = size }(config.Cfg.ResyncChunkSize)
+	config.Cfg.ResyncChunkSize = 1
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_ = json.NewEncoder(w).Encode(SyncResponse{TotalResources: 1})
+	}))
+	defer ts.Close()
+
+	s := Sender{
+		httpClient:    *ts.Client(),
+		aggregatorURL: ts.URL,
+	}
+
+	payload := Payload{ClearAll: true, AddResources: []tr.Node{{UID: "n1"}, {UID: "n2"}}}
+
+	err := s.sendComplete(context.Background(), payload, 2, 0)
+
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Aggregator reported wrong number of total resources")
+}
@@ -0,0 +1,313 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package send
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/klog/v2"
+
+	"github.com/stolostron/search-collector/pkg/config"
+	"github.com/stolostron/search-collector/pkg/metrics"
+	tr "github.com/stolostron/search-collector/pkg/transforms"
+)
+
+// Tracks the resources and edges the aggregator failed to apply. They are sent again with the next diff,
+// instead of forcing a complete resync for a few bad resources.
+type retrySet struct {
+	nodes       map[string]tr.Operation // Failed operation, keyed by node UID
+	addEdges    map[[2]string]tr.Edge   // Edges that failed to be added, keyed by source and dest UID
+	deleteEdges map[[2]string]tr.Edge   // Edges that failed to be deleted, keyed by source and dest UID
+}
+
+// Number of pending resources and edges.
+func (rs *retrySet) size() int {
+	return len(rs.nodes) + len(rs.addEdges) + len(rs.deleteEdges)
+}
+
+// Forgets all pending failures. Used when the complete state is sent.
+func (rs *retrySet) reset() {
+	rs.nodes = nil
+	rs.addEdges = nil
+	rs.deleteEdges = nil
+	metrics.SyncRetryPending.Set(0)
+}
+
+// Records the errors reported by the aggregator for the payload.
+// Only the edges reported as failed are retried, plus the edges of the resources that are retried, because the
+// aggregator can't apply an edge to a resource it doesn't have.
+func (rs *retrySet) track(payload Payload, r SyncResponse) {
+	if rs.nodes == nil {
+		rs.nodes = map[string]tr.Operation{}
+		rs.addEdges = map[[2]string]tr.Edge{}
+		rs.deleteEdges = map[[2]string]tr.Edge{}
+	}
+	for _, e := range r.AddErrors {
+		rs.nodes[e.ResourceUID] = tr.Create
+		countSyncError("add", e)
+	}
+	for _, e := range r.UpdateErrors {
+		rs.nodes[e.ResourceUID] = tr.Update
+		countSyncError("update", e)
+	}
+	for _, e := range r.DeleteErrors {
+		rs.nodes[e.ResourceUID] = tr.Delete
+		countSyncError("delete", e)
+	}
+	trackEdges(rs.addEdges, payload.AddEdges, r.AddEdgeErrors, rs.nodes, "addEdge")
+	trackEdges(rs.deleteEdges, payload.DeleteEdges, r.DeleteEdgeErrors, rs.nodes, "deleteEdge")
+	metrics.SyncRetryPending.Set(float64(rs.size()))
+}
+
+// Adds the sent edges that failed to pending. An error identifies the edge by its source and DestUID. Aggregators
+// that don't set DestUID only report the source, so all edges of that source are retried.
+func trackEdges(pending map[[2]string]tr.Edge, sent []tr.Edge, errs []SyncError, retried map[string]tr.Operation,
+	operation string) {
+	if len(errs) == 0 && len(retried) == 0 {
+		return
+	}
+	failedEdges := make(map[[2]string]struct{}, len(errs))
+	failedSources := map[string]struct{}{}
+	for _, e := range errs {
+		if e.DestUID != "" {
+			failedEdges[[2]string{e.ResourceUID, e.DestUID}] = struct{}{}
+		} else {
+			failedSources[e.ResourceUID] = struct{}{}
+		}
+		countSyncError(operation, e)
+	}
+	for _, edge := range sent {
+		key := [2]string{edge.SourceUID, edge.DestUID}
+		_, failed := failedEdges[key]
+		_, sourceFailed := failedSources[edge.SourceUID]
+		_, sourceRetried := retried[edge.SourceUID]
+		_, destRetried := retried[edge.DestUID]
+		if failed || sourceFailed || sourceRetried || destRetried {
+			pending[key] = edge
+		}
+	}
+}
+
+// Records the whole payload as pending, used when sending it was interrupted before the aggregator
+// responded. Nodes are resent with their current state from the reconciler.
+func (rs *retrySet) requeue(payload Payload) {
+	if rs.nodes == nil {
+		rs.nodes = map[string]tr.Operation{}
+		rs.addEdges = map[[2]string]tr.Edge{}
+		rs.deleteEdges = map[[2]string]tr.Edge{}
+	}
+	for _, n := range payload.AddResources {
+		rs.nodes[n.UID] = tr.Create
+	}
+	for _, n := range payload.UpdatedResources {
+		if _, ok := rs.nodes[n.UID]; !ok {
+			rs.nodes[n.UID] = tr.Update
+		}
+	}
+	// Patches are resent as whole nodes, we don't know which of them the aggregator applied.
+	for _, p := range payload.PatchResources {
+		if _, ok := rs.nodes[p.UID]; !ok {
+			rs.nodes[p.UID] = tr.Update
+		}
+	}
+	for _, d := range payload.DeletedResources {
+		rs.nodes[d.UID] = tr.Delete
+	}
+	for _, e := range payload.AddEdges {
+		rs.addEdges[[2]string{e.SourceUID, e.DestUID}] = e
+	}
+	for _, e := range payload.DeleteEdges {
+		rs.deleteEdges[[2]string{e.SourceUID, e.DestUID}] = e
+	}
+	metrics.SyncRetryPending.Set(float64(rs.size()))
+}
+
+// Merges the pending failures into the diff payload and clears them. If they fail again, the response
+// adds them back. The lookup returns the current state of a node from the reconciler.
+func (rs *retrySet) apply(payload *Payload, lookup func(uid string) (tr.Node, bool)) {
+	if rs.size() == 0 {
+		return
+	}
+	klog.V(2).Infof("Resending %d resources and %d edges that failed in a previous sync.",
+		len(rs.nodes), len(rs.addEdges)+len(rs.deleteEdges))
+
+	added := uidSet(payload.AddResources)
+	updated := uidSet(payload.UpdatedResources)
+	patched := make(map[string]struct{}, len(payload.PatchResources))
+	for _, p := range payload.PatchResources {
+		patched[p.UID] = struct{}{}
+	}
+	deleted := make(map[string]struct{}, len(payload.DeletedResources))
+	for _, d := range payload.DeletedResources {
+		deleted[d.UID] = struct{}{}
+	}
+
+	uids := make([]string, 0, len(rs.nodes))
+	for uid := range rs.nodes {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+
+	for _, uid := range uids {
+		node, exists := lookup(uid)
+		_, inAdd := added[uid]
+		_, inUpdate := updated[uid]
+		_, inPatch := patched[uid]
+		_, inDelete := deleted[uid]
+
+		switch rs.nodes[uid] {
+		case tr.Create:
+			if inDelete {
+				// The aggregator never had it, no need to delete it.
+				payload.DeletedResources = removeDeletion(payload.DeletedResources, uid)
+			} else if inUpdate {
+				// The aggregator doesn't have it, so the update must be an add.
+				var update tr.Node
+				payload.UpdatedResources, update = takeNode(payload.UpdatedResources, uid)
+				payload.AddResources = append(payload.AddResources, update)
+			} else if inPatch {
+				// The aggregator can't patch a node it doesn't have, add the whole node.
+				payload.PatchResources = removePatch(payload.PatchResources, uid)
+				if exists {
+					payload.AddResources = append(payload.AddResources, node)
+				}
+			} else if exists && !inAdd {
+				payload.AddResources = append(payload.AddResources, node)
+			}
+		case tr.Update:
+			if inPatch {
+				// The last update failed, so the patch may not apply. Send the whole node instead.
+				payload.PatchResources = removePatch(payload.PatchResources, uid)
+			}
+			if exists && !inAdd && !inUpdate && !inDelete {
+				payload.UpdatedResources = append(payload.UpdatedResources, node)
+			}
+		case tr.Delete:
+			if !exists && !inDelete {
+				payload.DeletedResources = append(payload.DeletedResources, tr.Deletion{UID: uid})
+			}
+		}
+	}
+
+	applyEdges(&payload.AddEdges, &payload.DeleteEdges, rs.addEdges, deleted)
+	applyEdges(&payload.DeleteEdges, &payload.AddEdges, rs.deleteEdges, nil)
+
+	rs.nodes = nil
+	rs.addEdges = nil
+	rs.deleteEdges = nil
+}
+
+// Appends the pending edges to the target list. A pending edge that now shows up in the opposite list
+// cancels out with it. Edges of deleted nodes are dropped, the aggregator deletes them with the node.
+func applyEdges(target, opposite *[]tr.Edge, pending map[[2]string]tr.Edge, deletedNodes map[string]struct{}) {
+	if len(pending) == 0 {
+		return
+	}
+	inTarget := edgeSet(*target)
+	inOpposite := edgeSet(*opposite)
+
+	keys := make([][2]string, 0, len(pending))
+	for key := range pending {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || (keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1])
+	})
+
+	for _, key := range keys {
+		if _, ok := inOpposite[key]; ok {
+			*opposite = removeEdge(*opposite, key)
+			continue
+		}
+		_, srcDeleted := deletedNodes[key[0]]
+		_, destDeleted := deletedNodes[key[1]]
+		if _, ok := inTarget[key]; !ok && !srcDeleted && !destDeleted {
+			*target = append(*target, pending[key])
+		}
+	}
+}
+
+// Returns an error if the pending failures passed the limit. In that case we fall back to a complete resync.
+func (rs *retrySet) checkLimit() error {
+	if rs.size() > config.Cfg.MaxSyncErrors {
+		return fmt.Errorf("aggregator failed to apply %d resources and edges, more than the limit of %d",
+			rs.size(), config.Cfg.MaxSyncErrors)
+	}
+	return nil
+}
+
+// Counts a sync error reported by the aggregator.
+func countSyncError(operation string, e SyncError) {
+	klog.V(3).Infof("Aggregator failed to %s resource %s: %s", operation, e.ResourceUID, e.Message)
+	metrics.SyncErrorsTotal.WithLabelValues(operation, syncErrorReason(e.Message)).Inc()
+}
+
+// Reduces an error message to a short reason, to keep the cardinality of the metric labels low.
+// Messages usually start with a description followed by details like "insert failed: <details>".
+func syncErrorReason(message string) string {
+	reason, _, _ := strings.Cut(message, ":")
+	reason = strings.TrimSpace(reason)
+	if len(reason) > 64 {
+		reason = reason[:64]
+	}
+	if reason == "" {
+		return "unknown"
+	}
+	return reason
+}
+
+func uidSet(nodes []tr.Node) map[string]struct{} {
+	set := make(map[string]struct{}, len(nodes))
+	for _, n := range nodes {
+		set[n.UID] = struct{}{}
+	}
+	return set
+}
+
+func edgeSet(edges []tr.Edge) map[[2]string]struct{} {
+	set := make(map[[2]string]struct{}, len(edges))
+	for _, e := range edges {
+		set[[2]string{e.SourceUID, e.DestUID}] = struct{}{}
+	}
+	return set
+}
+
+// Removes the node with the UID from the list and returns it.
+func takeNode(nodes []tr.Node, uid string) ([]tr.Node, tr.Node) {
+	for i := range nodes {
+		if nodes[i].UID == uid {
+			node := nodes[i]
+			return append(nodes[:i], nodes[i+1:]...), node
+		}
+	}
+	return nodes, tr.Node{}
+}
+
+func removeDeletion(deletions []tr.Deletion, uid string) []tr.Deletion {
+	for i := range deletions {
+		if deletions[i].UID == uid {
+			return append(deletions[:i], deletions[i+1:]...)
+		}
+	}
+	return deletions
+}
+
+func removePatch(patches []tr.NodePatch, uid string) []tr.NodePatch {
+	for i := range patches {
+		if patches[i].UID == uid {
+			return append(patches[:i], patches[i+1:]...)
+		}
+	}
+	return patches
+}
+
+func removeEdge(edges []tr.Edge, key [2]string) []tr.Edge {
+	for i := range edges {
+		if edges[i].SourceUID == key[0] && edges[i].DestUID == key[1] {
+			return append(edges[:i], edges[i+1:]...)
+		}
+	}
+	return edges
+}
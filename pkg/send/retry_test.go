@@ -0,0 +1,145 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package send
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	tr "github.com/stolostron/search-collector/pkg/transforms"
+)
+
+func nodeLookup(nodes ...tr.Node) func(string) (tr.Node, bool) {
+	return func(uid string) (tr.Node, bool) {
+		for _, n := range nodes {
+			if n.UID == uid {
+				return n, true
+			}
+		}
+		return tr.Node{}, false
+	}
+}
+
+func Test_retrySet_track(t *testing.T) {
+	rs := retrySet{}
+	payload := Payload{
+		AddEdges: []tr.Edge{
+			{SourceUID: "a", DestUID: "b", EdgeType: "ownedBy"},
+			{SourceUID: "a", DestUID: "c", EdgeType: "ownedBy"},
+			{SourceUID: "d", DestUID: "e", EdgeType: "ownedBy"},
+		},
+	}
+	r := SyncResponse{
+		AddErrors:     []SyncError{{ResourceUID: "x", Message: "insert failed: duplicate key"}},
+		UpdateErrors:  []SyncError{{ResourceUID: "y", Message: "update failed"}},
+		DeleteErrors:  []SyncError{{ResourceUID: "z", Message: "delete failed"}},
+		AddEdgeErrors: []SyncError{{ResourceUID: "a", Message: "insert failed"}},
+	}
+
+	rs.track(payload, r)
+
+	assert.Equal(t, map[string]tr.Operation{"x": tr.Create, "y": tr.Update, "z": tr.Delete}, rs.nodes)
+	assert.Len(t, rs.addEdges, 2, "Expected both edges of the source to be retried when the error has no DestUID.")
+	assert.Contains(t, rs.addEdges, [2]string{"a", "b"})
+	assert.Contains(t, rs.addEdges, [2]string{"a", "c"})
+	assert.Equal(t, 5, rs.size())
+}
+
+func Test_retrySet_trackEdges(t *testing.T) {
+	rs := retrySet{}
+	payload := Payload{
+		AddEdges: []tr.Edge{
+			{SourceUID: "a", DestUID: "b", EdgeType: "ownedBy"},
+			{SourceUID: "a", DestUID: "c", EdgeType: "ownedBy"},
+			{SourceUID: "d", DestUID: "x", EdgeType: "ownedBy"},
+			{SourceUID: "d", DestUID: "e", EdgeType: "ownedBy"},
+		},
+		DeleteEdges: []tr.Edge{
+			{SourceUID: "f", DestUID: "g", EdgeType: "usedBy"},
+			{SourceUID: "f", DestUID: "h", EdgeType: "usedBy"},
+		},
+	}
+	r := SyncResponse{
+		AddErrors:        []SyncError{{ResourceUID: "x", Message: "insert failed"}},
+		AddEdgeErrors:    []SyncError{{ResourceUID: "a", DestUID: "c", Message: "insert failed"}},
+		DeleteEdgeErrors: []SyncError{{ResourceUID: "f", DestUID: "h", Message: "delete failed"}},
+	}
+
+	rs.track(payload, r)
+
+	assert.Equal(t, map[[2]string]tr.Edge{
+		{"a", "c"}: payload.AddEdges[1],
+		{"d", "x"}: payload.AddEdges[2], // The destination failed to be added.
+	}, rs.addEdges)
+	assert.Equal(t, map[[2]string]tr.Edge{{"f", "h"}: payload.DeleteEdges[1]}, rs.deleteEdges)
+}
+
+func Test_retrySet_apply(t *testing.T) {
+	rs := retrySet{
+		nodes: map[string]tr.Operation{
+			"failedAdd":         tr.Create,
+			"failedAddUpdated":  tr.Create,
+			"failedAddDeleted":  tr.Create,
+			"failedUpdate":      tr.Update,
+			"failedDelete":      tr.Delete,
+			"failedDeleteAgain": tr.Delete,
+		},
+		addEdges: map[[2]string]tr.Edge{
+			{"failedAdd", "dest"}:        {SourceUID: "failedAdd", DestUID: "dest", EdgeType: "ownedBy"},
+			{"failedAddDeleted", "dest"}: {SourceUID: "failedAddDeleted", DestUID: "dest", EdgeType: "ownedBy"},
+		},
+		deleteEdges: map[[2]string]tr.Edge{
+			{"src", "dest"}: {SourceUID: "src", DestUID: "dest", EdgeType: "ownedBy"},
+		},
+	}
+	lookup := nodeLookup(
+		tr.Node{UID: "failedAdd"},
+		tr.Node{UID: "failedAddUpdated"},
+		tr.Node{UID: "failedUpdate"},
+	)
+	payload := Payload{
+		UpdatedResources: []tr.Node{{UID: "failedAddUpdated", Properties: map[string]interface{}{"name": "new"}}},
+		DeletedResources: []tr.Deletion{{UID: "failedAddDeleted"}, {UID: "failedDeleteAgain"}},
+		AddEdges:         []tr.Edge{{SourceUID: "src", DestUID: "dest", EdgeType: "ownedBy"}},
+	}
+
+	rs.apply(&payload, lookup)
+
+	assert.Equal(t, []tr.Node{
+		{UID: "failedAdd"},
+		{UID: "failedAddUpdated", Properties: map[string]interface{}{"name": "new"}},
+	}, payload.AddResources, "Expected failed adds to be sent as adds, including the ones updated since.")
+	assert.Equal(t, []tr.Node{{UID: "failedUpdate"}}, payload.UpdatedResources)
+	assert.Equal(t, []tr.Deletion{{UID: "failedDeleteAgain"}, {UID: "failedDelete"}}, payload.DeletedResources,
+		"Expected the delete of a node the aggregator never had to be dropped.")
+	assert.Equal(t, []tr.Edge{{SourceUID: "failedAdd", DestUID: "dest", EdgeType: "ownedBy"}}, payload.AddEdges,
+		"Expected the edge of the deleted node to be dropped and the edge added again to cancel the failed delete.")
+	assert.Empty(t, payload.DeleteEdges)
+	assert.Equal(t, 0, rs.size(), "Expected the retry set to be cleared.")
+}
+
+func Test_retrySet_applyPatches(t *testing.T) {
+	rs := retrySet{nodes: map[string]tr.Operation{"failedAdd": tr.Create, "failedUpdate": tr.Update}}
+	lookup := nodeLookup(tr.Node{UID: "failedAdd"}, tr.Node{UID: "failedUpdate"})
+	payload := Payload{PatchResources: []tr.NodePatch{
+		{UID: "failedAdd", Set: map[string]interface{}{"status": "Running"}},
+		{UID: "failedUpdate", Set: map[string]interface{}{"status": "Running"}},
+		{UID: "patched", Unset: []string{"label"}},
+	}}
+
+	rs.apply(&payload, lookup)
+
+	assert.Equal(t, []tr.Node{{UID: "failedAdd"}}, payload.AddResources)
+	assert.Equal(t, []tr.Node{{UID: "failedUpdate"}}, payload.UpdatedResources,
+		"Expected the whole node instead of the patch after a failed update.")
+	assert.Equal(t, []tr.NodePatch{{UID: "patched", Unset: []string{"label"}}}, payload.PatchResources)
+}
+
+func Test_retrySet_requeuePatches(t *testing.T) {
+	rs := retrySet{}
+
+	rs.requeue(Payload{PatchResources: []tr.NodePatch{{UID: "patched", Unset: []string{"label"}}}})
+
+	assert.Equal(t, map[string]tr.Operation{"patched": tr.Update}, rs.nodes)
+}
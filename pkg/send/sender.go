@@ -11,9 +11,9 @@ Copyright (c) 2020 Red Hat, Inc.
 package send
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -21,13 +21,16 @@ import (
 	"math"
 	"math/big"
 	"net/http"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"k8s.io/klog/v2"
 
 	"github.com/stolostron/search-collector/pkg/config"
+	"github.com/stolostron/search-collector/pkg/health"
 	"github.com/stolostron/search-collector/pkg/metrics"
 	"github.com/stolostron/search-collector/pkg/reconciler"
 	tr "github.com/stolostron/search-collector/pkg/transforms"
@@ -45,15 +48,23 @@ type Payload struct {
 	AddResources     []tr.Node     `json:"addResources,omitempty"`    // List of Nodes which must be added
 	UpdatedResources []tr.Node     `json:"updateResources,omitempty"` // List of Nodes that exist and must be updated
 
+	PatchResources []tr.NodePatch `json:"patchResources,omitempty"` // Changed properties of Nodes that exist, instead of UpdatedResources
+
 	AddEdges    []tr.Edge `json:"addEdges,omitempty"`    // List of Edges which must be added
 	DeleteEdges []tr.Edge `json:"deleteEdges,omitempty"` // List of Edges which must be deleted
 	ClearAll    bool      `json:"clearAll,omitempty"`    // Tells the aggregator to clear existing data first.
 	Version     string    `json:"version,omitempty"`     // Version of this collector
+
+	Resync    *ResyncChunk `json:"resync,omitempty"`    // Set when the complete state is sent in chunks.
+	StateHash string       `json:"stateHash,omitempty"` // Hash of the state after applying this payload.
+
+	KindHashes   map[string]string `json:"kindHashes,omitempty"`   // Hashes of the state by kind, to find the kinds that differ.
+	ReplaceKinds []string          `json:"replaceKinds,omitempty"` // Kinds to replace with the resources and edges in this payload.
 }
 
 func (p Payload) empty() bool {
 	return len(p.DeletedResources) == 0 && len(p.AddResources) == 0 && len(p.UpdatedResources) == 0 &&
-		len(p.AddEdges) == 0 && len(p.DeleteEdges) == 0
+		len(p.PatchResources) == 0 && len(p.AddEdges) == 0 && len(p.DeleteEdges) == 0
 }
 
 // SyncResponse - Response to a SyncEvent
@@ -71,49 +82,162 @@ type SyncResponse struct {
 	AddEdgeErrors     []SyncError
 	DeleteEdgeErrors  []SyncError
 	Version           string
+	StateHash         string            // Hash of the state the aggregator has for the cluster
+	KindHashes        map[string]string // Hashes of the state the aggregator has, by kind. Set when asked with KindHashes.
 }
 
 // SyncError is used to respond with errors.
 type SyncError struct {
 	ResourceUID string
+	DestUID     string `json:",omitempty"` // Destination of the failed edge, for the edge errors. Source is ResourceUID.
 	Message     string
 }
 
+// Source of the state sent by a Sender. The reconciler for the first aggregator, a cursor over it for the others.
+type stateSource interface {
+	Diff() reconciler.Diff
+	Complete() reconciler.CompleteState
+	StateHash() string
+	KindHashes() map[string]string
+	KindState(kinds []string) reconciler.State
+	SentState() reconciler.State
+	Restore(state reconciler.State)
+	GetNode(uid string) (tr.Node, bool)
+}
+
 // Keeps the total data for this cluster as well as the data since the last send operation.
 type Sender struct {
 	aggregatorURL      string // URL of the aggregator, minus any path
 	aggregatorSyncPath string // Path of the aggregator's POST route [ /aggregator/clusters/{clustername}/sync ]
+	contentEncoding    string // Encoding of the request body. Falls back to none if the aggregator rejects it.
 	httpClient         http.Client
 	lastSentTime       int64 // Time we last successfully sent data to the hub. Gets reset to -1 if a send cycle fails.
-	rec                *reconciler.Reconciler
+	rec                stateSource
+	retry              retrySet    // Resources and edges the aggregator failed to apply, resent with the next diff.
+	store              *stateStore // Saves the acknowledged state. Nil unless STATE_DIR is set.
+	restoredHash       string      // Hash of the state restored at startup, until the aggregator confirms it.
+	restoredNodes      int         // Nodes of the restored state, to check the totals when its kinds are replaced.
+	restoredEdges      int         // Edges of the restored state.
+	ackHash            string      // Hash of the state the aggregator acknowledged last. Empty if it's unknown.
+	ackSequence        int64       // Sequence of the last acknowledged state, saved with its hash.
+	savedSequence      int64       // Sequence of the last saved state.
+	lastStateSave      time.Time   // Time the state was last saved.
+	signer             *signer     // Signs the sync requests. Nil unless SIGNING_KEY_FILE is set.
+	features           *featureSet // Features the aggregator supports. Nil when they aren't negotiated.
+	sink               Sink        // Receives the payloads. Senders built without NewSender send to the aggregator.
+	notBefore          time.Time   // Earliest time to send again, as asked by the aggregator.
+	target             string      // Name of the aggregator target, to reload its config.
+	resync             atomic.Bool // Set by ForceResync to send the complete state with the next sync.
 }
 
 func (s *Sender) reloadSender() {
-	s.aggregatorURL = config.Cfg.AggregatorURL
+	target, ok := config.Cfg.AggregatorTarget(s.target)
+	if !ok {
+		klog.Warningf("Aggregator target %s is no longer configured. Keeping its previous config.", s.target)
+		return
+	}
+	s.aggregatorURL = target.URL
 	s.aggregatorSyncPath = strings.Join([]string{"/aggregator/clusters/", config.Cfg.ClusterName, "/sync"}, "")
 	if !config.Cfg.DeployedInHub {
 		s.aggregatorSyncPath = strings.Join([]string{"/", config.Cfg.ClusterName, "/aggregator/sync"}, "")
 	}
-	s.httpClient = getHTTPSClient()
+	s.contentEncoding = contentEncodingFor(config.Cfg.SyncCompression)
+	s.httpClient = getHTTPSClient(target)
+	if s.features != nil {
+		// Fetch the capabilities again with the next sync, the aggregator may have changed.
+		s.features = newFeatureSet()
+	}
+	if sg, err := newSigner(config.Cfg.ClusterName); err != nil {
+		klog.Warning("Error reloading the signing key. Keeping the previous one. ", err)
+	} else {
+		if sg != nil {
+			sg.restoreSequence(s.store)
+		}
+		s.signer = sg
+	}
 }
 
 // Constructs a new Sender using the provided channels.
 // Sends to the URL provided by aggregatorURL, listing itself as clusterName.
 func NewSender(rec *reconciler.Reconciler, aggregatorURL, clusterName string) *Sender {
+	target := config.AggregatorTarget{
+		Name:   config.DEFAULT_AGGREGATOR_TARGET,
+		URL:    aggregatorURL,
+		Config: config.Cfg.AggregatorConfig,
+	}
+	return newSender(rec, target, clusterName)
+}
+
+// Constructs a Sender for each aggregator target. Each one keeps its own diff cursor, backoff and
+// lastSentTime, so a slow or unreachable hub doesn't hold back the others.
+// Other sinks get a single Sender.
+func NewSenders(rec *reconciler.Reconciler, clusterName string) []*Sender {
+	if !config.Cfg.SendsToAggregator() || len(config.Cfg.AggregatorTargets) == 0 {
+		return []*Sender{NewSender(rec, config.Cfg.AggregatorURL, clusterName)}
+	}
+	senders := make([]*Sender, 0, len(config.Cfg.AggregatorTargets))
+	for i, target := range config.Cfg.AggregatorTargets {
+		// The first target uses the changes tracked by the reconciler, the others a cursor that tracks its own.
+		var source stateSource = rec
+		if i > 0 {
+			source = rec.NewCursor()
+		}
+		senders = append(senders, newSender(source, target, clusterName))
+	}
+	return senders
+}
+
+func newSender(rec stateSource, target config.AggregatorTarget, clusterName string) *Sender {
 
 	// Construct senders
 	s := &Sender{
-		aggregatorURL:      aggregatorURL,
+		aggregatorURL:      target.URL,
 		aggregatorSyncPath: strings.Join([]string{"/aggregator/clusters/", clusterName, "/sync"}, ""),
-		httpClient:         getHTTPSClient(),
+		contentEncoding:    contentEncodingFor(config.Cfg.SyncCompression),
+		httpClient:         getHTTPSClient(target),
 		lastSentTime:       -1,
 		rec:                rec,
+		target:             target.Name,
 	}
 
 	if !config.Cfg.DeployedInHub {
 		s.aggregatorSyncPath = strings.Join([]string{"/", clusterName, "/aggregator/sync"}, "")
 	}
 
+	sg, err := newSigner(clusterName)
+	if err != nil {
+		// Exit because this is an unrecoverable configuration problem.
+		klog.Fatal("Error loading the signing key. Original error: ", err)
+	}
+	s.signer = sg
+
+	sink, err := newSink(s, config.Cfg.Sink)
+	if err != nil {
+		klog.Fatalf("Error creating the %s sink: %s", config.Cfg.Sink, err)
+	}
+	s.sink = sink
+
+	// Only the aggregator can confirm it still has the saved state. Additional targets keep their state in
+	// a directory named after the target.
+	if _, ok := sink.(aggregatorSink); ok && config.Cfg.StateDir != "" {
+		dir := config.Cfg.StateDir
+		if target.Name != config.DEFAULT_AGGREGATOR_TARGET {
+			dir = filepath.Join(dir, target.Name)
+		}
+		s.store = newStateStore(dir)
+		s.restoreState()
+	}
+	if s.signer != nil {
+		s.signer.restoreSequence(s.store)
+		if _, ok := sink.(aggregatorSink); ok && s.store == nil {
+			klog.Warning("STATE_DIR isn't set, the signature sequence starts from the clock after each restart. " +
+				"If the clock goes back, the aggregator rejects the requests as replays until it catches up.")
+		}
+	}
+	if _, ok := sink.(aggregatorSink); ok && config.Cfg.CapabilitiesTTLMS > 0 {
+		s.features = newFeatureSet()
+	}
+
 	return s
 }
 
@@ -132,6 +256,12 @@ func (s *Sender) diffPayload() (Payload, int, int) {
 
 		AddEdges:    diff.AddEdges,
 		DeleteEdges: diff.DeleteEdges,
+		StateHash:   diff.StateHash,
+	}
+	// Send only the changed properties of updated nodes, if the aggregator can apply them.
+	if s.supports(featureNodePatch) {
+		payload.UpdatedResources = nil
+		payload.PatchResources = diff.PatchNodes
 	}
 
 	return payload, diff.TotalNodes, diff.TotalEdges
@@ -147,31 +277,49 @@ func (s *Sender) completePayload() (Payload, int, int) {
 		ClearAll:     true,
 		AddResources: complete.Nodes,
 
-		AddEdges: complete.Edges,
+		AddEdges:  complete.Edges,
+		StateHash: complete.StateHash,
 	}
 	return payload, complete.TotalNodes, complete.TotalEdges
 }
 
+// Returns the state sent with the last payload as a complete payload, without building the state again.
+func (s *Sender) sentPayload() (Payload, int, int) {
+	state := s.rec.SentState()
+	payload := Payload{
+		ClearAll:     true,
+		AddResources: state.Nodes,
+
+		AddEdges:  state.Edges,
+		StateHash: s.rec.StateHash(),
+	}
+	return payload, len(state.Nodes), len(state.Edges)
+}
+
 // Send will retry after recoverable errors.
-//   - indexer busy
-func (s *Sender) sendWithRetry(payload Payload, expectedTotalResources int, expectedTotalEdges int) error {
+//   - indexer busy, waiting as long as the indexer asks with Retry-After
+func (s *Sender) sendWithRetry(ctx context.Context, payload Payload, expectedTotalResources int, expectedTotalEdges int) error {
 	retry := 0
 	for {
-		sendError := s.send(payload, expectedTotalResources, expectedTotalEdges)
+		sendError := s.send(ctx, payload, expectedTotalResources, expectedTotalEdges)
 		retry++
-		nextRetryWait := sendInterval(retry)
+		nextRetryWait := retryWait(sendError, retry)
 
 		// If indexer was busy, wait and retry with the same payload.
-		if sendError != nil && sendError.Error() == "indexer busy" {
+		if sendError != nil && isBusy(sendError) {
 			klog.Warningf("Received busy response from Indexer. Resending in %s.", nextRetryWait)
-			time.Sleep(nextRetryWait)
+			if err := sleep(ctx, nextRetryWait); err != nil {
+				return sendError
+			}
 			continue
 		}
 		// For other errors, wait, reload the config, and re-send the full state payload.
 		if sendError != nil {
 			klog.Warningf("Received error response [%s] from Indexer. Resetting config and resending in %s.",
 				sendError.Error(), nextRetryWait)
-			time.Sleep(nextRetryWait)
+			if err := sleep(ctx, nextRetryWait); err != nil {
+				return sendError
+			}
 			config.InitConfig() // re-initialize config to get the latest certificate.
 			s.reloadSender()    // reload sender variables - Aggregator URL, path and client
 		}
@@ -182,31 +330,67 @@ func (s *Sender) sendWithRetry(payload Payload, expectedTotalResources int, expe
 // Sends data to the aggregator and returns an error if it didn't work.
 // Pointer receiver because Sender contains a mutex - that freaked the linter out even though it
 // doesn't use the mutex. Changed it so that if we do need to use the mutex we wont have any problems.
-func (s *Sender) send(payload Payload, expectedTotalResources int, expectedTotalEdges int) error {
-	klog.Infof("Sending Resources { add: %2d, update: %2d, delete: %2d, edge add: %2d, edge delete: %2d }",
-		len(payload.AddResources), len(payload.UpdatedResources), len(payload.DeletedResources),
-		len(payload.AddEdges), len(payload.DeleteEdges))
+func (s *Sender) send(ctx context.Context, payload Payload, expectedTotalResources int, expectedTotalEdges int) error {
+	r, err := s.post(ctx, payload)
+	if err != nil {
+		return err
+	}
+	if err = verifyTotals(r, expectedTotalResources, expectedTotalEdges); err != nil {
+		return err
+	}
+	// Keep what the aggregator failed to apply, so we resend it with the next diff.
+	s.retry.track(payload, r)
+	if err = s.retry.checkLimit(); err != nil {
+		return err
+	}
+	return s.checkStateHash(ctx, payload, r, expectedTotalResources, expectedTotalEdges)
+}
+
+// POSTs the payload to the aggregator and returns the decoded response.
+func (s *Sender) post(ctx context.Context, payload Payload) (SyncResponse, error) {
+	klog.Infof("Sending Resources { add: %2d, update: %2d, patch: %2d, delete: %2d, edge add: %2d, edge delete: %2d }",
+		len(payload.AddResources), len(payload.UpdatedResources), len(payload.PatchResources),
+		len(payload.DeletedResources), len(payload.AddEdges), len(payload.DeleteEdges))
 
 	syncType := "sync"
-	if payload.ClearAll {
+	if payload.ClearAll || payload.Resync != nil {
 		syncType = "resync"
 	}
 
-	payloadBytes, err := json.Marshal(payload)
-	if err != nil {
-		return err
+	// Stream the payload into the request body, so we never hold the complete encoded payload in memory.
+	encoding := s.contentEncoding
+	if isCompressed(encoding) && !s.supports(encoding) {
+		encoding = encodingNone
 	}
-	payloadBuffer := bytes.NewBuffer(payloadBytes)
+	body, encoded := payloadReader(payload, encoding)
 
-	req, err := http.NewRequest("POST", s.aggregatorURL+s.aggregatorSyncPath, payloadBuffer)
+	req, err := http.NewRequestWithContext(ctx, "POST", s.aggregatorURL+s.aggregatorSyncPath, body)
 	if err != nil {
-		return err
+		_ = body.Close()
+		return SyncResponse{}, err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("X-Overwrite-State", strconv.FormatBool(payload.ClearAll))
+	if isCompressed(encoding) {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	if s.signer != nil {
+		// The signature is sent before the streamed body, hash the same encoded body in a first pass. The
+		// encoders write the same output for the same payload.
+		bodyHash := sha256.New()
+		if hashed := encodePayload(bodyHash, payload, encoding); hashed.err != nil {
+			_ = body.Close()
+			<-encoded
+			return SyncResponse{}, hashed.err
+		}
+		s.signer.sign(req, bodyHash.Sum(nil))
+	}
 
 	resp, err := s.httpClient.Do(req)
+	// Stop the encoder if the request ended before it wrote the complete payload.
+	_ = body.Close()
+	sizes := <-encoded
 	if resp != nil && resp.Body != nil {
 		// #nosec G307
 		defer func(Body io.ReadCloser) {
@@ -215,28 +399,44 @@ func (s *Sender) send(payload Payload, expectedTotalResources int, expectedTotal
 	}
 	if err != nil {
 		klog.Error("httpClient error: ", err)
-		return err
+		return SyncResponse{}, err
 	}
 
 	metrics.SyncRequestTotal.WithLabelValues(strconv.Itoa(resp.StatusCode), syncType).Inc()
-	if resp.StatusCode == http.StatusTooManyRequests {
-		return errors.New("indexer busy")
+	s.recordNextSyncHint(resp.Header)
+	// Aggregators that don't support the encoding reject the body. Fall back to plain JSON and resend.
+	if isCompressed(encoding) && rejectsEncoding(resp) {
+		klog.Warningf("Aggregator rejected %s encoded payload with StatusCode: %d. Falling back to uncompressed JSON.",
+			encoding, resp.StatusCode)
+		s.contentEncoding = encodingNone
+		return s.post(ctx, payload)
+	}
+	retryAfter, hasRetryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	if resp.StatusCode == http.StatusTooManyRequests ||
+		(resp.StatusCode == http.StatusServiceUnavailable && hasRetryAfter) {
+		return SyncResponse{}, busyError{retryAfter: retryAfter}
 	} else if resp.StatusCode != http.StatusOK {
 		msg := fmt.Sprintf("POST to: %s responded with error. StatusCode: %d  Message: %s",
 			s.aggregatorURL+s.aggregatorSyncPath, resp.StatusCode, resp.Status)
 		if resp.StatusCode == http.StatusUnauthorized {
 			msg = "401 Unauthorized"
 		}
-		return errors.New(msg)
+		return SyncResponse{}, errors.New(msg)
 	}
 
+	recordCompression(encoding, sizes.uncompressedSize, sizes.compressedSize)
+
 	r := SyncResponse{}
 	err = json.NewDecoder(resp.Body).Decode(&r)
 	if err != nil {
 		klog.Error("Error decoding JSON response.")
-		return err
+		return SyncResponse{}, err
 	}
+	return r, nil
+}
 
+// Compares the totals reported by the aggregator with the totals we track.
+func verifyTotals(r SyncResponse, expectedTotalResources int, expectedTotalEdges int) error {
 	// Compare size that comes back in r to size that we track, accounting for the errors reported by the aggregator.
 	if r.TotalResources != (expectedTotalResources + len(r.DeleteErrors) - len(r.AddErrors)) {
 		msg := fmt.Sprintf("Aggregator reported wrong number of total resources. Expected %d, got %d",
@@ -254,25 +454,45 @@ func (s *Sender) send(payload Payload, expectedTotalResources int, expectedTotal
 	return nil
 }
 
+// ForceResync makes the next sync send the complete state, like after a failed sync cycle.
+// Safe to call from other goroutines.
+func (s *Sender) ForceResync() {
+	s.resync.Store(true)
+}
+
 // Sends data to the aggregator.
 // Attempts to send a diff, then just sends the complete if the aggregator appears to need that.
-func (s *Sender) Sync() error {
-	if s.lastSentTime == -1 { // If we have never sent before, we just send the complete.
+// Stops when the context is done. An interrupted diff is resent with the next diff.
+func (s *Sender) Sync(ctx context.Context) error {
+	if s.sink == nil {
+		s.sink = aggregatorSink{s: s}
+	}
+	s.refreshCapabilities(ctx)
+	if s.resync.Swap(false) {
+		klog.Infof("Resync requested for aggregator %s.", s.target)
+		s.lastSentTime = -1
+	}
+	// If we have never sent before, we just send the complete. Unless the aggregator still has the state
+	// we restored after a restart.
+	if s.lastSentTime == -1 && !s.confirmRestoredState(ctx) {
 		klog.Info("First time sending or last Sync cycle failed, sending complete payload")
 		payload, expectedTotalResources, expectedTotalEdges := s.completePayload()
-		err := s.sendWithRetry(payload, expectedTotalResources, expectedTotalEdges)
+		err := s.sink.SendComplete(ctx, payload, expectedTotalResources, expectedTotalEdges)
 		if err != nil {
 			klog.Error("Sync sender error. ", err)
 			return err
 		}
 
+		s.acknowledge(payload.StateHash)
 		s.lastSentTime = time.Now().Unix()
 		return nil
 	}
 
 	// If this isn't the first time we've sent, we can now attempt to send a diff.
 	payload, expectedTotalResources, expectedTotalEdges := s.diffPayload()
-	if payload.empty() {
+	s.retry.apply(&payload, s.rec.GetNode)
+	empty := payload.empty()
+	if empty {
 		// check if a ping is necessary
 		if time.Now().Unix()-s.lastSentTime < int64(config.Cfg.HeartbeatMS/1000) {
 			klog.V(3).Info("Nothing to send, skipping send cycle.")
@@ -280,14 +500,20 @@ func (s *Sender) Sync() error {
 		}
 		klog.V(2).Info("Sending empty payload for heartbeat.")
 	}
-	err := s.sendWithRetry(payload, expectedTotalResources, expectedTotalEdges)
+	err := s.sink.SendDiff(ctx, payload, expectedTotalResources, expectedTotalEdges)
+	if err != nil && ctx.Err() != nil {
+		// Shutting down, there is no time for the complete payload. Keep the diff for the final flush.
+		klog.Warning("Diff payload sending was interrupted: ", err)
+		s.retry.requeue(payload)
+		return err
+	}
 	if err != nil {
 		// If something went wrong here, form a new complete payload (only necessary because
 		// currentState may have changed since we got it, and we have to keep our diffs synced)
 		klog.Warning("Error on diff payload sending: ", err)
 		payload, expectedTotalResources, expectedTotalEdges := s.completePayload()
 		klog.Warning("Retrying with complete payload")
-		err := s.sendWithRetry(payload, expectedTotalResources, expectedTotalEdges)
+		err := s.sink.SendComplete(ctx, payload, expectedTotalResources, expectedTotalEdges)
 		if err != nil {
 			klog.Error("Error resending complete payload.")
 			// If this retry fails, we want to start over with a complete payload next time,
@@ -295,10 +521,14 @@ func (s *Sender) Sync() error {
 			s.lastSentTime = -1
 			return err
 		}
+		s.acknowledge(payload.StateHash)
 		s.lastSentTime = time.Now().Unix()
 		return nil
 	}
 
+	if !empty {
+		s.acknowledge(payload.StateHash)
+	}
 	s.lastSentTime = time.Now().Unix()
 	return nil
 }
@@ -312,14 +542,22 @@ func (s *Sender) StartSendLoop(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
+			s.flush()
+			s.saveState(true)
+			if s.sink != nil {
+				if err := s.sink.Close(); err != nil {
+					klog.Warning("Error closing the sink. ", err)
+				}
+			}
 			return
 		default:
 		}
 
-		klog.V(3).Info("Beginning Send Cycle")
-		err := s.Sync()
+		klog.V(3).Info("Beginning Send Cycle for aggregator ", s.target)
+		health.SendCycle(s.target, 0)
+		err := s.Sync(ctx)
 		if err != nil {
-			klog.Error("SEND ERROR: ", err)
+			klog.Errorf("SEND ERROR [%s]: %s", s.target, err)
 			// Increase the backoffFactor, doubling the wait time. Stops increasing after it passes the max
 			// wait time so that we don't overflow int. Can be changed with env:MAX_BACKOFF_MS
 			if sendInterval(backoffFactor) < time.Duration(config.Cfg.MaxBackoffMS)*time.Millisecond {
@@ -327,6 +565,8 @@ func (s *Sender) StartSendLoop(ctx context.Context) {
 			}
 		} else {
 			klog.V(2).Info("Send Cycle Completed Successfully")
+			health.SendSucceeded()
+			s.saveState(false)
 			backoffFactor = 1 // Reset backoff to 1 because we had a sucessful send.
 		}
 
@@ -334,11 +574,36 @@ func (s *Sender) StartSendLoop(ctx context.Context) {
 		if backoffFactor > 1 {
 			klog.Warningf("Error during last sync. Resending in %s.", nextSendWait)
 		}
-		// Sleep either for the current backed off interval, or the maximum time defined in the config
-		time.Sleep(nextSendWait)
+		// Wait longer if the aggregator asked for it.
+		if untilAllowed := time.Until(s.notBefore); untilAllowed > nextSendWait {
+			klog.V(2).Infof("Waiting %s for the next sync, as asked by the aggregator.", untilAllowed)
+			nextSendWait = untilAllowed
+		}
+		health.SendCycle(s.target, nextSendWait)
+		// Sleep either for the current backed off interval, or the maximum time defined in the config.
+		// Returns early on shutdown, the loop flushes the last changes.
+		_ = sleep(ctx, nextSendWait)
 	}
 }
 
+// Sends the changes since the last sync before shutting down, bounded by SHUTDOWN_FLUSH_TIMEOUT_MS.
+// Skipped if nothing was sent yet, the next collector sends the complete state anyway.
+func (s *Sender) flush() {
+	if s.lastSentTime == -1 || config.Cfg.ShutdownFlushTimeoutMS <= 0 {
+		return
+	}
+	timeout := time.Duration(config.Cfg.ShutdownFlushTimeoutMS) * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	klog.Infof("Flushing the last changes before shutting down. Waiting up to %s.", timeout)
+	if err := s.Sync(ctx); err != nil {
+		klog.Warning("Failed to flush the last changes before shutting down. ", err)
+		return
+	}
+	klog.Info("Flushed the last changes.")
+}
+
 // Returns the smaller of two ints
 func min(a, b int) int {
 	if a > b {
@@ -355,6 +620,9 @@ func sendInterval(retry int) time.Duration {
 
 // Generate a random jitter to add to the backoff retry to prevent clients from retrying at the same interval.
 func addJitter() int {
+	if config.Cfg.RetryJitterMS <= 0 {
+		return 0
+	}
 	max := big.NewInt(int64(config.Cfg.RetryJitterMS))
 	j, err := rand.Int(rand.Reader, max)
 	if err != nil {
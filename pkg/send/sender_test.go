@@ -11,13 +11,18 @@ irrespective of what has been deposited with the U.S. Copyright Office.
 package send
 
 import (
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/stolostron/search-collector/pkg/config"
+	"github.com/stolostron/search-collector/pkg/reconciler"
 	"github.com/stolostron/search-collector/pkg/transforms"
 	"github.com/stretchr/testify/assert"
 )
@@ -43,7 +48,7 @@ func TestSenderWrongCount(t *testing.T) {
 
 	payload := Payload{}
 
-	err := s.send(payload, 5, 0)
+	err := s.send(context.Background(), payload, 5, 0)
 	if err == nil {
 		t.Fatal("send function does not error when expected count differs")
 	}
@@ -68,7 +73,7 @@ func TestSenderUnavailable(t *testing.T) {
 
 	payload := Payload{}
 
-	err := s.send(payload, 0, 0)
+	err := s.send(context.Background(), payload, 0, 0)
 	if err == nil {
 		t.Fatal("send function does not error if server returns a 503")
 	}
@@ -113,12 +118,136 @@ func TestSenderSuccessful(t *testing.T) {
 		})
 	}
 
-	err := s.send(payload, n, n)
+	err := s.send(context.Background(), payload, n, n)
 	if err != nil {
 		t.Fatal("send function reports error:", err)
 	}
 }
 
+func TestSenderPartialFailure(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := SyncResponse{
+			TotalResources: 1,
+			TotalAdded:     1,
+			AddErrors:      []SyncError{{ResourceUID: "Node1", Message: "insert failed: bad property"}},
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		err := json.NewEncoder(w).Encode(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}))
+	defer ts.Close()
+
+	s := Sender{
+		httpClient:    *ts.Client(),
+		aggregatorURL: ts.URL,
+	}
+	payload := Payload{
+		AddResources: []transforms.Node{{UID: "Node0"}, {UID: "Node1"}},
+	}
+
+	config.Cfg.MaxSyncErrors = 1
+	err := s.send(context.Background(), payload, 2, 0)
+	assert.Nil(t, err, "Expected errors within the limit to be retried with the next diff.")
+	assert.Equal(t, map[string]transforms.Operation{"Node1": transforms.Create}, s.retry.nodes)
+
+	config.Cfg.MaxSyncErrors = 0
+	err = s.send(context.Background(), payload, 2, 0)
+	assert.NotNil(t, err, "Expected errors over the limit to fail the sync.")
+	config.Cfg.MaxSyncErrors = config.DEFAULT_MAX_SYNC_ERRORS
+}
+
+func TestSenderGzipPayload(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload := Payload{}
+		if err := json.NewDecoder(reader).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		_ = json.NewEncoder(w).Encode(SyncResponse{TotalResources: len(payload.AddResources)})
+	}))
+	defer ts.Close()
+
+	s := Sender{
+		httpClient:      *ts.Client(),
+		aggregatorURL:   ts.URL,
+		contentEncoding: encodingGzip,
+	}
+
+	payload := Payload{AddResources: []transforms.Node{{UID: "Node1"}, {UID: "Node2"}}}
+
+	err := s.send(context.Background(), payload, 2, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, encodingGzip, s.contentEncoding)
+}
+
+func TestSenderCompressionFallback(t *testing.T) {
+	requests := 0
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Content-Encoding") != "" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		_ = json.NewEncoder(w).Encode(SyncResponse{})
+	}))
+	defer ts.Close()
+
+	s := Sender{
+		httpClient:      *ts.Client(),
+		aggregatorURL:   ts.URL,
+		contentEncoding: encodingZstd,
+	}
+
+	err := s.send(context.Background(), Payload{}, 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, encodingNone, s.contentEncoding)
+}
+
+func TestSenderCompressionBadRequest(t *testing.T) {
+	requests := 0
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "invalid signature", http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	s := Sender{
+		httpClient:      *ts.Client(),
+		aggregatorURL:   ts.URL,
+		contentEncoding: encodingZstd,
+	}
+
+	_, err := s.post(context.Background(), Payload{})
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, requests)
+	assert.Equal(t, encodingZstd, s.contentEncoding, "Expected a rejected payload to keep the compression.")
+
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Content-Encoding") != "" {
+			http.Error(w, "unsupported Content-Encoding zstd", http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(SyncResponse{})
+	})
+	_, err = s.post(context.Background(), Payload{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, requests)
+	assert.Equal(t, encodingNone, s.contentEncoding)
+}
+
 func Test_minIsB(t *testing.T) {
 	min := min(11, 99)
 	assert.Equal(t, 11, min)
@@ -144,3 +273,117 @@ func Test_sendInterval_minBackoff(t *testing.T) {
 	assert.GreaterOrEqual(t, wait.Milliseconds(), int64(0))
 	assert.LessOrEqual(t, wait.Milliseconds(), int64(6000))
 }
+
+// Records the payloads. Fails diffs once the context is done, like an interrupted request.
+type recordingSink struct {
+	completes []Payload
+	diffs     []Payload
+}
+
+func (rs *recordingSink) SendComplete(ctx context.Context, payload Payload, _, _ int) error {
+	rs.completes = append(rs.completes, payload)
+	return nil
+}
+
+func (rs *recordingSink) SendDiff(ctx context.Context, payload Payload, _, _ int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	rs.diffs = append(rs.diffs, payload)
+	return nil
+}
+
+func (rs *recordingSink) Close() error { return nil }
+
+func TestSenderFlush(t *testing.T) {
+	rec := reconciler.NewReconciler()
+	rec.Restore(reconciler.State{Nodes: []transforms.Node{{UID: "n1", Properties: map[string]interface{}{"kind": "Pod"}}}})
+	sink := &recordingSink{}
+	s := Sender{
+		lastSentTime: time.Now().Unix(),
+		rec:          rec,
+		sink:         sink,
+	}
+
+	// The diff deleting n1 is interrupted by the shutdown.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NotNil(t, s.Sync(ctx))
+	assert.Empty(t, sink.completes, "Expected no complete payload after an interrupted diff.")
+	assert.Equal(t, 1, s.retry.size())
+
+	s.flush()
+
+	assert.Len(t, sink.diffs, 1)
+	assert.Equal(t, []transforms.Deletion{{UID: "n1"}}, sink.diffs[0].DeletedResources)
+	assert.Equal(t, 0, s.retry.size())
+}
+
+func TestSenderForceResync(t *testing.T) {
+	sink := &recordingSink{}
+	s := Sender{
+		lastSentTime: time.Now().Unix(),
+		rec:          reconciler.NewReconciler(),
+		sink:         sink,
+	}
+
+	s.ForceResync()
+	assert.Nil(t, s.Sync(context.Background()))
+	assert.Nil(t, s.Sync(context.Background()))
+
+	assert.Len(t, sink.completes, 1, "Expected a single complete payload after the resync request.")
+	assert.True(t, sink.completes[0].ClearAll)
+	assert.NotEqual(t, int64(-1), s.lastSentTime)
+}
+
+func TestSenderFlushNothingSent(t *testing.T) {
+	sink := &recordingSink{}
+	s := Sender{
+		lastSentTime: -1,
+		rec:          reconciler.NewReconciler(),
+		sink:         sink,
+	}
+
+	s.flush()
+
+	assert.Empty(t, sink.completes)
+	assert.Empty(t, sink.diffs)
+}
+
+func TestNewSendersFanOut(t *testing.T) {
+	defer func(targets []config.AggregatorTarget) { config.Cfg.AggregatorTargets = targets }(config.Cfg.AggregatorTargets)
+
+	healthy := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(SyncResponse{})
+	}))
+	defer healthy.Close()
+	down := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer down.Close()
+
+	config.Cfg.AggregatorTargets = []config.AggregatorTarget{
+		{Name: config.DEFAULT_AGGREGATOR_TARGET, URL: down.URL},
+		{Name: "hub-1", URL: healthy.URL},
+	}
+	rec := reconciler.NewReconciler()
+	senders := NewSenders(rec, "cluster")
+
+	assert.Len(t, senders, 2)
+	assert.Equal(t, down.URL, senders[0].aggregatorURL)
+	assert.Equal(t, healthy.URL, senders[1].aggregatorURL)
+	assert.Same(t, rec, senders[0].rec, "Expected the first target to use the reconciler.")
+	assert.IsType(t, &reconciler.Cursor{}, senders[1].rec, "Expected the other targets to use their own cursor.")
+
+	senders[0].httpClient = *down.Client()
+	senders[1].httpClient = *healthy.Client()
+	for _, s := range senders {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		_ = s.Sync(ctx)
+		cancel()
+	}
+
+	assert.Equal(t, int64(-1), senders[0].lastSentTime)
+	assert.NotEqual(t, int64(-1), senders[1].lastSentTime, "Expected the healthy hub not to be held back.")
+}
@@ -0,0 +1,186 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package send
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/stolostron/search-collector/pkg/config"
+)
+
+// Algorithms accepted in SIGNING_ALGORITHM.
+const (
+	signingHMACSHA256 = "hmac-sha256"
+	signingEd25519    = "ed25519"
+)
+
+// Headers of the detached signature sent with each sync request.
+const (
+	SignatureHeader          = "X-Signature"           // Base64 signature of the signed message
+	SignatureAlgorithmHeader = "X-Signature-Algorithm" // hmac-sha256 or ed25519
+	SignatureKeyIDHeader     = "X-Signature-Key-Id"    // Identifies the key that signed the request
+	SignatureSequenceHeader  = "X-Signature-Sequence"  // Increases with every request, to reject replays
+)
+
+// Number of sequence numbers reserved with each write of the sequence file, so it isn't written with every request.
+const sequenceBlock = 1000
+
+// Returns the message that is signed: the cluster name, the sequence number, the method, the path and the
+// X-Overwrite-State header of the request, and the SHA-256 of the request body as sent, after compression.
+// The path is the sync route of the aggregator, see syncRoute.
+func signedMessage(cluster string, sequence int64, method, path, overwriteState string, bodyHash []byte) []byte {
+	return []byte(fmt.Sprintf("v2\n%s\n%d\n%s\n%s\n%s\n%s", cluster, sequence, method, path, overwriteState,
+		hex.EncodeToString(bodyHash)))
+}
+
+// Returns the sync route of the cluster as the aggregator serves it. The requests from managed clusters go to
+// the hub proxy first, which forwards them to this route, so it's signed instead of the path of the request.
+func syncRoute(cluster string) string {
+	return "/aggregator/clusters/" + cluster + "/sync"
+}
+
+// Signs the sync requests of a cluster with the key from SIGNING_KEY_FILE.
+type signer struct {
+	algorithm  string
+	keyID      string
+	cluster    string
+	hmacKey    []byte
+	ed25519Key ed25519.PrivateKey
+
+	mutex        sync.Mutex
+	lastSequence int64
+	reserved     int64       // Last sequence number saved in the store
+	store        *stateStore // Keeps the sequence across restarts. Nil starts it from the clock.
+}
+
+// Loads the signing key from the SIGNING_* settings. Returns nil when SIGNING_KEY_FILE isn't set.
+func newSigner(cluster string) (*signer, error) {
+	if config.Cfg.SigningKeyFile == "" {
+		return nil, nil
+	}
+	key, err := os.ReadFile(config.Cfg.SigningKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	sg := &signer{algorithm: strings.ToLower(strings.TrimSpace(config.Cfg.SigningAlgorithm)), cluster: cluster}
+	switch sg.algorithm {
+	case signingHMACSHA256:
+		sg.hmacKey = []byte(strings.TrimSpace(string(key)))
+		if len(sg.hmacKey) < 32 {
+			return nil, fmt.Errorf("HMAC key in %s is too short, it needs at least 32 bytes", config.Cfg.SigningKeyFile)
+		}
+		// Derived from the key without revealing it, so a rotated key gets a new ID.
+		mac := hmac.New(sha256.New, sg.hmacKey)
+		mac.Write([]byte("key-id"))
+		sg.keyID = hex.EncodeToString(mac.Sum(nil)[:8])
+	case signingEd25519:
+		if sg.ed25519Key, err = parseEd25519PrivateKey(key); err != nil {
+			return nil, fmt.Errorf("error parsing the Ed25519 key in %s: %w", config.Cfg.SigningKeyFile, err)
+		}
+		publicKeyHash := sha256.Sum256(sg.ed25519Key.Public().(ed25519.PublicKey))
+		sg.keyID = hex.EncodeToString(publicKeyHash[:8])
+	default:
+		return nil, fmt.Errorf("unsupported SIGNING_ALGORITHM [%s], expected %s or %s", config.Cfg.SigningAlgorithm,
+			signingHMACSHA256, signingEd25519)
+	}
+	if config.Cfg.SigningKeyID != "" {
+		sg.keyID = config.Cfg.SigningKeyID
+	}
+	return sg, nil
+}
+
+// Parses a PEM encoded PKCS #8 Ed25519 private key, as written by `openssl genpkey -algorithm ed25519`.
+func parseEd25519PrivateKey(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an Ed25519 key, got %T", key)
+	}
+	return edKey, nil
+}
+
+// Continues the sequence saved in the store, so it keeps increasing after the collector restarts without
+// depending on the clock. Without a store, or before the sequence was saved, starts from the current time in
+// nanoseconds, which is greater than the sequence sent by earlier collector versions.
+func (sg *signer) restoreSequence(store *stateStore) {
+	sg.mutex.Lock()
+	defer sg.mutex.Unlock()
+	sg.store = store
+	if store == nil {
+		return
+	}
+	saved, err := store.loadSequence()
+	if err == nil && saved.Cluster == sg.cluster {
+		sg.lastSequence = max(sg.lastSequence, saved.Reserved)
+	} else {
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			klog.Warningf("Failed to load the signature sequence from %s. Starting it from the clock. Error: %s",
+				store.dir, err)
+		}
+		sg.lastSequence = max(sg.lastSequence, time.Now().UnixNano())
+	}
+	sg.reserved = sg.lastSequence
+}
+
+// Returns the next sequence number. With a store, saves the next block of sequence numbers before using the
+// first one of it, so a restarted collector never sends a sequence number again.
+func (sg *signer) nextSequence() int64 {
+	sg.mutex.Lock()
+	defer sg.mutex.Unlock()
+	if sg.store == nil {
+		sg.lastSequence = max(sg.lastSequence+1, time.Now().UnixNano())
+		return sg.lastSequence
+	}
+	sg.lastSequence++
+	if sg.lastSequence > sg.reserved {
+		sg.reserved = sg.lastSequence + sequenceBlock - 1
+		err := sg.store.saveSequence(savedSignatureSequence{Cluster: sg.cluster, Reserved: sg.reserved})
+		if err != nil {
+			klog.Warningf("Failed to save the signature sequence to %s. Error: %s", sg.store.dir, err)
+		}
+	}
+	return sg.lastSequence
+}
+
+// Sets the signature headers of a request, with the SHA-256 of the body as it will be sent. The body is
+// streamed, so it's hashed in a first pass, see Sender.post. Call it after the other headers are set.
+func (sg *signer) sign(req *http.Request, bodyHash []byte) {
+	sequence := sg.nextSequence()
+	message := signedMessage(sg.cluster, sequence, req.Method, syncRoute(sg.cluster),
+		req.Header.Get("X-Overwrite-State"), bodyHash)
+	var signature []byte
+	if sg.algorithm == signingEd25519 {
+		signature = ed25519.Sign(sg.ed25519Key, message)
+	} else {
+		mac := hmac.New(sha256.New, sg.hmacKey)
+		mac.Write(message)
+		signature = mac.Sum(nil)
+	}
+	req.Header.Set(SignatureHeader, base64.StdEncoding.EncodeToString(signature))
+	req.Header.Set(SignatureAlgorithmHeader, sg.algorithm)
+	req.Header.Set(SignatureKeyIDHeader, sg.keyID)
+	req.Header.Set(SignatureSequenceHeader, strconv.FormatInt(sequence, 10))
+}
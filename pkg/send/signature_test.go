@@ -0,0 +1,253 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package send
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stolostron/search-collector/pkg/config"
+	"github.com/stolostron/search-collector/pkg/transforms"
+	"github.com/stretchr/testify/assert"
+)
+
+const testHMACSecret = "0123456789abcdef0123456789abcdef"
+
+func setSigningConfig(t *testing.T, algorithm string, key []byte) {
+	cfg := config.Cfg
+	t.Cleanup(func() { config.Cfg = cfg })
+	config.Cfg.SigningAlgorithm = algorithm
+	config.Cfg.SigningKeyFile = filepath.Join(t.TempDir(), "signing.key")
+	config.Cfg.SigningKeyID = ""
+	assert.Nil(t, os.WriteFile(config.Cfg.SigningKeyFile, key, 0o600))
+}
+
+// Returns a signed sync request of cluster1.
+func signedRequest(sg *signer, overwriteState string, body []byte) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, syncRoute("cluster1"), bytes.NewReader(body))
+	req.Header.Set("X-Overwrite-State", overwriteState)
+	bodyHash := sha256.Sum256(body)
+	sg.sign(req, bodyHash[:])
+	return req
+}
+
+// Verifies the signatures like the aggregator, and rejects replayed requests.
+type verifier struct {
+	hmacKeys     map[string][]byte
+	ed25519Keys  map[string]ed25519.PublicKey
+	lastSequence map[string]int64 // Last accepted sequence number by cluster.
+}
+
+func newVerifier() *verifier {
+	return &verifier{
+		hmacKeys:     map[string][]byte{},
+		ed25519Keys:  map[string]ed25519.PublicKey{},
+		lastSequence: map[string]int64{},
+	}
+}
+
+// Verifies the signature headers of a request from the cluster to the sync route, with the body as received.
+func (v *verifier) verify(cluster, route string, req *http.Request, body []byte) error {
+	header := req.Header
+	signature, err := base64.StdEncoding.DecodeString(header.Get(SignatureHeader))
+	if err != nil || len(signature) == 0 {
+		return errors.New("missing or malformed signature")
+	}
+	sequence, err := strconv.ParseInt(header.Get(SignatureSequenceHeader), 10, 64)
+	if err != nil {
+		return errors.New("missing or malformed signature sequence")
+	}
+	keyID := header.Get(SignatureKeyIDHeader)
+	bodyHash := sha256.Sum256(body)
+	message := signedMessage(cluster, sequence, req.Method, route, header.Get("X-Overwrite-State"), bodyHash[:])
+
+	switch header.Get(SignatureAlgorithmHeader) {
+	case signingHMACSHA256:
+		secret, ok := v.hmacKeys[keyID]
+		if !ok {
+			return fmt.Errorf("unknown HMAC key ID [%s]", keyID)
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(message)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return errors.New("signature doesn't match")
+		}
+	case signingEd25519:
+		key, ok := v.ed25519Keys[keyID]
+		if !ok {
+			return fmt.Errorf("unknown Ed25519 key ID [%s]", keyID)
+		}
+		if !ed25519.Verify(key, message, signature) {
+			return errors.New("signature doesn't match")
+		}
+	default:
+		return fmt.Errorf("unsupported signature algorithm [%s]", header.Get(SignatureAlgorithmHeader))
+	}
+
+	// Only checked once the signature is valid, so a forged request can't move the sequence forward.
+	if sequence <= v.lastSequence[cluster] {
+		return fmt.Errorf("replayed request, sequence %d isn't greater than %d", sequence, v.lastSequence[cluster])
+	}
+	v.lastSequence[cluster] = sequence
+	return nil
+}
+
+func Test_signer_hmac(t *testing.T) {
+	setSigningConfig(t, signingHMACSHA256, []byte(testHMACSecret+"\n"))
+	sg, err := newSigner("cluster1")
+	assert.Nil(t, err)
+	v := newVerifier()
+	v.hmacKeys[sg.keyID] = []byte(testHMACSecret)
+
+	body := []byte(`{"addResources":[{"uid":"cluster1/1234"}]}`)
+	req := signedRequest(sg, "false", body)
+
+	assert.Equal(t, signingHMACSHA256, req.Header.Get(SignatureAlgorithmHeader))
+	assert.Nil(t, v.verify("cluster1", syncRoute("cluster1"), req, body))
+	assert.NotNil(t, v.verify("cluster1", syncRoute("cluster1"), req, body), "Expected the replayed request to be rejected.")
+
+	req = signedRequest(sg, "false", body)
+	assert.NotNil(t, v.verify("cluster1", syncRoute("cluster1"), req, []byte(`{}`)), "Expected a changed body to be rejected.")
+	assert.NotNil(t, v.verify("cluster2", syncRoute("cluster2"), req, body), "Expected another cluster name to be rejected.")
+	req.Header.Set("X-Overwrite-State", "true")
+	assert.NotNil(t, v.verify("cluster1", syncRoute("cluster1"), req, body), "Expected a changed X-Overwrite-State to be rejected.")
+	req.Header.Set("X-Overwrite-State", "false")
+	assert.NotNil(t, v.verify("cluster1", "/cluster1/aggregator/sync", req, body),
+		"Expected another route to be rejected.")
+	req.Method = http.MethodPut
+	assert.NotNil(t, v.verify("cluster1", syncRoute("cluster1"), req, body), "Expected a changed method to be rejected.")
+	req.Method = http.MethodPost
+	assert.Nil(t, v.verify("cluster1", syncRoute("cluster1"), req, body), "Expected rejected requests not to move the sequence.")
+}
+
+func Test_signer_ed25519(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	assert.Nil(t, err)
+	setSigningConfig(t, "Ed25519", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	config.Cfg.SigningKeyID = "collector-2026"
+
+	sg, err := newSigner("cluster1")
+	assert.Nil(t, err)
+	v := newVerifier()
+	v.ed25519Keys["collector-2026"] = publicKey
+
+	body := []byte(`{}`)
+	req := signedRequest(sg, "true", body)
+
+	assert.Equal(t, "collector-2026", req.Header.Get(SignatureKeyIDHeader))
+	assert.Nil(t, v.verify("cluster1", syncRoute("cluster1"), req, body))
+
+	req = signedRequest(sg, "true", body)
+	req.Header.Set(SignatureKeyIDHeader, "unknown")
+	assert.NotNil(t, v.verify("cluster1", syncRoute("cluster1"), req, body), "Expected an unknown key ID to be rejected.")
+}
+
+func Test_newSigner_errors(t *testing.T) {
+	setSigningConfig(t, signingHMACSHA256, []byte("short"))
+	_, err := newSigner("cluster1")
+	assert.NotNil(t, err, "Expected a short HMAC key to be rejected.")
+
+	config.Cfg.SigningAlgorithm = "rsa"
+	_, err = newSigner("cluster1")
+	assert.NotNil(t, err)
+
+	config.Cfg.SigningAlgorithm = signingEd25519
+	_, err = newSigner("cluster1")
+	assert.NotNil(t, err, "Expected a key that isn't PEM encoded to be rejected.")
+
+	config.Cfg.SigningKeyFile = ""
+	sg, err := newSigner("cluster1")
+	assert.Nil(t, err)
+	assert.Nil(t, sg, "Expected signing to be disabled without SIGNING_KEY_FILE.")
+}
+
+func Test_signer_sequence(t *testing.T) {
+	sg := &signer{lastSequence: 1 << 62}
+
+	first := sg.nextSequence()
+	second := sg.nextSequence()
+
+	assert.Equal(t, int64(1<<62+1), first)
+	assert.Equal(t, first+1, second)
+}
+
+func Test_signer_sequenceRestored(t *testing.T) {
+	store := newStateStore(t.TempDir())
+	sg := &signer{cluster: "cluster1"}
+	sg.restoreSequence(store)
+	first := sg.nextSequence()
+	assert.Greater(t, first, int64(1<<60), "Expected the first sequence to start from the clock.")
+	for i := 0; i < sequenceBlock+1; i++ {
+		sg.nextSequence()
+	}
+	last := sg.nextSequence()
+
+	// A restarted collector continues after the reserved block, even if the clock went back.
+	restarted := &signer{cluster: "cluster1"}
+	restarted.restoreSequence(store)
+	next := restarted.nextSequence()
+	assert.Greater(t, next, last)
+	assert.Equal(t, first+2*sequenceBlock, next)
+
+	saved, err := store.loadSequence()
+	assert.Nil(t, err)
+	assert.Equal(t, next+sequenceBlock-1, saved.Reserved)
+}
+
+func TestSenderSignedPayload(t *testing.T) {
+	setSigningConfig(t, signingHMACSHA256, []byte(testHMACSecret))
+	sg, err := newSigner("cluster1")
+	assert.Nil(t, err)
+	v := newVerifier()
+	v.hmacKeys[sg.keyID] = []byte(testHMACSecret)
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.Nil(t, err)
+		if err := v.verify("cluster1", syncRoute("cluster1"), r, body); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		assert.NotEmpty(t, r.Header.Get("Content-Encoding"))
+		assert.Equal(t, "/cluster1/aggregator/sync", r.URL.Path, "Expected the request to go through the proxy.")
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(SyncResponse{TotalResources: 1})
+	}))
+	defer ts.Close()
+
+	s := Sender{
+		httpClient:         *ts.Client(),
+		aggregatorURL:      ts.URL,
+		aggregatorSyncPath: "/cluster1/aggregator/sync", // Signed as the sync route the proxy forwards to.
+		contentEncoding:    encodingGzip,
+		signer:             sg,
+	}
+	payload := Payload{AddResources: []transforms.Node{{UID: "cluster1/1234"}}}
+
+	assert.Nil(t, s.send(context.Background(), payload, 1, 0))
+	assert.Nil(t, s.send(context.Background(), payload, 1, 0), "Expected a new sequence number for each request.")
+	s.contentEncoding = encodingZstd
+	assert.Nil(t, s.send(context.Background(), payload, 1, 0), "Expected the compressed body to be hashed the same.")
+
+	s.signer = nil
+	assert.NotNil(t, s.send(context.Background(), payload, 1, 0), "Expected unsigned requests to be rejected.")
+}
@@ -0,0 +1,219 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package send
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/stolostron/search-collector/pkg/config"
+)
+
+// Receives the payloads built by the Sender. The complete payload has ClearAll set and replaces everything
+// sent before it, the diffs that follow apply on top of it. An error on a diff makes the Sender send the
+// complete payload next. Sinks stop waiting when the context is done.
+type Sink interface {
+	SendComplete(ctx context.Context, payload Payload, expectedTotalResources, expectedTotalEdges int) error
+	SendDiff(ctx context.Context, payload Payload, expectedTotalResources, expectedTotalEdges int) error
+	Close() error
+}
+
+// Returns the sink for the SINK value, normalized by config.InitConfig.
+func newSink(s *Sender, configured string) (Sink, error) {
+	switch configured {
+	case "", config.SINK_AGGREGATOR:
+		return aggregatorSink{s: s}, nil
+	case config.SINK_STDOUT:
+		return &streamSink{w: os.Stdout}, nil
+	case config.SINK_FILE:
+		fs, err := newFileSink(config.Cfg.SinkFilePath, int64(config.Cfg.SinkFileMaxMB)*1024*1024,
+			config.Cfg.SinkFileMaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		fs.sentState = s.sentPayload
+		return fs, nil
+	}
+	return nil, fmt.Errorf("unsupported SINK value [%s]", configured)
+}
+
+// Sends to the aggregator's sync endpoint.
+type aggregatorSink struct {
+	s *Sender
+}
+
+func (a aggregatorSink) SendComplete(ctx context.Context, payload Payload, expectedTotalResources, expectedTotalEdges int) error {
+	return a.s.sendComplete(ctx, payload, expectedTotalResources, expectedTotalEdges)
+}
+
+func (a aggregatorSink) SendDiff(ctx context.Context, payload Payload, expectedTotalResources, expectedTotalEdges int) error {
+	return a.s.sendWithRetry(ctx, payload, expectedTotalResources, expectedTotalEdges)
+}
+
+func (a aggregatorSink) Close() error { return nil }
+
+// A payload written by the stream and file sinks, one JSON object per line.
+type sinkRecord struct {
+	Cluster        string `json:"cluster"`
+	Time           string `json:"time"`
+	Type           string `json:"type"` // complete or diff
+	TotalResources int    `json:"totalResources"`
+	TotalEdges     int    `json:"totalEdges"`
+}
+
+// Writes the record as a single line of JSON, streaming the payload like the request body.
+func writeRecord(w io.Writer, recordType string, payload Payload, totalResources, totalEdges int) error {
+	head, err := json.Marshal(sinkRecord{
+		Cluster:        config.Cfg.ClusterName,
+		Time:           time.Now().UTC().Format(time.RFC3339),
+		Type:           recordType,
+		TotalResources: totalResources,
+		TotalEdges:     totalEdges,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(head[:len(head)-1]); err != nil {
+		return err
+	}
+	if _, err = io.WriteString(w, `,"payload":`); err != nil {
+		return err
+	}
+	if err = writePayload(w, payload); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "}\n")
+	return err
+}
+
+// Writes NDJSON records to a stream, like stdout.
+type streamSink struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func (ss *streamSink) SendComplete(ctx context.Context, payload Payload, expectedTotalResources, expectedTotalEdges int) error {
+	return ss.write("complete", payload, expectedTotalResources, expectedTotalEdges)
+}
+
+func (ss *streamSink) SendDiff(ctx context.Context, payload Payload, expectedTotalResources, expectedTotalEdges int) error {
+	return ss.write("diff", payload, expectedTotalResources, expectedTotalEdges)
+}
+
+func (ss *streamSink) write(recordType string, payload Payload, totalResources, totalEdges int) error {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	buffered := bufio.NewWriter(ss.w)
+	if err := writeRecord(buffered, recordType, payload, totalResources, totalEdges); err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
+
+func (ss *streamSink) Close() error { return nil }
+
+// Writes NDJSON records to a local file. Once the file passes maxBytes it's rotated to path.1, path.1 to
+// path.2 and so on, keeping maxBackups old files. Records are never split across files.
+// Each new file starts with a complete record, so the state can be rebuilt from a single file. When a diff
+// rotates the file, it's replaced by the complete state after the diff.
+type fileSink struct {
+	mutex      sync.Mutex
+	path       string
+	maxBytes   int64
+	maxBackups int
+	file       *os.File
+	size       int64
+
+	sentState func() (Payload, int, int) // Complete payload of the state after the last diff. Nil writes the diff.
+}
+
+func newFileSink(path string, maxBytes int64, maxBackups int) (*fileSink, error) {
+	fs := &fileSink{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+	if err := fs.open(); err != nil {
+		return nil, err
+	}
+	klog.Infof("Writing payloads to file %s.", path)
+	return fs, nil
+}
+
+func (fs *fileSink) open() error {
+	if err := os.MkdirAll(filepath.Dir(fs.path), 0o750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fs.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640) // #nosec G304
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	fs.file = f
+	fs.size = info.Size()
+	return nil
+}
+
+// Shifts the old files by one, dropping the oldest, and starts a new file.
+func (fs *fileSink) rotate() error {
+	if err := fs.file.Close(); err != nil {
+		klog.Warningf("Error closing file %s before rotating it: %s", fs.path, err)
+	}
+	if fs.maxBackups > 0 {
+		_ = os.Remove(fmt.Sprintf("%s.%d", fs.path, fs.maxBackups))
+		for i := fs.maxBackups - 1; i > 0; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", fs.path, i), fmt.Sprintf("%s.%d", fs.path, i+1))
+		}
+		if err := os.Rename(fs.path, fs.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(fs.path); err != nil {
+		return err
+	}
+	return fs.open()
+}
+
+func (fs *fileSink) SendComplete(ctx context.Context, payload Payload, expectedTotalResources, expectedTotalEdges int) error {
+	return fs.write("complete", payload, expectedTotalResources, expectedTotalEdges)
+}
+
+func (fs *fileSink) SendDiff(ctx context.Context, payload Payload, expectedTotalResources, expectedTotalEdges int) error {
+	return fs.write("diff", payload, expectedTotalResources, expectedTotalEdges)
+}
+
+func (fs *fileSink) write(recordType string, payload Payload, totalResources, totalEdges int) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if fs.maxBytes > 0 && fs.size >= fs.maxBytes {
+		if err := fs.rotate(); err != nil {
+			return err
+		}
+		if recordType == "diff" && fs.sentState != nil {
+			recordType = "complete"
+			payload, totalResources, totalEdges = fs.sentState()
+		}
+	}
+	counted := &countingWriter{w: fs.file}
+	buffered := bufio.NewWriterSize(counted, 32*1024)
+	err := writeRecord(buffered, recordType, payload, totalResources, totalEdges)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	fs.size += counted.count
+	return err
+}
+
+func (fs *fileSink) Close() error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.file.Close()
+}
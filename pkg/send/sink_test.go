@@ -0,0 +1,116 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package send
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stolostron/search-collector/pkg/reconciler"
+	tr "github.com/stolostron/search-collector/pkg/transforms"
+	"github.com/stretchr/testify/assert"
+)
+
+type testRecord struct {
+	sinkRecord
+	Payload Payload `json:"payload"`
+}
+
+func readRecords(t *testing.T, data []byte) []testRecord {
+	records := []testRecord{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		record := testRecord{}
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &record), "Expected one JSON record per line.")
+		records = append(records, record)
+	}
+	return records
+}
+
+func Test_streamSink(t *testing.T) {
+	buf := &bytes.Buffer{}
+	sink := &streamSink{w: buf}
+	payload := Payload{
+		AddResources: []tr.Node{{UID: "n1", Properties: map[string]interface{}{"kind": "Pod"}}},
+		AddEdges:     []tr.Edge{{EdgeType: "ownedBy", SourceUID: "n1", DestUID: "n2"}},
+	}
+
+	assert.Nil(t, sink.SendComplete(context.Background(), payload, 1, 1))
+	assert.Nil(t, sink.SendDiff(context.Background(), Payload{DeletedResources: []tr.Deletion{{UID: "n1"}}}, 0, 0))
+
+	records := readRecords(t, buf.Bytes())
+	assert.Len(t, records, 2)
+	assert.Equal(t, "complete", records[0].Type)
+	assert.Equal(t, 1, records[0].TotalResources)
+	assert.Equal(t, payload.AddResources, records[0].Payload.AddResources)
+	assert.Equal(t, payload.AddEdges, records[0].Payload.AddEdges)
+	assert.Equal(t, "diff", records[1].Type)
+	assert.Equal(t, []tr.Deletion{{UID: "n1"}}, records[1].Payload.DeletedResources)
+}
+
+func Test_fileSink_rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out", "payloads.ndjson")
+	sink, err := newFileSink(path, 1, 2)
+	assert.Nil(t, err)
+
+	// Every record passes the size, so each one goes to a new file.
+	for i := 0; i < 4; i++ {
+		payload := Payload{DeletedResources: []tr.Deletion{{UID: string(rune('a' + i))}}}
+		assert.Nil(t, sink.SendDiff(context.Background(), payload, 0, 0))
+	}
+	assert.Nil(t, sink.Close())
+
+	current, _ := os.ReadFile(path)
+	backup1, _ := os.ReadFile(path + ".1")
+	backup2, _ := os.ReadFile(path + ".2")
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err), "Expected only 2 backups to be kept.")
+	assert.Equal(t, "d", readRecords(t, current)[0].Payload.DeletedResources[0].UID)
+	assert.Equal(t, "c", readRecords(t, backup1)[0].Payload.DeletedResources[0].UID)
+	assert.Equal(t, "b", readRecords(t, backup2)[0].Payload.DeletedResources[0].UID)
+}
+
+func TestSenderSyncToSink(t *testing.T) {
+	buf := &bytes.Buffer{}
+	rec := reconciler.NewReconciler()
+	rec.Restore(reconciler.State{Nodes: []tr.Node{{UID: "n1", Properties: map[string]interface{}{"kind": "Pod"}}}})
+	s := Sender{
+		lastSentTime: -1,
+		rec:          rec,
+		sink:         &streamSink{w: buf},
+	}
+
+	assert.Nil(t, s.Sync(context.Background()))
+	s.lastSentTime = 0 // Force the heartbeat.
+	assert.Nil(t, s.Sync(context.Background()))
+
+	records := readRecords(t, buf.Bytes())
+	assert.Len(t, records, 2)
+	assert.Equal(t, "complete", records[0].Type)
+	assert.True(t, records[0].Payload.ClearAll)
+	assert.Equal(t, "diff", records[1].Type)
+}
+
+func Test_fileSink_rotateStartsWithComplete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "payloads.ndjson")
+	sink, err := newFileSink(path, 1, 1)
+	assert.Nil(t, err)
+	complete := Payload{ClearAll: true, AddResources: []tr.Node{{UID: "n2"}}, StateHash: "hash-after-diff"}
+	sink.sentState = func() (Payload, int, int) { return complete, 1, 0 }
+
+	assert.Nil(t, sink.SendComplete(context.Background(), Payload{ClearAll: true}, 0, 0))
+	assert.Nil(t, sink.SendDiff(context.Background(), Payload{AddResources: []tr.Node{{UID: "n2"}}}, 1, 0))
+	assert.Nil(t, sink.Close())
+
+	current, _ := os.ReadFile(path)
+	records := readRecords(t, current)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "complete", records[0].Type, "Expected the rotated file to start with the complete state.")
+	assert.Equal(t, complete.StateHash, records[0].Payload.StateHash)
+	assert.Equal(t, 1, records[0].TotalResources)
+}
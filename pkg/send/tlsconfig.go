@@ -0,0 +1,243 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package send
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/stolostron/search-collector/pkg/config"
+)
+
+// Curves accepted in TLS_CURVES.
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// Builds the TLS config used by the collector deployed in the hub to connect to the aggregator URL, from the
+// TLS_* settings. The client certificate and the CA bundle are reloaded when the files change, so rotated
+// certificates are picked up without restarting the pod.
+func hubTLSConfig(aggregatorURL string) (*tls.Config, error) {
+	minVersion, err := parseTLSVersion(config.Cfg.TLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	cipherSuites, err := parseCipherSuites(config.Cfg.TLSCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	curves, err := parseCurves(config.Cfg.TLSCurves)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg := &tls.Config{
+		MinVersion:       minVersion,
+		CipherSuites:     cipherSuites, // Only used up to TLS 1.2, the TLS 1.3 suites are not configurable.
+		CurvePreferences: curves,
+	}
+
+	caFile := config.Cfg.TLSCAFile
+	if caFile == "" {
+		caFile = config.Cfg.TLSCertFile
+	}
+	reloader, err := newCertReloader(config.Cfg.TLSCertFile, config.Cfg.TLSKeyFile, caFile)
+	if err == nil {
+		reloader.host, err = verifiedHost(aggregatorURL)
+	}
+	if err != nil {
+		if config.Cfg.TLSStrict {
+			return nil, fmt.Errorf("TLS_STRICT is set and the certificates couldn't be loaded: %w", err)
+		}
+		// This should only happen during development.
+		klog.Error("WARNING: Using insecure TLS connection. Couldn't load certs ", err)
+		tlsCfg.InsecureSkipVerify = true // #nosec G402
+		return tlsCfg, nil
+	}
+
+	// The default verification uses a fixed RootCAs pool. Skip it and verify against the reloaded CA bundle
+	// in VerifyConnection instead, which runs on every handshake.
+	tlsCfg.InsecureSkipVerify = true // #nosec G402
+	tlsCfg.VerifyConnection = reloader.verifyConnection
+	tlsCfg.GetClientCertificate = reloader.getClientCertificate
+	return tlsCfg, nil
+}
+
+// Keeps the client certificate and the CA bundle loaded from files, and reloads them when the files change.
+type certReloader struct {
+	certFile, keyFile, caFile string
+	host                      string // Expected in the server certificate. The SNI is empty for IP addresses.
+
+	mutex   sync.Mutex
+	cert    *tls.Certificate
+	roots   *x509.CertPool
+	modTime time.Time // Latest modification time of the files when they were loaded.
+}
+
+func newCertReloader(certFile, keyFile, caFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err = cr.load(modTime); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Latest modification time of the files. Kubernetes updates mounted secrets by swapping a symlink, which
+// os.Stat follows.
+func (cr *certReloader) latestModTime() (time.Time, error) {
+	latest := time.Time{}
+	for _, file := range []string{cr.certFile, cr.keyFile, cr.caFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Loads the files. NOT THREADSAFE, locking left up to the caller.
+func (cr *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	caCert, err := os.ReadFile(cr.caFile)
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caCert) {
+		return fmt.Errorf("no certificates found in CA file %s", cr.caFile)
+	}
+	cr.cert = &cert
+	cr.roots = roots
+	cr.modTime = modTime
+	return nil
+}
+
+// Reloads the files if they changed since they were loaded. Keeps the loaded ones if the new files can't
+// be loaded, for example while they are only partially written.
+func (cr *certReloader) reloadIfChanged() {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	modTime, err := cr.latestModTime()
+	if err != nil || modTime.Equal(cr.modTime) {
+		return
+	}
+	if err = cr.load(modTime); err != nil {
+		klog.Warningf("Failed to reload the rotated certificates, keeping the previous ones. Error: %s", err)
+		return
+	}
+	klog.Info("Reloaded the rotated TLS certificates.")
+}
+
+func (cr *certReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cr.reloadIfChanged()
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	return cr.cert, nil
+}
+
+// Verifies the server certificate chain and host name against the CA bundle.
+func (cr *certReloader) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("aggregator didn't present a certificate")
+	}
+	cr.reloadIfChanged()
+	cr.mutex.Lock()
+	roots := cr.roots
+	cr.mutex.Unlock()
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       cr.host,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// Returns the host name or IP address of the aggregator URL, that the server certificate must be valid for.
+func verifiedHost(aggregatorURL string) (string, error) {
+	u, err := url.Parse(aggregatorURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("no host in the aggregator URL [%s]", aggregatorURL)
+	}
+	return u.Hostname(), nil
+}
+
+// Parses TLS_MIN_VERSION: 1.2 or 1.3.
+func parseTLSVersion(version string) (uint16, error) {
+	switch strings.TrimSpace(version) {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS_MIN_VERSION [%s], expected 1.2 or 1.3", version)
+	}
+}
+
+// Parses the comma separated TLS_CIPHER_SUITES, with the names used by crypto/tls.
+// Only the secure suites are accepted. Empty uses the Go defaults.
+func parseCipherSuites(list string) ([]uint16, error) {
+	secure := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		secure[suite.Name] = suite.ID
+	}
+	var ids []uint16
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := secure[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported or insecure cipher suite [%s] in TLS_CIPHER_SUITES", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Parses the comma separated TLS_CURVES. Empty uses the Go defaults.
+func parseCurves(list string) ([]tls.CurveID, error) {
+	var curves []tls.CurveID
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(name), "-", ""))
+		if name == "" {
+			continue
+		}
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve [%s] in TLS_CURVES", name)
+		}
+		curves = append(curves, curve)
+	}
+	return curves, nil
+}
@@ -0,0 +1,186 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package send
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stolostron/search-collector/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// Writes a self-signed certificate and its key to the files, and returns the certificate.
+func writeTestCert(t *testing.T, certFile, keyFile, commonName string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	assert.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return cert
+}
+
+func setTLSConfig(t *testing.T, certFile, keyFile, caFile string, strict bool) {
+	cfg := config.Cfg
+	t.Cleanup(func() { config.Cfg = cfg })
+	config.Cfg.TLSCertFile = certFile
+	config.Cfg.TLSKeyFile = keyFile
+	config.Cfg.TLSCAFile = caFile
+	config.Cfg.TLSStrict = strict
+	config.Cfg.TLSMinVersion = config.DEFAULT_TLS_MIN_VERSION
+	config.Cfg.TLSCipherSuites = config.DEFAULT_TLS_CIPHER_SUITES
+	config.Cfg.TLSCurves = config.DEFAULT_TLS_CURVES
+}
+
+func Test_parseTLSSettings(t *testing.T) {
+	version, err := parseTLSVersion("1.3")
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), version)
+	_, err = parseTLSVersion("1.0")
+	assert.NotNil(t, err, "Expected TLS 1.0 to be rejected.")
+
+	suites, err := parseCipherSuites(config.DEFAULT_TLS_CIPHER_SUITES)
+	assert.Nil(t, err)
+	assert.Len(t, suites, 6)
+	_, err = parseCipherSuites("TLS_RSA_WITH_RC4_128_SHA")
+	assert.NotNil(t, err, "Expected insecure cipher suites to be rejected.")
+	suites, err = parseCipherSuites("")
+	assert.Nil(t, err)
+	assert.Nil(t, suites, "Expected the Go defaults when empty.")
+
+	curves, err := parseCurves("X25519, P-256")
+	assert.Nil(t, err)
+	assert.Equal(t, []tls.CurveID{tls.X25519, tls.CurveP256}, curves)
+	_, err = parseCurves("P224")
+	assert.NotNil(t, err)
+}
+
+func Test_hubTLSConfig_strict(t *testing.T) {
+	dir := t.TempDir()
+	setTLSConfig(t, filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), "", true)
+
+	_, err := hubTLSConfig("https://localhost:3010")
+	assert.NotNil(t, err, "Expected strict mode to refuse missing certificates.")
+
+	config.Cfg.TLSStrict = false
+	tlsCfg, err := hubTLSConfig("https://localhost:3010")
+	assert.Nil(t, err)
+	assert.True(t, tlsCfg.InsecureSkipVerify)
+	assert.Nil(t, tlsCfg.VerifyConnection)
+}
+
+func Test_certReloader_rotate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeTestCert(t, certFile, keyFile, "first")
+
+	reloader, err := newCertReloader(certFile, keyFile, certFile)
+	assert.Nil(t, err)
+	cert, _ := reloader.getClientCertificate(nil)
+	assert.Equal(t, "first", cert.Leaf.Subject.CommonName)
+
+	writeTestCert(t, certFile, keyFile, "second")
+	later := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(certFile, later, later))
+
+	cert, _ = reloader.getClientCertificate(nil)
+	assert.Equal(t, "second", cert.Leaf.Subject.CommonName, "Expected the rotated certificate.")
+
+	// A partially written key keeps the previous certificate.
+	assert.Nil(t, os.WriteFile(keyFile, []byte("partial"), 0o600))
+	assert.Nil(t, os.Chtimes(keyFile, later.Add(time.Minute), later.Add(time.Minute)))
+	cert, _ = reloader.getClientCertificate(nil)
+	assert.Equal(t, "second", cert.Leaf.Subject.CommonName)
+}
+
+func Test_hubTLSConfig_verify(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	writeTestCert(t, certFile, keyFile, "collector")
+	serverCA := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	assert.Nil(t, os.WriteFile(caFile, serverCA, 0o600))
+	setTLSConfig(t, certFile, keyFile, caFile, true)
+
+	tlsCfg, err := hubTLSConfig(ts.URL)
+	assert.Nil(t, err)
+	client := http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+	resp, err := client.Get(ts.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Expected the client certificate to be sent.")
+	_ = resp.Body.Close()
+
+	// The server isn't signed by the CA bundle.
+	writeTestCert(t, caFile, filepath.Join(dir, "other.key"), "other")
+	later := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(caFile, later, later))
+	client = http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+	_, err = client.Get(ts.URL)
+	assert.NotNil(t, err, "Expected the server to be verified against the reloaded CA bundle.")
+}
+
+// The host name check must not be skipped for IP addresses, where the SNI is empty.
+func Test_hubTLSConfig_verifyIPAddress(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "aggregator"},
+		DNSNames:     []string{"aggregator.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	ts.StartTLS()
+	defer ts.Close()
+
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	writeTestCert(t, certFile, keyFile, "collector")
+	assert.Nil(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	setTLSConfig(t, certFile, keyFile, caFile, true)
+
+	tlsCfg, err := hubTLSConfig(ts.URL)
+	assert.Nil(t, err)
+	client := http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+	_, err = client.Get(ts.URL)
+	assert.NotNil(t, err, "Expected the certificate to be rejected for the IP address of the server.")
+	assert.Contains(t, err.Error(), "127.0.0.1")
+}
@@ -0,0 +1,111 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package send
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+
+	"github.com/stolostron/search-collector/pkg/config"
+)
+
+// Builds the transport for the aggregator connections of the hub deployment from the TRANSPORT_* settings.
+func newTransport(tlsCfg *tls.Config, proxy func(*http.Request) (*url.URL, error)) *http.Transport {
+	tr := &http.Transport{
+		Proxy:               proxy,
+		DialContext:         newDialer().DialContext,
+		TLSClientConfig:     tlsCfg,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	applyTransportSettings(tr)
+	return tr
+}
+
+// Builds the transport for the aggregator connections of the klusterlet deployment with client-go, so the
+// credentials, the exec plugins and the rotation of the client certificate of the kubeconfig are kept. The
+// TRANSPORT_* settings and AGGREGATOR_PROXY_URL are layered on top.
+func newRESTTransport(restCfg *rest.Config) (http.RoundTripper, error) {
+	restCfg = rest.CopyConfig(restCfg)
+	if proxy := aggregatorProxy(); proxy != nil {
+		restCfg.Proxy = proxy
+	}
+	if restCfg.Dial == nil {
+		restCfg.Dial = newDialer().DialContext
+	}
+	rt, err := rest.TransportFor(restCfg)
+	if err != nil {
+		return nil, err
+	}
+	// The base transport isn't shared with other clients, the dialer is part of the key of client-go's transport cache.
+	for wrapped := rt; wrapped != nil; {
+		if tr, ok := wrapped.(*http.Transport); ok {
+			applyTransportSettings(tr)
+			return rt, nil
+		}
+		wrapper, ok := wrapped.(utilnet.RoundTripperWrapper)
+		if !ok {
+			break
+		}
+		wrapped = wrapper.WrappedRoundTripper()
+	}
+	klog.Warning("The TRANSPORT_* settings aren't applied to the custom transport of the kubeconfig.")
+	return rt, nil
+}
+
+func newDialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout:   time.Duration(config.Cfg.TransportDialTimeoutMS) * time.Millisecond,
+		KeepAlive: time.Duration(config.Cfg.TransportKeepAliveMS) * time.Millisecond,
+	}
+}
+
+// Applies the connection pool, timeout and HTTP/2 settings to the transport.
+func applyTransportSettings(tr *http.Transport) {
+	tr.MaxIdleConns = config.Cfg.TransportMaxIdleConns
+	tr.MaxIdleConnsPerHost = config.Cfg.TransportMaxIdleConns // All connections go to the same aggregator.
+	tr.IdleConnTimeout = time.Duration(config.Cfg.TransportIdleTimeoutMS) * time.Millisecond
+	tr.ResponseHeaderTimeout = time.Duration(config.Cfg.TransportHeaderTimeoutMS) * time.Millisecond
+
+	// Use the HTTP/2 of the standard library, configured below, instead of the one client-go sets up. The
+	// protocols offered in the TLS handshake are set again when the first request is sent.
+	tr.TLSNextProto = nil
+	if tr.TLSClientConfig != nil {
+		tr.TLSClientConfig = tr.TLSClientConfig.Clone()
+		tr.TLSClientConfig.NextProtos = nil
+	}
+	// HTTP/2 isn't attempted by default when the transport has a custom dialer or TLS config.
+	tr.ForceAttemptHTTP2 = !config.Cfg.TransportDisableHTTP2
+	if config.Cfg.TransportDisableHTTP2 {
+		tr.Protocols = new(http.Protocols)
+		tr.Protocols.SetHTTP1(true)
+	} else if config.Cfg.TransportHTTP2PingMS > 0 {
+		// Ping idle HTTP/2 connections, so a connection dropped by the proxy or a load balancer is detected
+		// before the next sync hangs on it.
+		ping := time.Duration(config.Cfg.TransportHTTP2PingMS) * time.Millisecond
+		tr.HTTP2 = &http.HTTP2Config{SendPingTimeout: ping, PingTimeout: ping / 2}
+	}
+}
+
+// Returns the proxy for the aggregator connections from AGGREGATOR_PROXY_URL and AGGREGATOR_NO_PROXY,
+// or nil when AGGREGATOR_PROXY_URL isn't set.
+func aggregatorProxy() func(*http.Request) (*url.URL, error) {
+	if config.Cfg.AggregatorProxyURL == "" {
+		return nil
+	}
+	proxyFunc := (&httpproxy.Config{
+		HTTPProxy:  config.Cfg.AggregatorProxyURL,
+		HTTPSProxy: config.Cfg.AggregatorProxyURL,
+		NoProxy:    config.Cfg.AggregatorNoProxy,
+	}).ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}
+}
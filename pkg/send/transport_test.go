@@ -0,0 +1,172 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package send
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stolostron/search-collector/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/rest"
+)
+
+// Stands in for an egress proxy. Records the requested URLs and the Authorization headers.
+type testProxy struct {
+	*httptest.Server
+	mutex sync.Mutex
+	urls  []string
+	auth  []string
+}
+
+func newTestProxy(t *testing.T) *testProxy {
+	p := &testProxy{}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		p.urls = append(p.urls, r.URL.String())
+		p.auth = append(p.auth, r.Header.Get("Authorization"))
+	}))
+	t.Cleanup(p.Close)
+	return p
+}
+
+func setTransportConfig(t *testing.T, proxyURL, noProxy string) {
+	cfg := config.Cfg
+	t.Cleanup(func() { config.Cfg = cfg })
+	config.Cfg.AggregatorProxyURL = proxyURL
+	config.Cfg.AggregatorNoProxy = noProxy
+	config.Cfg.TransportDialTimeoutMS = config.DEFAULT_DIAL_TIMEOUT_MS
+	config.Cfg.TransportKeepAliveMS = config.DEFAULT_KEEP_ALIVE_MS
+	config.Cfg.TransportIdleTimeoutMS = config.DEFAULT_IDLE_CONN_TIMEOUT_MS
+	config.Cfg.TransportMaxIdleConns = config.DEFAULT_MAX_IDLE_CONNS
+	config.Cfg.TransportHeaderTimeoutMS = 0
+	config.Cfg.TransportHTTP2PingMS = config.DEFAULT_HTTP2_PING_MS
+	config.Cfg.TransportDisableHTTP2 = false
+}
+
+func Test_newTransport(t *testing.T) {
+	setTransportConfig(t, "", "")
+	config.Cfg.TransportMaxIdleConns = 7
+	config.Cfg.TransportHeaderTimeoutMS = 2000
+
+	tr := newTransport(nil, nil)
+
+	assert.Equal(t, 7, tr.MaxIdleConns)
+	assert.Equal(t, 7, tr.MaxIdleConnsPerHost)
+	assert.Equal(t, 90*time.Second, tr.IdleConnTimeout)
+	assert.Equal(t, 2*time.Second, tr.ResponseHeaderTimeout)
+	assert.True(t, tr.ForceAttemptHTTP2)
+	assert.Equal(t, 30*time.Second, tr.HTTP2.SendPingTimeout)
+	assert.Nil(t, tr.Proxy)
+
+	config.Cfg.TransportDisableHTTP2 = true
+	tr = newTransport(nil, nil)
+
+	assert.False(t, tr.ForceAttemptHTTP2)
+	assert.False(t, tr.Protocols.HTTP2(), "Expected HTTP/2 to be disabled.")
+}
+
+func Test_newTransport_headerTimeout(t *testing.T) {
+	setTransportConfig(t, "", "")
+	config.Cfg.TransportHeaderTimeoutMS = 50
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	client := http.Client{Transport: newTransport(nil, nil)}
+	_, err := client.Get(ts.URL)
+
+	assert.NotNil(t, err, "Expected the request to time out waiting for the response headers.")
+}
+
+func Test_newRESTTransport(t *testing.T) {
+	setTransportConfig(t, "", "")
+	config.Cfg.TransportMaxIdleConns = 7
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+	caData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	restCfg := &rest.Config{Host: ts.URL, TLSClientConfig: rest.TLSClientConfig{CAData: caData}}
+
+	for _, disableHTTP2 := range []bool{false, true} {
+		config.Cfg.TransportDisableHTTP2 = disableHTTP2
+		rt, err := newRESTTransport(restCfg)
+		assert.Nil(t, err)
+		tr, ok := rt.(*http.Transport)
+		assert.True(t, ok, "Expected the client-go transport without wrappers for a kubeconfig without credentials.")
+		assert.Equal(t, 7, tr.MaxIdleConns)
+		assert.Nil(t, restCfg.Dial, "Expected the kubeconfig not to be changed.")
+
+		resp, err := (&http.Client{Transport: rt}).Get(ts.URL)
+		assert.Nil(t, err)
+		_ = resp.Body.Close()
+		if disableHTTP2 {
+			assert.Equal(t, "HTTP/1.1", resp.Proto)
+		} else {
+			assert.Equal(t, "HTTP/2.0", resp.Proto)
+		}
+	}
+}
+
+func Test_getHTTPSClient_proxy(t *testing.T) {
+	proxy := newTestProxy(t)
+	setTransportConfig(t, proxy.URL, "")
+	config.Cfg.DeployedInHub = true
+
+	client := getHTTPSClient(config.AggregatorTarget{Name: "default", URL: "http://aggregator.test:3010"})
+	resp, err := client.Get("http://aggregator.test:3010/aggregator/clusters/c1/sync")
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_ = resp.Body.Close()
+	assert.Equal(t, []string{"http://aggregator.test:3010/aggregator/clusters/c1/sync"}, proxy.urls)
+}
+
+func Test_getHTTPSClient_proxyKlusterlet(t *testing.T) {
+	proxy := newTestProxy(t)
+	setTransportConfig(t, proxy.URL, "")
+	config.Cfg.DeployedInHub = false
+
+	target := config.AggregatorTarget{Name: "default", URL: "http://hub.test:6443",
+		Config: &rest.Config{Host: "http://hub.test:6443", BearerToken: "test-token"}}
+	client := getHTTPSClient(target)
+	resp, err := client.Get("http://hub.test:6443/apis/proxy.open-cluster-management.io/v1beta1")
+
+	assert.Nil(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, []string{"http://hub.test:6443/apis/proxy.open-cluster-management.io/v1beta1"}, proxy.urls)
+	assert.Equal(t, []string{"Bearer test-token"}, proxy.auth, "Expected the kubeconfig credentials to be kept.")
+}
+
+func Test_aggregatorProxy_noProxy(t *testing.T) {
+	setTransportConfig(t, "http://proxy.test:3128", "internal.test,.svc")
+
+	proxy := aggregatorProxy()
+
+	for host, expected := range map[string]string{
+		"https://hub.example.com:6443":               "http://proxy.test:3128",
+		"https://internal.test:3010":                 "",
+		"https://search.open-cluster-management.svc": "",
+	} {
+		req, _ := http.NewRequest(http.MethodPost, host, nil)
+		proxyURL, err := proxy(req)
+		assert.Nil(t, err)
+		if expected == "" {
+			assert.Nil(t, proxyURL, "Expected %s to bypass the proxy.", host)
+		} else {
+			assert.Equal(t, expected, proxyURL.String())
+		}
+	}
+
+	config.Cfg.AggregatorProxyURL = ""
+	assert.Nil(t, aggregatorProxy(), "Expected no proxy when AGGREGATOR_PROXY_URL isn't set.")
+}
@@ -0,0 +1,150 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package server
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/stolostron/search-collector/pkg/informer"
+	"github.com/stolostron/search-collector/pkg/reconciler"
+	"github.com/stolostron/search-collector/pkg/send"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog/v2"
+)
+
+// Admin performs the actions of the admin routes.
+type Admin interface {
+	ForceResync()                                                               // Sends the complete state with the next sync
+	RestartInformer(ctx context.Context, gvr schema.GroupVersionResource) error // Lists the resources again
+	WriteSnapshot(w io.Writer) error                                            // Writes a reconciler snapshot
+}
+
+// Admin actions on the senders, the informers and the reconciler of the collector.
+type collectorAdmin struct {
+	senders    []*send.Sender
+	reconciler *reconciler.Reconciler
+}
+
+// NewAdmin returns the admin actions on the senders, the informers and the reconciler of the collector.
+func NewAdmin(senders []*send.Sender, r *reconciler.Reconciler) Admin {
+	return collectorAdmin{senders: senders, reconciler: r}
+}
+
+func (a collectorAdmin) ForceResync() {
+	for _, s := range a.senders {
+		s.ForceResync()
+	}
+}
+
+func (a collectorAdmin) RestartInformer(ctx context.Context, gvr schema.GroupVersionResource) error {
+	return informer.RestartInformer(ctx, gvr)
+}
+
+func (a collectorAdmin) WriteSnapshot(w io.Writer) error {
+	return a.reconciler.WriteSnapshot(w)
+}
+
+// The klog flags, to change the verbosity at runtime. Registered before the command line is parsed, so the
+// flags of the command line are kept.
+var klogFlags = func() *flag.FlagSet {
+	flags := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(flags)
+	return flags
+}()
+
+// Routes to force a resync, restart an informer, change the log verbosity and download a snapshot, to debug a
+// collector without restarting it. They always require authentication, and each action is audit logged.
+type adminAPI struct {
+	admin Admin
+}
+
+// Adds the admin routes to the router, under /api/v1/admin.
+func (a *adminAPI) register(router *mux.Router, authn *authenticator) {
+	admin := router.PathPrefix("/api/v1/admin").Subrouter()
+	admin.Use(authn.protect)
+	admin.HandleFunc("/resync", a.resync).Methods("POST")
+	admin.HandleFunc("/informers/restart", a.restartInformer).Methods("POST")
+	admin.HandleFunc("/loglevel", a.getLogLevel).Methods("GET")
+	admin.HandleFunc("/loglevel", a.setLogLevel).Methods("PUT")
+	admin.HandleFunc("/snapshot", a.snapshot).Methods("GET")
+}
+
+// Sends the complete state with the next sync of each aggregator.
+func (a *adminAPI) resync(w http.ResponseWriter, r *http.Request) {
+	a.admin.ForceResync()
+	audit(r, "resync", nil)
+	writeJSON(w, map[string]string{"message": "The complete state is sent with the next sync."})
+}
+
+// Restarts the informer of the group, version and resource parameters. The group is empty for core resources.
+func (a *adminAPI) restartInformer(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	gvr := schema.GroupVersionResource{
+		Group:    params.Get("group"),
+		Version:  params.Get("version"),
+		Resource: params.Get("resource"),
+	}
+	if gvr.Version == "" || gvr.Resource == "" {
+		http.Error(w, "version and resource are required", http.StatusBadRequest)
+		return
+	}
+
+	err := a.admin.RestartInformer(r.Context(), gvr)
+	audit(r, "restart informer "+gvr.String(), err)
+	switch {
+	case errors.Is(err, informer.ErrInformerNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		writeJSON(w, map[string]string{"message": fmt.Sprintf("Restarted the informer of %s.", gvr.String())})
+	}
+}
+
+func (a *adminAPI) getLogLevel(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{"v": klogFlags.Lookup("v").Value.String()})
+}
+
+// Sets the klog verbosity to the v parameter.
+func (a *adminAPI) setLogLevel(w http.ResponseWriter, r *http.Request) {
+	level := r.URL.Query().Get("v")
+	if v, err := strconv.ParseInt(level, 10, 32); err != nil || v < 0 {
+		http.Error(w, "v must be a number from 0", http.StatusBadRequest)
+		return
+	}
+
+	previous := klogFlags.Lookup("v").Value.String()
+	err := klogFlags.Set("v", level)
+	audit(r, fmt.Sprintf("set log verbosity from %s to %s", previous, level), err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]string{"v": level, "previous": previous})
+}
+
+// Writes a reconciler snapshot, which the graph subcommand exports. The resources the nodes were built from, to
+// build the edges again, are only in the snapshot with FEATURE_SNAPSHOT.
+func (a *adminAPI) snapshot(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="snapshot.json"`)
+	err := a.admin.WriteSnapshot(w)
+	audit(r, "download a snapshot", err)
+}
+
+// Logs the admin action with the user that requested it and its result.
+func audit(r *http.Request, action string, err error) {
+	result := "succeeded"
+	if err != nil {
+		result = "failed: " + err.Error()
+	}
+	klog.Infof("Audit: user %q from %s requested to %s. The action %s.", requestUser(r), r.RemoteAddr, action,
+		result)
+}
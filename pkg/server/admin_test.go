@@ -0,0 +1,110 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stolostron/search-collector/pkg/informer"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog/v2"
+)
+
+// Records the admin actions. Only pods have an informer.
+type fakeAdmin struct {
+	resyncs   int
+	restarted []schema.GroupVersionResource
+}
+
+func (f *fakeAdmin) ForceResync() { f.resyncs++ }
+
+func (f *fakeAdmin) WriteSnapshot(w io.Writer) error {
+	_, err := io.WriteString(w, `{"clusterName":"test-cluster"}`)
+	return err
+}
+
+func (f *fakeAdmin) RestartInformer(ctx context.Context, gvr schema.GroupVersionResource) error {
+	if gvr.Resource != "pods" {
+		return fmt.Errorf("%w: %s", informer.ErrInformerNotFound, gvr.String())
+	}
+	f.restarted = append(f.restarted, gvr)
+	return nil
+}
+
+// Sends the request with the token to the admin routes.
+func adminRequest(admin Admin, method, url, token string) (int, map[string]string) {
+	reviews := 0
+	router := mux.NewRouter()
+	(&adminAPI{admin: admin}).register(router, newAuthenticator(fakeAuthnClient(&reviews)))
+
+	req := httptest.NewRequest(method, url, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	body := map[string]string{}
+	if rr.Code == http.StatusOK {
+		_ = json.Unmarshal(rr.Body.Bytes(), &body)
+	}
+	return rr.Code, body
+}
+
+func TestAdminResync(t *testing.T) {
+	admin := &fakeAdmin{}
+
+	code, _ := adminRequest(admin, http.MethodPost, "/api/v1/admin/resync", "invalid")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, 0, admin.resyncs)
+
+	code, _ = adminRequest(admin, http.MethodPost, "/api/v1/admin/resync", "valid")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, admin.resyncs)
+}
+
+func TestAdminRestartInformer(t *testing.T) {
+	admin := &fakeAdmin{}
+
+	code, _ := adminRequest(admin, http.MethodPost, "/api/v1/admin/informers/restart?version=v1&resource=pods", "valid")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []schema.GroupVersionResource{{Version: "v1", Resource: "pods"}}, admin.restarted)
+
+	code, _ = adminRequest(admin, http.MethodPost,
+		"/api/v1/admin/informers/restart?group=apps&version=v1&resource=deployments", "valid")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, _ = adminRequest(admin, http.MethodPost, "/api/v1/admin/informers/restart?resource=pods", "valid")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	original := klogFlags.Lookup("v").Value.String()
+	defer func() { _ = klogFlags.Set("v", original) }()
+
+	code, body := adminRequest(&fakeAdmin{}, http.MethodPut, "/api/v1/admin/loglevel?v=5", "valid")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]string{"v": "5", "previous": original}, body)
+	assert.True(t, klog.V(5).Enabled(), "Expected the verbosity of the klog logger to change.")
+
+	_, body = adminRequest(&fakeAdmin{}, http.MethodGet, "/api/v1/admin/loglevel", "valid")
+	assert.Equal(t, "5", body["v"])
+
+	code, _ = adminRequest(&fakeAdmin{}, http.MethodPut, "/api/v1/admin/loglevel?v=high", "valid")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestAdminSnapshot(t *testing.T) {
+	code, _ := adminRequest(&fakeAdmin{}, http.MethodGet, "/api/v1/admin/snapshot", "invalid")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, body := adminRequest(&fakeAdmin{}, http.MethodGet, "/api/v1/admin/snapshot", "valid")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "test-cluster", body["clusterName"])
+}
@@ -0,0 +1,201 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	authnv1 "k8s.io/api/authentication/v1"
+	authzv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// Time an authenticated token and an allowed access are trusted without asking the API server again.
+const authnCacheTTL = time.Minute
+
+// Requires a bearer token of a user allowed by RBAC to use the method of the request on its route, as a
+// non-resource URL. For example, get /metrics or post /api/v1/admin/resync.
+// The token is authenticated with a TokenReview and authorized with a SubjectAccessReview.
+type authenticator struct {
+	client  kubernetes.Interface
+	mutex   sync.Mutex
+	users   map[[sha256.Size]byte]cachedUser // Authenticated tokens, keyed by their SHA-256
+	allowed map[access]time.Time             // Expiration of the allowed accesses
+	now     func() time.Time
+}
+
+type cachedUser struct {
+	user       authnv1.UserInfo
+	expiration time.Time
+}
+
+// A verb on the path of a route, by a user.
+type access struct {
+	user, verb, path string
+}
+
+// Key of the authenticated user in the request context.
+type userKey struct{}
+
+// Returns the user authenticated by the authenticator, or an empty string.
+func requestUser(r *http.Request) string {
+	user, _ := r.Context().Value(userKey{}).(string)
+	return user
+}
+
+func newAuthenticator(client kubernetes.Interface) *authenticator {
+	return &authenticator{
+		client:  client,
+		users:   map[[sha256.Size]byte]cachedUser{},
+		allowed: map[access]time.Time{},
+		now:     time.Now,
+	}
+}
+
+// Deletes the expired tokens and accesses every authnCacheTTL, until the context is done.
+func (a *authenticator) run(ctx context.Context) {
+	ticker := time.NewTicker(authnCacheTTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.evict()
+		}
+	}
+}
+
+func (a *authenticator) evict() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	now := a.now()
+	for key, cached := range a.users {
+		if !now.Before(cached.expiration) {
+			delete(a.users, key)
+		}
+	}
+	for key, expiration := range a.allowed {
+		if !now.Before(expiration) {
+			delete(a.allowed, key)
+		}
+	}
+}
+
+// Wraps the handler, so it's only called for requests allowed by RBAC.
+func (a *authenticator) protect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		user, status := a.authorize(r, token)
+		if status != http.StatusOK {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+	})
+}
+
+// Returns the path that is authorized for the request: the path template of its route, with a * instead of
+// the first variable and what follows. So a user allowed on /api/v1/nodes/* gets the edges of every node, and
+// the access is reviewed once for all the nodes. Without a route, the path of the request.
+func routePath(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return r.URL.Path
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return r.URL.Path
+	}
+	if i := strings.Index(template, "{"); i >= 0 {
+		return template[:i] + "*"
+	}
+	return template
+}
+
+// Returns the user and http.StatusOK if the token is allowed to use the method on the route, or the status to
+// respond with.
+func (a *authenticator) authorize(r *http.Request, token string) (string, int) {
+	verb := strings.ToLower(r.Method)
+	if r.Method == http.MethodHead {
+		verb = "get"
+	}
+	path := routePath(r)
+
+	user, status := a.authenticate(r.Context(), token)
+	if status != http.StatusOK {
+		return "", status
+	}
+	key := access{user: user.Username, verb: verb, path: path}
+	a.mutex.Lock()
+	expiration, ok := a.allowed[key]
+	a.mutex.Unlock()
+	if ok && a.now().Before(expiration) {
+		return user.Username, http.StatusOK
+	}
+
+	extra := make(map[string]authzv1.ExtraValue, len(user.Extra))
+	for key, value := range user.Extra {
+		extra[key] = authzv1.ExtraValue(value)
+	}
+	review, err := a.client.AuthorizationV1().SubjectAccessReviews().Create(r.Context(),
+		&authzv1.SubjectAccessReview{Spec: authzv1.SubjectAccessReviewSpec{
+			User:                  user.Username,
+			UID:                   user.UID,
+			Groups:                user.Groups,
+			Extra:                 extra,
+			NonResourceAttributes: &authzv1.NonResourceAttributes{Path: path, Verb: verb},
+		}}, metav1.CreateOptions{})
+	if err != nil {
+		klog.Warningf("Error authorizing %s to %s %s. %v", user.Username, verb, path, err)
+		return "", http.StatusInternalServerError
+	}
+	if !review.Status.Allowed {
+		klog.V(2).Infof("Denied %s to %s %s. %s", user.Username, verb, path, review.Status.Reason)
+		return "", http.StatusForbidden
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.allowed[key] = a.now().Add(authnCacheTTL)
+	return user.Username, http.StatusOK
+}
+
+// Returns the user of the token and http.StatusOK, or the status to respond with. Only the SHA-256 of the
+// token is kept, for authnCacheTTL.
+func (a *authenticator) authenticate(ctx context.Context, token string) (authnv1.UserInfo, int) {
+	key := sha256.Sum256([]byte(token))
+	a.mutex.Lock()
+	cached, ok := a.users[key]
+	a.mutex.Unlock()
+	if ok && a.now().Before(cached.expiration) {
+		return cached.user, http.StatusOK
+	}
+
+	review, err := a.client.AuthenticationV1().TokenReviews().Create(ctx,
+		&authnv1.TokenReview{Spec: authnv1.TokenReviewSpec{Token: token}}, metav1.CreateOptions{})
+	if err != nil {
+		klog.Warningf("Error authenticating a request. %v", err)
+		return authnv1.UserInfo{}, http.StatusInternalServerError
+	}
+	if !review.Status.Authenticated {
+		return authnv1.UserInfo{}, http.StatusUnauthorized
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.users[key] = cachedUser{user: review.Status.User, expiration: a.now().Add(authnCacheTTL)}
+	return review.Status.User, http.StatusOK
+}
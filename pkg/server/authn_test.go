@@ -0,0 +1,130 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package server
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	authnv1 "k8s.io/api/authentication/v1"
+	authzv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// Non-resource URLs the user "sre" is allowed to use. A trailing * matches any path with the prefix, like in RBAC.
+var sreAllowed = map[string]bool{
+	"get /metrics":                         true,
+	"get /api/v1/nodes*":                   true,
+	"get /api/v1/graph":                    true,
+	"get /api/v1/diffs":                    true,
+	"post /api/v1/admin/resync":            true,
+	"post /api/v1/admin/informers/restart": true,
+	"get /api/v1/admin/loglevel":           true,
+	"put /api/v1/admin/loglevel":           true,
+	"get /api/v1/admin/snapshot":           true,
+}
+
+// Fake API server that authenticates the token "valid" as user "sre", allowed to use the sreAllowed URLs only.
+func fakeAuthnClient(reviews *int) *fake.Clientset {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		*reviews++
+		review := action.(k8stesting.CreateAction).GetObject().(*authnv1.TokenReview)
+		if review.Spec.Token == "valid" {
+			review.Status = authnv1.TokenReviewStatus{Authenticated: true, User: authnv1.UserInfo{Username: "sre"}}
+		}
+		return true, review, nil
+	})
+	client.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authzv1.SubjectAccessReview)
+		attributes := review.Spec.NonResourceAttributes
+		review.Status.Allowed = review.Spec.User == "sre" && sreIsAllowed(attributes.Verb+" "+attributes.Path)
+		return true, review, nil
+	})
+	return client
+}
+
+func sreIsAllowed(url string) bool {
+	for allowed := range sreAllowed {
+		if prefix, ok := strings.CutSuffix(allowed, "*"); ok && strings.HasPrefix(url, prefix) || allowed == url {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAuthenticator(t *testing.T) {
+	reviews := 0
+	var user string
+	handler := newAuthenticator(fakeAuthnClient(&reviews)).protect(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { user = requestUser(r) }))
+	request := func(method, path, token string) int {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/metrics", ""))
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/metrics", "invalid"))
+	assert.Equal(t, http.StatusForbidden, request(http.MethodGet, "/api/v1/other", "valid"))
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/metrics", "valid"),
+		"Expected the method of the request to be authorized.")
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/metrics", "valid"))
+	assert.Equal(t, "sre", user)
+
+	reviews = 0
+	user = ""
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/metrics", "valid"))
+	assert.Equal(t, 0, reviews, "Expected the allowed token to be cached.")
+	assert.Equal(t, "sre", user, "Expected the user of the cached token.")
+}
+
+func TestAuthenticatorRoutes(t *testing.T) {
+	reviews := 0
+	client := fakeAuthnClient(&reviews)
+	authn := newAuthenticator(client)
+	now := time.Now()
+	authn.now = func() time.Time { return now }
+	router := mux.NewRouter()
+	router.Handle("/api/v1/nodes/{uid:.+}/edges",
+		authn.protect(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})))
+	request := func(path string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer valid")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusOK, request("/api/v1/nodes/uid1/edges"))
+	assert.Equal(t, http.StatusOK, request("/api/v1/nodes/uid2/edges"))
+	assert.Equal(t, 1, reviews, "Expected the token to be reviewed once.")
+	accessReviews := 0
+	for _, action := range client.Actions() {
+		if action.GetResource().Resource == "subjectaccessreviews" {
+			assert.Equal(t, "/api/v1/nodes/*",
+				action.(k8stesting.CreateAction).GetObject().(*authzv1.SubjectAccessReview).Spec.NonResourceAttributes.Path)
+			accessReviews++
+		}
+	}
+	assert.Equal(t, 1, accessReviews, "Expected the access to be reviewed once for the route.")
+	assert.Contains(t, authn.users, sha256.Sum256([]byte("valid")), "Expected only the hash of the token to be kept.")
+
+	// The expired entries are deleted by evict, not when they are looked up.
+	now = now.Add(authnCacheTTL)
+	authn.evict()
+	assert.Empty(t, authn.users)
+	assert.Empty(t, authn.allowed)
+}
@@ -3,20 +3,47 @@
 package server
 
 import (
-	"fmt"
+	"encoding/json"
 	"net/http"
+	"time"
 
+	"github.com/stolostron/search-collector/pkg/health"
 	"k8s.io/klog/v2"
 )
 
-// LivenessProbe is used to check if this service is alive.
+// Response of the probes. Status is "failed" when any check failed.
+type probeResponse struct {
+	Status string         `json:"status"`
+	Checks []health.Check `json:"checks"`
+}
+
+// LivenessProbe fails when the pipeline is stuck: the reconciler doesn't receive events, all the transformer
+// routines are blocked, or a send cycle is late.
 func LivenessProbe(w http.ResponseWriter, r *http.Request) {
 	klog.V(7).Info("livenessProbe")
-	_, _ = fmt.Fprint(w, "OK")
+	writeProbe(w, "liveness", health.Liveness(time.Now()))
 }
 
-// ReadinessProbe checks if this service is available.
+// ReadinessProbe fails until the informers listed all the resources and the state was sent.
 func ReadinessProbe(w http.ResponseWriter, r *http.Request) {
 	klog.V(7).Info("readinessProbe")
-	_, _ = fmt.Fprint(w, "OK")
+	writeProbe(w, "readiness", health.Readiness())
+}
+
+// Writes the checks, with status 503 when any check failed.
+func writeProbe(w http.ResponseWriter, probe string, checks []health.Check) {
+	response := probeResponse{Status: "ok", Checks: checks}
+	status := http.StatusOK
+	for _, check := range checks {
+		if !check.OK {
+			response.Status = "failed"
+			status = http.StatusServiceUnavailable
+			klog.V(2).Infof("The %s check %s failed. %s", probe, check.Name, check.Message)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		klog.Warningf("Error writing the %s probe response. %v", probe, err)
+	}
 }
@@ -3,10 +3,12 @@
 package server
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
+	"github.com/stolostron/search-collector/pkg/health"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -21,21 +23,40 @@ func TestLivenessProbe(t *testing.T) {
 
 	// Then: we get HTTP.StatusOK 200 without err
 	assert.Nil(t, reqErr)
-	assert.Equal(t, rr.Code, http.StatusOK)
-	assert.Equal(t, rr.Body.String(), "OK")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	response := probeResponse{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, "ok", response.Status)
+	assert.Len(t, response.Checks, 3)
 }
 
 func TestReadinessProbe(t *testing.T) {
 	// Given: a GET request against the /readiness endpoint
 	req, reqErr := http.NewRequest("GET", "/readiness", nil)
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(LivenessProbe)
+	handler := http.HandlerFunc(ReadinessProbe)
 
-	// When: we submit the request
+	// When: we submit the request before the informers are synced and the state is sent
 	handler.ServeHTTP(rr, req)
 
-	// Then: we get HTTP.StatusOK 200 without err
+	// Then: we get HTTP.StatusServiceUnavailable 503 with the failed checks
 	assert.Nil(t, reqErr)
-	assert.Equal(t, rr.Code, http.StatusOK)
-	assert.Equal(t, rr.Body.String(), "OK")
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	response := probeResponse{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, "failed", response.Status)
+	assert.Equal(t, []string{"informers", "send"}, []string{response.Checks[0].Name, response.Checks[1].Name})
+	assert.False(t, response.Checks[0].OK)
+	assert.NotEmpty(t, response.Checks[0].Message)
+
+	// When: the informers are synced and the state is sent
+	defer health.Reset()
+	health.InformersSynced()
+	health.SendSucceeded()
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	// Then: we get HTTP.StatusOK 200
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"status":"ok"`)
 }
@@ -0,0 +1,208 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/stolostron/search-collector/pkg/graph"
+	tr "github.com/stolostron/search-collector/pkg/transforms"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultQueryLimit = 500
+	maxQueryLimit     = 5000
+)
+
+// Graph is the current state of the collector, served by the query API. Implemented by the reconciler.
+type Graph interface {
+	CurrentNodes() []tr.Node // Sorted by UID
+	CurrentEdges() []tr.Edge
+	GetNode(uid string) (tr.Node, bool)
+}
+
+// A page of nodes or edges. Continue is set when there are more items, pass it to get the next page.
+type queryPage struct {
+	Items    interface{} `json:"items"`
+	Continue string      `json:"continue,omitempty"`
+}
+
+// A node with the selected properties.
+type queryNode struct {
+	UID            string                 `json:"uid"`
+	ResourceString string                 `json:"resourceString"`
+	Properties     map[string]interface{} `json:"properties"`
+}
+
+// Read-only query API over the nodes and edges held by the collector.
+type queryAPI struct {
+	graph Graph
+}
+
+// Adds the query routes to the /api/v1 router.
+func (q *queryAPI) register(api *mux.Router) {
+	api.HandleFunc("/nodes", q.listNodes).Methods("GET")
+	api.HandleFunc("/nodes/{uid:.+}/edges", q.listEdges).Methods("GET")
+	api.HandleFunc("/graph", q.exportGraph).Methods("GET")
+}
+
+// Lists the nodes, filtered by the kind, namespace and label selector parameters.
+func (q *queryAPI) listNodes(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	limit, start, err := pageParams(params.Get("limit"), params.Get("continue"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	selector, err := labels.Parse(params.Get("label"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid label selector: %v", err), http.StatusBadRequest)
+		return
+	}
+	kind, namespace := params.Get("kind"), params.Get("namespace")
+	fields := graph.SplitList(params.Get("fields"))
+
+	page := queryPage{}
+	items := []queryNode{}
+	nodes := q.graph.CurrentNodes()
+	i := sort.Search(len(nodes), func(i int) bool { return nodes[i].UID > start })
+	for ; i < len(nodes); i++ {
+		n := nodes[i]
+		if (kind != "" && !strings.EqualFold(fmt.Sprint(n.Properties["kind"]), kind)) ||
+			(namespace != "" && n.Properties["namespace"] != namespace) ||
+			!selector.Matches(labels.Set(nodeLabels(n))) {
+			continue
+		}
+		if len(items) == limit {
+			page.Continue = continueToken(items[len(items)-1].UID)
+			break
+		}
+		items = append(items, queryNode{UID: n.UID, ResourceString: n.ResourceString,
+			Properties: selectProperties(n.Properties, fields)})
+	}
+	page.Items = items
+	writeJSON(w, page)
+}
+
+// Lists the edges from and to the node.
+func (q *queryAPI) listEdges(w http.ResponseWriter, r *http.Request) {
+	uid := mux.Vars(r)["uid"]
+	params := r.URL.Query()
+	limit, start, err := pageParams(params.Get("limit"), params.Get("continue"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := q.graph.GetNode(uid); !ok {
+		http.Error(w, fmt.Sprintf("node %s not found", uid), http.StatusNotFound)
+		return
+	}
+
+	// Edges are sorted by source, destination and type, so the key of the last edge continues the page.
+	page := queryPage{}
+	items := []tr.Edge{}
+	for _, e := range q.graph.CurrentEdges() {
+		if (e.SourceUID != uid && e.DestUID != uid) || edgeKey(e) <= start {
+			continue
+		}
+		if len(items) == limit {
+			page.Continue = continueToken(edgeKey(items[len(items)-1]))
+			break
+		}
+		items = append(items, e)
+	}
+	page.Items = items
+	writeJSON(w, page)
+}
+
+// Exports the nodes and edges, filtered by the namespace and kind parameters, in the format parameter.
+func (q *queryAPI) exportGraph(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	format := params.Get("format")
+	if format == "" {
+		format = graph.DOT
+	}
+	if !slices.Contains(graph.Formats, format) {
+		http.Error(w, fmt.Sprintf("format must be one of %s", strings.Join(graph.Formats, ", ")),
+			http.StatusBadRequest)
+		return
+	}
+	nodes, edges := graph.Filter(q.graph.CurrentNodes(), q.graph.CurrentEdges(),
+		graph.SplitList(strings.Join(params["namespace"], ",")), graph.SplitList(strings.Join(params["kind"], ",")))
+
+	w.Header().Set("Content-Type", graph.ContentType(format))
+	if err := graph.Write(w, format, nodes, edges); err != nil {
+		klog.Warningf("Error writing the graph export. %v", err)
+	}
+}
+
+// Returns the page size and the key after which the page starts.
+func pageParams(limitParam, continueParam string) (int, string, error) {
+	limit := defaultQueryLimit
+	if limitParam != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitParam); err != nil || limit < 1 || limit > maxQueryLimit {
+			return 0, "", fmt.Errorf("limit must be a number from 1 to %d", maxQueryLimit)
+		}
+	}
+	start, err := base64.RawURLEncoding.DecodeString(continueParam)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid continue token")
+	}
+	return limit, string(start), nil
+}
+
+func continueToken(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// Key that sorts edges like the payloads.
+func edgeKey(e tr.Edge) string {
+	return e.SourceUID + "\x00" + e.DestUID + "\x00" + string(e.EdgeType)
+}
+
+// Labels are map[string]string, or map[string]interface{} for nodes read from a snapshot.
+func nodeLabels(n tr.Node) map[string]string {
+	switch nodeLabels := n.Properties["label"].(type) {
+	case map[string]string:
+		return nodeLabels
+	case map[string]interface{}:
+		result := make(map[string]string, len(nodeLabels))
+		for key, value := range nodeLabels {
+			result[key] = fmt.Sprint(value)
+		}
+		return result
+	}
+	return nil
+}
+
+// Returns the properties in fields, or all of them if fields is empty.
+func selectProperties(properties map[string]interface{}, fields []string) map[string]interface{} {
+	if len(fields) == 0 {
+		return properties
+	}
+	selected := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		if value, ok := properties[field]; ok {
+			selected[field] = value
+		}
+	}
+	return selected
+}
+
+func writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		klog.Warningf("Error writing the query response. %v", err)
+	}
+}
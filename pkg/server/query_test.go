@@ -0,0 +1,170 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stolostron/search-collector/pkg/config"
+	tr "github.com/stolostron/search-collector/pkg/transforms"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeGraph struct {
+	nodes []tr.Node
+	edges []tr.Edge
+}
+
+func (g fakeGraph) CurrentNodes() []tr.Node { return g.nodes }
+func (g fakeGraph) CurrentEdges() []tr.Edge { return g.edges }
+
+func (g fakeGraph) GetNode(uid string) (tr.Node, bool) {
+	for _, n := range g.nodes {
+		if n.UID == uid {
+			return n, true
+		}
+	}
+	return tr.Node{}, false
+}
+
+func testGraph() fakeGraph {
+	pod := func(name, namespace, app string) tr.Node {
+		return tr.Node{UID: "local-cluster/" + name, ResourceString: "pods", Properties: map[string]interface{}{
+			"kind": "Pod", "name": name, "namespace": namespace, "label": map[string]string{"app": app}}}
+	}
+	return fakeGraph{
+		nodes: []tr.Node{pod("pod1", "a", "web"), pod("pod2", "a", "db"), pod("pod3", "b", "web"),
+			{UID: "local-cluster/rs1", ResourceString: "replicasets",
+				Properties: map[string]interface{}{"kind": "ReplicaSet", "name": "rs1", "namespace": "a"}}},
+		edges: []tr.Edge{
+			{EdgeType: "ownedBy", SourceUID: "local-cluster/pod1", DestUID: "local-cluster/rs1"},
+			{EdgeType: "ownedBy", SourceUID: "local-cluster/pod2", DestUID: "local-cluster/rs1"},
+		},
+	}
+}
+
+// Authenticator with the fake API server of fakeAuthnClient.
+func testAuthenticator() *authenticator {
+	reviews := 0
+	return newAuthenticator(fakeAuthnClient(&reviews))
+}
+
+// GET request to the API with the bearer token, see fakeAuthnClient.
+func apiRequest(url, token string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+// Sends the request to a router with the query API enabled.
+func query(t *testing.T, graph Graph, url string) (int, queryPage) {
+	config.Cfg.FeatureQueryAPI = true
+	defer func() { config.Cfg.FeatureQueryAPI = false }()
+
+	rr := httptest.NewRecorder()
+	newRouter(graph, nil, nil, testAuthenticator()).ServeHTTP(rr, apiRequest(url, "valid"))
+
+	page := queryPage{}
+	if rr.Code == http.StatusOK {
+		assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &page))
+	}
+	return rr.Code, page
+}
+
+func uids(items interface{}) []string {
+	result := []string{}
+	for _, item := range items.([]interface{}) {
+		result = append(result, item.(map[string]interface{})["uid"].(string))
+	}
+	return result
+}
+
+func TestQueryNodes(t *testing.T) {
+	code, page := query(t, testGraph(), "/api/v1/nodes?kind=pod&namespace=a")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"local-cluster/pod1", "local-cluster/pod2"}, uids(page.Items))
+
+	_, page = query(t, testGraph(), "/api/v1/nodes?label=app%3Dweb&fields=name")
+	assert.Equal(t, []string{"local-cluster/pod1", "local-cluster/pod3"}, uids(page.Items))
+	assert.Equal(t, map[string]interface{}{"name": "pod1"},
+		page.Items.([]interface{})[0].(map[string]interface{})["properties"], "Expected only the selected fields.")
+
+	code, _ = query(t, testGraph(), "/api/v1/nodes?label=app%20in")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestQueryNodesPages(t *testing.T) {
+	var all []string
+	url := "/api/v1/nodes?limit=3"
+	for {
+		code, page := query(t, testGraph(), url)
+		assert.Equal(t, http.StatusOK, code)
+		all = append(all, uids(page.Items)...)
+		if page.Continue == "" {
+			break
+		}
+		url = "/api/v1/nodes?limit=3&continue=" + page.Continue
+	}
+	assert.Equal(t, []string{"local-cluster/pod1", "local-cluster/pod2", "local-cluster/pod3", "local-cluster/rs1"},
+		all)
+
+	code, _ := query(t, testGraph(), "/api/v1/nodes?limit=0")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestQueryEdges(t *testing.T) {
+	code, page := query(t, testGraph(), "/api/v1/nodes/local-cluster/rs1/edges?limit=1")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, page.Items, 1)
+	assert.Equal(t, "local-cluster/pod1", page.Items.([]interface{})[0].(map[string]interface{})["SourceUID"])
+
+	_, page = query(t, testGraph(), "/api/v1/nodes/local-cluster/rs1/edges?continue="+page.Continue)
+	assert.Len(t, page.Items, 1)
+	assert.Equal(t, "local-cluster/pod2", page.Items.([]interface{})[0].(map[string]interface{})["SourceUID"])
+	assert.Empty(t, page.Continue)
+
+	code, _ = query(t, testGraph(), "/api/v1/nodes/local-cluster/missing/edges")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestQueryDisabled(t *testing.T) {
+	rr := httptest.NewRecorder()
+	newRouter(testGraph(), nil, nil, testAuthenticator()).ServeHTTP(rr, apiRequest("/api/v1/nodes", "valid"))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+// The query API requires a token also without SERVER_AUTHN.
+func TestQueryAuthn(t *testing.T) {
+	config.Cfg.FeatureQueryAPI = true
+	defer func() { config.Cfg.FeatureQueryAPI = false }()
+	router := newRouter(testGraph(), nil, nil, testAuthenticator())
+
+	for token, expected := range map[string]int{"": http.StatusUnauthorized, "invalid": http.StatusUnauthorized,
+		"valid": http.StatusOK} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, apiRequest("/api/v1/nodes", token))
+		assert.Equal(t, expected, rr.Code, "token %q", token)
+	}
+}
+
+func TestQueryGraph(t *testing.T) {
+	config.Cfg.FeatureQueryAPI = true
+	defer func() { config.Cfg.FeatureQueryAPI = false }()
+	router := newRouter(testGraph(), nil, nil, testAuthenticator())
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, apiRequest("/api/v1/graph?kind=pod&kind=replicaset&namespace=a", "valid"))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "text/vnd.graphviz", rr.Header().Get("Content-Type"))
+	assert.Contains(t, rr.Body.String(), `"local-cluster/pod2" -> "local-cluster/rs1" [label="ownedBy"];`)
+	assert.NotContains(t, rr.Body.String(), "pod3", "Expected only the nodes in namespace a.")
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, apiRequest("/api/v1/graph?format=svg", "valid"))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
@@ -3,11 +3,11 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"k8s.io/klog/v2"
+	"net"
 	"net/http"
-	"os"
-	"os/signal"
-	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -16,29 +16,86 @@ import (
 	"github.com/stolostron/search-collector/pkg/metrics"
 )
 
-func StartAndListen() {
-	router := mux.NewRouter()
-	router.HandleFunc("/liveness", LivenessProbe).Methods("GET")
-	router.HandleFunc("/readiness", ReadinessProbe).Methods("GET")
-	router.Handle("/metrics", promhttp.HandlerFor(metrics.PromRegistry, promhttp.HandlerOpts{})).Methods("GET")
-
+// Serves the probes, metrics and API until the context is done, then shuts the server down.
+// The diff stream gets its diffs from diffs, which is nil without FEATURE_DIFF_STREAM. The admin routes perform
+// the actions of admin, when FEATURE_ADMIN_API is set.
+func StartAndListen(ctx context.Context, graph Graph, diffs DiffSource, admin Admin) {
+	var stream *diffStream
+	if diffs != nil {
+		stream = newDiffStream(diffs)
+		go stream.run(ctx)
+	}
+	if !config.Cfg.FeatureAdminAPI {
+		admin = nil
+	}
+	var authn *authenticator
+	if config.Cfg.ServerAuthn || admin != nil || config.Cfg.FeatureQueryAPI || stream != nil {
+		authn = newAuthenticator(config.GetKubeClient(config.GetKubeConfig()))
+		go authn.run(ctx)
+		if config.Cfg.ServerTLSCertFile == "" {
+			klog.Warning("SERVER_TLS_CERT_FILE isn't set. The bearer tokens and the API responses are sent over plain HTTP.")
+		}
+	}
 	srv := &http.Server{
 		Addr:              config.Cfg.ServerAddress,
-		Handler:           router,
+		Handler:           newRouter(graph, stream, admin, authn),
 		ReadHeaderTimeout: time.Duration(config.Cfg.HTTPTimeout) * time.Millisecond,
+		TLSConfig:         &tls.Config{MinVersion: tls.VersionTLS12},
+		// Requests are canceled on termination, so the open diff streams don't hold back the shutdown.
+		BaseContext: func(net.Listener) context.Context { return ctx },
 	}
 
 	go func() {
 		klog.Info("Listening on: ", srv.Addr)
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		var err error
+		if config.Cfg.ServerTLSCertFile != "" {
+			err = srv.ListenAndServeTLS(config.Cfg.ServerTLSCertFile, config.Cfg.ServerTLSKeyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
 			klog.Fatal(err, ". Encountered while starting the server.")
 		}
 	}()
 
-	// Listen and wait for termination signal.
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	<-ctx.Done() // Waits for termination signal.
+	klog.Warning("Received termination signal. Shutting down server.")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		klog.Warning("Error shutting down the server. ", err)
+	}
+}
+
+// Builds the routes. The metrics require authentication when SERVER_AUTHN is set. The query API, the diff stream
+// and the admin routes serve the resources of the cluster or change the collector, so they always do. The probes
+// never do. The authenticator is only used by the routes that require authentication.
+func newRouter(graph Graph, stream *diffStream, admin Admin, authn *authenticator) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/liveness", LivenessProbe).Methods("GET")
+	router.HandleFunc("/readiness", ReadinessProbe).Methods("GET")
 
-	sig := <-sigs // Waits for termination signal.
-	klog.Warningf("Received termination signal %s. Exiting server. ", sig)
+	metricsHandler := promhttp.HandlerFor(metrics.PromRegistry, promhttp.HandlerOpts{})
+	if config.Cfg.ServerAuthn {
+		metricsHandler = authn.protect(metricsHandler)
+	}
+	router.Handle("/metrics", metricsHandler).Methods("GET")
+
+	// Before the other API routes, so their authentication doesn't apply to the admin routes too.
+	if admin != nil {
+		(&adminAPI{admin: admin}).register(router, authn)
+	}
+	if !config.Cfg.FeatureQueryAPI && stream == nil {
+		return router
+	}
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.Use(authn.protect)
+	if config.Cfg.FeatureQueryAPI {
+		(&queryAPI{graph: graph}).register(api)
+	}
+	if stream != nil {
+		api.HandleFunc("/diffs", stream.serve).Methods("GET")
+	}
+	return router
 }
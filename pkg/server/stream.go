@@ -0,0 +1,360 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stolostron/search-collector/pkg/config"
+	"github.com/stolostron/search-collector/pkg/graph"
+	"github.com/stolostron/search-collector/pkg/metrics"
+	"github.com/stolostron/search-collector/pkg/reconciler"
+	tr "github.com/stolostron/search-collector/pkg/transforms"
+	"k8s.io/klog/v2"
+)
+
+// DiffSource returns the changes since its previous diff. Implemented by a reconciler cursor, so the stream
+// doesn't take the changes the reconciler tracks for the senders.
+type DiffSource interface {
+	Diff() reconciler.Diff
+	Complete() reconciler.CompleteState
+}
+
+// Changes published to the subscribers of the stream.
+type streamDiff struct {
+	AddNodes    []tr.Node     `json:"addNodes,omitempty"`
+	UpdateNodes []tr.Node     `json:"updateNodes,omitempty"`
+	DeleteNodes []tr.Deletion `json:"deleteNodes,omitempty"`
+	AddEdges    []tr.Edge     `json:"addEdges,omitempty"`
+	DeleteEdges []tr.Edge     `json:"deleteEdges,omitempty"`
+}
+
+// Kind and namespace of a node, to filter the diffs. The namespace is empty for cluster scoped nodes.
+type nodeScope struct {
+	kind, namespace string
+}
+
+func scopeOf(n tr.Node) nodeScope {
+	namespace, _ := n.Properties["namespace"].(string)
+	return nodeScope{kind: fmt.Sprint(n.Properties["kind"]), namespace: namespace}
+}
+
+// A published diff, with the scope of the nodes and edge ends in it.
+type streamEvent struct {
+	seq    uint64
+	diff   streamDiff
+	scopes map[string]nodeScope // Keyed by UID
+}
+
+// Publishes the diffs of the collector to the subscribers of the stream route. The last diffs are kept, so a
+// subscriber that reconnects with the ID of the last event it got doesn't miss any diff.
+// Each subscriber has a queue of DIFF_STREAM_QUEUE diffs. A subscriber that lets its queue fill up is
+// disconnected instead of holding back the others, and can resume while its diffs are kept.
+type diffStream struct {
+	source      DiffSource
+	epoch       string // Identifies this process in the event IDs, so IDs from a previous run aren't resumed
+	mutex       sync.Mutex
+	seq         uint64                                // Of the last published diff
+	history     []*streamEvent                        // Oldest first, up to DIFF_STREAM_HISTORY
+	subscribers map[chan *streamEvent]struct{}        // Closed when the subscriber is dropped
+	scopes      map[string]nodeScope                  // Of the current nodes, to filter their deletion
+	diffs       func(ctx context.Context) <-chan bool // Ticks when it's time to publish a diff, replaced in tests
+}
+
+func newDiffStream(source DiffSource) *diffStream {
+	return &diffStream{
+		source:      source,
+		epoch:       strconv.FormatInt(time.Now().UnixNano(), 36),
+		subscribers: map[chan *streamEvent]struct{}{},
+		scopes:      map[string]nodeScope{},
+		diffs:       reportTicks,
+	}
+}
+
+// Ticks every REPORT_RATE_MS, like the senders, until the context is done.
+func reportTicks(ctx context.Context) <-chan bool {
+	ticks := make(chan bool)
+	go func() {
+		defer close(ticks)
+		ticker := time.NewTicker(time.Duration(config.Cfg.ReportRateMS) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				ticks <- true
+			}
+		}
+	}()
+	return ticks
+}
+
+// Publishes the diffs until the context is done. Nothing is published for the state before it started,
+// subscribers get the current nodes from the query API.
+func (s *diffStream) run(ctx context.Context) {
+	complete := s.source.Complete()
+	s.mutex.Lock()
+	for _, n := range complete.Nodes {
+		s.scopes[n.UID] = scopeOf(n)
+	}
+	s.mutex.Unlock()
+
+	for range s.diffs(ctx) {
+		s.publish(s.source.Diff())
+	}
+}
+
+// Adds the diff to the history and queues it for every subscriber. Never waits for a subscriber.
+func (s *diffStream) publish(diff reconciler.Diff) {
+	event := &streamEvent{
+		diff: streamDiff{AddNodes: diff.AddNodes, UpdateNodes: diff.UpdateNodes, DeleteNodes: diff.DeleteNodes,
+			AddEdges: diff.AddEdges, DeleteEdges: diff.DeleteEdges},
+		scopes: map[string]nodeScope{},
+	}
+	if event.diff.empty() {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, nodes := range [][]tr.Node{diff.AddNodes, diff.UpdateNodes} {
+		for _, n := range nodes {
+			s.scopes[n.UID] = scopeOf(n)
+			event.scopes[n.UID] = s.scopes[n.UID]
+		}
+	}
+	for _, edges := range [][]tr.Edge{diff.AddEdges, diff.DeleteEdges} {
+		for _, e := range edges {
+			event.scopes[e.SourceUID] = s.edgeEndScope(e.SourceUID, e.SourceKind)
+			event.scopes[e.DestUID] = s.edgeEndScope(e.DestUID, e.DestKind)
+		}
+	}
+	for _, d := range diff.DeleteNodes {
+		event.scopes[d.UID] = s.scopes[d.UID]
+		delete(s.scopes, d.UID)
+	}
+
+	s.seq++
+	event.seq = s.seq
+	s.history = append(s.history, event)
+	if len(s.history) > config.Cfg.DiffStreamHistory {
+		s.history = slices.Delete(s.history, 0, len(s.history)-max(config.Cfg.DiffStreamHistory, 0))
+	}
+
+	for events := range s.subscribers {
+		select {
+		case events <- event:
+		default:
+			klog.Warningf("Dropping a diff stream subscriber. It didn't read the last %d diffs.", cap(events))
+			s.remove(events)
+			metrics.DiffStreamDroppedTotal.Inc()
+		}
+	}
+}
+
+// Returns the scope of an edge end. Edges of deleted nodes can point to nodes the stream doesn't know.
+func (s *diffStream) edgeEndScope(uid, kind string) nodeScope {
+	if scope, ok := s.scopes[uid]; ok {
+		return scope
+	}
+	return nodeScope{kind: kind}
+}
+
+// Adds a subscriber. If the ID of the last event it got is still in the history, returns the diffs after it
+// and true. Returns the ID of the last published diff.
+func (s *diffStream) subscribe(lastEventID string) (chan *streamEvent, []*streamEvent, bool, string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	events := make(chan *streamEvent, max(config.Cfg.DiffStreamQueue, 1))
+	s.subscribers[events] = struct{}{}
+	metrics.DiffStreamSubscribers.Inc()
+
+	seq, ok := s.parseEventID(lastEventID)
+	if !ok {
+		return events, nil, false, s.eventID(s.seq)
+	}
+	var missed []*streamEvent
+	for _, event := range s.history {
+		if event.seq > seq {
+			missed = append(missed, event)
+		}
+	}
+	return events, missed, true, s.eventID(s.seq)
+}
+
+// Removes the subscriber, if it wasn't dropped already.
+func (s *diffStream) unsubscribe(events chan *streamEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.subscribers[events]; ok {
+		s.remove(events)
+	}
+}
+
+// NOT THREADSAFE, locking left up to the caller.
+func (s *diffStream) remove(events chan *streamEvent) {
+	delete(s.subscribers, events)
+	close(events)
+	metrics.DiffStreamSubscribers.Dec()
+}
+
+func (s *diffStream) eventID(seq uint64) string {
+	return s.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// Returns the sequence number of the event ID, and true if the diffs after it are all in the history.
+// NOT THREADSAFE, locking left up to the caller.
+func (s *diffStream) parseEventID(id string) (uint64, bool) {
+	epoch, seqString, found := strings.Cut(id, "-")
+	if !found || epoch != s.epoch {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(seqString, 10, 64)
+	if err != nil || seq > s.seq {
+		return 0, false
+	}
+	if seq < s.seq && (len(s.history) == 0 || seq+1 < s.history[0].seq) {
+		return 0, false
+	}
+	return seq, true
+}
+
+// Filter of a subscriber. Empty lists match everything.
+type streamFilter struct {
+	kinds, namespaces []string
+}
+
+func (f streamFilter) matches(scope nodeScope) bool {
+	return (len(f.kinds) == 0 || slices.ContainsFunc(f.kinds, func(kind string) bool {
+		return strings.EqualFold(kind, scope.kind)
+	})) && (len(f.namespaces) == 0 || slices.Contains(f.namespaces, scope.namespace))
+}
+
+// Returns the changes of the nodes that match the filter, and of the edges with at least one end that does.
+func (f streamFilter) apply(event *streamEvent) streamDiff {
+	if len(f.kinds) == 0 && len(f.namespaces) == 0 {
+		return event.diff
+	}
+	matchesNode := func(n tr.Node) bool { return f.matches(event.scopes[n.UID]) }
+	matchesEdge := func(e tr.Edge) bool {
+		return f.matches(event.scopes[e.SourceUID]) || f.matches(event.scopes[e.DestUID])
+	}
+	return streamDiff{
+		AddNodes:    filtered(event.diff.AddNodes, matchesNode),
+		UpdateNodes: filtered(event.diff.UpdateNodes, matchesNode),
+		DeleteNodes: filtered(event.diff.DeleteNodes, func(d tr.Deletion) bool {
+			return f.matches(event.scopes[d.UID])
+		}),
+		AddEdges:    filtered(event.diff.AddEdges, matchesEdge),
+		DeleteEdges: filtered(event.diff.DeleteEdges, matchesEdge),
+	}
+}
+
+func filtered[T any](items []T, keep func(T) bool) []T {
+	var result []T
+	for _, item := range items {
+		if keep(item) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func (d streamDiff) empty() bool {
+	return len(d.AddNodes)+len(d.UpdateNodes)+len(d.DeleteNodes)+len(d.AddEdges)+len(d.DeleteEdges) == 0
+}
+
+// Streams the diffs as Server-Sent Events, filtered by the kind and namespace parameters.
+// The first event is a start event, or a reset event when the Last-Event-ID header or the resume parameter
+// can't be resumed. After a reset, the subscriber lists the nodes again. Diffs are diff events. A dropped
+// event is sent before the stream is closed because the subscriber didn't keep up.
+func (s *diffStream) serve(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	params := r.URL.Query()
+	filter := streamFilter{
+		kinds:      graph.SplitList(strings.Join(params["kind"], ",")),
+		namespaces: graph.SplitList(strings.Join(params["namespace"], ",")),
+	}
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = params.Get("resume")
+	}
+
+	events, missed, resumed, currentID := s.subscribe(lastEventID)
+	defer s.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	var err error
+	switch {
+	case lastEventID == "":
+		err = writeEvent(w, "start", currentID, struct{}{})
+	case !resumed:
+		err = writeEvent(w, "reset", currentID, map[string]string{
+			"reason": "the diffs after the last event ID are no longer kept"})
+	}
+	for _, event := range missed {
+		if err != nil {
+			break
+		}
+		err = s.writeDiff(w, filter, event)
+	}
+	flusher.Flush()
+
+	for err == nil {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, open := <-events:
+			if !open {
+				_ = writeEvent(w, "dropped", "", map[string]string{
+					"reason": "the subscriber didn't keep up with the diffs, resume with the last event ID"})
+				flusher.Flush()
+				return
+			}
+			err = s.writeDiff(w, filter, event)
+			flusher.Flush()
+		}
+	}
+	klog.V(3).Infof("Diff stream subscriber disconnected. %v", err)
+}
+
+// Writes the diff event, unless the filter leaves nothing of the diff.
+func (s *diffStream) writeDiff(w io.Writer, filter streamFilter, event *streamEvent) error {
+	diff := filter.apply(event)
+	if diff.empty() {
+		return nil
+	}
+	return writeEvent(w, "diff", s.eventID(event.seq), diff)
+}
+
+func writeEvent(w io.Writer, name, id string, data interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		if _, err = fmt.Fprintf(w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, body)
+	return err
+}
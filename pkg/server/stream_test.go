@@ -0,0 +1,185 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stolostron/search-collector/pkg/config"
+	"github.com/stolostron/search-collector/pkg/reconciler"
+	tr "github.com/stolostron/search-collector/pkg/transforms"
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns the queued diffs, one per call.
+type fakeDiffSource struct {
+	complete reconciler.CompleteState
+	diffs    chan reconciler.Diff
+}
+
+func (f *fakeDiffSource) Complete() reconciler.CompleteState { return f.complete }
+func (f *fakeDiffSource) Diff() reconciler.Diff              { return <-f.diffs }
+
+type sseEvent struct {
+	id, name string
+	data     streamDiff
+}
+
+// Reads the next event of the stream.
+func readEvent(t *testing.T, rd *bufio.Reader) sseEvent {
+	event := sseEvent{}
+	for {
+		line, err := rd.ReadString('\n')
+		assert.Nil(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return event
+		}
+		field, value, _ := strings.Cut(line, ": ")
+		switch field {
+		case "id":
+			event.id = value
+		case "event":
+			event.name = value
+		case "data":
+			assert.Nil(t, json.Unmarshal([]byte(value), &event.data))
+		}
+	}
+}
+
+// Subscribes to the stream served by the router.
+func subscribe(t *testing.T, srv *httptest.Server, query, lastEventID string) (*bufio.Reader, func()) {
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/diffs"+query, nil)
+	req.Header.Set("Authorization", "Bearer valid")
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := srv.Client().Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	return bufio.NewReader(resp.Body), func() { resp.Body.Close() }
+}
+
+func streamNode(uid, kind, namespace string) tr.Node {
+	return tr.Node{UID: uid, Properties: map[string]interface{}{"kind": kind, "name": uid, "namespace": namespace}}
+}
+
+func TestDiffStream(t *testing.T) {
+	originalHistory, originalQueue := config.Cfg.DiffStreamHistory, config.Cfg.DiffStreamQueue
+	config.Cfg.DiffStreamHistory, config.Cfg.DiffStreamQueue = 10, 10
+	defer func() { config.Cfg.DiffStreamHistory, config.Cfg.DiffStreamQueue = originalHistory, originalQueue }()
+	source := &fakeDiffSource{
+		complete: reconciler.CompleteState{Nodes: []tr.Node{streamNode("pod0", "Pod", "a")}},
+		diffs:    make(chan reconciler.Diff),
+	}
+	stream := newDiffStream(source)
+	ticks := make(chan bool)
+	stream.diffs = func(ctx context.Context) <-chan bool { return ticks }
+	go stream.run(context.Background())
+	defer close(ticks)
+	publish := func(diff reconciler.Diff) {
+		ticks <- true
+		source.diffs <- diff
+	}
+
+	srv := httptest.NewServer(newRouter(testGraph(), stream, nil, testAuthenticator()))
+	defer srv.Close()
+	all, closeAll := subscribe(t, srv, "", "")
+	defer closeAll()
+	pods, closePods := subscribe(t, srv, "?kind=pod&namespace=a", "")
+	defer closePods()
+	start := readEvent(t, all)
+	assert.Equal(t, "start", start.name)
+	assert.Equal(t, "start", readEvent(t, pods).name)
+
+	publish(reconciler.Diff{
+		AddNodes: []tr.Node{streamNode("pod1", "Pod", "a"), streamNode("rs1", "ReplicaSet", "a"),
+			streamNode("pod2", "Pod", "b")},
+		AddEdges: []tr.Edge{{EdgeType: "ownedBy", SourceUID: "pod1", DestUID: "rs1", SourceKind: "Pod",
+			DestKind: "ReplicaSet"}},
+	})
+	publish(reconciler.Diff{DeleteNodes: []tr.Deletion{{UID: "pod0"}, {UID: "pod2"}}})
+
+	first := readEvent(t, all)
+	assert.Equal(t, "diff", first.name)
+	assert.Len(t, first.data.AddNodes, 3)
+	second := readEvent(t, all)
+	assert.Equal(t, []tr.Deletion{{UID: "pod0"}, {UID: "pod2"}}, second.data.DeleteNodes)
+
+	filtered := readEvent(t, pods)
+	assert.Equal(t, first.id, filtered.id)
+	assert.Len(t, filtered.data.AddNodes, 1)
+	assert.Equal(t, "pod1", filtered.data.AddNodes[0].UID)
+	assert.Len(t, filtered.data.AddEdges, 1, "Expected the edges with one end that matches the filter.")
+	assert.Equal(t, []tr.Deletion{{UID: "pod0"}}, readEvent(t, pods).data.DeleteNodes,
+		"Expected the deletion of a node from before the stream started to be filtered by its namespace.")
+
+	// Resume after the first diff.
+	resumed, closeResumed := subscribe(t, srv, "", first.id)
+	defer closeResumed()
+	event := readEvent(t, resumed)
+	assert.Equal(t, second.id, event.id)
+	assert.Equal(t, "diff", event.name)
+
+	// The IDs of another process or of forgotten diffs can't be resumed.
+	for _, lastEventID := range []string{"other-1", strings.Replace(second.id, "-2", "-3", 1)} {
+		reset, closeReset := subscribe(t, srv, "", lastEventID)
+		event = readEvent(t, reset)
+		assert.Equal(t, "reset", event.name)
+		assert.Equal(t, second.id, event.id)
+		closeReset()
+	}
+}
+
+func TestDiffStreamHistory(t *testing.T) {
+	originalHistory := config.Cfg.DiffStreamHistory
+	config.Cfg.DiffStreamHistory = 2
+	defer func() { config.Cfg.DiffStreamHistory = originalHistory }()
+
+	stream := newDiffStream(&fakeDiffSource{})
+	for i := 0; i < 3; i++ {
+		stream.publish(reconciler.Diff{AddNodes: []tr.Node{streamNode("pod1", "Pod", "a")}})
+	}
+	stream.publish(reconciler.Diff{}) // Empty diffs aren't published.
+
+	assert.Len(t, stream.history, 2)
+	_, missed, ok, currentID := stream.subscribe(stream.eventID(1))
+	assert.True(t, ok, "Expected the diffs after the oldest kept diff to be resumed.")
+	assert.Len(t, missed, 2)
+	assert.Equal(t, stream.eventID(3), currentID)
+	_, _, ok, _ = stream.subscribe(stream.eventID(0))
+	assert.False(t, ok, "Expected the forgotten diff not to be resumed.")
+}
+
+func TestDiffStreamDropsSlowSubscribers(t *testing.T) {
+	originalQueue := config.Cfg.DiffStreamQueue
+	config.Cfg.DiffStreamQueue = 1
+	defer func() { config.Cfg.DiffStreamQueue = originalQueue }()
+
+	stream := newDiffStream(&fakeDiffSource{})
+	slow, _, _, _ := stream.subscribe("")
+	fast, _, _, _ := stream.subscribe("")
+
+	diff := reconciler.Diff{AddNodes: []tr.Node{streamNode("pod1", "Pod", "a")}}
+	stream.publish(diff)
+	<-fast
+	stream.publish(diff) // Doesn't wait for the slow subscriber.
+
+	assert.Len(t, slow, 1)
+	<-slow
+	_, open := <-slow
+	assert.False(t, open, "Expected the slow subscriber to be dropped.")
+	assert.Len(t, fast, 1)
+	assert.Len(t, stream.subscribers, 1)
+
+	stream.unsubscribe(slow) // Already dropped.
+	stream.unsubscribe(fast)
+	assert.Empty(t, stream.subscribers)
+}
@@ -37,6 +37,11 @@ func (d AppDeployableResource) BuildNode() Node {
 	return d.node
 }
 
+func init() {
+	// Deployables are looked up by name from the channels and subscriptions of any namespace.
+	declareEdgeScope(RebuildAllEdges, []string{"Deployable"}, nil)
+}
+
 // BuildEdges construct the edges for the AppDeployable Resources
 // See documentation at pkg/transforms/README.md
 func (d AppDeployableResource) BuildEdges(ns NodeStore) []Edge {
@@ -53,6 +53,11 @@ func (a AppHelmCRResource) BuildNode() Node {
 	return a.node
 }
 
+func init() {
+	// Helm release CRs are looked up by name from the subscriptions of any namespace.
+	declareEdgeScope(RebuildAllEdges, []string{"HelmRelease"}, nil)
+}
+
 // BuildEdges construct the edges for the AppHelmCRResource Resources
 func (a AppHelmCRResource) BuildEdges(ns NodeStore) []Edge {
 	ret := []Edge{}
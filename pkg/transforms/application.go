@@ -37,6 +37,12 @@ func (a ApplicationResource) BuildNode() Node {
 	return a.node
 }
 
+func init() {
+	// Applications are looked up by name from the subscriptions and deployables of any namespace, and their edges
+	// set the hosting application of other nodes.
+	declareEdgeScope(RebuildAllEdges, []string{"Application"}, nil)
+}
+
 // BuildEdges construct the edges for the Application Resources
 // See documentation at pkg/transforms/README.md
 func (a ApplicationResource) BuildEdges(ns NodeStore) []Edge {
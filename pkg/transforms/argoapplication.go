@@ -170,6 +170,12 @@ func (a ArgoApplicationResource) BuildNode() Node {
 	return a.node
 }
 
+func init() {
+	// Argo applications build edges to the resources in their destination namespaces, and application sets
+	// are looked up by name from the applications they generate.
+	declareEdgeScope(RebuildAllEdges, []string{"Application", "ApplicationSet"}, nil)
+}
+
 // BuildEdges construct the edges for the Application Resources
 // See documentation at pkg/transforms/README.md
 func (a ArgoApplicationResource) BuildEdges(ns NodeStore) []Edge {
@@ -37,6 +37,11 @@ func (c ChannelResource) BuildNode() Node {
 	return c.node
 }
 
+func init() {
+	// Channels are looked up by name from the subscriptions of any namespace.
+	declareEdgeScope(RebuildAllEdges, []string{"Channel"}, nil)
+}
+
 // BuildEdges construct the edges for the Channel Resources
 // See documentation at pkg/transforms/README.md
 func (c ChannelResource) BuildEdges(ns NodeStore) []Edge {
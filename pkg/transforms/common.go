@@ -242,6 +242,11 @@ func edgesByDefaultTransformConfig(ret []Edge, currNode Node, ns NodeStore) []Ed
 	return ret
 }
 
+func init() {
+	// Gatekeeper mutations are looked up by name from the resources they mutate in any namespace.
+	declareEdgeScope(RebuildAllEdges, nil, []string{"mutations.gatekeeper.sh"})
+}
+
 // Function to create an edge linking a resource to Gatekeeper mutations (e.g., Assign, AssignImage) that modify the resource.
 func edgesByGatekeeperMutation(ret []Edge, currNode Node, ns NodeStore) []Edge {
 	mutationEntries := currNode.GetMetadata("gatekeeper.sh/mutations")
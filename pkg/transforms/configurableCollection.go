@@ -27,6 +27,7 @@ func LoadAndMergeConfigurableCollection() {
 		klog.Info("Configurable collection feature is disabled, skipping custom config load")
 		// Initialize mergedTransformConfig to a copy of defaultTransformConfig
 		mergedTransformConfig = deepCopyTransformConfig(defaultTransformConfig)
+		mergedUpdateRules = deepCopyUpdateRules(defaultUpdateRules)
 		return
 	}
 
@@ -56,6 +57,7 @@ var collectorConfigGVR = schema.GroupVersionResource{
 func loadAndMergeConfigurableCollectionWithClient(dynamicClient dynamic.Interface) {
 	// Start with a deep copy of defaultTransformConfig
 	mergedTransformConfig = deepCopyTransformConfig(defaultTransformConfig)
+	mergedUpdateRules = deepCopyUpdateRules(defaultUpdateRules)
 
 	namespace := config.Cfg.PodNamespace
 
@@ -81,19 +83,24 @@ func loadAndMergeConfigurableCollectionWithClient(dynamicClient dynamic.Interfac
 
 	klog.V(1).Info("Found merged-collector-config resource, merging with default config")
 
+	// warnings accumulates messages for rules or fields that were skipped.
+	// These become the status condition message so users can see issues via `oc describe`.
+	// The typed CollectorConfig doesn't have the updateRules, so they are read from the unstructured object.
+	warnings := mergeUpdateRules(configObj)
+
 	// Get collection rules from spec
 	collectionRules := collectorConfig.Spec.CollectionRules
 	if len(collectionRules) == 0 {
 		klog.Warning("No collectionRules found in merged-collector-config resource")
 		// Empty rules is a valid (though unusual) configuration — mark as Applied.
-		updateCollectorConfigStatus(dynamicClient, namespace, configObj, nil, collectorConfigReasonApplied)
+		reason := collectorConfigReasonApplied
+		if len(warnings) > 0 {
+			reason = collectorConfigReasonRulesSkipped
+		}
+		updateCollectorConfigStatus(dynamicClient, namespace, configObj, warnings, reason)
 		return
 	}
 
-	// warnings accumulates messages for rules or fields that were skipped.
-	// These become the status condition message so users can see issues via `oc describe`.
-	var warnings []string
-
 	// merge each rule from collectionRules with mergedTransformConfig
 	for _, rule := range collectionRules {
 		// Get field suffix for this rule (defaults to empty string)
@@ -0,0 +1,41 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package transforms
+
+// EdgeScope tells which nodes can have edges that change when a node of a kind changes. The reconciler uses it
+// to build again only the edges that a change can affect.
+type EdgeScope int
+
+const (
+	// NamespaceEdges are only built to nodes in the same namespace, to cluster scoped nodes and to owners.
+	NamespaceEdges EdgeScope = iota
+	// GlobalEdges look up nodes in other namespaces, or update the metadata of other nodes. They're built again
+	// with every diff.
+	GlobalEdges
+	// RebuildAllEdges is for kinds that nodes in any namespace look up by name. A change to one of them builds
+	// the edges of all the nodes again.
+	RebuildAllEdges
+)
+
+// Edge scopes declared by the transforms with declareEdgeScope, keyed by kind and by API group.
+var (
+	kindEdgeScopes  = map[string]EdgeScope{}
+	groupEdgeScopes = map[string]EdgeScope{}
+)
+
+// Declares the edge scope of kinds and API groups. Called from the init function of the transform that builds
+// the edges reaching across namespaces, next to its BuildEdges.
+func declareEdgeScope(scope EdgeScope, kinds []string, groups []string) {
+	for _, kind := range kinds {
+		kindEdgeScopes[kind] = max(kindEdgeScopes[kind], scope)
+	}
+	for _, group := range groups {
+		groupEdgeScopes[group] = max(groupEdgeScopes[group], scope)
+	}
+}
+
+// KindEdgeScope returns the edge scope of a kind and API group, NamespaceEdges unless a transform declared
+// another one.
+func KindEdgeScope(kind, group string) EdgeScope {
+	return max(kindEdgeScopes[kind], groupEdgeScopes[group])
+}
@@ -0,0 +1,88 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package transforms
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Builds the nodes of the test data resources, with the namespaced ones moved to the namespace when it's set.
+func buildTestDataNodes(t *testing.T, files []string, namespace string) []NodeEvent {
+	var events []*Event
+	for _, file := range files {
+		rawBytes, err := os.ReadFile(file)
+		assert.Nil(t, err)
+		resource := &unstructured.Unstructured{}
+		if json.Unmarshal(rawBytes, &resource.Object) != nil || resource.GetKind() == "" || resource.IsList() {
+			continue
+		}
+		if namespace != "" && resource.GetNamespace() != "" {
+			resource.SetNamespace(namespace)
+			resource.SetUID(resource.GetUID() + "-moved")
+		}
+		events = append(events, &Event{Resource: resource, ResourceString: strings.ToLower(resource.GetKind()) + "s"})
+	}
+	var nodeEvents []NodeEvent
+	built, errs := TransformEvents(events)
+	for i, ne := range built {
+		if errs[i] == nil && ne.UID != "" {
+			nodeEvents = append(nodeEvents, ne)
+		}
+	}
+	return nodeEvents
+}
+
+// Every edge between nodes of different namespaces must be built by a kind with global edges, or end at a kind
+// that rebuilds all the edges, otherwise the reconciler keeps the edge after the other node changes. Moves each
+// test data resource to another namespace, where the edges it finds in its own namespace by name go away and the
+// ones it finds in other namespaces remain.
+func Test_declaredEdgeScopes(t *testing.T) {
+	files, err := filepath.Glob("../../test-data/*.json")
+	assert.Nil(t, err)
+
+	for _, file := range files {
+		moved := buildTestDataNodes(t, []string{file}, "moved-namespace")
+		if len(moved) == 0 || moved[0].Properties["namespace"] == nil {
+			continue
+		}
+		var others []string
+		for _, other := range files {
+			if other != file {
+				others = append(others, other)
+			}
+		}
+		nodeEvents := append(buildTestDataNodes(t, others, ""), moved...)
+		nodes := make([]Node, 0, len(nodeEvents))
+		for _, ne := range nodeEvents {
+			nodes = append(nodes, ne.Node)
+		}
+		store := BuildFakeNodeStore(nodes)
+
+		for _, ne := range nodeEvents {
+			for _, edge := range ne.ComputeEdges(store) {
+				source, dest := store.ByUID[edge.SourceUID], store.ByUID[edge.DestUID]
+				if source.Properties["namespace"] == nil || dest.Properties["namespace"] == nil ||
+					source.Properties["namespace"] == dest.Properties["namespace"] {
+					continue
+				}
+				other := dest
+				if other.UID == ne.UID {
+					other = source
+				}
+				group, _ := ne.Properties["apigroup"].(string)
+				otherGroup, _ := other.Properties["apigroup"].(string)
+				assert.True(t, KindEdgeScope(ne.Properties["kind"].(string), group) != NamespaceEdges ||
+					KindEdgeScope(other.Properties["kind"].(string), otherGroup) == RebuildAllEdges,
+					"Expected %s to declare its edges to %s in other namespaces, found after moving %s.",
+					ne.Properties["kind"], other.Properties["kind"], filepath.Base(file))
+			}
+		}
+	}
+}
@@ -48,6 +48,11 @@ func (r GkConstraintResource) BuildNode() Node {
 	return r.node
 }
 
+func init() {
+	// Constraints build edges to their violating objects in any namespace.
+	declareEdgeScope(GlobalEdges, nil, []string{"constraints.gatekeeper.sh"})
+}
+
 func (r GkConstraintResource) BuildEdges(ns NodeStore) []Edge {
 	constraintKind, ok := r.node.Properties["kind"].(string)
 	if !ok {
@@ -111,6 +111,11 @@ func getSummarizedManifestResources(h HelmReleaseResource) []SummarizedManifestR
 	return smr
 }
 
+func init() {
+	// Releases set the release of the resources they deploy in any namespace, which their owners look up.
+	declareEdgeScope(RebuildAllEdges, []string{"Release"}, nil)
+}
+
 func (h HelmReleaseResource) BuildEdges(ns NodeStore) []Edge {
 	smr := getSummarizedManifestResources(h)
 
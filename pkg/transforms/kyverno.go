@@ -64,6 +64,11 @@ func (p KyvernoPolicyResource) BuildNode() Node {
 	return p.node
 }
 
+func init() {
+	// Kyverno policies are looked up by name from the resources they generate in any namespace.
+	declareEdgeScope(RebuildAllEdges, nil, []string{"kyverno.io", "policies.kyverno.io"})
+}
+
 func (p KyvernoPolicyResource) BuildEdges(ns NodeStore) []Edge {
 	return []Edge{}
 }
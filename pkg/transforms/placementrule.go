@@ -36,6 +36,11 @@ func (p PlacementRuleResource) BuildNode() Node {
 	return p.node
 }
 
+func init() {
+	// Placement rules are looked up by name from the subscriptions of any namespace.
+	declareEdgeScope(RebuildAllEdges, []string{"PlacementRule"}, nil)
+}
+
 // BuildEdges construct the edges for the PlacementRule Resources
 func (p PlacementRuleResource) BuildEdges(ns NodeStore) []Edge {
 	//no op for now to implement interface
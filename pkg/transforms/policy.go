@@ -291,6 +291,11 @@ func (p PolicyResource) BuildNode() Node {
 	return p.node
 }
 
+func init() {
+	// Policies build edges to their related objects in any namespace.
+	declareEdgeScope(GlobalEdges, []string{"CertificatePolicy", "ConfigurationPolicy", "OperatorPolicy", "Policy"}, nil)
+}
+
 func (p PolicyResource) BuildEdges(ns NodeStore) []Edge {
 	policyKind, ok := p.node.Properties["kind"].(string)
 	if !ok {
@@ -158,6 +158,11 @@ func (pr PolicyReportResource) BuildNode() Node {
 	return pr.node
 }
 
+func init() {
+	// Policy reports build edges to the policies of their results in any namespace.
+	declareEdgeScope(GlobalEdges, []string{"ClusterPolicyReport", "PolicyReport"}, nil)
+}
+
 // BuildEdges builds any necessary edges to related resources
 func (pr PolicyReportResource) BuildEdges(ns NodeStore) []Edge {
 	edges := []Edge{}
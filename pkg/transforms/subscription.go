@@ -82,6 +82,12 @@ func (s SubscriptionResource) BuildNode() Node {
 	return s.node
 }
 
+func init() {
+	// Subscriptions look up their channels and placement rules in other namespaces, and set the hosting
+	// subscription of the resources they deploy in any namespace.
+	declareEdgeScope(RebuildAllEdges, []string{"Subscription"}, nil)
+}
+
 // BuildEdges construct the edges for the Subscription Resources
 // See documentation at pkg/transforms/README.md
 func (s SubscriptionResource) BuildEdges(ns NodeStore) []Edge {
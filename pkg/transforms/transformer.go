@@ -15,12 +15,14 @@ import (
 	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	ocpapp "github.com/openshift/api/apps/v1"
 	policy "github.com/stolostron/governance-policy-propagator/api/v1"
 	klusterletaddon "github.com/stolostron/klusterlet-addon-controller/pkg/apis/agent/v1"
 	appDeployable "github.com/stolostron/multicloud-operators-deployable/pkg/apis/apps/v1"
 	rule "github.com/stolostron/multicloud-operators-placementrule/pkg/apis/apps/v1"
+	"github.com/stolostron/search-collector/pkg/health"
 	apps "k8s.io/api/apps/v1"
 	batch "k8s.io/api/batch/v1"
 	batchBeta "k8s.io/api/batch/v1beta1"
@@ -55,6 +57,16 @@ type Event struct {
 	Resource                 *unstructured.Unstructured
 	ResourceString           string            // This is a plural identifier of the kind.
 	AdditionalPrinterColumns []ExtractProperty // The entries from the additionalPrinterColumns array in the CRD.
+	Sequence                 uint64            // Order in which the informers received the events, see NextEventSequence.
+	barrier                  *barrier          // Set on the barrier events, see Transformer.Barrier.
+}
+
+var eventSequence atomic.Uint64
+
+// Returns the sequence number of the next informer event. The informers deliver the events of each object
+// in order, so the numbers keep that order after the events go through the transformer routines.
+func NextEventSequence() uint64 {
+	return eventSequence.Add(1)
 }
 
 // A generic node type that is passed to the aggregator to store in the database.
@@ -99,12 +111,35 @@ type NodeEvent struct {
 	ComputeEdges func(ns NodeStore) []Edge
 	Time         int64
 	Operation    Operation
+	Source       *Event // Informer event the node was built from, nil for deletes
+
+	// Used to order the events of the node, with Time as a fallback. Empty for nodes that aren't built from
+	// a single Kubernetes object, like Helm releases.
+	ResourceVersion string // Of the Kubernetes object. Opaque, only compared for equality.
+	Sequence        uint64 // Of the informer event, see NextEventSequence
+
+	// Set on the barrier node event instead of a node. The reconciler calls it once it reconciled the events
+	// received before, see Transformer.Barrier.
+	Barrier func()
 }
 
 type Deletion struct {
 	UID string `json:"uid,omitempty"`
 }
 
+// Changed properties of a node the aggregator already has. It sets the properties in Set and removes the
+// ones in Unset, and keeps the others.
+type NodePatch struct {
+	UID   string                 `json:"uid"`
+	Set   map[string]interface{} `json:"set,omitempty"`
+	Unset []string               `json:"unset,omitempty"`
+}
+
+// Returns true if the patch doesn't change any property.
+func (p NodePatch) Empty() bool {
+	return len(p.Set) == 0 && len(p.Unset) == 0
+}
+
 // make new constructor here.
 func NewNodeEvent(event *Event, trans Transform, resourceString string) NodeEvent {
 	ne := NodeEvent{
@@ -112,6 +147,11 @@ func NewNodeEvent(event *Event, trans Transform, resourceString string) NodeEven
 		Operation:    event.Operation,
 		Node:         trans.BuildNode(),
 		ComputeEdges: trans.BuildEdges,
+		Source:       event,
+	}
+	if event.Resource != nil && ne.UID == prefixedUID(event.Resource.GetUID()) { //nolint:staticcheck // "could remove embedded field 'Node' from selector"
+		ne.ResourceVersion = event.Resource.GetResourceVersion()
+		ne.Sequence = event.Sequence
 	}
 	ne.ResourceString = resourceString
 	// Search v-2 , types is expected part of properties
@@ -147,8 +187,34 @@ type Transform interface {
 // Object that handles transformation of k8s objects.
 // To use, create one, call Start(), and begin passing in objects.
 type Transformer struct {
-	Input  chan *Event    // Put your k8s resources and corresponding times in here.
-	Output chan NodeEvent // And receive your aggregator-ready nodes (and times) from here.
+	Input    chan *Event    // Put your k8s resources and corresponding times in here.
+	Output   chan NodeEvent // And receive your aggregator-ready nodes (and times) from here.
+	routines int            // Number of transformer routines
+}
+
+// Passes through the transformer routines behind the events they received before it.
+type barrier struct {
+	routines sync.WaitGroup // Routines that didn't receive their barrier event yet
+	forward  sync.Once
+	done     func()
+}
+
+// Barrier sends a barrier through the transformer routines to the output. The reconciler calls done once it
+// reconciled the node events of all the events sent to the input before the barrier. Each routine receives one
+// barrier event and waits for the others to receive theirs, so no routine is still working on an earlier event.
+func (t Transformer) Barrier(done func()) {
+	b := &barrier{done: done}
+	b.routines.Add(t.routines)
+	for i := 0; i < t.routines; i++ {
+		t.Input <- &Event{barrier: b}
+	}
+}
+
+// Waits for the other routines to receive the barrier, then one of them sends it to the output.
+func (b *barrier) pass(output chan NodeEvent) {
+	b.routines.Done()
+	b.routines.Wait()
+	b.forward.Do(func() { output <- NodeEvent{Barrier: b.done} })
 }
 
 var (
@@ -169,8 +235,9 @@ func NewTransformer(inputChan chan *Event, outputChan chan NodeEvent, numRoutine
 		go TransformRoutine(inputChan, outputChan)
 	}
 	return Transformer{
-		Input:  inputChan,
-		Output: outputChan,
+		Input:    inputChan,
+		Output:   outputChan,
+		routines: nr,
 	}
 }
 
@@ -181,278 +248,316 @@ func NewTransformer(inputChan chan *Event, outputChan chan NodeEvent, numRoutine
 func TransformRoutine(input chan *Event, output chan NodeEvent) {
 	defer handleRoutineExit(input, output)
 	klog.Info("Starting transformer routine")
+	health.Transformers.Start()
 
 	for {
-		var trans Transform
-
 		event := <-input // Read from the input channel
+		if event.barrier != nil {
+			event.barrier.pass(output)
+			continue
+		}
 
-		// Determine apiGroup and version of the resource
-		apiGroup := ""
+		ne, err := transformEvent(event)
+		if err != nil {
+			panic(err) // Will be caught by handleRoutineExit
+		}
+		health.Transformers.Begin() // Busy until the reconciler receives the node event.
+		output <- ne
+		health.Transformers.End()
+	}
+}
+
+// Builds the node event of a resource. Returns an error if the resource can't be converted to its type.
+func transformEvent(event *Event) (NodeEvent, error) {
+	var trans Transform
 
-		if event.Resource.Object["apiVersion"] != nil && event.Resource.Object["apiVersion"] != "" {
-			if apiVersionStr, ok := event.Resource.Object["apiVersion"].(string); ok {
-				if len(strings.Split(apiVersionStr, "/")) == 2 {
-					apiGroup = strings.Split(apiVersionStr, "/")[0]
-				}
+	// Determine apiGroup and version of the resource
+	apiGroup := ""
+
+	if event.Resource.Object["apiVersion"] != nil && event.Resource.Object["apiVersion"] != "" {
+		if apiVersionStr, ok := event.Resource.Object["apiVersion"].(string); ok {
+			if len(strings.Split(apiVersionStr, "/")) == 2 {
+				apiGroup = strings.Split(apiVersionStr, "/")[0]
 			}
 		}
-		kindApigroup := [2]string{event.Resource.GetKind(), apiGroup}
-		// Might have to add more transform cases if resources like DaemonSet, StatefulSet etc. have other apigroups
-		switch kindApigroup {
-		case [2]string{"Application", "app.k8s.io"}:
-			typedResource := application.Application{}
-			err := runtime.DefaultUnstructuredConverter.
-				FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
-			if err != nil {
-				panic(err) // Will be caught by handleRoutineExit
-			}
-			trans = ApplicationResourceBuilder(&typedResource)
-
-		case [2]string{"Application", "argoproj.io"}:
-			typedResource := ArgoApplication{}
-			err := runtime.DefaultUnstructuredConverter.
-				FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
-			if err != nil {
-				panic(err) // Will be caught by handleRoutineExit
-			}
-			trans = ArgoApplicationResourceBuilder(&typedResource)
-
-		case [2]string{"Channel", APPS_OPEN_CLUSTER_MANAGEMENT_IO}:
-			typedResource := acmapp.Channel{}
-			err := runtime.DefaultUnstructuredConverter.
-				FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
-			if err != nil {
-				panic(err) // Will be caught by handleRoutineExit
-			}
-			trans = ChannelResourceBuilder(&typedResource)
-
-		case [2]string{"CronJob", "batch"}:
-			typedResource := batchBeta.CronJob{}
-			err := runtime.DefaultUnstructuredConverter.
-				FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
-			if err != nil {
-				panic(err) // Will be caught by handleRoutineExit
-			}
-			trans = CronJobResourceBuilder(&typedResource)
-
-		case [2]string{"DaemonSet", "extensions"},
-			[2]string{"DaemonSet", "apps"}:
-			typedResource := apps.DaemonSet{}
-			err := runtime.DefaultUnstructuredConverter.
-				FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
-			if err != nil {
-				panic(err) // Will be caught by handleRoutineExit
-			}
-			trans = DaemonSetResourceBuilder(&typedResource)
-
-		case [2]string{"Deployable", APPS_OPEN_CLUSTER_MANAGEMENT_IO}:
-			typedResource := appDeployable.Deployable{}
-			err := runtime.DefaultUnstructuredConverter.
-				FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
-			if err != nil {
-				panic(err) // Will be caught by handleRoutineExit
-			}
-			trans = AppDeployableResourceBuilder(&typedResource)
-
-		case [2]string{"Deployment", "apps"},
-			[2]string{"Deployment", "extensions"}:
-			typedResource := apps.Deployment{}
-			err := runtime.DefaultUnstructuredConverter.
-				FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
-			if err != nil {
-				panic(err) // Will be caught by handleRoutineExit
-			}
-			trans = DeploymentResourceBuilder(&typedResource)
-
-			// This is an ocp specific resource
-		case [2]string{"DeploymentConfig", "apps.openshift.io"}:
-			typedResource := ocpapp.DeploymentConfig{}
-			err := runtime.DefaultUnstructuredConverter.
-				FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
-			if err != nil {
-				panic(err) // Will be caught by handleRoutineExit
-			}
-			trans = DeploymentConfigResourceBuilder(&typedResource)
-
-			// This is the application's HelmCR of kind HelmRelease.
-		case [2]string{"HelmRelease", APPS_OPEN_CLUSTER_MANAGEMENT_IO}:
-			typedResource := appHelmRelease.HelmRelease{}
-			err := runtime.DefaultUnstructuredConverter.
-				FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
-			if err != nil {
-				panic(err) // Will be caught by handleRoutineExit
-			}
-			trans = AppHelmCRResourceBuilder(&typedResource)
-
-		case [2]string{"KlusterletAddonConfig", "agent.open-cluster-management.io"}:
-			typedResource := klusterletaddon.KlusterletAddonConfig{}
-			err := runtime.DefaultUnstructuredConverter.
-				FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
-			if err != nil {
-				panic(err) // Will be caught by handleRoutineExit
-			}
-			trans = KlusterletAddonConfigResourceBuilder(&typedResource)
-
-		case [2]string{"Job", "batch"}:
-			typedResource := batch.Job{}
-			err := runtime.DefaultUnstructuredConverter.
-				FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
-			if err != nil {
-				panic(err) // Will be caught by handleRoutineExit
-			}
-			trans = JobResourceBuilder(&typedResource, event.Resource)
-
-		case [2]string{"Node", ""}:
-			typedResource := core.Node{}
-			err := runtime.DefaultUnstructuredConverter.
-				FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
-			if err != nil {
-				panic(err) // Will be caught by handleRoutineExit
-			}
-			trans = NodeResourceBuilder(&typedResource, event.Resource)
-
-		case [2]string{"PersistentVolume", ""}:
-			typedResource := core.PersistentVolume{}
-			err := runtime.DefaultUnstructuredConverter.
-				FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
-			if err != nil {
-				panic(err) // Will be caught by handleRoutineExit
-			}
-			trans = PersistentVolumeResourceBuilder(&typedResource)
-
-		case [2]string{"PersistentVolumeClaim", ""}:
-			typedResource := core.PersistentVolumeClaim{}
-			err := runtime.DefaultUnstructuredConverter.
-				FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
-			if err != nil {
-				panic(err) // Will be caught by handleRoutineExit
-			}
-			trans = PersistentVolumeClaimResourceBuilder(&typedResource, event.Resource)
-
-		case [2]string{"PlacementBinding", APPS_OPEN_CLUSTER_MANAGEMENT_IO}:
-			typedResource := policy.PlacementBinding{}
-			err := runtime.DefaultUnstructuredConverter.
-				FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
-			if err != nil {
-				panic(err) // Will be caught by handleRoutineExit
-			}
-			trans = PlacementBindingResourceBuilder(&typedResource)
-
-		case [2]string{"PlacementRule", APPS_OPEN_CLUSTER_MANAGEMENT_IO}:
-			typedResource := rule.PlacementRule{}
-			err := runtime.DefaultUnstructuredConverter.
-				FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
-			if err != nil {
-				panic(err) // Will be caught by handleRoutineExit
-			}
-			trans = PlacementRuleResourceBuilder(&typedResource)
-
-		case [2]string{"Pod", ""}:
-			typedResource := core.Pod{}
-			err := runtime.DefaultUnstructuredConverter.
-				FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
-			if err != nil {
-				panic(err) // Will be caught by handleRoutineExit
-			}
-			trans = PodResourceBuilder(&typedResource, event.Resource)
-
-		case [2]string{"Policy", POLICY_OPEN_CLUSTER_MANAGEMENT_IO},
-			[2]string{"Policy", "policies.open-cluster-management.io"}:
-			typedResource := policy.Policy{}
-			err := runtime.DefaultUnstructuredConverter.
-				FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
-			if err != nil {
-				panic(err) // Will be caught by handleRoutineExit
-			}
-			trans = PolicyResourceBuilder(&typedResource)
+	}
+	kindApigroup := [2]string{event.Resource.GetKind(), apiGroup}
+	// Might have to add more transform cases if resources like DaemonSet, StatefulSet etc. have other apigroups
+	switch kindApigroup {
+	case [2]string{"Application", "app.k8s.io"}:
+		typedResource := application.Application{}
+		err := runtime.DefaultUnstructuredConverter.
+			FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
+		if err != nil {
+			return NodeEvent{}, err
+		}
+		trans = ApplicationResourceBuilder(&typedResource)
+
+	case [2]string{"Application", "argoproj.io"}:
+		typedResource := ArgoApplication{}
+		err := runtime.DefaultUnstructuredConverter.
+			FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
+		if err != nil {
+			return NodeEvent{}, err
+		}
+		trans = ArgoApplicationResourceBuilder(&typedResource)
+
+	case [2]string{"Channel", APPS_OPEN_CLUSTER_MANAGEMENT_IO}:
+		typedResource := acmapp.Channel{}
+		err := runtime.DefaultUnstructuredConverter.
+			FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
+		if err != nil {
+			return NodeEvent{}, err
+		}
+		trans = ChannelResourceBuilder(&typedResource)
+
+	case [2]string{"CronJob", "batch"}:
+		typedResource := batchBeta.CronJob{}
+		err := runtime.DefaultUnstructuredConverter.
+			FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
+		if err != nil {
+			return NodeEvent{}, err
+		}
+		trans = CronJobResourceBuilder(&typedResource)
+
+	case [2]string{"DaemonSet", "extensions"},
+		[2]string{"DaemonSet", "apps"}:
+		typedResource := apps.DaemonSet{}
+		err := runtime.DefaultUnstructuredConverter.
+			FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
+		if err != nil {
+			return NodeEvent{}, err
+		}
+		trans = DaemonSetResourceBuilder(&typedResource)
+
+	case [2]string{"Deployable", APPS_OPEN_CLUSTER_MANAGEMENT_IO}:
+		typedResource := appDeployable.Deployable{}
+		err := runtime.DefaultUnstructuredConverter.
+			FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
+		if err != nil {
+			return NodeEvent{}, err
+		}
+		trans = AppDeployableResourceBuilder(&typedResource)
+
+	case [2]string{"Deployment", "apps"},
+		[2]string{"Deployment", "extensions"}:
+		typedResource := apps.Deployment{}
+		err := runtime.DefaultUnstructuredConverter.
+			FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
+		if err != nil {
+			return NodeEvent{}, err
+		}
+		trans = DeploymentResourceBuilder(&typedResource)
+
+		// This is an ocp specific resource
+	case [2]string{"DeploymentConfig", "apps.openshift.io"}:
+		typedResource := ocpapp.DeploymentConfig{}
+		err := runtime.DefaultUnstructuredConverter.
+			FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
+		if err != nil {
+			return NodeEvent{}, err
+		}
+		trans = DeploymentConfigResourceBuilder(&typedResource)
+
+		// This is the application's HelmCR of kind HelmRelease.
+	case [2]string{"HelmRelease", APPS_OPEN_CLUSTER_MANAGEMENT_IO}:
+		typedResource := appHelmRelease.HelmRelease{}
+		err := runtime.DefaultUnstructuredConverter.
+			FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
+		if err != nil {
+			return NodeEvent{}, err
+		}
+		trans = AppHelmCRResourceBuilder(&typedResource)
+
+	case [2]string{"KlusterletAddonConfig", "agent.open-cluster-management.io"}:
+		typedResource := klusterletaddon.KlusterletAddonConfig{}
+		err := runtime.DefaultUnstructuredConverter.
+			FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
+		if err != nil {
+			return NodeEvent{}, err
+		}
+		trans = KlusterletAddonConfigResourceBuilder(&typedResource)
+
+	case [2]string{"Job", "batch"}:
+		typedResource := batch.Job{}
+		err := runtime.DefaultUnstructuredConverter.
+			FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
+		if err != nil {
+			return NodeEvent{}, err
+		}
+		trans = JobResourceBuilder(&typedResource, event.Resource)
+
+	case [2]string{"Node", ""}:
+		typedResource := core.Node{}
+		err := runtime.DefaultUnstructuredConverter.
+			FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
+		if err != nil {
+			return NodeEvent{}, err
+		}
+		trans = NodeResourceBuilder(&typedResource, event.Resource)
+
+	case [2]string{"PersistentVolume", ""}:
+		typedResource := core.PersistentVolume{}
+		err := runtime.DefaultUnstructuredConverter.
+			FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
+		if err != nil {
+			return NodeEvent{}, err
+		}
+		trans = PersistentVolumeResourceBuilder(&typedResource)
+
+	case [2]string{"PersistentVolumeClaim", ""}:
+		typedResource := core.PersistentVolumeClaim{}
+		err := runtime.DefaultUnstructuredConverter.
+			FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
+		if err != nil {
+			return NodeEvent{}, err
+		}
+		trans = PersistentVolumeClaimResourceBuilder(&typedResource, event.Resource)
+
+	case [2]string{"PlacementBinding", APPS_OPEN_CLUSTER_MANAGEMENT_IO}:
+		typedResource := policy.PlacementBinding{}
+		err := runtime.DefaultUnstructuredConverter.
+			FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
+		if err != nil {
+			return NodeEvent{}, err
+		}
+		trans = PlacementBindingResourceBuilder(&typedResource)
+
+	case [2]string{"PlacementRule", APPS_OPEN_CLUSTER_MANAGEMENT_IO}:
+		typedResource := rule.PlacementRule{}
+		err := runtime.DefaultUnstructuredConverter.
+			FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
+		if err != nil {
+			return NodeEvent{}, err
+		}
+		trans = PlacementRuleResourceBuilder(&typedResource)
+
+	case [2]string{"Pod", ""}:
+		typedResource := core.Pod{}
+		err := runtime.DefaultUnstructuredConverter.
+			FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
+		if err != nil {
+			return NodeEvent{}, err
+		}
+		trans = PodResourceBuilder(&typedResource, event.Resource)
+
+	case [2]string{"Policy", POLICY_OPEN_CLUSTER_MANAGEMENT_IO},
+		[2]string{"Policy", "policies.open-cluster-management.io"}:
+		typedResource := policy.Policy{}
+		err := runtime.DefaultUnstructuredConverter.
+			FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
+		if err != nil {
+			return NodeEvent{}, err
+		}
+		trans = PolicyResourceBuilder(&typedResource)
 
-		case [2]string{"ConfigurationPolicy", POLICY_OPEN_CLUSTER_MANAGEMENT_IO}:
-			trans = ConfigPolicyResourceBuilder(event.Resource)
+	case [2]string{"ConfigurationPolicy", POLICY_OPEN_CLUSTER_MANAGEMENT_IO}:
+		trans = ConfigPolicyResourceBuilder(event.Resource)
 
-		case [2]string{"CertificatePolicy", POLICY_OPEN_CLUSTER_MANAGEMENT_IO}:
-			trans = CertPolicyResourceBuilder(event.Resource)
+	case [2]string{"CertificatePolicy", POLICY_OPEN_CLUSTER_MANAGEMENT_IO}:
+		trans = CertPolicyResourceBuilder(event.Resource)
 
-		case [2]string{"OperatorPolicy", POLICY_OPEN_CLUSTER_MANAGEMENT_IO}:
-			trans = OperatorPolicyResourceBuilder(event.Resource)
+	case [2]string{"OperatorPolicy", POLICY_OPEN_CLUSTER_MANAGEMENT_IO}:
+		trans = OperatorPolicyResourceBuilder(event.Resource)
 
-		case [2]string{"ReplicaSet", "apps"},
-			[2]string{"ReplicaSet", "extensions"}:
-			typedResource := apps.ReplicaSet{}
-			err := runtime.DefaultUnstructuredConverter.
-				FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
-			if err != nil {
-				panic(err) // Will be caught by handleRoutineExit
-			}
-			trans = ReplicaSetResourceBuilder(&typedResource)
-
-		case [2]string{"Service", ""}:
-			typedResource := core.Service{}
-			err := runtime.DefaultUnstructuredConverter.
-				FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
-			if err != nil {
-				panic(err) // Will be caught by handleRoutineExit
-			}
-			trans = ServiceResourceBuilder(&typedResource, event.Resource)
-
-		case [2]string{"StatefulSet", "apps"}:
-			typedResource := apps.StatefulSet{}
-			err := runtime.DefaultUnstructuredConverter.
-				FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
-			if err != nil {
-				panic(err) // Will be caught by handleRoutineExit
-			}
-			trans = StatefulSetResourceBuilder(&typedResource)
-
-		case [2]string{"Subscription", APPS_OPEN_CLUSTER_MANAGEMENT_IO}:
-			typedResource := subscription.Subscription{}
-			err := runtime.DefaultUnstructuredConverter.
-				FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
-			if err != nil {
-				panic(err) // Will be caught by handleRoutineExit
-			}
-			trans = SubscriptionResourceBuilder(&typedResource)
-
-		case [2]string{"PolicyReport", "wgpolicyk8s.io"}, [2]string{"ClusterPolicyReport", "wgpolicyk8s.io"}:
-			typedResource := PolicyReport{}
-			err := runtime.DefaultUnstructuredConverter.
-				FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
-			if err != nil {
-				panic(err) // Will be caught by handleRoutineExit
-			}
-			trans = PolicyReportResourceBuilder(&typedResource)
-
-		case [2]string{"ValidatingAdmissionPolicyBinding", "admissionregistration.k8s.io"}:
-			trans = VapBindingResourceBuilder(event.Resource)
-
-		case [2]string{"Policy", "kyverno.io"}, [2]string{"ClusterPolicy", "kyverno.io"}:
-			fallthrough
-		case [2]string{"NamespacedGeneratingPolicy", "policies.kyverno.io"}, [2]string{"GeneratingPolicy", "policies.kyverno.io"}:
-			fallthrough
-		case [2]string{"NamespacedImageValidatingPolicy", "policies.kyverno.io"}, [2]string{"ImageValidatingPolicy", "policies.kyverno.io"}:
-			fallthrough
-		case [2]string{"NamespacedMutatingPolicy", "policies.kyverno.io"}, [2]string{"MutatingPolicy", "policies.kyverno.io"}:
-			fallthrough
-		case [2]string{"NamespacedValidatingPolicy", "policies.kyverno.io"}, [2]string{"ValidatingPolicy", "policies.kyverno.io"}:
-			trans = KyvernoPolicyResourceBuilder(event.Resource)
-
-		default:
-			// Gatekeeper constraint kinds are user defined, so key on just the API group to add an additional property.
-			if apiGroup == "constraints.gatekeeper.sh" {
-				trans = GkConstraintResourceBuilder(event.Resource, event.AdditionalPrinterColumns...)
-			} else {
-				trans = GenericResourceBuilder(event.Resource, event.AdditionalPrinterColumns...)
-			}
+	case [2]string{"ReplicaSet", "apps"},
+		[2]string{"ReplicaSet", "extensions"}:
+		typedResource := apps.ReplicaSet{}
+		err := runtime.DefaultUnstructuredConverter.
+			FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
+		if err != nil {
+			return NodeEvent{}, err
+		}
+		trans = ReplicaSetResourceBuilder(&typedResource)
+
+	case [2]string{"Service", ""}:
+		typedResource := core.Service{}
+		err := runtime.DefaultUnstructuredConverter.
+			FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
+		if err != nil {
+			return NodeEvent{}, err
+		}
+		trans = ServiceResourceBuilder(&typedResource, event.Resource)
+
+	case [2]string{"StatefulSet", "apps"}:
+		typedResource := apps.StatefulSet{}
+		err := runtime.DefaultUnstructuredConverter.
+			FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
+		if err != nil {
+			return NodeEvent{}, err
 		}
+		trans = StatefulSetResourceBuilder(&typedResource)
+
+	case [2]string{"Subscription", APPS_OPEN_CLUSTER_MANAGEMENT_IO}:
+		typedResource := subscription.Subscription{}
+		err := runtime.DefaultUnstructuredConverter.
+			FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
+		if err != nil {
+			return NodeEvent{}, err
+		}
+		trans = SubscriptionResourceBuilder(&typedResource)
+
+	case [2]string{"PolicyReport", "wgpolicyk8s.io"}, [2]string{"ClusterPolicyReport", "wgpolicyk8s.io"}:
+		typedResource := PolicyReport{}
+		err := runtime.DefaultUnstructuredConverter.
+			FromUnstructured(event.Resource.UnstructuredContent(), &typedResource)
+		if err != nil {
+			return NodeEvent{}, err
+		}
+		trans = PolicyReportResourceBuilder(&typedResource)
+
+	case [2]string{"ValidatingAdmissionPolicyBinding", "admissionregistration.k8s.io"}:
+		trans = VapBindingResourceBuilder(event.Resource)
+
+	case [2]string{"Policy", "kyverno.io"}, [2]string{"ClusterPolicy", "kyverno.io"}:
+		fallthrough
+	case [2]string{"NamespacedGeneratingPolicy", "policies.kyverno.io"}, [2]string{"GeneratingPolicy", "policies.kyverno.io"}:
+		fallthrough
+	case [2]string{"NamespacedImageValidatingPolicy", "policies.kyverno.io"}, [2]string{"ImageValidatingPolicy", "policies.kyverno.io"}:
+		fallthrough
+	case [2]string{"NamespacedMutatingPolicy", "policies.kyverno.io"}, [2]string{"MutatingPolicy", "policies.kyverno.io"}:
+		fallthrough
+	case [2]string{"NamespacedValidatingPolicy", "policies.kyverno.io"}, [2]string{"ValidatingPolicy", "policies.kyverno.io"}:
+		trans = KyvernoPolicyResourceBuilder(event.Resource)
+
+	default:
+		// Gatekeeper constraint kinds are user defined, so key on just the API group to add an additional property.
+		if apiGroup == "constraints.gatekeeper.sh" {
+			trans = GkConstraintResourceBuilder(event.Resource, event.AdditionalPrinterColumns...)
+		} else {
+			trans = GenericResourceBuilder(event.Resource, event.AdditionalPrinterColumns...)
+		}
+	}
 
-		output <- NewNodeEvent(event, trans, event.ResourceString)
+	return NewNodeEvent(event, trans, event.ResourceString), nil
+}
+
+// TransformEvents builds the node events of resources outside of the transformer routines, with an error
+// instead of a panic for each resource that can't be transformed.
+func TransformEvents(events []*Event) ([]NodeEvent, []error) {
+	nes := make([]NodeEvent, len(events))
+	errs := make([]error, len(events))
+	for i, event := range events {
+		nes[i], errs[i] = transformRecovered(event)
 	}
+	return nes, errs
+}
+
+// Like transformEvent, with an error instead of a panic of the resource builder.
+func transformRecovered(event *Event) (ne NodeEvent, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("could not transform %s %s: %v", event.ResourceString, event.Resource.GetName(), r)
+		}
+	}()
+	return transformEvent(event)
 }
 
 // Handles a panic from inside transformRoutine.
 // If the panic was due to an error, starts another transformRoutine with the same channels as this one.
 // If not, just lets it die.
 func handleRoutineExit(input chan *Event, output chan NodeEvent) {
+	health.Transformers.Stop()
 	// Recover and check the value. If we are here because of a panic, something will be in it.
 	if r := recover(); r != nil { // Case where we got here from a panic
 		klog.Errorf("Error in transformer routine: %v\n", r)
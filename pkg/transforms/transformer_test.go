@@ -11,11 +11,14 @@ Copyright (c) 2020 Red Hat, Inc.
 package transforms
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
 	agentv1 "github.com/stolostron/klusterlet-addon-controller/pkg/apis/agent/v1"
+	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/helm/pkg/proto/hapi/release"
 	app "sigs.k8s.io/application/api/v1beta1"
 )
 
@@ -169,3 +172,121 @@ func TestTransformRoutine(t *testing.T) {
 		AssertEqual(test.name, actual.Operation, test.expected.Operation, t)
 	}
 }
+
+func TestTransformerBarrier(t *testing.T) {
+	transformer := NewTransformer(make(chan *Event), make(chan NodeEvent), 3)
+	go func() {
+		for i := 0; i < 6; i++ {
+			resource := unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "ConfigMap",
+				"metadata":   map[string]interface{}{"uid": fmt.Sprintf("uid%d", i), "name": fmt.Sprintf("cm%d", i)},
+			}}
+			transformer.Input <- &Event{Time: time.Now().Unix(), Operation: Create, Resource: &resource,
+				ResourceString: "configmaps"}
+		}
+		transformer.Barrier(func() {})
+	}()
+
+	// The node events are slow to be received, so the routines are still sending them when the barrier is sent.
+	received := 0
+	for ne := range transformer.Output {
+		if ne.Barrier != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+		received++
+	}
+	AssertEqual("node events before the barrier", received, 6, t)
+
+	select {
+	case ne := <-transformer.Output:
+		t.Errorf("Expected a single barrier node event, got %v", ne)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// A routine can still be transforming an earlier event when another one receives the barrier.
+func TestBarrierWaitsForAllRoutines(t *testing.T) {
+	output := make(chan NodeEvent)
+	b := &barrier{done: func() {}}
+	b.routines.Add(2)
+
+	go b.pass(output)
+	select {
+	case <-output:
+		t.Error("Expected the barrier to wait for the other routine.")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	go b.pass(output)
+	select {
+	case ne := <-output:
+		AssertEqual("barrier", ne.Barrier != nil, true, t)
+	case <-time.After(time.Second):
+		t.Error("Expected the barrier once all the routines received it.")
+	}
+	select {
+	case <-output:
+		t.Error("Expected the barrier to be sent once.")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestNewNodeEventOrder(t *testing.T) {
+	resource := unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"kind": "foobar",
+			"metadata": map[string]interface{}{
+				"uid":             "1234",
+				"resourceVersion": "42",
+			},
+		},
+	}
+	event := &Event{Time: time.Now().Unix(), Operation: Update, Resource: &resource, Sequence: NextEventSequence()}
+
+	ne := NewNodeEvent(event, GenericResourceBuilder(&resource), "foobars")
+
+	AssertEqual("resourceVersion", ne.ResourceVersion, "42", t)
+	AssertEqual("sequence", ne.Sequence, event.Sequence, t)
+	AssertEqual("next sequence", NextEventSequence() > event.Sequence, true, t)
+
+	// Helm release nodes are built from a configmap, so they don't have its resourceVersion.
+	var c v1.ConfigMap
+	var r release.Release
+	UnmarshalFile("../../test-data/helmrelease-configmap.json", &c, t)
+	UnmarshalFile("../../test-data/helmrelease-release.json", &r, t)
+
+	ne = NewNodeEvent(event, HelmReleaseResource{&c, &r}, "releases")
+
+	AssertEqual("release resourceVersion", ne.ResourceVersion, "", t)
+	AssertEqual("release sequence", ne.Sequence, uint64(0), t)
+}
+
+func TestTransformEvents(t *testing.T) {
+	pod := func(uid string, spec interface{}) *Event {
+		resource := unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Pod",
+				"metadata": map[string]interface{}{
+					"uid":  uid,
+					"name": "pod" + uid,
+				},
+				"spec": spec,
+			},
+		}
+		return &Event{Time: time.Now().Unix(), Operation: Create, Resource: &resource, ResourceString: "pods"}
+	}
+	// A pod that can't be converted to its typed object gets an error instead of panicking.
+	events := []*Event{pod("1", map[string]interface{}{}), pod("2", "not a pod spec"), pod("3", map[string]interface{}{})}
+
+	nes, errs := TransformEvents(events)
+
+	AssertEqual("first error", errs[0], nil, t)
+	AssertEqual("kind", nes[0].Properties["kind"], "Pod", t)
+	AssertEqual("source", nes[0].Source, events[0], t)
+	AssertEqual("has error", errs[1] != nil, true, t)
+	AssertEqual("error after a failed event", errs[2], nil, t)
+	AssertEqual("uid after a failed event", nes[2].UID, "local-cluster/3", t)
+}
@@ -0,0 +1,155 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package transforms
+
+import (
+	"fmt"
+	"slices"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/klog/v2"
+)
+
+// UpdateRule tells the reconciler which updates of a kind to send to the aggregator. By default, an update
+// is sent only if the properties of the node changed.
+type UpdateRule struct {
+	ForceMetadata    []string // Metadata keys whose changes are sent. "*" sends every update.
+	IgnoreProperties []string // Properties whose changes alone aren't sent.
+	Revision         string   // Property with a revision number. Updates with a lower revision are dropped.
+}
+
+// Rules keyed like the transform config: kind, kind.apigroup, "*.apigroup" for all kinds in the group, or
+// "kind.*" for the kind in all the apigroups.
+var defaultUpdateRules = map[string]UpdateRule{
+	// Applications and subscriptions might have changes to the metadata used to build their edges.
+	"Application.*":  {ForceMetadata: []string{"*"}},
+	"Subscription.*": {ForceMetadata: []string{"*"}},
+
+	// The edges of these kinds are built from their metadata.
+	"ValidatingAdmissionPolicyBinding.*": {ForceMetadata: []string{"paramRef"}},
+	"CertificatePolicy.*":                {ForceMetadata: []string{"relObjs"}},
+	"ConfigurationPolicy.*":              {ForceMetadata: []string{"relObjs"}},
+	"OperatorPolicy.*":                   {ForceMetadata: []string{"relObjs"}},
+	"*.constraints.gatekeeper.sh":        {ForceMetadata: []string{"relObjs"}},
+
+	// Each configmap of a Helm release transforms the release again, in no particular order.
+	"Release": {Revision: "revision"},
+}
+
+// mergedUpdateRules contains defaultUpdateRules plus the updateRules of the CollectorConfig CR.
+// This is populated by LoadAndMergeConfigurableCollection and used by GetUpdateRule.
+var mergedUpdateRules map[string]UpdateRule
+
+// Rule in the spec.updateRules of the CollectorConfig CR.
+type updateRuleSpec struct {
+	ResourceSelector struct {
+		APIGroups []string `json:"apiGroups"`
+		Kinds     []string `json:"kinds"`
+	} `json:"resourceSelector"`
+	ForceUpdateMetadata []string `json:"forceUpdateMetadata,omitempty"`
+	IgnoreProperties    []string `json:"ignoreProperties,omitempty"`
+}
+
+// GetUpdateRule returns the update rule of the kind, with the rules for all the kinds in its apigroup and for
+// the kind in all the apigroups.
+func GetUpdateRule(group, kind string) UpdateRule {
+	rules := mergedUpdateRules
+	if rules == nil {
+		// Safety fallback if LoadAndMergeConfigurableCollection hasn't been called yet
+		rules = defaultUpdateRules
+	}
+	rule := rules[updateRuleKey(group, kind)]
+	for _, key := range []string{updateRuleKey(group, "*"), updateRuleKey("*", kind)} {
+		if otherRule, ok := rules[key]; ok {
+			rule = rule.merge(otherRule)
+		}
+	}
+	return rule
+}
+
+func updateRuleKey(group, kind string) string {
+	if group == "" { // kubernetes core api resources
+		return kind
+	}
+	return kind + "." + group
+}
+
+// Returns a rule with the keys and properties of both rules.
+func (r UpdateRule) merge(other UpdateRule) UpdateRule {
+	merged := UpdateRule{Revision: r.Revision}
+	if merged.Revision == "" {
+		merged.Revision = other.Revision
+	}
+	merged.ForceMetadata = appendMissing(slices.Clone(r.ForceMetadata), other.ForceMetadata...)
+	merged.IgnoreProperties = appendMissing(slices.Clone(r.IgnoreProperties), other.IgnoreProperties...)
+	return merged
+}
+
+func appendMissing(list []string, items ...string) []string {
+	for _, item := range items {
+		if !slices.Contains(list, item) {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func deepCopyUpdateRules(src map[string]UpdateRule) map[string]UpdateRule {
+	dst := make(map[string]UpdateRule, len(src))
+	for key, rule := range src {
+		dst[key] = UpdateRule{}.merge(rule)
+	}
+	return dst
+}
+
+// mergeUpdateRules adds the spec.updateRules of the CollectorConfig CR to mergedUpdateRules. Returns warnings
+// for the rules that were skipped.
+func mergeUpdateRules(configObj *unstructured.Unstructured) []string {
+	items, found, err := unstructured.NestedSlice(configObj.Object, "spec", "updateRules")
+	if err != nil {
+		msg := fmt.Sprintf("Update rules skipped: %v", err)
+		klog.Warning(msg)
+		return []string{msg}
+	}
+	if !found {
+		return nil
+	}
+
+	var warnings []string
+	skip := func(i int, reason string) {
+		msg := fmt.Sprintf("Update rule %d skipped: %s", i, reason)
+		klog.Warning(msg)
+		warnings = append(warnings, msg)
+	}
+	for i, item := range items {
+		itemMap, ok := item.(map[string]interface{})
+		var spec updateRuleSpec
+		if !ok || runtime.DefaultUnstructuredConverter.FromUnstructured(itemMap, &spec) != nil {
+			skip(i, "could not parse it")
+			continue
+		}
+		if len(spec.ForceUpdateMetadata) == 0 && len(spec.IgnoreProperties) == 0 {
+			skip(i, "it requires forceUpdateMetadata or ignoreProperties")
+			continue
+		}
+		if len(spec.ResourceSelector.Kinds) == 0 || len(spec.ResourceSelector.APIGroups) == 0 {
+			skip(i, "resourceSelector requires kinds and apiGroups")
+			continue
+		}
+		for _, apiGroup := range spec.ResourceSelector.APIGroups {
+			for _, kind := range spec.ResourceSelector.Kinds {
+				if kind == "" {
+					continue
+				}
+				key := updateRuleKey(apiGroup, kind)
+				mergedUpdateRules[key] = mergedUpdateRules[key].merge(UpdateRule{
+					ForceMetadata:    spec.ForceUpdateMetadata,
+					IgnoreProperties: spec.IgnoreProperties,
+				})
+				klog.V(1).Infof("Merged update rule for resource %s", key)
+			}
+		}
+	}
+	return warnings
+}
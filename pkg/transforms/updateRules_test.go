@@ -0,0 +1,101 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package transforms
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stolostron/search-collector/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+func TestGetUpdateRule_Defaults(t *testing.T) {
+	mergedUpdateRules = nil
+
+	assert.Equal(t, []string{"*"}, GetUpdateRule("argoproj.io", "Application").ForceMetadata)
+	assert.Equal(t, []string{"*"}, GetUpdateRule("example.com", "Subscription").ForceMetadata,
+		"Expected the subscriptions of any apigroup to use the rule.")
+	assert.Equal(t, []string{"paramRef"},
+		GetUpdateRule("admissionregistration.k8s.io", "ValidatingAdmissionPolicyBinding").ForceMetadata)
+	assert.Equal(t, []string{"relObjs"}, GetUpdateRule("constraints.gatekeeper.sh", "K8sRequiredLabels").ForceMetadata,
+		"Expected the constraints to use the rule for all the kinds in the apigroup.")
+	assert.Equal(t, "revision", GetUpdateRule("", "Release").Revision)
+	assert.Equal(t, UpdateRule{}, GetUpdateRule("", "Pod"), "Expected no rule for pods.")
+}
+
+func TestLoadAndMergeConfigurableCollection_UpdateRules(t *testing.T) {
+	originalFeatureFlag := config.Cfg.FeatureConfigurableCollection
+	originalNamespace := config.Cfg.PodNamespace
+	defer func() {
+		config.Cfg.FeatureConfigurableCollection = originalFeatureFlag
+		config.Cfg.PodNamespace = originalNamespace
+		mergedTransformConfig = nil
+		mergedUpdateRules = nil
+	}()
+
+	config.Cfg.FeatureConfigurableCollection = true
+	config.Cfg.PodNamespace = "test-namespace"
+
+	collectionConfig := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "search.open-cluster-management.io/v1alpha1",
+			"kind":       "CollectorConfig",
+			"metadata": map[string]interface{}{
+				"name":      "merged-collector-config",
+				"namespace": "test-namespace",
+			},
+			"spec": map[string]interface{}{
+				"updateRules": []interface{}{
+					map[string]interface{}{
+						"resourceSelector": map[string]interface{}{
+							"apiGroups": []interface{}{"", "apps"},
+							"kinds":     []interface{}{"Pod", "*"},
+						},
+						"ignoreProperties": []interface{}{"restarts"},
+					},
+					map[string]interface{}{
+						"resourceSelector": map[string]interface{}{
+							"apiGroups": []interface{}{"constraints.gatekeeper.sh"},
+							"kinds":     []interface{}{"*"},
+						},
+						"forceUpdateMetadata": []interface{}{"relObjs", "violations"},
+					},
+					map[string]interface{}{
+						// No forceUpdateMetadata or ignoreProperties, rule should be skipped
+						"resourceSelector": map[string]interface{}{
+							"apiGroups": []interface{}{""},
+							"kinds":     []interface{}{"Service"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	scheme := runtime.NewScheme()
+	fakeClient := fake.NewSimpleDynamicClient(scheme, collectionConfig)
+
+	loadAndMergeConfigurableCollectionWithClient(fakeClient)
+
+	assert.Equal(t, []string{"restarts"}, GetUpdateRule("", "Pod").IgnoreProperties)
+	assert.Equal(t, []string{"restarts"}, GetUpdateRule("apps", "Deployment").IgnoreProperties,
+		"Expected the rule for all the kinds in the apps apigroup.")
+	assert.Equal(t, []string{"relObjs", "violations"},
+		GetUpdateRule("constraints.gatekeeper.sh", "K8sRequiredLabels").ForceMetadata,
+		"Expected the metadata keys to be added to the default rule.")
+	assert.Equal(t, UpdateRule{IgnoreProperties: []string{"restarts"}}, GetUpdateRule("", "Service"),
+		"Expected only the rule for all the core kinds, since the Service rule was skipped.")
+	assert.Equal(t, []string{"relObjs"}, defaultUpdateRules["*.constraints.gatekeeper.sh"].ForceMetadata,
+		"Expected the default rules to be unchanged.")
+
+	cond := getStatusConditionFromFakeClient(fakeClient)
+	require.NotNil(t, cond, "Expected a status condition to be written to the CollectorConfig CR")
+	assert.Equal(t, "RulesSkipped", cond["reason"])
+	msg, _ := cond["message"].(string)
+	assert.True(t, strings.Contains(msg, "Update rule 2 skipped"), "Message should mention the skipped rule, got: %s", msg)
+}
@@ -90,6 +90,11 @@ func (v VapBindingResource) BuildNode() Node {
 	return v.node
 }
 
+func init() {
+	// Bindings build edges to their parameters in any namespace.
+	declareEdgeScope(GlobalEdges, []string{"ValidatingAdmissionPolicyBinding"}, nil)
+}
+
 // BuildEdges construct the edges for VapBindingResource
 func (v VapBindingResource) BuildEdges(ns NodeStore) []Edge {
 	policyName, ok := v.node.Properties["policyName"].(string)